@@ -0,0 +1,25 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"text/tabwriter"
+
+	"quic-relay/internal/handler"
+)
+
+// printHandlers lists the handler types and their config options (the
+// "handlers" subcommand).
+func printHandlers(w io.Writer) {
+	tw := tabwriter.NewWriter(w, 0, 4, 2, ' ', 0)
+	for _, info := range handler.Handlers() {
+		fmt.Fprintln(tw, info.Name)
+		if len(info.Options) == 0 {
+			fmt.Fprintln(tw, "  (no options)")
+		}
+		for _, o := range info.Options {
+			fmt.Fprintf(tw, "  %s\t%s\n", o.Name, o.Type)
+		}
+	}
+	tw.Flush()
+}
@@ -0,0 +1,30 @@
+package main
+
+import (
+	"bytes"
+	"regexp"
+	"strings"
+	"testing"
+)
+
+func TestPrintHandlers(t *testing.T) {
+	var out bytes.Buffer
+	printHandlers(&out)
+	got := out.String()
+
+	// Each handler is listed with its options, indented and aligned
+	for _, want := range []string{
+		"logsni\n  (no options)\n",
+		"simple-router\n  backend   string\n  backends  []string\n",
+	} {
+		if !strings.Contains(got, want) {
+			t.Errorf("output lacks %q:\n%s", want, got)
+		}
+	}
+	if !regexp.MustCompile(`(?m)^  routes\.\*\.idle_timeout +int$`).MatchString(got) {
+		t.Errorf("sni-router route options missing:\n%s", got)
+	}
+	if i, j := strings.Index(got, "forwarder\n"), strings.Index(got, "match\n"); i < 0 || j < i {
+		t.Errorf("handlers not sorted by name:\n%s", got)
+	}
+}
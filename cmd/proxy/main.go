@@ -7,6 +7,7 @@ import (
 	"os"
 	"os/signal"
 	"strings"
+	"sync"
 	"syscall"
 
 	"quic-relay/internal/debug"
@@ -18,9 +19,20 @@ import (
 var Version = "dev"
 
 func main() {
+	if len(os.Args) > 1 && os.Args[1] == "handlers" {
+		printHandlers(os.Stdout)
+		return
+	}
+
 	configFlag := flag.String("config", "", "Config file path or JSON string")
 	debugFlag := flag.Bool("d", false, "Enable debug logging")
 	versionFlag := flag.Bool("version", false, "Print version and exit")
+	flag.Usage = func() {
+		out := flag.CommandLine.Output()
+		fmt.Fprintf(out, "Usage: %s -config <file or JSON> [-d]\n", os.Args[0])
+		fmt.Fprintf(out, "       %s handlers   List handlers and their config options\n\n", os.Args[0])
+		flag.PrintDefaults()
+	}
 	flag.Parse()
 
 	if *versionFlag {
@@ -41,23 +53,40 @@ func main() {
 		log.Fatalf("Failed to load config: %v", err)
 	}
 
-	// Environment variables as fallback (config takes precedence)
-	if cfg.Listen == "" {
-		cfg.Listen = getEnv("QUIC_RELAY_LISTEN", ":5520")
-	}
+	applyEnvDefaults(cfg)
 
 	chain, err := handler.BuildChain(cfg.Handlers)
 	if err != nil {
 		log.Fatalf("Failed to build handler chain: %v", err)
 	}
+	if err := proxy.CheckConfig(cfg, chain); err != nil {
+		log.Fatalf("Invalid config: %v", err)
+	}
 
 	p := proxy.New(cfg.Listen, chain)
 	p.SetSessionTimeout(cfg.SessionTimeout)
+	p.SetDrainTimeout(cfg.DrainTimeout, cfg.DrainIdleTimeout)
+	p.SetRetry(cfg.Retry)
+	if err := p.SetBans(cfg.Ban); err != nil {
+		log.Fatalf("Failed to set up ban list: %v", err)
+	}
+
+	// Take over listener and sessions when started by a zero-downtime upgrade
+	if inherited, err := inheritFromParent(p); err != nil {
+		log.Fatalf("Failed to inherit from previous process: %v", err)
+	} else if inherited {
+		log.Println("[proxy] upgrade complete, took over from previous process")
+	}
 
 	sigChan := make(chan os.Signal, 1)
-	signal.Notify(sigChan, syscall.SIGINT, syscall.SIGTERM, syscall.SIGHUP)
+	signal.Notify(sigChan, syscall.SIGINT, syscall.SIGTERM, syscall.SIGHUP, syscall.SIGUSR2)
+
+	// Closed once the proxy has shut down or handed off, so main can exit
+	done := make(chan struct{})
+	finish := sync.OnceFunc(func() { close(done) })
 
 	go func() {
+		shuttingDown := false
 		for sig := range sigChan {
 			switch sig {
 			case syscall.SIGHUP:
@@ -70,17 +99,66 @@ func main() {
 					log.Printf("[proxy] reload failed: %v", err)
 					continue
 				}
+				applyEnvDefaults(newCfg)
 				newChain, err := handler.BuildChain(newCfg.Handlers)
 				if err != nil {
 					log.Printf("[proxy] reload failed: %v", err)
 					continue
 				}
-				p.ReloadChain(newChain)
+				if err := proxy.CheckConfig(newCfg, newChain); err != nil {
+					log.Printf("[proxy] reload failed: %v", err)
+					continue
+				}
+				if err := p.ReloadChain(newChain); err != nil {
+					log.Printf("[proxy] reload failed: %v", err)
+					continue
+				}
 				p.SetSessionTimeout(newCfg.SessionTimeout)
+				p.SetDrainTimeout(newCfg.DrainTimeout, newCfg.DrainIdleTimeout)
+				p.SetRetry(newCfg.Retry)
+
+				var notApplied []string
+				if err := p.SetBans(newCfg.Ban); err != nil {
+					notApplied = append(notApplied, fmt.Sprintf("ban: %v", err))
+				}
+				if newCfg.Listen != cfg.Listen {
+					if err := p.Rebind(newCfg.Listen); err != nil {
+						notApplied = append(notApplied, fmt.Sprintf("listen: %q -> %q (%v)", cfg.Listen, newCfg.Listen, err))
+						newCfg.Listen = cfg.Listen
+					}
+				}
+				cfg = newCfg
+
 				log.Printf("[proxy] config reloaded, handlers: %v, session_timeout: %ds", handlerNames(newChain), newCfg.SessionTimeout)
+				if len(notApplied) > 0 {
+					log.Printf("[proxy] WARNING: reload incomplete, %d setting(s) NOT applied:", len(notApplied))
+					for _, d := range notApplied {
+						log.Printf("[proxy]   %s", d)
+					}
+				}
+			case syscall.SIGUSR2:
+				log.Println("[proxy] upgrading: starting new process...")
+				if err := upgrade(p); err != nil {
+					log.Printf("[proxy] upgrade failed: %v", err)
+					continue
+				}
+				log.Println("[proxy] handed off to new process, exiting")
+				finish()
+				return
 			case syscall.SIGINT, syscall.SIGTERM:
-				log.Println("[proxy] shutting down...")
+				if !shuttingDown {
+					// First signal: drain (stops immediately if drain_timeout is 0)
+					shuttingDown = true
+					log.Println("[proxy] shutting down...")
+					go func() {
+						p.Drain()
+						finish()
+					}()
+					continue
+				}
+				log.Println("[proxy] second signal received, stopping immediately")
 				p.Stop()
+				finish()
 				return
 			}
 		}
@@ -89,6 +167,7 @@ func main() {
 	if err := p.Run(); err != nil {
 		log.Fatalf("Proxy error: %v", err)
 	}
+	<-done
 }
 
 // loadConfig loads config from a file path or parses inline JSON.
@@ -102,6 +181,14 @@ func loadConfig(configFlag string) (*proxy.Config, bool, error) {
 	return cfg, true, err
 }
 
+// applyEnvDefaults fills unset config values from environment variables
+// (config takes precedence).
+func applyEnvDefaults(cfg *proxy.Config) {
+	if cfg.Listen == "" {
+		cfg.Listen = getEnv("QUIC_RELAY_LISTEN", ":5520")
+	}
+}
+
 // handlerNames returns the names of handlers in a chain.
 func handlerNames(chain *handler.Chain) []string {
 	var names []string
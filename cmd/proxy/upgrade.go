@@ -0,0 +1,94 @@
+package main
+
+import (
+	"fmt"
+	"net"
+	"os"
+	"os/exec"
+	"strconv"
+	"syscall"
+
+	"quic-relay/internal/proxy"
+)
+
+// upgradeFDEnv tells a freshly exec'd process which descriptor holds the
+// Unix socket to its predecessor.
+const upgradeFDEnv = "QUIC_RELAY_UPGRADE_FD"
+
+// upgrade starts a new instance of the current binary and hands the listener
+// and all sessions over to it. On success the caller must exit without
+// stopping the proxy.
+func upgrade(p *proxy.Proxy) error {
+	exe, err := os.Executable()
+	if err != nil {
+		return err
+	}
+
+	// The successor loads the ban list from disk on startup
+	p.FlushBans()
+
+	fds, err := syscall.Socketpair(syscall.AF_UNIX, syscall.SOCK_STREAM|syscall.SOCK_CLOEXEC, 0)
+	if err != nil {
+		return fmt.Errorf("socketpair: %w", err)
+	}
+	parentFile := os.NewFile(uintptr(fds[0]), "upgrade-parent")
+	childFile := os.NewFile(uintptr(fds[1]), "upgrade-child")
+	defer parentFile.Close()
+
+	cmd := exec.Command(exe, os.Args[1:]...)
+	cmd.Stdout = os.Stdout
+	cmd.Stderr = os.Stderr
+	cmd.ExtraFiles = []*os.File{childFile} // Becomes fd 3 in the child
+	cmd.Env = append(os.Environ(), upgradeFDEnv+"=3")
+	err = cmd.Start()
+	childFile.Close()
+	if err != nil {
+		return fmt.Errorf("failed to start new process: %w", err)
+	}
+
+	c, err := net.FileConn(parentFile)
+	if err != nil {
+		cmd.Process.Kill()
+		return err
+	}
+	defer c.Close()
+
+	if err := p.HandOff(c.(*net.UnixConn)); err != nil {
+		// Successor never took over and this process serves again: make
+		// sure it doesn't linger
+		cmd.Process.Kill()
+		return err
+	}
+
+	// Don't wait for the child: it outlives us
+	return cmd.Process.Release()
+}
+
+// inheritFromParent takes over listener and sessions if this process was
+// started by upgrade. Returns false if this is a regular start.
+func inheritFromParent(p *proxy.Proxy) (bool, error) {
+	v := os.Getenv(upgradeFDEnv)
+	if v == "" {
+		return false, nil
+	}
+	os.Unsetenv(upgradeFDEnv) // Don't leak into our own future upgrades
+
+	fd, err := strconv.Atoi(v)
+	if err != nil {
+		return true, fmt.Errorf("invalid %s: %w", upgradeFDEnv, err)
+	}
+	f := os.NewFile(uintptr(fd), "upgrade")
+	defer f.Close()
+
+	c, err := net.FileConn(f)
+	if err != nil {
+		return true, err
+	}
+	defer c.Close()
+
+	uc, ok := c.(*net.UnixConn)
+	if !ok {
+		return true, fmt.Errorf("%s is not a unix socket", upgradeFDEnv)
+	}
+	return true, p.Inherit(uc)
+}
@@ -0,0 +1,3 @@
+module blocklist
+
+go 1.25.0
@@ -0,0 +1,84 @@
+// Command blocklist is an example wasm handler: it drops connections to
+// blocked domains and routes the rest by their SNI.
+//
+// Build it as a WASI reactor module:
+//
+//	GOOS=wasip1 GOARCH=wasm go build -buildmode=c-shared -o blocklist.wasm .
+//
+// and add it to the handler chain before the forwarder:
+//
+//	{"type": "wasm", "config": {"file": "blocklist.wasm"}}
+//
+// See docs/handlers.md for the host interface (ABI version 1).
+package main
+
+import (
+	"strings"
+	"unsafe"
+)
+
+const (
+	actionContinue = 0
+	actionHandled  = 1
+	actionDrop     = 2
+)
+
+var blocked = []string{".blocked.example.com", "spam.example.net"}
+
+var routes = map[string]string{
+	"eu.example.com": "10.0.1.1:5520",
+	"us.example.com": "10.0.2.1:5520",
+}
+
+//go:wasmexport quic_relay_abi_version
+func abiVersion() int32 { return 1 }
+
+//go:wasmexport on_connect
+func onConnect() int32 {
+	sni, _ := get(":sni")
+	for _, b := range blocked {
+		if sni == strings.TrimPrefix(b, ".") || strings.HasSuffix(sni, b) {
+			logf("blocked " + sni)
+			return actionDrop
+		}
+	}
+	if backend, ok := routes[sni]; ok {
+		set("backend", backend)
+	}
+	return actionContinue
+}
+
+//go:wasmimport quic_relay get
+func hostGet(keyPtr unsafe.Pointer, keyLen uint32, bufPtr unsafe.Pointer, bufLen uint32) int32
+
+//go:wasmimport quic_relay set
+func hostSet(keyPtr unsafe.Pointer, keyLen uint32, valPtr unsafe.Pointer, valLen uint32)
+
+//go:wasmimport quic_relay log
+func hostLog(msgPtr unsafe.Pointer, msgLen uint32)
+
+// get returns a context value or connection field, e.g. ":sni".
+func get(key string) (string, bool) {
+	buf := make([]byte, 256)
+	for {
+		n := hostGet(unsafe.Pointer(unsafe.StringData(key)), uint32(len(key)), unsafe.Pointer(&buf[0]), uint32(len(buf)))
+		if n < 0 {
+			return "", false
+		}
+		if int(n) <= len(buf) {
+			return string(buf[:n]), true
+		}
+		buf = make([]byte, n)
+	}
+}
+
+// set stores a context value for later handlers, e.g. "backend".
+func set(key, value string) {
+	hostSet(unsafe.Pointer(unsafe.StringData(key)), uint32(len(key)), unsafe.Pointer(unsafe.StringData(value)), uint32(len(value)))
+}
+
+func logf(msg string) {
+	hostLog(unsafe.Pointer(unsafe.StringData(msg)), uint32(len(msg)))
+}
+
+func main() {}
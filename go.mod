@@ -4,17 +4,22 @@ go 1.25.0
 
 require (
 	github.com/quic-go/quic-go v0.57.1
+	github.com/tetratelabs/wazero v1.11.0
+	github.com/yuin/gopher-lua v1.1.2
 	golang.org/x/crypto v0.46.0
+	golang.org/x/sys v0.39.0
+	proxyproto v0.0.0
 	quic-terminator v0.0.0
 )
 
 require (
 	github.com/klauspost/compress v1.18.2 // indirect
 	golang.org/x/net v0.48.0 // indirect
-	golang.org/x/sys v0.39.0 // indirect
 	protohytale v0.0.0 // indirect
 )
 
 replace quic-terminator => ./pkg/terminator
 
 replace protohytale => ./pkg/protohytale
+
+replace proxyproto => ./pkg/proxyproto
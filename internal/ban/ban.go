@@ -0,0 +1,469 @@
+// Package ban keeps a list of banned client addresses and subnets.
+//
+// Bans come from rate limiters, from repeated malformed packets (strikes, if
+// enabled) and from manual calls. Automatic bans escalate: each repeat offense within
+// ForgetAfter gets the next, longer duration. The list is persisted to disk so
+// bans survive restarts. Lookups read an immutable snapshot and take no locks,
+// so they are cheap enough to run for every packet.
+package ban
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net"
+	"net/netip"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// Config configures the ban list.
+type Config struct {
+	File         string   `json:"file,omitempty"`          // Where bans are persisted (default: memory only)
+	Durations    []int    `json:"durations,omitempty"`     // Escalating ban durations in seconds (default: 60, 600, 3600, 86400)
+	ForgetAfter  int      `json:"forget_after,omitempty"`  // Seconds after a ban ends before escalation resets (default: 86400)
+	Static       []string `json:"static,omitempty"`        // Addresses or CIDRs banned permanently
+	StrikeLimit  int      `json:"strike_limit,omitempty"`  // Malformed packets from one validated IP before a ban (default: 0 = never)
+	StrikeWindow int      `json:"strike_window,omitempty"` // Seconds over which strikes are counted (default: 10)
+}
+
+var defaultDurations = []time.Duration{time.Minute, 10 * time.Minute, time.Hour, 24 * time.Hour}
+
+const (
+	defaultForgetAfter  = 24 * time.Hour
+	defaultStrikeWindow = 10 * time.Second
+	maxStrikeEntries    = 100000 // Bound memory under floods from many (spoofed) sources
+	saveDelay           = time.Second
+)
+
+// Entry is a single ban.
+type Entry struct {
+	Prefix netip.Prefix `json:"prefix"`
+	Until  time.Time    `json:"until,omitzero"` // Zero for permanent bans
+	Reason string       `json:"reason,omitempty"`
+	Level  int          `json:"level"` // Index into the escalation durations
+}
+
+// Active reports whether the ban is in effect at now.
+func (e *Entry) Active(now time.Time) bool {
+	return e.Until.IsZero() || now.Before(e.Until)
+}
+
+// List is a set of bans. Safe for concurrent use.
+type List struct {
+	mu          sync.Mutex
+	file        string
+	durations   []time.Duration
+	forgetAfter time.Duration
+	static      []netip.Prefix
+	entries     map[netip.Prefix]*Entry // Also remembers expired bans for escalation
+	dirty       bool
+	saveTimer   *time.Timer
+
+	strikesMu    sync.Mutex // Guards the fields below
+	strikes      map[netip.Addr]*strikeCount
+	strikeLimit  int
+	strikeWindow time.Duration
+
+	snap atomic.Pointer[snapshot]
+}
+
+type strikeCount struct {
+	n     int
+	start time.Time
+}
+
+// snapshot is the immutable lookup view of all active bans.
+type snapshot struct {
+	addrs    map[netip.Addr]time.Time // Single addresses (zero time = permanent)
+	prefixes []Entry                  // CIDR bans
+}
+
+// New creates a ban list and loads persisted bans from cfg.File.
+func New(cfg *Config) (*List, error) {
+	l := &List{
+		entries: make(map[netip.Prefix]*Entry),
+		strikes: make(map[netip.Addr]*strikeCount),
+	}
+	if err := l.Configure(cfg); err != nil {
+		return nil, err
+	}
+	if err := l.load(); err != nil {
+		return nil, err
+	}
+	return l, nil
+}
+
+// Configure applies cfg to an existing list (hot-reload safe). Bans are kept.
+func (l *List) Configure(cfg *Config) error {
+	if cfg == nil {
+		cfg = &Config{}
+	}
+	static := make([]netip.Prefix, 0, len(cfg.Static))
+	for _, s := range cfg.Static {
+		p, err := ParsePrefix(s)
+		if err != nil {
+			return err
+		}
+		static = append(static, p)
+	}
+	durations := defaultDurations
+	if len(cfg.Durations) > 0 {
+		durations = make([]time.Duration, len(cfg.Durations))
+		for i, d := range cfg.Durations {
+			if d <= 0 {
+				return fmt.Errorf("ban durations must be > 0")
+			}
+			durations[i] = time.Duration(d) * time.Second
+		}
+	}
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.file = cfg.File
+	l.durations = durations
+	l.static = static
+	l.forgetAfter = defaultForgetAfter
+	if cfg.ForgetAfter > 0 {
+		l.forgetAfter = time.Duration(cfg.ForgetAfter) * time.Second
+	}
+	l.rebuild(time.Now())
+
+	l.strikesMu.Lock()
+	l.strikeLimit = max(cfg.StrikeLimit, 0)
+	l.strikeWindow = defaultStrikeWindow
+	if cfg.StrikeWindow > 0 {
+		l.strikeWindow = time.Duration(cfg.StrikeWindow) * time.Second
+	}
+	l.strikesMu.Unlock()
+	return nil
+}
+
+// ParsePrefix parses an address ("192.0.2.1") or CIDR ("192.0.2.0/24").
+func ParsePrefix(s string) (netip.Prefix, error) {
+	if p, err := netip.ParsePrefix(s); err == nil {
+		return p.Masked(), nil
+	}
+	a, err := netip.ParseAddr(s)
+	if err != nil {
+		return netip.Prefix{}, fmt.Errorf("invalid address or CIDR %q", s)
+	}
+	a = a.Unmap()
+	return netip.PrefixFrom(a, a.BitLen()), nil
+}
+
+// IsBanned reports whether ip is banned. Lock-free.
+func (l *List) IsBanned(ip net.IP) bool {
+	s := l.snap.Load()
+	if len(s.addrs) == 0 && len(s.prefixes) == 0 {
+		return false
+	}
+	addr, ok := netip.AddrFromSlice(ip)
+	if !ok {
+		return false
+	}
+	addr = addr.Unmap()
+
+	if until, ok := s.addrs[addr]; ok && (until.IsZero() || time.Now().Before(until)) {
+		return true
+	}
+	for i := range s.prefixes {
+		if s.prefixes[i].Prefix.Contains(addr) && s.prefixes[i].Active(time.Now()) {
+			return true
+		}
+	}
+	return false
+}
+
+// Ban bans prefix with escalation: the duration grows with each repeat
+// offense. Returns the remaining ban duration (0 if permanent).
+func (l *List) Ban(prefix netip.Prefix, reason string) time.Duration {
+	prefix = prefix.Masked()
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	now := time.Now()
+	level := 0
+	if e, ok := l.entries[prefix]; ok {
+		if e.Active(now) {
+			if e.Until.IsZero() {
+				return 0 // Already banned permanently
+			}
+			return e.Until.Sub(now) // Already banned
+		}
+		if now.Sub(e.Until) < l.forgetAfter {
+			level = min(e.Level+1, len(l.durations)-1)
+		}
+	}
+	d := l.durations[level]
+	l.entries[prefix] = &Entry{Prefix: prefix, Until: now.Add(d), Reason: reason, Level: level}
+	log.Printf("[ban] banned %s for %v: %s (offense %d)", prefix, d, reason, level+1)
+	l.changed(now)
+	return d
+}
+
+// BanFor bans prefix for d, or permanently if d is 0, without escalation.
+func (l *List) BanFor(prefix netip.Prefix, d time.Duration, reason string) {
+	prefix = prefix.Masked()
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	now := time.Now()
+	e := &Entry{Prefix: prefix, Reason: reason}
+	if d > 0 {
+		e.Until = now.Add(d)
+		log.Printf("[ban] banned %s for %v: %s", prefix, d, reason)
+	} else {
+		log.Printf("[ban] banned %s permanently: %s", prefix, reason)
+	}
+	l.entries[prefix] = e
+	l.changed(now)
+}
+
+// Unban lifts a ban and forgets past offenses. Returns false if prefix wasn't
+// banned. Static bans from the config can't be lifted.
+func (l *List) Unban(prefix netip.Prefix) bool {
+	prefix = prefix.Masked()
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	if _, ok := l.entries[prefix]; !ok {
+		return false
+	}
+	delete(l.entries, prefix)
+	log.Printf("[ban] unbanned %s", prefix)
+	l.changed(time.Now())
+	return true
+}
+
+// Strike records a misbehaving packet from ip, and bans it once strike_limit
+// is reached within strike_window. Returns true if this strike caused a ban.
+// Callers must only strike addresses they have validated, since anyone can
+// send packets with a spoofed source address. A strike_limit of 0 disables strikes.
+func (l *List) Strike(ip net.IP, reason string) bool {
+	addr, ok := netip.AddrFromSlice(ip)
+	if !ok {
+		return false
+	}
+	addr = addr.Unmap()
+
+	now := time.Now()
+	l.strikesMu.Lock()
+	limit, window := l.strikeLimit, l.strikeWindow
+	if limit == 0 {
+		l.strikesMu.Unlock()
+		return false
+	}
+	s := l.strikes[addr]
+	if s == nil || now.Sub(s.start) > window {
+		if s == nil && len(l.strikes) >= maxStrikeEntries {
+			l.pruneStrikes(now, window)
+		}
+		s = &strikeCount{start: now}
+		l.strikes[addr] = s
+	}
+	s.n++
+	hit := s.n >= limit
+	if hit {
+		delete(l.strikes, addr)
+	}
+	l.strikesMu.Unlock()
+
+	if hit {
+		l.Ban(netip.PrefixFrom(addr, addr.BitLen()), fmt.Sprintf("%d %s packets within %v", limit, reason, window))
+	}
+	return hit
+}
+
+// pruneStrikes drops stale strike counters, or all of them if none are stale.
+// Must be called with strikesMu held.
+func (l *List) pruneStrikes(now time.Time, window time.Duration) {
+	for a, s := range l.strikes {
+		if now.Sub(s.start) > window {
+			delete(l.strikes, a)
+		}
+	}
+	if len(l.strikes) >= maxStrikeEntries {
+		clear(l.strikes)
+	}
+}
+
+// Entries returns all bans in effect, static ones included, sorted by prefix.
+func (l *List) Entries() []Entry {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	now := time.Now()
+	out := make([]Entry, 0, len(l.entries)+len(l.static))
+	for _, p := range l.static {
+		out = append(out, Entry{Prefix: p, Reason: "static"})
+	}
+	for _, e := range l.entries {
+		if e.Active(now) {
+			out = append(out, *e)
+		}
+	}
+	sort.Slice(out, func(i, j int) bool { return out[i].Prefix.String() < out[j].Prefix.String() })
+	return out
+}
+
+// Prune forgets bans whose escalation memory has run out and drops expired
+// bans from the lookup snapshot. Call periodically.
+func (l *List) Prune() {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	now := time.Now()
+	for p, e := range l.entries {
+		if !e.Until.IsZero() && now.Sub(e.Until) > l.forgetAfter {
+			delete(l.entries, p)
+			l.dirty = true
+		}
+	}
+	l.rebuild(now)
+	if l.dirty {
+		l.scheduleSave()
+	}
+
+	l.strikesMu.Lock()
+	l.pruneStrikes(now, l.strikeWindow)
+	l.strikesMu.Unlock()
+}
+
+// Flush writes pending changes to disk right away.
+func (l *List) Flush() error {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if l.saveTimer != nil {
+		l.saveTimer.Stop()
+		l.saveTimer = nil
+	}
+	return l.save()
+}
+
+// changed rebuilds the snapshot and schedules a save. Must be called with l.mu held.
+func (l *List) changed(now time.Time) {
+	l.rebuild(now)
+	l.dirty = true
+	l.scheduleSave()
+}
+
+// rebuild publishes a new lookup snapshot. Must be called with l.mu held.
+func (l *List) rebuild(now time.Time) {
+	s := &snapshot{addrs: make(map[netip.Addr]time.Time)}
+	add := func(e Entry) {
+		if e.Prefix.IsSingleIP() {
+			s.addrs[e.Prefix.Addr()] = e.Until
+		} else {
+			s.prefixes = append(s.prefixes, e)
+		}
+	}
+	for _, p := range l.static {
+		add(Entry{Prefix: p})
+	}
+	for _, e := range l.entries {
+		if e.Active(now) {
+			if _, static := s.addrs[e.Prefix.Addr()]; static && e.Prefix.IsSingleIP() {
+				continue // Don't let a temporary ban shorten a static one
+			}
+			add(*e)
+		}
+	}
+	l.snap.Store(s)
+}
+
+// scheduleSave writes the list after a short delay, so a burst of bans
+// results in a single write. Must be called with l.mu held.
+func (l *List) scheduleSave() {
+	if l.file == "" || l.saveTimer != nil {
+		return
+	}
+	l.saveTimer = time.AfterFunc(saveDelay, func() {
+		l.mu.Lock()
+		defer l.mu.Unlock()
+		l.saveTimer = nil
+		if err := l.save(); err != nil {
+			log.Printf("[ban] failed to save ban list: %v", err)
+		}
+	})
+}
+
+// save writes all bans (including expired ones still remembered for
+// escalation) atomically. Must be called with l.mu held.
+func (l *List) save() error {
+	if l.file == "" || !l.dirty {
+		return nil
+	}
+	entries := make([]*Entry, 0, len(l.entries))
+	for _, e := range l.entries {
+		entries = append(entries, e)
+	}
+	sort.Slice(entries, func(i, j int) bool { return entries[i].Prefix.String() < entries[j].Prefix.String() })
+
+	data, err := json.MarshalIndent(entries, "", "  ")
+	if err != nil {
+		return err
+	}
+	tmp, err := os.CreateTemp(filepath.Dir(l.file), ".bans-*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+	if _, err := tmp.Write(data); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	if err := os.Rename(tmp.Name(), l.file); err != nil {
+		return err
+	}
+	l.dirty = false
+	return nil
+}
+
+// load reads persisted bans. A missing file is not an error.
+func (l *List) load() error {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if l.file == "" {
+		return nil
+	}
+
+	data, err := os.ReadFile(l.file)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil
+	}
+	if err != nil {
+		return fmt.Errorf("failed to read ban list: %w", err)
+	}
+	var entries []*Entry
+	if err := json.Unmarshal(data, &entries); err != nil {
+		return fmt.Errorf("invalid ban list %s: %w", l.file, err)
+	}
+
+	now := time.Now()
+	active := 0
+	for _, e := range entries {
+		if !e.Prefix.IsValid() {
+			continue
+		}
+		e.Prefix = e.Prefix.Masked()
+		e.Level = min(max(e.Level, 0), len(l.durations)-1)
+		l.entries[e.Prefix] = e
+		if e.Active(now) {
+			active++
+		}
+	}
+	l.rebuild(now)
+	if active > 0 {
+		log.Printf("[ban] loaded %d active ban(s) from %s", active, l.file)
+	}
+	return nil
+}
@@ -0,0 +1,133 @@
+package ban
+
+import (
+	"net"
+	"net/netip"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestBan_Escalation(t *testing.T) {
+	l, err := New(&Config{Durations: []int{1, 10}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	p := netip.MustParsePrefix("192.0.2.1/32")
+
+	if d := l.Ban(p, "test"); d != time.Second {
+		t.Errorf("first ban = %v, want 1s", d)
+	}
+	if !l.IsBanned(net.ParseIP("192.0.2.1")) {
+		t.Fatal("address not banned")
+	}
+	if l.IsBanned(net.ParseIP("192.0.2.2")) {
+		t.Error("neighbour banned")
+	}
+
+	// Expire the ban by hand; the repeat offense escalates
+	l.mu.Lock()
+	l.entries[p].Until = time.Now().Add(-time.Millisecond)
+	l.rebuild(time.Now())
+	l.mu.Unlock()
+	if l.IsBanned(net.ParseIP("192.0.2.1")) {
+		t.Fatal("expired ban still active")
+	}
+	if d := l.Ban(p, "test"); d != 10*time.Second {
+		t.Errorf("second ban = %v, want 10s", d)
+	}
+}
+
+func TestBan_CIDR(t *testing.T) {
+	l, err := New(&Config{Static: []string{"198.51.100.0/24", "2001:db8::/32"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for ip, want := range map[string]bool{
+		"198.51.100.7":        true,
+		"::ffff:198.51.100.8": true,
+		"198.51.101.1":        false,
+		"2001:db8:1::1":       true,
+		"2001:db9::1":         false,
+	} {
+		if got := l.IsBanned(net.ParseIP(ip)); got != want {
+			t.Errorf("IsBanned(%s) = %v, want %v", ip, got, want)
+		}
+	}
+
+	l.BanFor(netip.MustParsePrefix("203.0.113.99/24"), 0, "manual")
+	if !l.IsBanned(net.ParseIP("203.0.113.1")) {
+		t.Error("CIDR ban not applied")
+	}
+	if !l.Unban(netip.MustParsePrefix("203.0.113.0/24")) || l.IsBanned(net.ParseIP("203.0.113.1")) {
+		t.Error("unban failed")
+	}
+	if l.Unban(netip.MustParsePrefix("198.51.100.0/24")) {
+		t.Error("static ban lifted")
+	}
+}
+
+func TestBan_Persistence(t *testing.T) {
+	file := filepath.Join(t.TempDir(), "bans.json")
+	l, err := New(&Config{File: file})
+	if err != nil {
+		t.Fatal(err)
+	}
+	l.Ban(netip.MustParsePrefix("192.0.2.1/32"), "test")
+	l.BanFor(netip.MustParsePrefix("198.51.100.0/24"), 0, "manual")
+	if err := l.Flush(); err != nil {
+		t.Fatal(err)
+	}
+
+	l2, err := New(&Config{File: file})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !l2.IsBanned(net.ParseIP("192.0.2.1")) || !l2.IsBanned(net.ParseIP("198.51.100.50")) {
+		t.Error("bans not restored from disk")
+	}
+	if n := len(l2.Entries()); n != 2 {
+		t.Errorf("entries = %d, want 2", n)
+	}
+}
+
+func TestBan_Strikes(t *testing.T) {
+	l, err := New(&Config{StrikeLimit: 3})
+	if err != nil {
+		t.Fatal(err)
+	}
+	ip := net.ParseIP("192.0.2.1")
+	for i := 0; i < 2; i++ {
+		if l.Strike(ip, "malformed") {
+			t.Fatalf("banned after %d strikes", i+1)
+		}
+	}
+	if !l.Strike(ip, "malformed") || !l.IsBanned(ip) {
+		t.Error("not banned after reaching the strike limit")
+	}
+
+	// Strikes are opt-in
+	for _, cfg := range []*Config{{}, {StrikeLimit: -1}} {
+		off, err := New(cfg)
+		if err != nil {
+			t.Fatal(err)
+		}
+		for i := 0; i < 200; i++ {
+			off.Strike(ip, "malformed")
+		}
+		if off.IsBanned(ip) {
+			t.Errorf("strike_limit %d: banned with strikes disabled", cfg.StrikeLimit)
+		}
+	}
+}
+
+func TestBan_InvalidConfig(t *testing.T) {
+	for _, cfg := range []*Config{
+		{Static: []string{"not-an-ip"}},
+		{Durations: []int{60, 0}},
+	} {
+		if _, err := New(cfg); err == nil {
+			t.Errorf("expected error for %+v", cfg)
+		}
+	}
+}
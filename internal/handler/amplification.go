@@ -0,0 +1,115 @@
+package handler
+
+import (
+	"bytes"
+	"encoding/binary"
+	"sync/atomic"
+
+	"quic-relay/internal/quicvarint"
+)
+
+// amplificationFactor limits backend-to-client traffic to this multiple of the
+// bytes received from the client until its address is validated (RFC 9000 Section 8).
+// Without it, a spoofed Initial turns the relay into a reflector.
+const amplificationFactor = 3
+
+// amplification tracks a session's anti-amplification budget.
+type amplification struct {
+	validated atomic.Bool
+	bytesIn   atomic.Int64           // Bytes received from the client
+	bytesOut  atomic.Int64           // Bytes sent to the client
+	serverCID atomic.Pointer[[]byte] // Backend's SCID, which the client's 1-RTT packets carry as DCID
+	dropped   atomic.Int64           // Datagrams to the client dropped over budget
+}
+
+// AddressValidated reports whether the client proved it owns its address.
+// Until then, traffic to the client is limited to 3x the traffic from it.
+func (s *Session) AddressValidated() bool {
+	return s.amp.validated.Load()
+}
+
+// ValidateAddress lifts the anti-amplification limit, e.g. after a Retry.
+func (s *Session) ValidateAddress() {
+	s.amp.validated.Store(true)
+}
+
+// AmplificationDrops returns how many datagrams to the client were dropped
+// because they exceeded the anti-amplification limit.
+func (s *Session) AmplificationDrops() int64 {
+	return s.amp.dropped.Load()
+}
+
+// fromClient accounts for a datagram received from the client. The address
+// counts as validated once the client sends a 1-RTT packet addressed to the
+// backend's connection ID: a spoofer never sees that ID.
+func (s *Session) fromClient(datagram []byte) {
+	if s.amp.validated.Load() {
+		return
+	}
+	s.amp.bytesIn.Add(int64(len(datagram)))
+	if cid := s.amp.serverCID.Load(); cid != nil && hasShortHeaderFor(datagram, *cid) {
+		s.amp.validated.Store(true)
+	}
+}
+
+// toClient reports whether a datagram from the backend may be sent
+// to the client, and charges it against the budget if so.
+func (s *Session) toClient(datagram []byte) bool {
+	if s.amp.validated.Load() {
+		return true
+	}
+	if s.amp.serverCID.Load() == nil && len(datagram) > 6 && datagram[0]&0x80 != 0 {
+		// Long header: remember the backend's SCID
+		dcidLen := int(datagram[5])
+		if off := 6 + dcidLen; off < len(datagram) {
+			if scidLen := int(datagram[off]); scidLen > 0 && off+1+scidLen <= len(datagram) {
+				cid := bytes.Clone(datagram[off+1 : off+1+scidLen])
+				s.amp.serverCID.Store(&cid)
+			}
+		}
+	}
+	n := int64(len(datagram))
+	if s.amp.bytesOut.Load()+n > amplificationFactor*s.amp.bytesIn.Load() {
+		s.amp.dropped.Add(1)
+		return false
+	}
+	s.amp.bytesOut.Add(n)
+	return true
+}
+
+// hasShortHeaderFor reports whether datagram contains a short header (1-RTT)
+// packet with the given DCID, skipping any coalesced long header packets.
+func hasShortHeaderFor(datagram, dcid []byte) bool {
+	for off := 0; off < len(datagram); {
+		pkt := datagram[off:]
+		if pkt[0]&0x80 == 0 {
+			return len(pkt) > len(dcid) && bytes.Equal(pkt[1:1+len(dcid)], dcid)
+		}
+
+		// Long header: flags, version, DCID, SCID, [token,] length, payload
+		if len(pkt) < 7 || binary.BigEndian.Uint32(pkt[1:5]) == 0 {
+			return false // Version negotiation has no length field
+		}
+		i := 6 + int(pkt[5])
+		if i >= len(pkt) {
+			return false
+		}
+		i += 1 + int(pkt[i])
+		if pkt[0]&0x30 == 0x30 {
+			return false // Retry: never coalesced with anything else
+		}
+		if pkt[0]&0x30 == 0x00 { // Initial carries a token
+			tokenLen, n, err := quicvarint.Read(pkt[min(i, len(pkt)):])
+			if err != nil || uint64(len(pkt)-i-n) < tokenLen {
+				return false
+			}
+			i += n + int(tokenLen)
+		}
+		length, n, err := quicvarint.Read(pkt[min(i, len(pkt)):])
+		if err != nil || uint64(len(pkt)-i-n) < length {
+			return false
+		}
+		off += i + n + int(length)
+	}
+	return false
+}
@@ -0,0 +1,123 @@
+package handler
+
+import (
+	"net"
+	"testing"
+	"time"
+)
+
+// longHeader builds a long header packet of the given type bits with a payload of n bytes.
+func longHeader(typ byte, dcid, scid []byte, n int) []byte {
+	b := []byte{0xC0 | typ<<4, 0, 0, 0, 1, byte(len(dcid))}
+	b = append(b, dcid...)
+	b = append(b, byte(len(scid)))
+	b = append(b, scid...)
+	if typ == 0 {
+		b = append(b, 0) // Empty token
+	}
+	b = append(b, 0x40|byte(n>>8), byte(n)) // 2-byte length
+	return append(b, make([]byte, n)...)
+}
+
+func TestHasShortHeaderFor(t *testing.T) {
+	cid := []byte{7, 7, 7, 7}
+	oneRTT := append([]byte{0x40}, append(cid, 1, 2, 3)...)
+
+	tests := []struct {
+		name     string
+		datagram []byte
+		want     bool
+	}{
+		{"1-RTT", oneRTT, true},
+		{"1-RTT with other DCID", append([]byte{0x40}, 1, 2, 3, 4, 5), false},
+		{"coalesced Handshake + 1-RTT", append(longHeader(2, cid, nil, 40), oneRTT...), true},
+		{"coalesced Initial + 1-RTT", append(longHeader(0, cid, nil, 40), oneRTT...), true},
+		{"Handshake only", longHeader(2, cid, nil, 40), false},
+		{"truncated long header", longHeader(2, cid, nil, 40)[:20], false},
+	}
+	for _, tt := range tests {
+		if got := hasShortHeaderFor(tt.datagram, cid); got != tt.want {
+			t.Errorf("%s: got %v, want %v", tt.name, got, tt.want)
+		}
+	}
+}
+
+func TestForwarder_AntiAmplification(t *testing.T) {
+	backend, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatalf("listen: %v", err)
+	}
+	defer backend.Close()
+	relay, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatalf("listen: %v", err)
+	}
+	defer relay.Close()
+	client, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatalf("listen: %v", err)
+	}
+	defer client.Close()
+
+	h, _ := NewForwarderHandler(nil)
+	fwd := h.(*ForwarderHandler)
+
+	clientCID := []byte{1, 1, 1, 1, 1, 1, 1, 1}
+	serverCID := []byte{2, 2, 2, 2}
+	ctx := &Context{
+		ClientAddr:    client.LocalAddr().(*net.UDPAddr),
+		InitialPacket: longHeader(0, clientCID, nil, 1000), // ~1 KB from the client
+		ProxyConn:     relay,
+	}
+	ctx.Set("backend", backend.LocalAddr().String())
+	if result := h.OnConnect(ctx); result.Action != Handled {
+		t.Fatalf("OnConnect: %v", result.Error)
+	}
+	defer h.OnDisconnect(ctx)
+
+	buf := make([]byte, 2048)
+	backend.SetReadDeadline(time.Now().Add(2 * time.Second))
+	_, relayAddr, err := backend.ReadFromUDP(buf)
+	if err != nil {
+		t.Fatalf("backend read: %v", err)
+	}
+
+	// Backend answers with 5 datagrams of ~1 KB: only 3x the client's bytes may pass
+	for i := 0; i < 5; i++ {
+		backend.WriteToUDP(longHeader(0, nil, serverCID, 990), relayAddr)
+	}
+	received := 0
+	client.SetReadDeadline(time.Now().Add(300 * time.Millisecond))
+	for {
+		if _, _, err := client.ReadFromUDP(buf); err != nil {
+			break
+		}
+		received++
+	}
+	if received != 3 {
+		t.Errorf("client received %d datagrams before validation, want 3", received)
+	}
+	if drops := fwd.AmplificationDrops(); drops != 2 {
+		t.Errorf("AmplificationDrops = %d, want 2", drops)
+	}
+
+	// A 1-RTT packet to the backend's CID proves the client owns its address
+	h.OnPacket(ctx, append([]byte{0x40}, append(serverCID, 0, 0)...), Inbound)
+	if !ctx.Session.AddressValidated() {
+		t.Fatal("address not validated after 1-RTT packet")
+	}
+	for i := 0; i < 5; i++ {
+		backend.WriteToUDP(longHeader(2, nil, serverCID, 990), relayAddr)
+	}
+	received = 0
+	client.SetReadDeadline(time.Now().Add(300 * time.Millisecond))
+	for {
+		if _, _, err := client.ReadFromUDP(buf); err != nil {
+			break
+		}
+		received++
+	}
+	if received != 5 {
+		t.Errorf("client received %d datagrams after validation, want 5", received)
+	}
+}
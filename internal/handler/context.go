@@ -2,7 +2,9 @@ package handler
 
 import (
 	"context"
+	"log"
 	"net"
+	"slices"
 	"sync"
 	"sync/atomic"
 	"time"
@@ -39,6 +41,55 @@ type ClientHello struct {
 	SNI string
 	// ALPNProtocols contains the Application Layer Protocol Negotiation values.
 	ALPNProtocols []string
+
+	// Version is the legacy_version field (0x0303 for TLS 1.3 clients).
+	Version uint16
+	// CipherSuites lists the offered cipher suites in order, GREASE included.
+	CipherSuites []uint16
+	// Extensions lists the extension types in the order sent, GREASE included.
+	Extensions []uint16
+	// SupportedVersions contains the supported_versions extension values.
+	SupportedVersions []uint16
+	// SupportedGroups contains the supported_groups extension values.
+	SupportedGroups []uint16
+	// SignatureAlgorithms contains the signature_algorithms extension values.
+	SignatureAlgorithms []uint16
+	// KeyShares contains the groups of the key shares sent.
+	KeyShares []uint16
+	// RawTransportParameters is the raw quic_transport_parameters extension (0x39).
+	RawTransportParameters []byte
+	// TransportParameters holds the parsed transport parameters (nil if absent or malformed).
+	TransportParameters *TransportParameters
+
+	// JA4 is the JA4 fingerprint of the ClientHello, e.g. "q13d0312h3_55b375c5d22e_06cda9e17597".
+	JA4 string
+}
+
+// TransportParameters are the QUIC transport parameters a client advertised
+// (RFC 9000 Section 18.2). Parameters the client didn't send hold their
+// default values.
+type TransportParameters struct {
+	MaxIdleTimeout                 time.Duration // 0 = no idle timeout advertised
+	MaxUDPPayloadSize              uint64        // Default 65527
+	InitialMaxData                 uint64
+	InitialMaxStreamDataBidiLocal  uint64
+	InitialMaxStreamDataBidiRemote uint64
+	InitialMaxStreamDataUni        uint64
+	InitialMaxStreamsBidi          uint64
+	InitialMaxStreamsUni           uint64
+	AckDelayExponent               uint64        // Default 3
+	MaxAckDelay                    time.Duration // Default 25ms
+	DisableActiveMigration         bool
+	ActiveConnectionIDLimit        uint64 // Default 2
+	InitialSourceConnectionID      []byte
+	MaxDatagramFrameSize           uint64 // RFC 9221; 0 = datagrams not supported
+	GreaseQUICBit                  bool   // RFC 9287
+
+	// Unknown lists the IDs of parameters not listed above, in the order sent.
+	Unknown []uint64
+	// Anomalies describes values a conforming client doesn't send, e.g.
+	// server-only parameters or out-of-range values. Empty for normal clients.
+	Anomalies []string
 }
 
 // Session represents a UDP session between client and backend.
@@ -51,6 +102,12 @@ type Session struct {
 	CreatedAt    time.Time
 	LastActivity atomic.Int64 // Unix timestamp - updated atomically on every packet
 	closed       atomic.Bool  // Set when session is being closed - prevents use-after-close
+	proxyHeader  []byte       // PROXY protocol preamble sent ahead of client Initials (nil if disabled)
+	amp          amplification
+
+	aliasMu      sync.Mutex
+	aliases      []string // Extra lookup keys routed to this session (see AddAlias)
+	aliasesTaken bool     // Set by TakeAliases when the session is removed
 }
 
 // Touch updates the last activity timestamp atomically.
@@ -71,6 +128,18 @@ func (s *Session) Close() bool {
 	return s.closed.CompareAndSwap(false, true)
 }
 
+// ProxyHeader returns the PROXY protocol preamble sent ahead of client
+// Initials, or nil if the session has none.
+func (s *Session) ProxyHeader() []byte {
+	return s.proxyHeader
+}
+
+// SetProxyHeader sets the PROXY protocol preamble, e.g. for a session
+// inherited from a previous process. Must be called before the session is used.
+func (s *Session) SetProxyHeader(header []byte) {
+	s.proxyHeader = header
+}
+
 // IsClosed returns whether the session has been closed.
 func (s *Session) IsClosed() bool {
 	return s.closed.Load()
@@ -81,6 +150,46 @@ func (s *Session) DCIDKey() string {
 	return string(s.DCID)
 }
 
+// AddAlias records a lookup key the proxy routes to this session, such as a
+// connection ID chosen by the backend, so it is removed along with the session.
+// Returns false if key is already recorded or the session has been removed.
+func (s *Session) AddAlias(key string) bool {
+	s.aliasMu.Lock()
+	defer s.aliasMu.Unlock()
+	if s.aliasesTaken || slices.Contains(s.aliases, key) {
+		return false
+	}
+	s.aliases = append(s.aliases, key)
+	return true
+}
+
+// TakeAliases returns all recorded alias keys and makes later AddAlias calls fail.
+// Called once when the session is removed.
+func (s *Session) TakeAliases() []string {
+	s.aliasMu.Lock()
+	defer s.aliasMu.Unlock()
+	s.aliasesTaken = true
+	aliases := s.aliases
+	s.aliases = nil
+	return aliases
+}
+
+// AliasesTaken reports whether TakeAliases has been called. The proxy checks
+// it after publishing an alias, to undo aliases added while the session was
+// being removed.
+func (s *Session) AliasesTaken() bool {
+	s.aliasMu.Lock()
+	defer s.aliasMu.Unlock()
+	return s.aliasesTaken
+}
+
+// AliasCount returns the number of recorded alias keys.
+func (s *Session) AliasCount() int {
+	s.aliasMu.Lock()
+	defer s.aliasMu.Unlock()
+	return len(s.aliases)
+}
+
 // ClientAddr returns the current client address (atomic read).
 // Safe to call from multiple goroutines.
 func (s *Session) ClientAddr() *net.UDPAddr {
@@ -117,11 +226,41 @@ type Context struct {
 	OnServerPacket func(packet []byte)
 
 	// DropSession immediately removes the session from the proxy.
-	// Set by proxy after session is stored. Safe to call multiple times (idempotent).
+	// Set by proxy before passing context to handlers; a session dropped
+	// before it is stored is never stored. Use Drop to call it.
 	// Handlers can call this to immediately terminate a connection.
 	DropSession       func()
 	dropSessionCalled atomic.Bool
 
+	// BanClient bans the client's IP address, with escalating durations.
+	// Set by proxy; nil if banning is not available. Use Ban to call it.
+	BanClient func(reason string)
+
+	// Chain is the chain that accepted the session. Its handlers get all of
+	// the session's packets and its disconnect, even after a reload has
+	// replaced it for new connections (set by the proxy).
+	Chain *Chain
+
+	// OnResume is called with the chain's OnConnect result when OnConnect
+	// returned Pending, from the goroutine that decided it (set by proxy).
+	OnResume func(Result)
+
+	// ConnectTimeout limits how long OnConnect may stay Pending in total;
+	// the connection is then dropped with ErrConnectTimeout (set by proxy,
+	// 0 = no limit).
+	ConnectTimeout time.Duration
+
+	// pending holds the state of an OnConnect suspended by a handler.
+	pending pendingConnect
+
+	// outbound holds the handlers that see backend-to-client packets (set by
+	// Chain, nil if none want them). See OutboundHandler.
+	outbound []*stage
+
+	// idleTimeout overrides the proxy's idle timeout for this session
+	// (nanoseconds, 0 = not set). See SetIdleTimeout.
+	idleTimeout atomic.Int64
+
 	// values is a thread-safe key-value store for passing data between handlers.
 	values map[string]any
 	mu     sync.RWMutex
@@ -145,6 +284,61 @@ func (c *Context) Drop() {
 	}
 }
 
+// Dropped reports whether Drop has been called.
+func (c *Context) Dropped() bool {
+	return c.dropSessionCalled.Load()
+}
+
+// filterOutbound passes a backend-to-client packet through the handlers that
+// asked for outbound packets. Returns false if one dropped or consumed it.
+func (c *Context) filterOutbound(packet []byte) bool {
+	for _, s := range c.outbound {
+		result := s.packet(c, packet, Outbound)
+		switch result.Action {
+		case Continue:
+			continue
+		case Drop:
+			if result.Error != nil {
+				log.Printf("[%s] outbound packet dropped: %v", s.h.Name(), result.Error)
+			}
+		}
+		return false
+	}
+	return true
+}
+
+// Ban bans the client's IP address if the proxy has banning enabled and the
+// address is validated. An unvalidated source address may be spoofed, and
+// banning it would lock out its real owner, so such calls are ignored.
+func (c *Context) Ban(reason string) {
+	if c.BanClient != nil && c.AddressValidated() {
+		c.BanClient(reason)
+	}
+}
+
+// AddressValidated reports whether the client has proven it receives at its
+// source address: it came back with a Retry token, or its session passed the
+// amplification check (see Session.AddressValidated).
+func (c *Context) AddressValidated() bool {
+	if _, ok := RetryODCID.Get(c); ok {
+		return true
+	}
+	return c.Session != nil && c.Session.AddressValidated()
+}
+
+// SetIdleTimeout sets how long the session may be idle before the proxy
+// removes it, overriding the timeout derived from the client's transport
+// parameters and session_timeout. 0 removes the override. Safe to call from
+// any goroutine, at any time during the session.
+func (c *Context) SetIdleTimeout(d time.Duration) {
+	c.idleTimeout.Store(int64(max(d, 0)))
+}
+
+// IdleTimeout returns the override set with SetIdleTimeout, or 0 if none.
+func (c *Context) IdleTimeout() time.Duration {
+	return time.Duration(c.idleTimeout.Load())
+}
+
 // Set stores a value in the context (thread-safe).
 func (c *Context) Set(key string, value any) {
 	c.mu.Lock()
@@ -166,6 +360,18 @@ func (c *Context) Get(key string) (any, bool) {
 	return v, ok
 }
 
+// Range calls fn for each value in the context (thread-safe).
+// Iteration stops when fn returns false. fn must not modify the context.
+func (c *Context) Range(fn func(key string, value any) bool) {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	for k, v := range c.values {
+		if !fn(k, v) {
+			return
+		}
+	}
+}
+
 // GetValue retrieves a typed value from the context (thread-safe).
 // Returns zero value and false if key doesn't exist or type doesn't match.
 func GetValue[T any](ctx *Context, key string) (T, bool) {
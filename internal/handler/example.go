@@ -3,7 +3,7 @@ package handler
 import "encoding/json"
 
 func init() {
-	Register("example", NewExampleHandler)
+	RegisterConfig("example", NewExampleHandler, nil)
 }
 
 // ExampleHandler is a no-op handler for demonstration and testing.
@@ -17,6 +17,9 @@ func NewExampleHandler(_ json.RawMessage) (Handler, error) {
 // Name returns the handler name.
 func (h *ExampleHandler) Name() string { return "example" }
 
+// ProvidesKeys reports that the handler sets no keys.
+func (h *ExampleHandler) ProvidesKeys() []AnyKey { return nil }
+
 // OnConnect does nothing.
 func (h *ExampleHandler) OnConnect(ctx *Context) Result { return Result{Action: Continue} }
 
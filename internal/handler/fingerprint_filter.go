@@ -0,0 +1,115 @@
+package handler
+
+import (
+	"encoding/json"
+	"fmt"
+	"path"
+)
+
+func init() {
+	RegisterConfig("fingerprint-filter", NewFingerprintFilterHandler, FingerprintFilterConfig{})
+}
+
+// FingerprintFilterConfig is the configuration for the fingerprint filter.
+type FingerprintFilterConfig struct {
+	Rules   []FingerprintRule `json:"rules"`
+	Default string            `json:"default,omitempty"` // "allow" (default) or "deny" when no rule decides
+}
+
+// FingerprintRule matches JA4 fingerprints against a glob pattern, e.g. "q13d0312h3_*".
+type FingerprintRule struct {
+	Match  string `json:"match"`
+	Action string `json:"action"`        // "allow", "deny" or "tag"
+	Tag    string `json:"tag,omitempty"` // Stored as FingerprintTag (required for "tag")
+}
+
+// FingerprintFilterHandler allows, denies or tags connections by their JA4
+// ClientHello fingerprint. Rules are checked in order: "tag" rules set the
+// tag and move on, the first matching "allow" or "deny" rule decides.
+type FingerprintFilterHandler struct {
+	rules    []FingerprintRule
+	denyRest bool
+}
+
+// NewFingerprintFilterHandler creates a new fingerprint filter handler.
+func NewFingerprintFilterHandler(raw json.RawMessage) (Handler, error) {
+	var cfg FingerprintFilterConfig
+	if len(raw) > 0 {
+		if err := decodeConfig(raw, &cfg); err != nil {
+			return nil, fmt.Errorf("invalid fingerprint-filter config: %w", err)
+		}
+	}
+	if len(cfg.Rules) == 0 {
+		return nil, fmt.Errorf("fingerprint-filter requires 'rules'")
+	}
+
+	h := &FingerprintFilterHandler{rules: cfg.Rules}
+	switch cfg.Default {
+	case "", "allow":
+	case "deny":
+		h.denyRest = true
+	default:
+		return nil, fmt.Errorf("fingerprint-filter: unknown default %q (use \"allow\" or \"deny\")", cfg.Default)
+	}
+	for i, r := range cfg.Rules {
+		if _, err := path.Match(r.Match, ""); err != nil || r.Match == "" {
+			return nil, fmt.Errorf("fingerprint-filter: rule %d: invalid pattern %q", i, r.Match)
+		}
+		switch r.Action {
+		case "allow", "deny":
+		case "tag":
+			if r.Tag == "" {
+				return nil, fmt.Errorf("fingerprint-filter: rule %d: 'tag' action requires 'tag'", i)
+			}
+		default:
+			return nil, fmt.Errorf("fingerprint-filter: rule %d: unknown action %q (use \"allow\", \"deny\" or \"tag\")", i, r.Action)
+		}
+	}
+	return h, nil
+}
+
+// Name returns the handler name.
+func (h *FingerprintFilterHandler) Name() string {
+	return "fingerprint-filter"
+}
+
+// OnConnect applies the rules to the connection's JA4 fingerprint.
+func (h *FingerprintFilterHandler) OnConnect(ctx *Context) Result {
+	ja4 := ""
+	if ctx.Hello != nil {
+		ja4 = ctx.Hello.JA4
+	}
+	if ja4 != "" {
+		for _, r := range h.rules {
+			if ok, _ := path.Match(r.Match, ja4); !ok {
+				continue
+			}
+			if r.Tag != "" {
+				FingerprintTag.Set(ctx, r.Tag)
+			}
+			switch r.Action {
+			case "allow":
+				return Result{Action: Continue}
+			case "deny":
+				return Result{Action: Drop, Error: fmt.Errorf("fingerprint %s denied", ja4)}
+			}
+		}
+	}
+	if h.denyRest {
+		return Result{Action: Drop, Error: fmt.Errorf("fingerprint %q not allowed", ja4)}
+	}
+	return Result{Action: Continue}
+}
+
+// OnPacket passes through.
+func (h *FingerprintFilterHandler) OnPacket(ctx *Context, packet []byte, dir Direction) Result {
+	return Result{Action: Continue}
+}
+
+// OnDisconnect does nothing.
+func (h *FingerprintFilterHandler) OnDisconnect(ctx *Context) {}
+
+// ProvidesKeys reports that the handler sets the fingerprint tag.
+func (h *FingerprintFilterHandler) ProvidesKeys() []AnyKey {
+	return []AnyKey{FingerprintTag}
+}
@@ -0,0 +1,66 @@
+package handler
+
+import (
+	"encoding/json"
+	"testing"
+)
+
+const (
+	testHytaleJA4 = "q13d0312h3_55b375c5d22e_06cda9e17597"
+	testBotJA4    = "q13d0310h3_e8f1e7e78f70_9b3a8f24d1c2"
+)
+
+func TestFingerprintFilter_RequiresConfig(t *testing.T) {
+	for _, raw := range []string{
+		``,
+		`{"rules": []}`,
+		`{"rules": [{"match": "q13*", "action": "block"}]}`,
+		`{"rules": [{"match": "q13*", "action": "tag"}]}`,
+		`{"rules": [{"match": "[", "action": "deny"}]}`,
+		`{"rules": [{"match": "q13*", "action": "deny"}], "default": "drop"}`,
+	} {
+		if _, err := NewFingerprintFilterHandler(json.RawMessage(raw)); err == nil {
+			t.Errorf("expected error for config %q", raw)
+		}
+	}
+}
+
+func TestFingerprintFilter_Rules(t *testing.T) {
+	h, err := NewFingerprintFilterHandler(json.RawMessage(`{
+		"rules": [
+			{"match": "q13d0310h3_e8f1e7e78f70_*", "action": "deny"},
+			{"match": "q13d03*", "action": "tag", "tag": "quic13"},
+			{"match": "` + testHytaleJA4 + `", "action": "allow", "tag": "hytale"}
+		],
+		"default": "deny"
+	}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	bot := &Context{Hello: &ClientHello{JA4: testBotJA4}}
+	if r := h.OnConnect(bot); r.Action != Drop {
+		t.Error("denied fingerprint passed")
+	}
+
+	client := &Context{Hello: &ClientHello{JA4: testHytaleJA4}}
+	if r := h.OnConnect(client); r.Action != Continue {
+		t.Errorf("allowed fingerprint dropped: %v", r.Error)
+	}
+	if tag := FingerprintTag.Value(client); tag != "hytale" {
+		t.Errorf("tag = %q, want hytale", tag)
+	}
+
+	// Tagged but not allowed: falls through to the default
+	other := &Context{Hello: &ClientHello{JA4: "q13d0399h3_000000000000_000000000000"}}
+	if r := h.OnConnect(other); r.Action != Drop {
+		t.Error("default deny not applied")
+	}
+	if tag := FingerprintTag.Value(other); tag != "quic13" {
+		t.Errorf("tag = %q, want quic13", tag)
+	}
+
+	if r := h.OnConnect(&Context{}); r.Action != Drop {
+		t.Error("connection without ClientHello passed default deny")
+	}
+}
@@ -3,26 +3,103 @@ package handler
 import (
 	"encoding/json"
 	"errors"
+	"fmt"
 	"log"
 	"net"
+	"net/netip"
 	"sync/atomic"
 	"time"
 
+	"proxyproto"
 	"quic-relay/internal/debug"
 )
 
 func init() {
-	Register("forwarder", NewForwarderHandler)
+	RegisterConfig("forwarder", NewForwarderHandler, ForwarderConfig{})
+}
+
+// ForwarderConfig is the configuration for the forwarder.
+type ForwarderConfig struct {
+	ProxyProtocol *ProxyProtocolConfig `json:"proxy_protocol,omitempty"`
+	Transparent   bool                 `json:"transparent,omitempty"` // Spoof client source IPs toward backends (Linux TPROXY)
+}
+
+// ProxyProtocolConfig enables PROXY protocol v2 preambles toward backends.
+type ProxyProtocolConfig struct {
+	Backends []string `json:"backends"` // Backend addresses to send the preamble to ("*" for all)
 }
 
 // ForwarderHandler handles UDP packet forwarding between clients and backends.
 type ForwarderHandler struct {
-	sessionCounter atomic.Uint64
+	counters      *forwarderCounters // Shared across reloads
+	proxyProtocol map[string]bool    // Backends that receive a PROXY protocol preamble
+	proxyProtoAll bool
+	transparent   bool
+}
+
+// SendsProxyHeaders reports whether the chain has a forwarder and every
+// forwarder in it, including those in nested chains, sends PROXY protocol
+// headers to all backends ("*"). Backends learn the Retry connection IDs only
+// from these headers.
+func (c *Chain) SendsProxyHeaders() bool {
+	found, all := false, true
+	c.walk(func(h Handler) {
+		if f, ok := h.(*ForwarderHandler); ok {
+			found = true
+			all = all && f.proxyProtoAll
+		}
+	})
+	return found && all
 }
 
 // NewForwarderHandler creates a new forwarder handler.
-func NewForwarderHandler(_ json.RawMessage) (Handler, error) {
-	return &ForwarderHandler{}, nil
+func NewForwarderHandler(raw json.RawMessage) (Handler, error) {
+	var cfg ForwarderConfig
+	if len(raw) > 0 {
+		if err := decodeConfig(raw, &cfg); err != nil {
+			return nil, fmt.Errorf("invalid forwarder config: %w", err)
+		}
+	}
+
+	h := &ForwarderHandler{counters: &forwarderCounters{}, transparent: cfg.Transparent}
+	if cfg.Transparent {
+		if err := checkTransparent(); err != nil {
+			return nil, fmt.Errorf("forwarder: %w", err)
+		}
+	}
+	if cfg.ProxyProtocol != nil {
+		if len(cfg.ProxyProtocol.Backends) == 0 {
+			return nil, fmt.Errorf("forwarder 'proxy_protocol' requires 'backends'")
+		}
+		h.proxyProtocol = make(map[string]bool, len(cfg.ProxyProtocol.Backends))
+		for _, b := range cfg.ProxyProtocol.Backends {
+			if b == "*" {
+				h.proxyProtoAll = true
+			}
+			h.proxyProtocol[b] = true
+		}
+	}
+	return h, nil
+}
+
+// forwarderCounters outlive a reload: session IDs must stay unique, and
+// the old handler keeps forwarding for sessions started before it.
+type forwarderCounters struct {
+	sessions           atomic.Uint64
+	amplificationDrops atomic.Uint64
+}
+
+// Reload shares the session numbering and drop count of the handler it replaces.
+func (h *ForwarderHandler) Reload(old Handler) {
+	if o, ok := old.(*ForwarderHandler); ok {
+		h.counters = o.counters
+	}
+}
+
+// AmplificationDrops returns how many backend datagrams were dropped across
+// all sessions because the client's address was not validated yet.
+func (h *ForwarderHandler) AmplificationDrops() uint64 {
+	return h.counters.amplificationDrops.Load()
 }
 
 // Name returns the handler name.
@@ -33,7 +110,7 @@ func (h *ForwarderHandler) Name() string {
 // OnConnect establishes a UDP session to the backend.
 func (h *ForwarderHandler) OnConnect(ctx *Context) Result {
 	// Get backend from context (set by router handler)
-	backend := ctx.GetString("backend")
+	backend := Backend.Value(ctx)
 	if backend == "" {
 		return Result{Action: Drop, Error: errors.New("no backend address")}
 	}
@@ -45,7 +122,7 @@ func (h *ForwarderHandler) OnConnect(ctx *Context) Result {
 	}
 
 	// Create UDP connection to backend
-	backendConn, err := net.DialUDP("udp", nil, backendAddr)
+	backendConn, err := h.dialBackend(ctx.ClientAddr, backendAddr)
 	if err != nil {
 		return Result{Action: Drop, Error: err}
 	}
@@ -53,19 +130,38 @@ func (h *ForwarderHandler) OnConnect(ctx *Context) Result {
 	// Create session
 	now := time.Now()
 	session := &Session{
-		ID:          h.sessionCounter.Add(1),
+		ID:          h.counters.sessions.Add(1),
 		BackendAddr: backendAddr,
 		BackendConn: backendConn,
 		CreatedAt:   now,
 	}
 	session.SetClientAddr(ctx.ClientAddr)
 	session.LastActivity.Store(now.Unix())
+	if _, ok := RetryODCID.Get(ctx); ok {
+		session.ValidateAddress() // Client already echoed our Retry token
+	}
 	ctx.Session = session
 
 	log.Printf("[forwarder] session=%d %s -> %s", session.ID, ctx.ClientAddr, backend)
 
+	// Tell the backend who the client is before any QUIC packet
+	if h.proxyProtoAll || h.proxyProtocol[backend] {
+		preamble, err := buildProxyHeader(ctx)
+		if err != nil {
+			backendConn.Close()
+			return Result{Action: Drop, Error: err}
+		}
+		session.proxyHeader = preamble
+		if _, err := backendConn.Write(preamble); err != nil {
+			log.Printf("[forwarder] failed to send PROXY header: %v", err)
+			backendConn.Close()
+			return Result{Action: Drop, Error: err}
+		}
+	}
+
 	// Forward the initial packet to backend
 	if len(ctx.InitialPacket) > 0 {
+		session.fromClient(ctx.InitialPacket)
 		_, err := backendConn.Write(ctx.InitialPacket)
 		if err != nil {
 			log.Printf("[forwarder] failed to forward initial packet: %v", err)
@@ -83,6 +179,44 @@ func (h *ForwarderHandler) OnConnect(ctx *Context) Result {
 	return Result{Action: Handled}
 }
 
+// dialBackend opens the backend socket. In transparent mode it is bound to the
+// client's address so the backend sees the real player IP.
+func (h *ForwarderHandler) dialBackend(clientAddr, backendAddr *net.UDPAddr) (*net.UDPConn, error) {
+	if !h.transparent {
+		return net.DialUDP("udp", nil, backendAddr)
+	}
+	conn, err := dialTransparent(clientAddr, backendAddr)
+	if err != nil {
+		return nil, fmt.Errorf("transparent dial from %s: %w", clientAddr, err)
+	}
+	return conn, nil
+}
+
+// ResumeSession takes over a session inherited from a previous process.
+// The backend connection is already restored; only the reader goroutine is restarted.
+func (h *ForwarderHandler) ResumeSession(ctx *Context) error {
+	session := ctx.Session
+	if session == nil || session.BackendConn == nil {
+		return errors.New("no session")
+	}
+
+	// Keep session IDs unique across the upgrade
+	for {
+		cur := h.counters.sessions.Load()
+		if session.ID <= cur || h.counters.sessions.CompareAndSwap(cur, session.ID) {
+			break
+		}
+	}
+
+	// Handshake state isn't transferred; inherited sessions are established
+	session.ValidateAddress()
+
+	log.Printf("[forwarder] resumed session=%d %s -> %s", session.ID, session.ClientAddr(), session.BackendAddr)
+
+	go h.backendToClient(ctx, session)
+	return nil
+}
+
 // OnPacket forwards packets from client to backend.
 func (h *ForwarderHandler) OnPacket(ctx *Context, packet []byte, dir Direction) Result {
 	if ctx.Session == nil {
@@ -100,13 +234,21 @@ func (h *ForwarderHandler) OnPacket(ctx *Context, packet []byte, dir Direction)
 	if dir == Inbound {
 		// Client -> Backend
 		debug.Printf(" client->backend: %d bytes, first byte: 0x%02x", len(packet), packet[0])
+		ctx.Session.fromClient(packet)
+
+		// Repeat the preamble ahead of retransmitted Initials in case it was lost
+		if ctx.Session.proxyHeader != nil && isInitialPacket(packet) {
+			ctx.Session.BackendConn.Write(ctx.Session.proxyHeader)
+		}
+
 		_, err := ctx.Session.BackendConn.Write(packet)
 		if err != nil {
 			log.Printf("[forwarder] write to backend failed: %v", err)
 			return Result{Action: Drop, Error: err}
 		}
 	}
-	// Outbound is handled by backendToClient goroutine
+	// Outbound packets are sent by the backendToClient goroutine, which
+	// passes them through earlier handlers that want them (OutboundHandler)
 
 	return Result{Action: Handled}
 }
@@ -124,6 +266,11 @@ func (h *ForwarderHandler) OnDisconnect(ctx *Context) {
 	}
 }
 
+// RequiresKeys reports that the forwarder needs a backend.
+func (h *ForwarderHandler) RequiresKeys() []AnyKey {
+	return []AnyKey{Backend}
+}
+
 // backendToClient reads packets from backend and sends to client.
 // Uses buffer pool to avoid per-session 64KB allocations.
 func (h *ForwarderHandler) backendToClient(ctx *Context, session *Session) {
@@ -161,6 +308,23 @@ func (h *ForwarderHandler) backendToClient(ctx *Context, session *Session) {
 
 		debug.Printf(" backend->client: %d bytes, first byte: 0x%02x", n, (*buf)[0])
 
+		// Let earlier handlers inspect, throttle or drop the packet
+		if len(ctx.outbound) > 0 && !ctx.filterOutbound((*buf)[:n]) {
+			PutBuffer(buf)
+			continue
+		}
+
+		// Don't reflect more than allowed at an unvalidated (possibly spoofed) address
+		if !session.toClient((*buf)[:n]) {
+			h.counters.amplificationDrops.Add(1)
+			if session.AmplificationDrops() == 1 {
+				log.Printf("[forwarder] session=%d: anti-amplification limit reached, dropping backend packets until %s is validated",
+					session.ID, session.ClientAddr())
+			}
+			PutBuffer(buf)
+			continue
+		}
+
 		// Send to client via proxy's UDP connection
 		if ctx.ProxyConn != nil {
 			_, err = ctx.ProxyConn.WriteToUDP((*buf)[:n], session.ClientAddr())
@@ -176,3 +340,45 @@ func (h *ForwarderHandler) backendToClient(ctx *Context, session *Session) {
 		PutBuffer(buf)
 	}
 }
+
+// buildProxyHeader encodes a PROXY protocol v2 header with the client address,
+// the relay address the client connected to, and SNI/ALPN as TLVs.
+func buildProxyHeader(ctx *Context) ([]byte, error) {
+	hdr := &proxyproto.Header{
+		Command: proxyproto.Proxy,
+		Source:  ctx.ClientAddr.AddrPort(),
+	}
+	if ctx.ProxyConn != nil {
+		if local, ok := ctx.ProxyConn.LocalAddr().(*net.UDPAddr); ok {
+			hdr.Destination = local.AddrPort()
+		}
+	}
+	if !hdr.Destination.IsValid() {
+		// Unknown relay address: use the unspecified address of the client's family
+		if hdr.Source.Addr().Unmap().Is4() {
+			hdr.Destination = netip.AddrPortFrom(netip.IPv4Unspecified(), 0)
+		} else {
+			hdr.Destination = netip.AddrPortFrom(netip.IPv6Unspecified(), 0)
+		}
+	}
+	if ctx.Hello != nil {
+		if ctx.Hello.SNI != "" {
+			hdr.TLVs = append(hdr.TLVs, proxyproto.TLV{Type: proxyproto.TypeAuthority, Value: []byte(ctx.Hello.SNI)})
+		}
+		if len(ctx.Hello.ALPNProtocols) > 0 {
+			hdr.TLVs = append(hdr.TLVs, proxyproto.TLV{Type: proxyproto.TypeALPN, Value: []byte(ctx.Hello.ALPNProtocols[0])})
+		}
+	}
+	if odcid, ok := RetryODCID.Get(ctx); ok {
+		scid := RetrySCID.Value(ctx)
+		hdr.TLVs = append(hdr.TLVs,
+			proxyproto.TLV{Type: proxyproto.TypeRetryODCID, Value: odcid},
+			proxyproto.TLV{Type: proxyproto.TypeRetrySCID, Value: scid})
+	}
+	return proxyproto.Append(nil, hdr)
+}
+
+// isInitialPacket reports whether packet is a QUIC v1 Initial (Long Header, type 00).
+func isInitialPacket(packet []byte) bool {
+	return len(packet) > 0 && packet[0]&0xF0 == 0xC0
+}
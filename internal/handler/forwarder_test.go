@@ -0,0 +1,69 @@
+package handler
+
+import (
+	"encoding/json"
+	"net"
+	"testing"
+	"time"
+
+	"proxyproto"
+)
+
+func TestForwarder_ProxyProtocolPreamble(t *testing.T) {
+	backend, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatalf("listen: %v", err)
+	}
+	defer backend.Close()
+	backendAddr := backend.LocalAddr().String()
+
+	h, err := NewForwarderHandler(json.RawMessage(`{"proxy_protocol": {"backends": ["` + backendAddr + `"]}}`))
+	if err != nil {
+		t.Fatalf("failed to create handler: %v", err)
+	}
+
+	initial := []byte{0xC0, 0x00, 0x00, 0x00, 0x01}
+	ctx := &Context{
+		ClientAddr:    &net.UDPAddr{IP: net.ParseIP("203.0.113.7"), Port: 51234},
+		InitialPacket: initial,
+		Hello:         &ClientHello{SNI: "play.example.com"},
+	}
+	ctx.Set("backend", backendAddr)
+
+	if result := h.OnConnect(ctx); result.Action != Handled {
+		t.Fatalf("expected Handled, got %v (error: %v)", result.Action, result.Error)
+	}
+	defer h.OnDisconnect(ctx)
+
+	buf := make([]byte, 1500)
+	backend.SetReadDeadline(time.Now().Add(2 * time.Second))
+
+	n, _, err := backend.ReadFromUDP(buf)
+	if err != nil {
+		t.Fatalf("read preamble: %v", err)
+	}
+	hdr, _, err := proxyproto.Parse(buf[:n])
+	if err != nil {
+		t.Fatalf("preamble is not a PROXY header: %v", err)
+	}
+	if hdr.Source.String() != "203.0.113.7:51234" {
+		t.Errorf("Source = %v, want 203.0.113.7:51234", hdr.Source)
+	}
+	if hdr.Authority() != "play.example.com" {
+		t.Errorf("Authority = %q, want play.example.com", hdr.Authority())
+	}
+
+	n, _, err = backend.ReadFromUDP(buf)
+	if err != nil {
+		t.Fatalf("read initial: %v", err)
+	}
+	if string(buf[:n]) != string(initial) {
+		t.Errorf("expected Initial after preamble, got %x", buf[:n])
+	}
+}
+
+func TestForwarder_ProxyProtocolRequiresBackends(t *testing.T) {
+	if _, err := NewForwarderHandler(json.RawMessage(`{"proxy_protocol": {}}`)); err == nil {
+		t.Error("expected error for empty proxy_protocol backends")
+	}
+}
@@ -1,5 +1,10 @@
 package handler
 
+import (
+	"errors"
+	"sync/atomic"
+)
+
 // Action represents the result action from a handler.
 type Action int
 
@@ -10,6 +15,11 @@ const (
 	Handled
 	// Drop discards the connection/packet.
 	Drop
+	// Pending suspends OnConnect while the handler waits for I/O, such as an
+	// auth lookup, without blocking the worker. The handler must call
+	// ctx.Resume with its actual result exactly once, from any goroutine.
+	// Only valid in OnConnect.
+	Pending
 )
 
 // Result is returned by handler methods.
@@ -39,6 +49,7 @@ type Handler interface {
 	// - Set routing info in ctx.Values (return Continue)
 	// - Rate limit (return Drop)
 	// - Start forwarding (return Handled)
+	// - Wait for I/O without blocking other clients (return Pending, see Pending)
 	OnConnect(ctx *Context) Result
 
 	// OnPacket is called for each packet after the initial connection.
@@ -49,47 +60,153 @@ type Handler interface {
 	OnPacket(ctx *Context, packet []byte, dir Direction) Result
 
 	// OnDisconnect is called when the connection ends. Used for cleanup.
+	// It is also called if the chain dropped the connection in OnConnect,
+	// so handlers can release anything they reserved there.
 	OnDisconnect(ctx *Context)
 }
 
-// Chain executes handlers in sequence.
+// SessionResumer is implemented by handlers that own per-session I/O.
+// The proxy calls ResumeSession for sessions inherited from a previous process
+// during a zero-downtime upgrade, after ctx.Session has been restored.
+// Returning ErrNotResumed passes the session on to the next resumer.
+type SessionResumer interface {
+	ResumeSession(ctx *Context) error
+}
+
+// OutboundHandler is implemented by handlers that want OnPacket calls for
+// backend-to-client packets (Outbound). The handler that forwards a session
+// (e.g. forwarder) passes each backend packet through the handlers before it
+// in the chain that return true. Sessions without any such handler skip this
+// step entirely, so other handlers pay nothing for it.
+type OutboundHandler interface {
+	WantsOutbound() bool
+}
+
+// ErrNotResumed is returned by ResumeSession when no handler took over the session.
+var ErrNotResumed = errors.New("no handler resumed the session")
+
+// Chain executes handlers in sequence. A handler that panics is treated as
+// if it returned Drop (see Stats).
 type Chain struct {
 	handlers []Handler
+	stages   []*stage // handlers with their counters
+	// outbound[i] holds the handlers before i that want outbound packets (nil
+	// if none); outbound[len(handlers)] holds all of them.
+	outbound [][]*stage
+	stopped  atomic.Bool  // Set by Shutdown
+	refs     atomic.Int64 // Owner's reference plus one per session, see Acquire
 }
 
 // NewChain creates a new handler chain.
 func NewChain(handlers ...Handler) *Chain {
-	return &Chain{handlers: handlers}
+	c := &Chain{handlers: handlers, outbound: make([][]*stage, len(handlers)+1)}
+	c.refs.Store(1)
+	var wants []*stage
+	for i, h := range handlers {
+		s := newStage(h)
+		c.stages = append(c.stages, s)
+		if len(wants) > 0 {
+			c.outbound[i] = wants[:len(wants):len(wants)]
+		}
+		if o, ok := h.(OutboundHandler); ok && o.WantsOutbound() {
+			wants = append(wants, s)
+		}
+	}
+	c.outbound[len(handlers)] = wants
+	return c
 }
 
 // OnConnect processes a new connection through the chain.
-// Stops at the first Handled or Drop result.
+// Stops at the first Handled or Drop result. Returns Pending if a handler
+// suspended the connection; ctx.OnResume then gets the result once the chain
+// has decided (see Context.Resume).
 func (c *Chain) OnConnect(ctx *Context) Result {
-	for _, h := range c.handlers {
-		result := h.OnConnect(ctx)
+	return ctx.settle(c.connect(ctx, nil))
+}
+
+// connect runs OnConnect on each handler until one returns Handled or Drop,
+// and returns Continue if none did. base holds the outbound handlers of the
+// enclosing chain, if any.
+func (c *Chain) connect(ctx *Context, base []*stage) Result {
+	return c.connectFrom(ctx, base, 0)
+}
+
+// connectFrom is connect starting at handler start. A handler that returns
+// Pending is recorded in ctx, so Resume can continue after it.
+func (c *Chain) connectFrom(ctx *Context, base []*stage, start int) Result {
+	for i := start; i < len(c.stages); i++ {
+		// Set before the call: a handler may start forwarding backend packets right away
+		ctx.outbound = joinStages(base, c.outbound[i])
+		result := c.stages[i].connect(ctx)
+		if result.Action == Pending {
+			ctx.pending.frames = append(ctx.pending.frames, connectFrame{chain: c, base: base, index: i})
+		}
 		if result.Action != Continue {
 			return result
 		}
 	}
-	// No handler handled the connection
-	return Result{Action: Drop}
+	return Result{Action: Continue}
+}
+
+// ResumeSession hands a session inherited from a previous process to the
+// first SessionResumer in the chain that takes it.
+// Returns ErrNotResumed if none did.
+func (c *Chain) ResumeSession(ctx *Context) error {
+	return c.resume(ctx, nil)
+}
+
+func (c *Chain) resume(ctx *Context, base []*stage) error {
+	for i, s := range c.stages {
+		r, ok := s.h.(SessionResumer)
+		if !ok {
+			continue
+		}
+		ctx.outbound = joinStages(base, c.outbound[i])
+		if err := s.resume(r, ctx); !errors.Is(err, ErrNotResumed) {
+			return err
+		}
+	}
+	return ErrNotResumed
 }
 
 // OnPacket processes a packet through the chain.
 func (c *Chain) OnPacket(ctx *Context, packet []byte, dir Direction) Result {
-	for _, h := range c.handlers {
-		result := h.OnPacket(ctx, packet, dir)
+	result := c.packet(ctx, packet, dir)
+	if result.Action == Continue {
+		return Result{Action: Drop}
+	}
+	return result
+}
+
+// packet runs OnPacket on each handler until one returns Handled or Drop,
+// and returns Continue if none did.
+func (c *Chain) packet(ctx *Context, packet []byte, dir Direction) Result {
+	for _, s := range c.stages {
+		result := s.packet(ctx, packet, dir)
 		if result.Action != Continue {
 			return result
 		}
 	}
-	return Result{Action: Drop}
+	return Result{Action: Continue}
+}
+
+// filterOutbound passes a backend-to-client packet through all handlers in
+// the chain that want outbound packets, and returns Continue if none
+// dropped or consumed it.
+func (c *Chain) filterOutbound(ctx *Context, packet []byte) Result {
+	for _, s := range c.outbound[len(c.handlers)] {
+		result := s.packet(ctx, packet, Outbound)
+		if result.Action != Continue {
+			return result
+		}
+	}
+	return Result{Action: Continue}
 }
 
 // OnDisconnect notifies all handlers of disconnection.
 func (c *Chain) OnDisconnect(ctx *Context) {
-	for _, h := range c.handlers {
-		h.OnDisconnect(ctx)
+	for _, s := range c.stages {
+		s.disconnect(ctx)
 	}
 }
 
@@ -97,3 +214,14 @@ func (c *Chain) OnDisconnect(ctx *Context) {
 func (c *Chain) Handlers() []Handler {
 	return c.handlers
 }
+
+// joinStages concatenates a and b, allocating only if both are non-empty.
+func joinStages(a, b []*stage) []*stage {
+	if len(a) == 0 {
+		return b
+	}
+	if len(b) == 0 {
+		return a
+	}
+	return append(a[:len(a):len(a)], b...)
+}
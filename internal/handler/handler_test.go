@@ -1,6 +1,7 @@
 package handler
 
 import (
+	"errors"
 	"net"
 	"testing"
 	"time"
@@ -147,6 +148,82 @@ func TestChain_Handlers(t *testing.T) {
 	}
 }
 
+// outboundMock is a mockHandler that opts into outbound packets.
+type outboundMock struct {
+	*mockHandler
+	wants bool
+}
+
+func (h *outboundMock) WantsOutbound() bool { return h.wants }
+
+func TestChain_Outbound(t *testing.T) {
+	h1 := &outboundMock{newMockHandler("h1", Continue, Continue), true}
+	h2 := &outboundMock{newMockHandler("h2", Continue, Continue), false}
+	h3 := newMockHandler("h3", Continue, Continue)
+	h4 := &resumerMock{mockHandler: newMockHandler("h4", Handled, Continue)}
+	after := &outboundMock{newMockHandler("after", Continue, Drop), true}
+
+	chain := NewChain(h1, h2, h3, h4, after)
+	ctx := &Context{}
+	chain.OnConnect(ctx)
+
+	// Only h1 opted in and sits before the handler that took the session
+	if len(ctx.outbound) != 1 || ctx.outbound[0].h != Handler(h1) {
+		t.Fatalf("outbound = %v, want [h1]", ctx.outbound)
+	}
+	if !ctx.filterOutbound([]byte{0x40}) {
+		t.Error("packet should pass")
+	}
+	if !h1.packetCalled || h2.packetCalled || after.packetCalled {
+		t.Error("only h1 should see outbound packets")
+	}
+
+	h1.onPacketResult = Result{Action: Drop}
+	if ctx.filterOutbound([]byte{0x40}) {
+		t.Error("packet should be dropped")
+	}
+
+	// Resumed sessions get the same handlers without OnConnect
+	resumed := &Context{}
+	if err := chain.ResumeSession(resumed); err != nil {
+		t.Fatal(err)
+	}
+	if resumed != h4.resumed || len(resumed.outbound) != 1 {
+		t.Errorf("ResumeSession: outbound = %v, want [h1]", resumed.outbound)
+	}
+}
+
+// resumerMock is a mockHandler that resumes sessions.
+type resumerMock struct {
+	*mockHandler
+	resumed *Context
+}
+
+func (h *resumerMock) ResumeSession(ctx *Context) error {
+	h.resumed = ctx
+	return nil
+}
+
+func TestChain_ResumeSession_None(t *testing.T) {
+	chain := NewChain(newMockHandler("h1", Handled, Continue))
+	if err := chain.ResumeSession(&Context{}); !errors.Is(err, ErrNotResumed) {
+		t.Errorf("got %v, want ErrNotResumed", err)
+	}
+}
+
+func TestChain_Outbound_NoneWanted(t *testing.T) {
+	h1 := newMockHandler("h1", Continue, Continue)
+	h2 := newMockHandler("h2", Handled, Continue)
+
+	chain := NewChain(h1, h2)
+	ctx := &Context{}
+	chain.OnConnect(ctx)
+
+	if ctx.outbound != nil {
+		t.Errorf("outbound = %v, want nil", ctx.outbound)
+	}
+}
+
 func TestContext_SetGet(t *testing.T) {
 	ctx := &Context{}
 
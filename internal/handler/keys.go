@@ -0,0 +1,85 @@
+package handler
+
+// Key is a typed context key. Declare it once, as a package-level variable,
+// and use it instead of a string:
+//
+//	var Backend = NewKey[string]("backend")
+//
+//	Backend.Set(ctx, "10.0.0.1:5520")
+//	addr, ok := Backend.Get(ctx)
+//
+// The name is what string-based access sees (Context.Get, match "values",
+// scripts). Names starting with "_" are internal: scripts and wasm modules
+// can't see them. Prefix the names of a handler's own keys with the handler
+// name, so keys of different handlers don't collide.
+type Key[T any] struct {
+	name string
+}
+
+// NewKey declares a context key.
+func NewKey[T any](name string) Key[T] {
+	return Key[T]{name: name}
+}
+
+// Name returns the key's name.
+func (k Key[T]) Name() string {
+	return k.name
+}
+
+// Get returns the value, and false if it isn't set or has another type.
+func (k Key[T]) Get(ctx *Context) (T, bool) {
+	return GetValue[T](ctx, k.name)
+}
+
+// Value returns the value, or the zero value if it isn't set.
+func (k Key[T]) Value(ctx *Context) T {
+	v, _ := k.Get(ctx)
+	return v
+}
+
+// Set stores the value.
+func (k Key[T]) Set(ctx *Context, value T) {
+	ctx.Set(k.name, value)
+}
+
+// AnyKey is a Key of any type.
+type AnyKey interface {
+	Name() string
+}
+
+// Well-known keys.
+var (
+	// Backend is the address ("host:port") the forwarder connects to. Set by
+	// routers; the terminator replaces it with its internal listener.
+	Backend = NewKey[string]("backend")
+
+	// SessionCount is the number of active sessions when the connection
+	// arrived (set by the proxy).
+	SessionCount = NewKey[int64]("_session_count")
+
+	// FingerprintTag is the tag of the fingerprint-filter rule that matched.
+	FingerprintTag = NewKey[string]("fingerprint_tag")
+
+	// RetryODCID is the DCID of the client's first Initial, set by the proxy
+	// on connections admitted with a Retry token.
+	RetryODCID = NewKey[[]byte]("_retry_odcid")
+
+	// RetrySCID is the SCID of the proxy's Retry packet, the DCID the client
+	// uses now (set with RetryODCID).
+	RetrySCID = NewKey[[]byte]("_retry_scid")
+)
+
+// KeyProvider is implemented by handlers that set context keys for later
+// handlers. Handlers that only set a key for some connections list it too,
+// and handlers that set none return nil. BuildChain assumes handlers that
+// implement neither KeyProvider nor KeyRequirer may set any key.
+type KeyProvider interface {
+	ProvidesKeys() []AnyKey
+}
+
+// KeyRequirer is implemented by handlers that need context keys set by an
+// earlier handler. BuildChain rejects chains where no earlier handler
+// provides them, and only warns if an earlier handler might.
+type KeyRequirer interface {
+	RequiresKeys() []AnyKey
+}
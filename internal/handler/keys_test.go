@@ -0,0 +1,66 @@
+package handler
+
+import (
+	"encoding/json"
+	"strings"
+	"testing"
+)
+
+func TestKey(t *testing.T) {
+	ctx := &Context{}
+	if _, ok := Backend.Get(ctx); ok {
+		t.Error("unset key reported as set")
+	}
+	Backend.Set(ctx, "10.0.0.1:5520")
+	if got := Backend.Value(ctx); got != "10.0.0.1:5520" {
+		t.Errorf("got %q", got)
+	}
+	// String access sees the same value
+	if got := ctx.GetString("backend"); got != "10.0.0.1:5520" {
+		t.Errorf("GetString = %q", got)
+	}
+
+	ctx.Set("_session_count", 5) // int, not int64
+	if _, ok := SessionCount.Get(ctx); ok {
+		t.Error("value of another type reported as set")
+	}
+}
+
+func TestBuildChain_Keys(t *testing.T) {
+	const (
+		router    = `{"type": "simple-router", "config": {"backend": "10.0.0.1:5520"}}`
+		forwarder = `{"type": "forwarder"}`
+	)
+	tests := []struct {
+		name     string
+		handlers string
+		wantErr  bool
+	}{
+		{"router before forwarder", `[` + router + `, ` + forwarder + `]`, false},
+		{"no router", `[{"type": "logsni"}, ` + forwarder + `]`, true},
+		{"router after forwarder", `[` + forwarder + `, ` + router + `]`, true},
+		{"script may route", `[{"type": "script", "config": {"source": "function on_connect(conn) end"}}, ` + forwarder + `]`, false},
+		{"router in branch and default", `[{"type": "match", "config": {"branches": [{"sni": ["*"], "handlers": [` + router + `]}], "default": [` + router + `]}}, ` + forwarder + `]`, false},
+		{"router in branch without default", `[{"type": "match", "config": {"branches": [{"sni": ["*"], "handlers": [` + router + `]}]}}, ` + forwarder + `]`, true},
+		{"router in some branches", `[{"type": "match", "config": {"branches": [{"sni": ["a.example"], "handlers": [` + router + `]}, {"sni": ["*"], "handlers": [{"type": "logsni"}]}], "default": [` + router + `]}}, ` + forwarder + `]`, true},
+		{"router before match", `[` + router + `, {"type": "match", "config": {"branches": [{"sni": ["*"], "handlers": [` + forwarder + `]}]}}]`, false},
+		// match-test declares no keys, like custom handlers from before keys
+		{"undeclared handler may route", `[{"type": "match-test"}, ` + forwarder + `]`, false},
+		{"undeclared handler in branch", `[{"type": "match", "config": {"branches": [{"sni": ["*"], "handlers": [{"type": "match-test"}]}]}}, ` + forwarder + `]`, false},
+		{"undeclared handler after forwarder", `[` + forwarder + `, {"type": "match-test"}]`, true},
+		{"no router in branch", `[{"type": "match", "config": {"branches": [{"sni": ["*"], "handlers": [` + forwarder + `]}], "default": [` + router + `]}}]`, true},
+	}
+	for _, tt := range tests {
+		var configs []HandlerConfig
+		if err := json.Unmarshal([]byte(tt.handlers), &configs); err != nil {
+			t.Fatal(err)
+		}
+		_, err := BuildChain(configs)
+		if (err != nil) != tt.wantErr {
+			t.Errorf("%s: got error %v, want error %v", tt.name, err, tt.wantErr)
+		}
+		if err != nil && !strings.Contains(err.Error(), `forwarder requires "backend"`) {
+			t.Errorf("%s: unexpected error %v", tt.name, err)
+		}
+	}
+}
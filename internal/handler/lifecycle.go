@@ -0,0 +1,137 @@
+package handler
+
+import (
+	"context"
+	"errors"
+	"fmt"
+)
+
+// Starter is implemented by handlers that acquire resources (listeners,
+// goroutines) before serving. The proxy calls Start once, before the chain
+// sees its first connection, after Reload if the chain replaces another.
+type Starter interface {
+	Start(ctx context.Context) error
+}
+
+// Shutdowner is implemented by handlers that hold resources. The proxy calls
+// Shutdown when the chain is replaced by a reload, when it stops, and when it
+// hands off to a successor. It may be called without a successful Start.
+type Shutdowner interface {
+	Shutdown(ctx context.Context) error
+}
+
+// Reloader is implemented by handlers that carry state over a config reload.
+// Reload is called on each new handler with the old handler of the same name
+// at the same position (counting handlers with that name), before Start.
+// old may be of a different type. The old handler is shut down afterwards
+// (or, if the new chain fails to start, keeps serving), so Reload must not
+// take anything from old that old's Shutdown would release.
+type Reloader interface {
+	Reload(old Handler)
+}
+
+// nester is implemented by handlers that contain nested chains (e.g. match),
+// so lifecycle calls reach the handlers inside them.
+type nester interface {
+	nestedChains() []*Chain
+}
+
+// walk calls fn for every handler in the chain, including those in nested
+// chains, depth-first in config order.
+func (c *Chain) walk(fn func(Handler)) {
+	for _, h := range c.handlers {
+		fn(h)
+		if n, ok := h.(nester); ok {
+			for _, nested := range n.nestedChains() {
+				nested.walk(fn)
+			}
+		}
+	}
+}
+
+// Reload lets the handlers of c take over state and counters (see Stats)
+// from the handlers of old. Handlers are paired by name and position, so
+// unchanged handlers find their predecessor even if others were added or
+// removed.
+func (c *Chain) Reload(old *Chain) {
+	if old == nil {
+		return
+	}
+	previous := make(map[string][]*stage)
+	old.walkStages("", func(_ string, s *stage) {
+		previous[s.h.Name()] = append(previous[s.h.Name()], s)
+	})
+	seen := make(map[string]int)
+	c.walkStages("", func(_ string, s *stage) {
+		name := s.h.Name()
+		i := seen[name]
+		seen[name]++
+		if i >= len(previous[name]) {
+			return
+		}
+		prev := previous[name][i]
+		s.stats = prev.stats
+		if r, ok := s.h.(Reloader); ok {
+			r.Reload(prev.h)
+		}
+	})
+}
+
+// Acquire takes a reference on the chain for a session. It fails once the
+// owner's reference and all session references have been released.
+func (c *Chain) Acquire() bool {
+	for {
+		n := c.refs.Load()
+		if n <= 0 {
+			return false
+		}
+		if c.refs.CompareAndSwap(n, n+1) {
+			return true
+		}
+	}
+}
+
+// Release drops a reference taken by Acquire, or the owner's reference that
+// NewChain starts with. Reports whether it was the last one: the chain then
+// serves nothing anymore and can be shut down.
+func (c *Chain) Release() bool {
+	return c.refs.Add(-1) == 0
+}
+
+// Start starts all handlers implementing Starter in config order. If one
+// fails, the chain is shut down and the error returned.
+func (c *Chain) Start(ctx context.Context) error {
+	var err error
+	c.walk(func(h Handler) {
+		if s, ok := h.(Starter); ok && err == nil {
+			if e := s.Start(ctx); e != nil {
+				err = fmt.Errorf("failed to start handler %s: %w", h.Name(), e)
+			}
+		}
+	})
+	if err != nil {
+		c.Shutdown(ctx)
+	}
+	return err
+}
+
+// Shutdown shuts down all handlers implementing Shutdowner in reverse config
+// order. Only the first call has an effect.
+func (c *Chain) Shutdown(ctx context.Context) error {
+	if !c.stopped.CompareAndSwap(false, true) {
+		return nil
+	}
+	var all []Handler
+	c.walk(func(h Handler) {
+		all = append(all, h)
+	})
+	var errs []error
+	for i := len(all) - 1; i >= 0; i-- {
+		if s, ok := all[i].(Shutdowner); ok {
+			if err := s.Shutdown(ctx); err != nil {
+				errs = append(errs, fmt.Errorf("%s: %w", all[i].Name(), err))
+			}
+		}
+	}
+	return errors.Join(errs...)
+}
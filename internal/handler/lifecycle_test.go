@@ -0,0 +1,149 @@
+package handler
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net"
+	"slices"
+	"testing"
+)
+
+// lifecycleMock records lifecycle calls into a shared log.
+type lifecycleMock struct {
+	*mockHandler
+	log      *[]string
+	startErr error
+	old      Handler
+}
+
+func newLifecycleMock(name string, log *[]string) *lifecycleMock {
+	return &lifecycleMock{mockHandler: newMockHandler(name, Continue, Continue), log: log}
+}
+
+func (h *lifecycleMock) Start(ctx context.Context) error {
+	*h.log = append(*h.log, "start "+h.name)
+	return h.startErr
+}
+
+func (h *lifecycleMock) Shutdown(ctx context.Context) error {
+	*h.log = append(*h.log, "shutdown "+h.name)
+	return nil
+}
+
+func (h *lifecycleMock) Reload(old Handler) { h.old = old }
+
+func TestChain_StartShutdown(t *testing.T) {
+	var log []string
+	a, b := newLifecycleMock("a", &log), newLifecycleMock("b", &log)
+	chain := NewChain(a, newMockHandler("plain", Continue, Continue), b)
+
+	if err := chain.Start(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	chain.Shutdown(context.Background())
+	chain.Shutdown(context.Background())
+
+	want := []string{"start a", "start b", "shutdown b", "shutdown a"}
+	if !slices.Equal(log, want) {
+		t.Errorf("got %v, want %v", log, want)
+	}
+}
+
+func TestChain_StartFailure(t *testing.T) {
+	var log []string
+	a, b, c := newLifecycleMock("a", &log), newLifecycleMock("b", &log), newLifecycleMock("c", &log)
+	b.startErr = errors.New("port in use")
+	chain := NewChain(a, b, c)
+
+	if err := chain.Start(context.Background()); err == nil {
+		t.Fatal("expected error")
+	}
+	// c never started, but every handler is shut down
+	want := []string{"start a", "start b", "shutdown c", "shutdown b", "shutdown a"}
+	if !slices.Equal(log, want) {
+		t.Errorf("got %v, want %v", log, want)
+	}
+}
+
+func TestChain_Reload(t *testing.T) {
+	var log []string
+	oldA1, oldA2, oldB := newLifecycleMock("a", &log), newLifecycleMock("a", &log), newLifecycleMock("b", &log)
+	old := NewChain(oldA1, oldB, oldA2)
+
+	// Paired by name and position among handlers of that name, also across
+	// nested chains
+	newA1, newA2, newA3 := newLifecycleMock("a", &log), newLifecycleMock("a", &log), newLifecycleMock("a", &log)
+	newC := newLifecycleMock("c", &log)
+	match := &MatchHandler{branches: []*matchBranch{{handlers: NewChain(newA2)}}}
+	chain := NewChain(newC, newA1, match, newA3)
+	chain.Reload(old)
+
+	if newA1.old != oldA1 || newA2.old != oldA2 {
+		t.Errorf("got %v and %v, want old a handlers in order", newA1.old, newA2.old)
+	}
+	if newA3.old != nil || newC.old != nil {
+		t.Error("handlers without a predecessor should not be reloaded")
+	}
+}
+
+func TestReload_CarriesState(t *testing.T) {
+	oldFwd, _ := NewForwarderHandler(nil)
+	oldFwd.(*ForwarderHandler).counters.sessions.Store(41)
+	oldRouter, _ := NewDynamicHandler(json.RawMessage(`{"routes": {"a.example.com": ["10.0.0.1:1", "10.0.0.2:1"]}}`))
+	oldRouter.OnConnect(&Context{Hello: &ClientHello{SNI: "a.example.com"}})
+
+	fwd, _ := NewForwarderHandler(nil)
+	router, _ := NewDynamicHandler(json.RawMessage(`{"routes": {"a.example.com": ["10.0.0.1:1", "10.0.0.2:1"]}}`))
+	NewChain(router, fwd).Reload(NewChain(oldRouter, oldFwd))
+
+	// Session IDs continue, and stay unique if the old forwarder creates more
+	if got := fwd.(*ForwarderHandler).counters.sessions.Add(1); got != 42 {
+		t.Errorf("next session ID = %d, want 42", got)
+	}
+	if oldFwd.(*ForwarderHandler).counters.sessions.Add(1) != 43 {
+		t.Error("forwarders don't share session numbering")
+	}
+
+	ctx := &Context{Hello: &ClientHello{SNI: "a.example.com"}}
+	router.OnConnect(ctx)
+	if got := ctx.GetString("backend"); got != "10.0.0.2:1" {
+		t.Errorf("backend = %q, want the next one in rotation", got)
+	}
+}
+
+func TestRateLimitIP_Reload(t *testing.T) {
+	cfg := json.RawMessage(`{"per_ip": {"max_connections": 1}}`)
+	old, _ := NewRateLimitIPHandler(cfg)
+	held := &Context{ClientAddr: &net.UDPAddr{IP: net.ParseIP("192.0.2.1"), Port: 1}}
+	if r := old.OnConnect(held); r.Action != Continue {
+		t.Fatal("first connection dropped")
+	}
+
+	// Unchanged limits: the session from before the reload still counts
+	h, _ := NewRateLimitIPHandler(cfg)
+	h.(Reloader).Reload(old)
+	ctx := &Context{ClientAddr: &net.UDPAddr{IP: net.ParseIP("192.0.2.1"), Port: 2}}
+	if r := h.OnConnect(ctx); r.Action != Drop {
+		t.Error("limit not kept across reload")
+	}
+	h.OnDisconnect(held)
+	if r := h.OnConnect(ctx); r.Action != Continue {
+		t.Error("slot not released by the new handler")
+	}
+
+	// Changed limits start empty, and sessions from before don't free slots in them
+	changed, _ := NewRateLimitIPHandler(json.RawMessage(`{"per_ip": {"max_connections": 2}}`))
+	changed.(Reloader).Reload(h)
+	for port := 3; port <= 4; port++ {
+		c := &Context{ClientAddr: &net.UDPAddr{IP: net.ParseIP("192.0.2.1"), Port: port}}
+		if r := changed.OnConnect(c); r.Action != Continue {
+			t.Fatalf("connection %d dropped", port)
+		}
+	}
+	changed.OnDisconnect(ctx)
+	extra := &Context{ClientAddr: &net.UDPAddr{IP: net.ParseIP("192.0.2.1"), Port: 5}}
+	if r := changed.OnConnect(extra); r.Action != Drop {
+		t.Error("old session freed a slot in the new limiter")
+	}
+}
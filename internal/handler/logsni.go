@@ -3,13 +3,14 @@ package handler
 import (
 	"encoding/json"
 	"log"
+	"strings"
 )
 
 func init() {
-	Register("logsni", NewLogSNIHandler)
+	RegisterConfig("logsni", NewLogSNIHandler, nil)
 }
 
-// LogSNIHandler logs the SNI for each new connection.
+// LogSNIHandler logs the SNI and JA4 fingerprint for each new connection.
 type LogSNIHandler struct{}
 
 // NewLogSNIHandler creates a new logsni handler.
@@ -20,13 +21,19 @@ func NewLogSNIHandler(_ json.RawMessage) (Handler, error) {
 // Name returns the handler name.
 func (h *LogSNIHandler) Name() string { return "logsni" }
 
-// OnConnect logs the SNI.
+// ProvidesKeys reports that the handler sets no keys.
+func (h *LogSNIHandler) ProvidesKeys() []AnyKey { return nil }
+
+// OnConnect logs the SNI and fingerprint, and any transport parameter anomalies.
 func (h *LogSNIHandler) OnConnect(ctx *Context) Result {
-	sni := ""
+	sni, ja4 := "", ""
 	if ctx.Hello != nil {
-		sni = ctx.Hello.SNI
+		sni, ja4 = ctx.Hello.SNI, ctx.Hello.JA4
+	}
+	log.Printf("[sni] %s ja4=%s", sni, ja4)
+	if ctx.Hello != nil && ctx.Hello.TransportParameters != nil && len(ctx.Hello.TransportParameters.Anomalies) > 0 {
+		log.Printf("[sni] %s sent unusual transport parameters: %s", ctx.ClientAddr, strings.Join(ctx.Hello.TransportParameters.Anomalies, "; "))
 	}
-	log.Printf("[sni] %s", sni)
 	return Result{Action: Continue}
 }
 
@@ -0,0 +1,236 @@
+package handler
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/netip"
+	"path"
+	"slices"
+	"sync/atomic"
+)
+
+func init() {
+	RegisterConfig("match", NewMatchHandler, MatchConfig{})
+}
+
+// MatchConfig is the configuration for the match handler.
+type MatchConfig struct {
+	Branches []MatchBranch   `json:"branches"`
+	Default  []HandlerConfig `json:"default,omitempty"` // Runs when no branch matches
+}
+
+// MatchBranch runs its handlers for connections that meet all of its conditions.
+type MatchBranch struct {
+	SNI      []string          `json:"sni,omitempty"`    // Glob patterns, e.g. "*.example.com"
+	ALPN     []string          `json:"alpn,omitempty"`   // Client offers any of these
+	CIDR     []string          `json:"cidr,omitempty"`   // Client address in any of these
+	Values   map[string]string `json:"values,omitempty"` // Context value matches glob pattern
+	Handlers []HandlerConfig   `json:"handlers"`
+}
+
+// matchSeq makes the context key of each match handler unique, so nested
+// match handlers don't overwrite each other's branch.
+var matchSeq atomic.Uint64
+
+// MatchHandler runs a nested chain for the first branch whose conditions the
+// connection meets. If that chain doesn't handle or drop the connection, the
+// chain after the match handler continues.
+type MatchHandler struct {
+	branches []*matchBranch
+	fallback *Chain      // nil if no default
+	key      Key[*Chain] // The session's nested chain (nil if no branch matched)
+}
+
+type matchBranch struct {
+	sni      []string
+	alpn     []string
+	cidr     []netip.Prefix
+	values   map[string]string
+	handlers *Chain
+}
+
+// NewMatchHandler creates a new match handler.
+func NewMatchHandler(raw json.RawMessage) (Handler, error) {
+	var cfg MatchConfig
+	if len(raw) > 0 {
+		if err := decodeConfig(raw, &cfg); err != nil {
+			return nil, fmt.Errorf("invalid match config: %w", err)
+		}
+	}
+	if len(cfg.Branches) == 0 {
+		return nil, fmt.Errorf("match requires 'branches'")
+	}
+
+	h := &MatchHandler{key: NewKey[*Chain](fmt.Sprintf("_match.%d", matchSeq.Add(1)))}
+	for i, bc := range cfg.Branches {
+		b, err := newMatchBranch(bc)
+		if err != nil {
+			return nil, fmt.Errorf("match: branch %d: %w", i, err)
+		}
+		h.branches = append(h.branches, b)
+	}
+	if len(cfg.Default) > 0 {
+		chain, err := buildChain(cfg.Default)
+		if err != nil {
+			return nil, fmt.Errorf("match: default: %w", err)
+		}
+		h.fallback = chain
+	}
+	return h, nil
+}
+
+func newMatchBranch(cfg MatchBranch) (*matchBranch, error) {
+	if len(cfg.SNI) == 0 && len(cfg.ALPN) == 0 && len(cfg.CIDR) == 0 && len(cfg.Values) == 0 {
+		return nil, fmt.Errorf("no conditions (use 'default' to match everything)")
+	}
+	if len(cfg.Handlers) == 0 {
+		return nil, fmt.Errorf("requires 'handlers'")
+	}
+
+	b := &matchBranch{sni: cfg.SNI, alpn: cfg.ALPN, values: cfg.Values}
+	for _, p := range cfg.SNI {
+		if _, err := path.Match(p, ""); err != nil {
+			return nil, fmt.Errorf("invalid sni pattern %q", p)
+		}
+	}
+	for k, p := range cfg.Values {
+		if _, err := path.Match(p, ""); err != nil {
+			return nil, fmt.Errorf("invalid pattern %q for value %q", p, k)
+		}
+	}
+	for _, s := range cfg.CIDR {
+		prefix, err := netip.ParsePrefix(s)
+		if err != nil {
+			return nil, fmt.Errorf("invalid cidr %q", s)
+		}
+		b.cidr = append(b.cidr, prefix.Masked())
+	}
+
+	chain, err := buildChain(cfg.Handlers)
+	if err != nil {
+		return nil, err
+	}
+	b.handlers = chain
+	return b, nil
+}
+
+// matches reports whether the connection meets all of the branch's conditions.
+func (b *matchBranch) matches(ctx *Context) bool {
+	var sni string
+	var alpn []string
+	if ctx.Hello != nil {
+		sni, alpn = ctx.Hello.SNI, ctx.Hello.ALPNProtocols
+	}
+
+	if len(b.sni) > 0 && !slices.ContainsFunc(b.sni, func(p string) bool {
+		ok, _ := path.Match(p, sni)
+		return ok
+	}) {
+		return false
+	}
+	if len(b.alpn) > 0 && !slices.ContainsFunc(b.alpn, func(p string) bool {
+		return slices.Contains(alpn, p)
+	}) {
+		return false
+	}
+	if len(b.cidr) > 0 {
+		if ctx.ClientAddr == nil {
+			return false
+		}
+		addr, ok := netip.AddrFromSlice(ctx.ClientAddr.IP)
+		if !ok {
+			return false
+		}
+		addr = addr.Unmap()
+		if !slices.ContainsFunc(b.cidr, func(p netip.Prefix) bool { return p.Contains(addr) }) {
+			return false
+		}
+	}
+	for k, p := range b.values {
+		if ok, _ := path.Match(p, ctx.GetString(k)); !ok {
+			return false
+		}
+	}
+	return true
+}
+
+// selectChain returns the nested chain for the connection, or nil if no
+// branch matches and there is no default.
+func (h *MatchHandler) selectChain(ctx *Context) *Chain {
+	for _, b := range h.branches {
+		if b.matches(ctx) {
+			return b.handlers
+		}
+	}
+	return h.fallback
+}
+
+// Name returns the handler name.
+func (h *MatchHandler) Name() string {
+	return "match"
+}
+
+// OnConnect runs the nested chain of the matching branch.
+func (h *MatchHandler) OnConnect(ctx *Context) Result {
+	chain := h.selectChain(ctx)
+	h.key.Set(ctx, chain)
+	if chain == nil {
+		return Result{Action: Continue}
+	}
+	return chain.connect(ctx, ctx.outbound)
+}
+
+// ResumeSession picks the branch again from the restored SNI, ALPN, client
+// address and string values, and resumes the session in its chain.
+func (h *MatchHandler) ResumeSession(ctx *Context) error {
+	chain := h.selectChain(ctx)
+	h.key.Set(ctx, chain)
+	if chain == nil {
+		return ErrNotResumed
+	}
+	return chain.resume(ctx, ctx.outbound)
+}
+
+// OnPacket passes the packet through the session's nested chain.
+func (h *MatchHandler) OnPacket(ctx *Context, packet []byte, dir Direction) Result {
+	chain, _ := h.key.Get(ctx)
+	if chain == nil {
+		return Result{Action: Continue}
+	}
+	if dir == Outbound {
+		return chain.filterOutbound(ctx, packet)
+	}
+	return chain.packet(ctx, packet, dir)
+}
+
+// OnDisconnect notifies the session's nested chain.
+func (h *MatchHandler) OnDisconnect(ctx *Context) {
+	if chain, _ := h.key.Get(ctx); chain != nil {
+		chain.OnDisconnect(ctx)
+	}
+}
+
+// nestedChains returns the chains of all branches and the default.
+func (h *MatchHandler) nestedChains() []*Chain {
+	var chains []*Chain
+	for _, b := range h.branches {
+		chains = append(chains, b.handlers)
+	}
+	if h.fallback != nil {
+		chains = append(chains, h.fallback)
+	}
+	return chains
+}
+
+// maySkip reports whether connections matching no branch pass the match
+// without running a nested chain.
+func (h *MatchHandler) maySkip() bool {
+	return h.fallback == nil
+}
+
+// WantsOutbound reports whether any nested handler wants outbound packets.
+func (h *MatchHandler) WantsOutbound() bool {
+	return slices.ContainsFunc(h.nestedChains(), func(c *Chain) bool {
+		return len(c.outbound[len(c.handlers)]) > 0
+	})
+}
@@ -0,0 +1,261 @@
+package handler
+
+import (
+	"encoding/json"
+	"errors"
+	"net"
+	"testing"
+)
+
+// matchTestHandler stands in for a forwarder: it handles the connection and
+// records what it saw.
+type matchTestHandler struct {
+	connects, packets, disconnects, resumes int
+}
+
+var lastMatchTestHandler *matchTestHandler
+
+func init() {
+	Register("match-test", func(json.RawMessage) (Handler, error) {
+		lastMatchTestHandler = &matchTestHandler{}
+		return lastMatchTestHandler, nil
+	})
+}
+
+func (h *matchTestHandler) Name() string { return "match-test" }
+
+func (h *matchTestHandler) OnConnect(ctx *Context) Result {
+	h.connects++
+	return Result{Action: Handled}
+}
+
+func (h *matchTestHandler) OnPacket(ctx *Context, packet []byte, dir Direction) Result {
+	h.packets++
+	return Result{Action: Handled}
+}
+
+func (h *matchTestHandler) OnDisconnect(ctx *Context) { h.disconnects++ }
+
+func (h *matchTestHandler) ResumeSession(ctx *Context) error {
+	h.resumes++
+	return nil
+}
+
+func newMatchContext(sni string, alpn []string, ip string) *Context {
+	return &Context{
+		ClientAddr: &net.UDPAddr{IP: net.ParseIP(ip), Port: 1234},
+		Hello:      &ClientHello{SNI: sni, ALPNProtocols: alpn},
+	}
+}
+
+func TestMatch_RequiresConfig(t *testing.T) {
+	for _, raw := range []string{
+		``,
+		`{"branches": []}`,
+		`{"branches": [{"handlers": [{"type": "forwarder"}]}]}`,
+		`{"branches": [{"sni": ["a.example.com"]}]}`,
+		`{"branches": [{"sni": ["["], "handlers": [{"type": "forwarder"}]}]}`,
+		`{"branches": [{"cidr": ["10.0.0.0"], "handlers": [{"type": "forwarder"}]}]}`,
+		`{"branches": [{"sni": ["a.example.com"], "handlers": [{"type": "nope"}]}]}`,
+		`{"branches": [{"sni": ["a.example.com"], "handlers": [{"type": "forwarder"}]}], "default": [{"type": "nope"}]}`,
+	} {
+		if _, err := NewMatchHandler(json.RawMessage(raw)); err == nil {
+			t.Errorf("expected error for config %q", raw)
+		}
+	}
+}
+
+func TestMatch_Branches(t *testing.T) {
+	h, err := NewMatchHandler(json.RawMessage(`{
+		"branches": [
+			{"sni": ["*.secure.example.com"], "handlers": [{"type": "simple-router", "config": {"backend": "10.0.0.1:5520"}}]},
+			{"alpn": ["h3"], "cidr": ["192.168.0.0/16"], "handlers": [{"type": "simple-router", "config": {"backend": "10.0.0.2:5520"}}]},
+			{"values": {"fingerprint_tag": "bot*"}, "handlers": [{"type": "simple-router", "config": {"backend": "10.0.0.3:5520"}}]}
+		],
+		"default": [{"type": "simple-router", "config": {"backend": "10.0.0.9:5520"}}]
+	}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tagged := newMatchContext("play.example.com", nil, "127.0.0.1")
+	FingerprintTag.Set(tagged, "bot-scanner")
+
+	tests := []struct {
+		name string
+		ctx  *Context
+		want string
+	}{
+		{"sni", newMatchContext("eu.secure.example.com", nil, "127.0.0.1"), "10.0.0.1:5520"},
+		{"alpn and cidr", newMatchContext("play.example.com", []string{"hytale/1", "h3"}, "192.168.1.5"), "10.0.0.2:5520"},
+		{"alpn without cidr", newMatchContext("play.example.com", []string{"h3"}, "10.1.1.1"), "10.0.0.9:5520"},
+		{"ipv4-mapped", newMatchContext("play.example.com", []string{"h3"}, "::ffff:192.168.1.5"), "10.0.0.2:5520"},
+		{"value", tagged, "10.0.0.3:5520"},
+		{"default", newMatchContext("play.example.com", nil, "127.0.0.1"), "10.0.0.9:5520"},
+	}
+	for _, tt := range tests {
+		// simple-router continues, so the match handler does too
+		if r := h.OnConnect(tt.ctx); r.Action != Continue {
+			t.Errorf("%s: got action %v, want Continue", tt.name, r.Action)
+		}
+		if got := tt.ctx.GetString("backend"); got != tt.want {
+			t.Errorf("%s: backend = %q, want %q", tt.name, got, tt.want)
+		}
+	}
+}
+
+func TestMatch_NestedChain(t *testing.T) {
+	h, err := NewMatchHandler(json.RawMessage(`{
+		"branches": [{"sni": ["direct.example.com"], "handlers": [{"type": "match-test"}]}]
+	}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	branch := lastMatchTestHandler
+	outer := &matchTestHandler{}
+	chain := NewChain(h, outer)
+
+	// Matching connections are handled inside the branch
+	ctx := newMatchContext("direct.example.com", nil, "127.0.0.1")
+	if r := chain.OnConnect(ctx); r.Action != Handled {
+		t.Fatalf("got action %v, want Handled", r.Action)
+	}
+	chain.OnPacket(ctx, []byte{0x40}, Inbound)
+	chain.OnDisconnect(ctx)
+	if branch.connects != 1 || branch.packets != 1 || branch.disconnects != 1 {
+		t.Errorf("branch saw %+v", branch)
+	}
+	if outer.connects != 0 || outer.packets != 0 {
+		t.Errorf("outer handler saw %+v", outer)
+	}
+
+	// Others fall through to the rest of the chain
+	other := newMatchContext("other.example.com", nil, "127.0.0.1")
+	if r := chain.OnConnect(other); r.Action != Handled {
+		t.Fatalf("got action %v, want Handled", r.Action)
+	}
+	chain.OnPacket(other, []byte{0x40}, Inbound)
+	chain.OnDisconnect(other)
+	if branch.connects != 1 || branch.packets != 1 || branch.disconnects != 1 {
+		t.Errorf("branch saw %+v", branch)
+	}
+	if outer.connects != 1 || outer.packets != 1 {
+		t.Errorf("outer handler saw %+v", outer)
+	}
+}
+
+func TestMatch_Nested(t *testing.T) {
+	h, err := NewMatchHandler(json.RawMessage(`{
+		"branches": [{"sni": ["*.example.com"], "handlers": [
+			{"type": "match", "config": {"branches": [
+				{"sni": ["a.example.com"], "handlers": [{"type": "simple-router", "config": {"backend": "10.0.0.1:5520"}}]}
+			], "default": [{"type": "simple-router", "config": {"backend": "10.0.0.2:5520"}}]}}
+		]}]
+	}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	for sni, want := range map[string]string{
+		"a.example.com": "10.0.0.1:5520",
+		"b.example.com": "10.0.0.2:5520",
+		"example.org":   "",
+	} {
+		ctx := newMatchContext(sni, nil, "127.0.0.1")
+		h.OnConnect(ctx)
+		if got := ctx.GetString("backend"); got != want {
+			t.Errorf("%s: backend = %q, want %q", sni, got, want)
+		}
+	}
+}
+
+func TestMatch_Outbound(t *testing.T) {
+	// An outbound limit inside a branch applies to a forwarder after the match
+	h, err := NewMatchHandler(json.RawMessage(`{
+		"branches": [{"sni": ["limited.example.com"], "handlers": [
+			{"type": "ratelimit-session", "config": {"default": {"outbound": {"pps": 1}}}}
+		]}]
+	}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !h.(OutboundHandler).WantsOutbound() {
+		t.Fatal("match should want outbound packets of its branches")
+	}
+	chain := NewChain(h, &matchTestHandler{})
+
+	ctx := newMatchContext("limited.example.com", nil, "127.0.0.1")
+	chain.OnConnect(ctx)
+	if !ctx.filterOutbound([]byte{0x40}) || ctx.filterOutbound([]byte{0x40}) {
+		t.Error("outbound limit not applied")
+	}
+
+	other := newMatchContext("other.example.com", nil, "127.0.0.1")
+	chain.OnConnect(other)
+	for i := 0; i < 3; i++ {
+		if !other.filterOutbound([]byte{0x40}) {
+			t.Fatal("unmatched session throttled")
+		}
+	}
+
+	// A forwarder inside a branch sees outbound handlers before the match too
+	limit, err := NewRateLimitSessionHandler(json.RawMessage(`{"default": {"outbound": {"pps": 1}}}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	inner, err := NewMatchHandler(json.RawMessage(`{"branches": [{"sni": ["*"], "handlers": [{"type": "match-test"}]}]}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctx = newMatchContext("a.example.com", nil, "127.0.0.1")
+	NewChain(limit, inner).OnConnect(ctx)
+	if len(ctx.outbound) != 1 || ctx.outbound[0].h != limit {
+		t.Errorf("outbound = %v, want [ratelimit-session]", ctx.outbound)
+	}
+}
+
+func TestMatch_ResumeSession(t *testing.T) {
+	h, err := NewMatchHandler(json.RawMessage(`{
+		"branches": [{"alpn": ["h3"], "handlers": [{"type": "match-test"}]}]
+	}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	branch := lastMatchTestHandler
+	outer := &matchTestHandler{}
+	chain := NewChain(h, outer)
+
+	if err := chain.ResumeSession(newMatchContext("a.example.com", []string{"h3"}, "127.0.0.1")); err != nil {
+		t.Fatal(err)
+	}
+	if err := chain.ResumeSession(newMatchContext("a.example.com", nil, "127.0.0.1")); err != nil {
+		t.Fatal(err)
+	}
+	if branch.resumes != 1 || outer.resumes != 1 {
+		t.Errorf("branch resumed %d, outer resumed %d, want 1 and 1", branch.resumes, outer.resumes)
+	}
+
+	alone := NewChain(h)
+	if err := alone.ResumeSession(newMatchContext("a.example.com", nil, "127.0.0.1")); !errors.Is(err, ErrNotResumed) {
+		t.Errorf("got %v, want ErrNotResumed", err)
+	}
+}
+
+func TestMatch_UnassignedSession(t *testing.T) {
+	h, err := NewMatchHandler(json.RawMessage(`{
+		"branches": [{"sni": ["a.example.com"], "handlers": [{"type": "match-test"}]}]
+	}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	branch := lastMatchTestHandler
+
+	// Handled before reaching the match handler: its branches never saw it
+	ctx := newMatchContext("a.example.com", nil, "127.0.0.1")
+	if r := h.OnPacket(ctx, []byte{0x40}, Inbound); r.Action != Continue {
+		t.Errorf("got action %v, want Continue", r.Action)
+	}
+	h.OnDisconnect(ctx)
+	if branch.packets != 0 || branch.disconnects != 0 {
+		t.Errorf("branch saw %+v", branch)
+	}
+}
@@ -0,0 +1,145 @@
+package handler
+
+import (
+	"errors"
+	"sync"
+	"time"
+)
+
+// ErrConnectTimeout is the error of connections dropped because a handler
+// didn't resume them within Context.ConnectTimeout.
+var ErrConnectTimeout = errors.New("handler did not resume the connection in time")
+
+// pendingConnect is the state of an OnConnect suspended with Pending.
+type pendingConnect struct {
+	mu        sync.Mutex
+	frames    []connectFrame // Where to continue, innermost chain first
+	suspended bool           // Waiting for Resume
+	early     *Result        // Resume called before the Pending reached the top of the chain
+	expired   bool           // ConnectTimeout passed while the chain was running
+	timer     *time.Timer    // Started at the first suspension
+}
+
+// connectFrame is a chain whose handler index returned Pending. A match
+// handler whose nested chain returned Pending adds a frame after the nested one.
+type connectFrame struct {
+	chain *Chain
+	base  []*stage
+	index int
+}
+
+// Resume continues a connection whose handler returned Pending from
+// OnConnect, with the handler's actual result: Continue runs the handlers
+// after it, Handled or Drop decide the connection. The rest of the chain runs
+// on the calling goroutine, and ctx.OnResume gets the result.
+//
+// Calls after the connection was dropped for ConnectTimeout do nothing; the
+// handler's OnDisconnect has been called by then, and should cancel its I/O.
+func (c *Context) Resume(r Result) {
+	p := &c.pending
+	p.mu.Lock()
+	if !p.suspended {
+		// Still returning Pending, or timed out; settle picks it up
+		if p.early == nil {
+			p.early = &r
+		}
+		p.mu.Unlock()
+		return
+	}
+	p.suspended = false
+	frames := p.take()
+	p.mu.Unlock()
+	c.decide(c.settle(c.proceed(frames, r)))
+}
+
+// expire drops a connection that is still suspended at its ConnectTimeout.
+func (c *Context) expire() {
+	p := &c.pending
+	p.mu.Lock()
+	if !p.suspended {
+		p.expired = true
+		p.mu.Unlock()
+		return
+	}
+	p.suspended = false
+	frames := p.take()
+	p.mu.Unlock()
+	c.decide(c.settle(c.proceed(frames, Result{Action: Drop, Error: ErrConnectTimeout})))
+}
+
+// decide passes the result of a resumed OnConnect to OnResume, unless a
+// handler suspended it again.
+func (c *Context) decide(r Result) {
+	if r.Action == Pending {
+		return
+	}
+	p := &c.pending
+	p.mu.Lock()
+	if p.timer != nil {
+		p.timer.Stop()
+	}
+	p.mu.Unlock()
+	if c.OnResume != nil {
+		c.OnResume(r)
+	}
+}
+
+// settle returns the final OnConnect result for r, the result of the
+// outermost chain, or suspends the connection if r is Pending.
+func (c *Context) settle(r Result) Result {
+	for r.Action == Pending {
+		p := &c.pending
+		p.mu.Lock()
+		var next Result
+		switch {
+		case p.early != nil:
+			next, p.early = *p.early, nil
+		case p.expired:
+			next = Result{Action: Drop, Error: ErrConnectTimeout}
+		default:
+			p.suspended = true
+			if p.timer == nil && c.ConnectTimeout > 0 {
+				p.timer = time.AfterFunc(c.ConnectTimeout, c.expire)
+			}
+			p.mu.Unlock()
+			return r
+		}
+		frames := p.take()
+		p.mu.Unlock()
+		r = c.proceed(frames, next)
+	}
+	if r.Action == Continue {
+		// No handler handled the connection
+		return Result{Action: Drop}
+	}
+	return r
+}
+
+// proceed continues the chains in frames, given r, the result of the handler
+// that returned Pending. Each frame's result is the result of the handler of
+// the next frame. Returns Pending if a later handler suspended the
+// connection again.
+func (c *Context) proceed(frames []connectFrame, r Result) Result {
+	for i, f := range frames {
+		if r.Action == Drop {
+			// The Pending was counted as a call, not as a drop
+			f.chain.stages[f.index].stats.connect.drops.Add(1)
+		}
+		if r.Action == Continue {
+			r = f.chain.connectFrom(c, f.base, f.index+1)
+		}
+		if r.Action == Pending {
+			// connectFrom added the inner frames; the outer ones are still waiting
+			c.pending.frames = append(c.pending.frames, frames[i+1:]...)
+			return r
+		}
+	}
+	return r
+}
+
+// take removes and returns the frames. p.mu must be held.
+func (p *pendingConnect) take() []connectFrame {
+	frames := p.frames
+	p.frames = nil
+	return frames
+}
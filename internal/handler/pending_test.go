@@ -0,0 +1,134 @@
+package handler
+
+import (
+	"errors"
+	"testing"
+	"time"
+)
+
+// pendingHandler suspends OnConnect; the test resumes it.
+type pendingHandler struct {
+	*mockHandler
+	resume *Result // Resume with this before returning Pending
+}
+
+func (h *pendingHandler) OnConnect(ctx *Context) Result {
+	h.mockHandler.OnConnect(ctx)
+	if h.resume != nil {
+		ctx.Resume(*h.resume)
+	}
+	return Result{Action: Pending}
+}
+
+// resumed collects the results passed to ctx.OnResume.
+func resumed(ctx *Context) <-chan Result {
+	ch := make(chan Result, 1)
+	ctx.OnResume = func(r Result) { ch <- r }
+	return ch
+}
+
+func TestPending_Resume(t *testing.T) {
+	for _, tc := range []struct {
+		name   string
+		result Result
+		want   Action
+		next   bool
+	}{
+		{"continue", Result{Action: Continue}, Handled, true},
+		{"handled", Result{Action: Handled}, Handled, false},
+		{"drop", Result{Action: Drop, Error: errors.New("denied")}, Drop, false},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			auth := &pendingHandler{mockHandler: newMockHandler("auth", Continue, Continue)}
+			next := newMockHandler("next", Handled, Handled)
+			chain := NewChain(auth, next)
+			ctx := &Context{}
+			done := resumed(ctx)
+
+			if r := chain.OnConnect(ctx); r.Action != Pending {
+				t.Fatalf("got action %v, want Pending", r.Action)
+			}
+			if next.connectCalled {
+				t.Fatal("next handler ran before Resume")
+			}
+			go ctx.Resume(tc.result)
+			if r := <-done; r.Action != tc.want {
+				t.Errorf("got action %v, want %v", r.Action, tc.want)
+			}
+			if next.connectCalled != tc.next {
+				t.Errorf("next handler called: %v, want %v", next.connectCalled, tc.next)
+			}
+			if tc.want == Drop && chain.Stats()[0].Connect.Drops != 1 {
+				t.Errorf("resumed Drop not counted: %+v", chain.Stats()[0].Connect)
+			}
+		})
+	}
+}
+
+func TestPending_ResumeBeforeReturn(t *testing.T) {
+	auth := &pendingHandler{mockHandler: newMockHandler("auth", Continue, Continue), resume: &Result{Action: Continue}}
+	next := newMockHandler("next", Handled, Handled)
+	ctx := &Context{}
+	ctx.OnResume = func(Result) { t.Error("OnResume called for a connection decided in OnConnect") }
+
+	if r := NewChain(auth, next).OnConnect(ctx); r.Action != Handled {
+		t.Errorf("got action %v, want Handled", r.Action)
+	}
+}
+
+func TestPending_Nested(t *testing.T) {
+	auth := &pendingHandler{mockHandler: newMockHandler("auth", Continue, Continue)}
+	inner := newMockHandler("inner", Continue, Continue)
+	match := &MatchHandler{fallback: NewChain(auth, inner), key: NewKey[*Chain]("_match.pending")}
+	lookup := &pendingHandler{mockHandler: newMockHandler("lookup", Continue, Continue)}
+	outer := newMockHandler("outer", Handled, Handled)
+	chain := NewChain(match, lookup, outer)
+	ctx := &Context{}
+	done := resumed(ctx)
+
+	if r := chain.OnConnect(ctx); r.Action != Pending {
+		t.Fatalf("got action %v, want Pending", r.Action)
+	}
+	// The nested chain continues, then the outer one until the next Pending
+	ctx.Resume(Result{Action: Continue})
+	if !inner.connectCalled || !lookup.connectCalled || outer.connectCalled {
+		t.Fatalf("after first Resume: inner %v, lookup %v, outer %v",
+			inner.connectCalled, lookup.connectCalled, outer.connectCalled)
+	}
+	select {
+	case r := <-done:
+		t.Fatalf("OnResume called with %v while suspended again", r.Action)
+	default:
+	}
+	ctx.Resume(Result{Action: Continue})
+	if r := <-done; r.Action != Handled || !outer.connectCalled {
+		t.Errorf("got action %v, outer called %v", r.Action, outer.connectCalled)
+	}
+}
+
+func TestPending_Timeout(t *testing.T) {
+	auth := &pendingHandler{mockHandler: newMockHandler("auth", Continue, Continue)}
+	next := newMockHandler("next", Handled, Handled)
+	chain := NewChain(auth, next)
+	ctx := &Context{ConnectTimeout: 10 * time.Millisecond}
+	done := resumed(ctx)
+
+	if r := chain.OnConnect(ctx); r.Action != Pending {
+		t.Fatalf("got action %v, want Pending", r.Action)
+	}
+	r := <-done
+	if r.Action != Drop || !errors.Is(r.Error, ErrConnectTimeout) {
+		t.Errorf("got %v (%v), want Drop with ErrConnectTimeout", r.Action, r.Error)
+	}
+
+	// Resuming too late does nothing
+	ctx.Resume(Result{Action: Continue})
+	if next.connectCalled {
+		t.Error("late Resume ran the next handler")
+	}
+	select {
+	case r := <-done:
+		t.Errorf("late Resume decided the connection again: %v", r.Action)
+	case <-time.After(20 * time.Millisecond):
+	}
+}
@@ -6,7 +6,7 @@ import (
 )
 
 func init() {
-	Register("ratelimit-global", NewRateLimitGlobalHandler)
+	RegisterConfig("ratelimit-global", NewRateLimitGlobalHandler, RateLimitGlobalConfig{})
 }
 
 // RateLimitGlobalConfig is the configuration for the global rate limiter.
@@ -24,7 +24,7 @@ type RateLimitGlobalHandler struct {
 func NewRateLimitGlobalHandler(raw json.RawMessage) (Handler, error) {
 	var cfg RateLimitGlobalConfig
 	if len(raw) > 0 {
-		if err := json.Unmarshal(raw, &cfg); err != nil {
+		if err := decodeConfig(raw, &cfg); err != nil {
 			return nil, fmt.Errorf("invalid ratelimit-global config: %w", err)
 		}
 	}
@@ -39,9 +39,14 @@ func (h *RateLimitGlobalHandler) Name() string {
 	return "ratelimit-global"
 }
 
+// ProvidesKeys reports that the handler sets no keys.
+func (h *RateLimitGlobalHandler) ProvidesKeys() []AnyKey {
+	return nil
+}
+
 // OnConnect checks if the connection limit has been reached.
 func (h *RateLimitGlobalHandler) OnConnect(ctx *Context) Result {
-	currentCount := ctx.GetInt64("_session_count")
+	currentCount := SessionCount.Value(ctx)
 	if currentCount >= h.maxParallelConnections {
 		return Result{Action: Drop, Error: fmt.Errorf("max connections exceeded (%d/%d)", currentCount, h.maxParallelConnections)}
 	}
@@ -0,0 +1,354 @@
+package handler
+
+import (
+	"encoding/json"
+	"fmt"
+	"hash/maphash"
+	"log"
+	"math"
+	"net/netip"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+func init() {
+	RegisterConfig("ratelimit-ip", NewRateLimitIPHandler, RateLimitIPConfig{})
+}
+
+// RateLimitIPConfig is the configuration for the per-IP rate limiter.
+type RateLimitIPConfig struct {
+	PerIP      *IPLimit `json:"per_ip,omitempty"`
+	PerSubnet  *IPLimit `json:"per_subnet,omitempty"`
+	IPv4Prefix int      `json:"ipv4_prefix,omitempty"` // Subnet size for IPv4 (default: 24)
+	IPv6Prefix int      `json:"ipv6_prefix,omitempty"` // Subnet size for IPv6 (default: 64)
+	BanAfter   int      `json:"ban_after,omitempty"`   // Ban an IP after this many per_ip drops of Retry-validated connections (0 = never)
+}
+
+// IPLimit limits new connections and concurrent sessions for one address or subnet.
+type IPLimit struct {
+	Rate           float64 `json:"rate,omitempty"`            // New connections per second (0 = unlimited)
+	Burst          int     `json:"burst,omitempty"`           // Bucket size (default: rate rounded up, at least 1)
+	MaxConnections int     `json:"max_connections,omitempty"` // Concurrent sessions (0 = unlimited)
+}
+
+const (
+	ipLimiterShards  = 64
+	ipSweepInterval  = 30 * time.Second // Per shard, amortized over OnConnect calls
+	ipOffenderLogGap = time.Minute      // Log each offender at most this often
+)
+
+// RateLimitIPHandler limits new connections and concurrent sessions per client
+// IP and per subnet, so a single host can't take all global slots.
+type RateLimitIPHandler struct {
+	perIP      *ipLimiter
+	perSubnet  *ipLimiter
+	ipv4Prefix int
+	ipv6Prefix int
+	banAfter   int
+}
+
+// NewRateLimitIPHandler creates a new per-IP rate limiter handler.
+func NewRateLimitIPHandler(raw json.RawMessage) (Handler, error) {
+	var cfg RateLimitIPConfig
+	if len(raw) > 0 {
+		if err := decodeConfig(raw, &cfg); err != nil {
+			return nil, fmt.Errorf("invalid ratelimit-ip config: %w", err)
+		}
+	}
+	if cfg.PerIP == nil && cfg.PerSubnet == nil {
+		return nil, fmt.Errorf("ratelimit-ip requires 'per_ip' or 'per_subnet'")
+	}
+	if cfg.IPv4Prefix == 0 {
+		cfg.IPv4Prefix = 24
+	}
+	if cfg.IPv6Prefix == 0 {
+		cfg.IPv6Prefix = 64
+	}
+	if cfg.IPv4Prefix < 0 || cfg.IPv4Prefix > 32 || cfg.IPv6Prefix < 0 || cfg.IPv6Prefix > 128 {
+		return nil, fmt.Errorf("ratelimit-ip: invalid subnet prefix /%d or /%d", cfg.IPv4Prefix, cfg.IPv6Prefix)
+	}
+	if cfg.BanAfter < 0 || (cfg.BanAfter > 0 && cfg.PerIP == nil) {
+		return nil, fmt.Errorf("ratelimit-ip: 'ban_after' must be positive and requires 'per_ip'")
+	}
+
+	h := &RateLimitIPHandler{ipv4Prefix: cfg.IPv4Prefix, ipv6Prefix: cfg.IPv6Prefix, banAfter: cfg.BanAfter}
+	var err error
+	if h.perIP, err = newIPLimiter("per_ip", cfg.PerIP); err != nil {
+		return nil, err
+	}
+	if h.perSubnet, err = newIPLimiter("per_subnet", cfg.PerSubnet); err != nil {
+		return nil, err
+	}
+	return h, nil
+}
+
+// Name returns the handler name.
+func (h *RateLimitIPHandler) Name() string {
+	return "ratelimit-ip"
+}
+
+// ProvidesKeys reports that the handler sets no keys.
+func (h *RateLimitIPHandler) ProvidesKeys() []AnyKey {
+	return nil
+}
+
+// ipLease records what a connection holds so OnDisconnect releases it exactly
+// once, in the limiters it was taken from.
+type ipLease struct {
+	perIP     *ipLimiter
+	perSubnet *ipLimiter
+	ip        netip.Prefix
+	subnet    netip.Prefix
+	released  atomic.Bool
+}
+
+var ipLeaseKey = NewKey[*ipLease]("_ratelimit_ip")
+
+// OnConnect takes a token and a session slot for the client IP and its subnet.
+// With ban_after set, an IP that keeps hitting its per_ip limit gets banned.
+// Only connections validated with a Retry count: the source address of any
+// other Initial may be spoofed.
+func (h *RateLimitIPHandler) OnConnect(ctx *Context) Result {
+	if ctx.ClientAddr == nil {
+		return Result{Action: Continue}
+	}
+	addr, ok := netip.AddrFromSlice(ctx.ClientAddr.IP)
+	if !ok {
+		return Result{Action: Continue}
+	}
+	addr = addr.Unmap()
+
+	lease := &ipLease{perIP: h.perIP, perSubnet: h.perSubnet, ip: netip.PrefixFrom(addr, addr.BitLen())}
+	bits := h.ipv6Prefix
+	if addr.Is4() {
+		bits = h.ipv4Prefix
+	}
+	lease.subnet, _ = addr.Prefix(bits)
+
+	now := time.Now()
+	if err := h.perIP.acquire(lease.ip, now); err != nil {
+		if h.banAfter > 0 && ctx.AddressValidated() && h.perIP.strike(lease.ip, h.banAfter) {
+			ctx.Ban("ratelimit-ip")
+		}
+		return Result{Action: Drop, Error: err}
+	}
+	if err := h.perSubnet.acquire(lease.subnet, now); err != nil {
+		h.perIP.refund(lease.ip)
+		return Result{Action: Drop, Error: err}
+	}
+	ipLeaseKey.Set(ctx, lease)
+	return Result{Action: Continue}
+}
+
+// OnPacket passes through.
+func (h *RateLimitIPHandler) OnPacket(ctx *Context, packet []byte, dir Direction) Result {
+	return Result{Action: Continue}
+}
+
+// OnDisconnect frees the session slots taken in OnConnect.
+func (h *RateLimitIPHandler) OnDisconnect(ctx *Context) {
+	lease, ok := ipLeaseKey.Get(ctx)
+	if !ok || !lease.released.CompareAndSwap(false, true) {
+		return
+	}
+	lease.perIP.release(lease.ip)
+	lease.perSubnet.release(lease.subnet)
+}
+
+// Reload keeps the old handler's buckets, session counts and strikes for
+// limits that didn't change. Changed limits start empty; sessions from
+// before the reload don't count toward them.
+func (h *RateLimitIPHandler) Reload(old Handler) {
+	o, ok := old.(*RateLimitIPHandler)
+	if !ok {
+		return
+	}
+	if h.perIP.sameLimits(o.perIP) {
+		h.perIP = o.perIP
+	}
+	if h.perSubnet.sameLimits(o.perSubnet) && h.ipv4Prefix == o.ipv4Prefix && h.ipv6Prefix == o.ipv6Prefix {
+		h.perSubnet = o.perSubnet
+	}
+}
+
+// ipLimiter is a sharded table of token buckets and session counters.
+// A nil *ipLimiter allows everything.
+type ipLimiter struct {
+	name   string
+	rate   float64
+	burst  float64
+	max    int
+	seed   maphash.Seed
+	shards [ipLimiterShards]ipShard
+}
+
+type ipShard struct {
+	mu        sync.Mutex
+	entries   map[netip.Prefix]*ipEntry
+	lastSweep time.Time
+}
+
+type ipEntry struct {
+	tokens    float64
+	updated   time.Time // Last token refill
+	active    int       // Concurrent sessions
+	lastLog   time.Time
+	throttled int // Connections dropped since lastLog
+	strikes   int // Connections dropped since the last ban
+}
+
+func newIPLimiter(name string, l *IPLimit) (*ipLimiter, error) {
+	if l == nil {
+		return nil, nil
+	}
+	if l.Rate < 0 || l.Burst < 0 || l.MaxConnections < 0 {
+		return nil, fmt.Errorf("ratelimit-ip: %s values must not be negative", name)
+	}
+	if l.Rate == 0 && l.MaxConnections == 0 {
+		return nil, fmt.Errorf("ratelimit-ip: %s requires 'rate' or 'max_connections'", name)
+	}
+	burst := float64(l.Burst)
+	if burst == 0 {
+		burst = max(1, math.Ceil(l.Rate))
+	}
+	lim := &ipLimiter{name: name, rate: l.Rate, burst: burst, max: l.MaxConnections, seed: maphash.MakeSeed()}
+	for i := range lim.shards {
+		lim.shards[i].entries = make(map[netip.Prefix]*ipEntry)
+	}
+	return lim, nil
+}
+
+// sameLimits reports whether l and o enforce the same limits.
+func (l *ipLimiter) sameLimits(o *ipLimiter) bool {
+	if l == nil || o == nil {
+		return false
+	}
+	return l.rate == o.rate && l.burst == o.burst && l.max == o.max
+}
+
+func (l *ipLimiter) shard(key netip.Prefix) *ipShard {
+	return &l.shards[maphash.Comparable(l.seed, key)%ipLimiterShards]
+}
+
+// acquire takes a token and a session slot for key, or returns why it can't.
+func (l *ipLimiter) acquire(key netip.Prefix, now time.Time) error {
+	if l == nil {
+		return nil
+	}
+	s := l.shard(key)
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if now.Sub(s.lastSweep) > ipSweepInterval {
+		l.sweep(s, now)
+	}
+
+	e := s.entries[key]
+	if e == nil {
+		e = &ipEntry{tokens: l.burst, updated: now}
+		s.entries[key] = e
+	}
+	l.refill(e, now)
+
+	var err error
+	switch {
+	case l.max > 0 && e.active >= l.max:
+		err = fmt.Errorf("%s: %s has %d concurrent connections (max %d)", l.name, key, e.active, l.max)
+	case l.rate > 0 && e.tokens < 1:
+		err = fmt.Errorf("%s: %s exceeded %g new connections/s", l.name, key, l.rate)
+	}
+	if err != nil {
+		e.throttled++
+		if now.Sub(e.lastLog) >= ipOffenderLogGap {
+			log.Printf("[ratelimit-ip] throttling %s: %v (%d dropped)", key, err, e.throttled)
+			e.lastLog = now
+			e.throttled = 0
+		}
+		return err
+	}
+
+	if l.rate > 0 {
+		e.tokens--
+	}
+	e.active++
+	return nil
+}
+
+// strike counts a dropped connection for key and reports whether it reached
+// limit, resetting the count if so.
+func (l *ipLimiter) strike(key netip.Prefix, limit int) bool {
+	s := l.shard(key)
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	e := s.entries[key]
+	if e == nil {
+		return false
+	}
+	e.strikes++
+	if e.strikes < limit {
+		return false
+	}
+	e.strikes = 0
+	return true
+}
+
+// refund undoes acquire for a connection that was dropped by a later limit.
+func (l *ipLimiter) refund(key netip.Prefix) {
+	if l == nil {
+		return
+	}
+	s := l.shard(key)
+	s.mu.Lock()
+	if e := s.entries[key]; e != nil {
+		if l.rate > 0 {
+			e.tokens = min(e.tokens+1, l.burst)
+		}
+		e.active--
+	}
+	s.mu.Unlock()
+}
+
+// release frees a session slot.
+func (l *ipLimiter) release(key netip.Prefix) {
+	if l == nil {
+		return
+	}
+	s := l.shard(key)
+	s.mu.Lock()
+	if e := s.entries[key]; e != nil && e.active > 0 {
+		e.active--
+	}
+	s.mu.Unlock()
+}
+
+func (l *ipLimiter) refill(e *ipEntry, now time.Time) {
+	if l.rate > 0 {
+		e.tokens = min(l.burst, e.tokens+now.Sub(e.updated).Seconds()*l.rate)
+	}
+	e.updated = now
+}
+
+// sweep drops entries with no sessions and a full bucket: they hold no state
+// a fresh entry wouldn't. Must be called with s.mu held.
+func (l *ipLimiter) sweep(s *ipShard, now time.Time) {
+	for key, e := range s.entries {
+		l.refill(e, now)
+		if e.active == 0 && (l.rate == 0 || e.tokens >= l.burst) {
+			delete(s.entries, key)
+		}
+	}
+	s.lastSweep = now
+}
+
+// size returns the number of tracked keys (for tests).
+func (l *ipLimiter) size() int {
+	n := 0
+	for i := range l.shards {
+		s := &l.shards[i]
+		s.mu.Lock()
+		n += len(s.entries)
+		s.mu.Unlock()
+	}
+	return n
+}
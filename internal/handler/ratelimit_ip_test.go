@@ -0,0 +1,184 @@
+package handler
+
+import (
+	"encoding/json"
+	"net"
+	"net/netip"
+	"testing"
+	"time"
+)
+
+func newIPTestContext(ip string) *Context {
+	return &Context{ClientAddr: &net.UDPAddr{IP: net.ParseIP(ip), Port: 4000}}
+}
+
+func TestRateLimitIP_RequiresConfig(t *testing.T) {
+	for _, raw := range []string{
+		``,
+		`{}`,
+		`{"per_ip": {}}`,
+		`{"per_ip": {"rate": -1}}`,
+		`{"per_subnet": {"max_connections": 5}, "ipv4_prefix": 33}`,
+		`{"per_subnet": {"max_connections": 5}, "ban_after": 3}`,
+	} {
+		if _, err := NewRateLimitIPHandler(json.RawMessage(raw)); err == nil {
+			t.Errorf("expected error for config %q", raw)
+		}
+	}
+}
+
+func TestRateLimitIP_MaxConnections(t *testing.T) {
+	h, err := NewRateLimitIPHandler(json.RawMessage(`{"per_ip": {"max_connections": 2}}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	a, b := newIPTestContext("192.0.2.1"), newIPTestContext("192.0.2.1")
+	for _, ctx := range []*Context{a, b} {
+		if r := h.OnConnect(ctx); r.Action != Continue {
+			t.Fatalf("expected Continue, got %v (%v)", r.Action, r.Error)
+		}
+	}
+	if r := h.OnConnect(newIPTestContext("192.0.2.1")); r.Action != Drop {
+		t.Error("third connection from the same IP should be dropped")
+	}
+	if r := h.OnConnect(newIPTestContext("192.0.2.2")); r.Action != Continue {
+		t.Error("other IP should not be affected")
+	}
+
+	// Releasing a slot (twice, as after DropSession + cleanup) frees exactly one
+	h.OnDisconnect(a)
+	h.OnDisconnect(a)
+	if r := h.OnConnect(newIPTestContext("192.0.2.1")); r.Action != Continue {
+		t.Error("connection should be allowed after disconnect")
+	}
+	if r := h.OnConnect(newIPTestContext("192.0.2.1")); r.Action != Drop {
+		t.Error("double OnDisconnect released two slots")
+	}
+}
+
+func TestRateLimitIP_Subnet(t *testing.T) {
+	h, err := NewRateLimitIPHandler(json.RawMessage(`{"per_subnet": {"max_connections": 2}}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	h.OnConnect(newIPTestContext("198.51.100.1"))
+	h.OnConnect(newIPTestContext("198.51.100.2"))
+	if r := h.OnConnect(newIPTestContext("198.51.100.200")); r.Action != Drop {
+		t.Error("third connection from the same /24 should be dropped")
+	}
+	if r := h.OnConnect(newIPTestContext("198.51.101.1")); r.Action != Continue {
+		t.Error("other /24 should not be affected")
+	}
+
+	h.OnConnect(newIPTestContext("2001:db8::1"))
+	h.OnConnect(newIPTestContext("2001:db8::ffff:1"))
+	if r := h.OnConnect(newIPTestContext("2001:db8::abcd")); r.Action != Drop {
+		t.Error("third connection from the same /64 should be dropped")
+	}
+}
+
+func TestRateLimitIP_SubnetDropRefundsIP(t *testing.T) {
+	h, err := NewRateLimitIPHandler(json.RawMessage(`{"per_ip": {"max_connections": 1}, "per_subnet": {"max_connections": 1}}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	h.OnConnect(newIPTestContext("203.0.113.1"))
+	if r := h.OnConnect(newIPTestContext("203.0.113.2")); r.Action != Drop {
+		t.Fatal("expected subnet limit to drop")
+	}
+	lim := h.(*RateLimitIPHandler).perIP
+	key := netip.MustParsePrefix("203.0.113.2/32")
+	s := lim.shard(key)
+	s.mu.Lock()
+	active := s.entries[key].active
+	s.mu.Unlock()
+	if active != 0 {
+		t.Errorf("per-IP slot not refunded after subnet drop: active=%d", active)
+	}
+}
+
+func TestRateLimitIP_BanAfter(t *testing.T) {
+	h, err := NewRateLimitIPHandler(json.RawMessage(`{"per_ip": {"max_connections": 1}, "ban_after": 3}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	h.OnConnect(newIPTestContext("192.0.2.1"))
+
+	bans := 0
+	for i := 0; i < 6; i++ {
+		ctx := newIPTestContext("192.0.2.1")
+		ctx.BanClient = func(string) { bans++ }
+		RetryODCID.Set(ctx, []byte{1, 2, 3, 4})
+		if r := h.OnConnect(ctx); r.Action != Drop {
+			t.Fatal("expected Drop")
+		}
+	}
+	if bans != 2 {
+		t.Errorf("bans = %d, want 2 (one per 3 drops)", bans)
+	}
+
+	// Without a Retry the source address may be spoofed: no strikes
+	for i := 0; i < 6; i++ {
+		ctx := newIPTestContext("192.0.2.1")
+		ctx.BanClient = func(string) { bans++ }
+		h.OnConnect(ctx)
+	}
+	if bans != 2 {
+		t.Errorf("bans = %d after unvalidated drops, want 2", bans)
+	}
+}
+
+func TestIPLimiter_TokenBucket(t *testing.T) {
+	lim, _ := newIPLimiter("per_ip", &IPLimit{Rate: 2, Burst: 3})
+	key := netip.MustParsePrefix("192.0.2.1/32")
+	now := time.Unix(1000, 0)
+
+	for i := 0; i < 3; i++ {
+		if err := lim.acquire(key, now); err != nil {
+			t.Fatalf("burst connection %d: %v", i+1, err)
+		}
+	}
+	if lim.acquire(key, now) == nil {
+		t.Fatal("expected rate limit after burst")
+	}
+	// 2/s refills one token every 500ms
+	if err := lim.acquire(key, now.Add(500*time.Millisecond)); err != nil {
+		t.Errorf("expected a refilled token: %v", err)
+	}
+}
+
+func TestIPLimiter_Expiry(t *testing.T) {
+	lim, _ := newIPLimiter("per_ip", &IPLimit{Rate: 1})
+	now := time.Unix(1000, 0)
+	for i := 0; i < 1000; i++ {
+		key := netip.PrefixFrom(netip.AddrFrom4([4]byte{10, 0, byte(i >> 8), byte(i)}), 32)
+		lim.acquire(key, now)
+		lim.release(key)
+	}
+	if lim.size() != 1000 {
+		t.Fatalf("expected 1000 entries, got %d", lim.size())
+	}
+
+	// The next connection after the sweep interval cleans up its shard
+	later := now.Add(ipSweepInterval + time.Second)
+	probe := netip.MustParsePrefix("172.16.0.1/32")
+	shard := lim.shard(probe)
+	lim.acquire(probe, later)
+	shard.mu.Lock()
+	left := len(shard.entries)
+	shard.mu.Unlock()
+	if left != 1 {
+		t.Errorf("shard kept %d entries after sweep, want only the new one", left)
+	}
+
+	for i := range lim.shards {
+		s := &lim.shards[i]
+		s.mu.Lock()
+		lim.sweep(s, later)
+		s.mu.Unlock()
+	}
+	if n := lim.size(); n != 1 {
+		t.Errorf("idle entries not expired: %d left", n)
+	}
+}
@@ -0,0 +1,264 @@
+package handler
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"sync"
+	"time"
+)
+
+func init() {
+	RegisterConfig("ratelimit-session", NewRateLimitSessionHandler, RateLimitSessionConfig{})
+}
+
+// RateLimitSessionConfig is the configuration for the per-session throttle.
+type RateLimitSessionConfig struct {
+	Default *SessionLimits            `json:"default,omitempty"` // Applies to SNIs without their own entry
+	SNI     map[string]*SessionLimits `json:"sni,omitempty"`
+	Policy  string                    `json:"policy,omitempty"` // "drop" (default), "kill" or "ban"
+}
+
+// SessionLimits holds the limits for each direction.
+type SessionLimits struct {
+	Inbound  *DirectionLimit `json:"inbound,omitempty"`  // Client -> backend
+	Outbound *DirectionLimit `json:"outbound,omitempty"` // Backend -> client
+}
+
+// DirectionLimit caps packets and bytes per second. Bursts of up to one
+// second's worth are allowed, and at least one full-size datagram.
+type DirectionLimit struct {
+	PPS int64 `json:"pps,omitempty"` // Packets per second (0 = unlimited)
+	BPS int64 `json:"bps,omitempty"` // Bytes per second (0 = unlimited)
+}
+
+// RateLimitSessionHandler throttles the packet and byte rate of each session.
+type RateLimitSessionHandler struct {
+	defaults *SessionLimits
+	sni      map[string]*SessionLimits
+	kill     bool
+	ban      bool // Kill and ban the client's IP
+}
+
+var sessionThrottleKey = NewKey[*sessionThrottle]("_ratelimit_session")
+
+// NewRateLimitSessionHandler creates a new per-session throttle handler.
+func NewRateLimitSessionHandler(raw json.RawMessage) (Handler, error) {
+	var cfg RateLimitSessionConfig
+	if len(raw) > 0 {
+		if err := decodeConfig(raw, &cfg); err != nil {
+			return nil, fmt.Errorf("invalid ratelimit-session config: %w", err)
+		}
+	}
+	if cfg.Default == nil && len(cfg.SNI) == 0 {
+		return nil, fmt.Errorf("ratelimit-session requires 'default' or 'sni' limits")
+	}
+
+	h := &RateLimitSessionHandler{defaults: cfg.Default, sni: cfg.SNI}
+	switch cfg.Policy {
+	case "", "drop":
+	case "kill":
+		h.kill = true
+	case "ban":
+		h.kill, h.ban = true, true
+	default:
+		return nil, fmt.Errorf("ratelimit-session: unknown policy %q (use \"drop\", \"kill\" or \"ban\")", cfg.Policy)
+	}
+
+	if err := cfg.Default.validate(); err != nil {
+		return nil, fmt.Errorf("ratelimit-session: default: %w", err)
+	}
+	for sni, l := range cfg.SNI {
+		if err := l.validate(); err != nil {
+			return nil, fmt.Errorf("ratelimit-session: sni %s: %w", sni, err)
+		}
+	}
+	return h, nil
+}
+
+func (l *SessionLimits) validate() error {
+	if l == nil {
+		return nil
+	}
+	for _, d := range []*DirectionLimit{l.Inbound, l.Outbound} {
+		if d != nil && (d.PPS < 0 || d.BPS < 0) {
+			return fmt.Errorf("limits must not be negative")
+		}
+	}
+	return nil
+}
+
+// Name returns the handler name.
+func (h *RateLimitSessionHandler) Name() string {
+	return "ratelimit-session"
+}
+
+// ProvidesKeys reports that the handler sets no keys.
+func (h *RateLimitSessionHandler) ProvidesKeys() []AnyKey {
+	return nil
+}
+
+// WantsOutbound reports whether any outbound limit is configured.
+func (h *RateLimitSessionHandler) WantsOutbound() bool {
+	if h.defaults != nil && h.defaults.Outbound != nil {
+		return true
+	}
+	for _, l := range h.sni {
+		if l != nil && l.Outbound != nil {
+			return true
+		}
+	}
+	return false
+}
+
+// OnConnect picks the limits for the session's SNI.
+func (h *RateLimitSessionHandler) OnConnect(ctx *Context) Result {
+	limits := h.defaults
+	if ctx.Hello != nil {
+		if l, ok := h.sni[ctx.Hello.SNI]; ok {
+			limits = l
+		}
+	}
+	if limits == nil {
+		return Result{Action: Continue}
+	}
+
+	now := time.Now()
+	t := &sessionThrottle{
+		inbound:  newPacketBucket(limits.Inbound, now),
+		outbound: newPacketBucket(limits.Outbound, now),
+	}
+	if t.inbound != nil || t.outbound != nil {
+		sessionThrottleKey.Set(ctx, t)
+	}
+	return Result{Action: Continue}
+}
+
+// OnPacket drops packets over the session's budget, or kills the session
+// (and bans the client with the "ban" policy).
+func (h *RateLimitSessionHandler) OnPacket(ctx *Context, packet []byte, dir Direction) Result {
+	t, ok := sessionThrottleKey.Get(ctx)
+	if !ok {
+		return Result{Action: Continue}
+	}
+	b, name := t.inbound, "inbound"
+	if dir == Outbound {
+		b, name = t.outbound, "outbound"
+	}
+	if b == nil {
+		return Result{Action: Continue}
+	}
+
+	exceeded, first := b.take(len(packet), time.Now())
+	if exceeded == "" {
+		return Result{Action: Continue}
+	}
+
+	if h.kill {
+		log.Printf("[ratelimit-session] %s exceeded %s %s limit, killing session", sessionLabel(ctx), name, exceeded)
+		if h.ban {
+			ctx.Ban(fmt.Sprintf("ratelimit-session %s %s", name, exceeded))
+		}
+		ctx.Drop()
+		return Result{Action: Drop, Error: fmt.Errorf("session killed: %s %s limit exceeded", name, exceeded)}
+	}
+	if first {
+		log.Printf("[ratelimit-session] %s exceeded %s %s limit, dropping packets", sessionLabel(ctx), name, exceeded)
+	}
+	return Result{Action: Drop}
+}
+
+// OnDisconnect logs how much was throttled.
+func (h *RateLimitSessionHandler) OnDisconnect(ctx *Context) {
+	t, ok := sessionThrottleKey.Get(ctx)
+	if !ok || h.kill {
+		return
+	}
+	in, out := t.inbound.droppedCount(), t.outbound.droppedCount()
+	if in > 0 || out > 0 {
+		log.Printf("[ratelimit-session] %s closed, dropped %d inbound and %d outbound packets", sessionLabel(ctx), in, out)
+	}
+}
+
+func sessionLabel(ctx *Context) string {
+	sni := ""
+	if ctx.Hello != nil {
+		sni = ctx.Hello.SNI
+	}
+	if ctx.Session != nil {
+		return fmt.Sprintf("session=%d (%s, SNI=%q)", ctx.Session.ID, ctx.Session.ClientAddr(), sni)
+	}
+	return fmt.Sprintf("%s (SNI=%q)", ctx.ClientAddr, sni)
+}
+
+// sessionThrottle holds a session's buckets; nil buckets are unlimited.
+type sessionThrottle struct {
+	inbound  *packetBucket
+	outbound *packetBucket
+}
+
+// maxDatagramSize is the largest datagram a QUIC connection sends in practice
+// (Ethernet MTU). The byte bucket holds at least this much, so a bps limit
+// below it slows a session down instead of dropping every full-size packet.
+const maxDatagramSize = 1500
+
+// packetBucket is a pair of token buckets for packets and bytes.
+type packetBucket struct {
+	mu        sync.Mutex
+	pps       float64
+	bps       float64
+	byteBurst float64 // Byte bucket capacity: max(bps, maxDatagramSize)
+	packets   float64 // Available packet tokens
+	bytes     float64 // Available byte tokens
+	updated   time.Time
+	dropped   int64
+}
+
+func newPacketBucket(l *DirectionLimit, now time.Time) *packetBucket {
+	if l == nil || (l.PPS == 0 && l.BPS == 0) {
+		return nil
+	}
+	burst := float64(max(l.BPS, maxDatagramSize))
+	return &packetBucket{
+		pps:       float64(l.PPS),
+		bps:       float64(l.BPS),
+		byteBurst: burst,
+		packets:   float64(l.PPS),
+		bytes:     burst,
+		updated:   now,
+	}
+}
+
+// take charges one packet of size n. It returns which limit was exceeded
+// ("" if none), and whether this is the first packet dropped.
+func (b *packetBucket) take(n int, now time.Time) (exceeded string, first bool) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	elapsed := now.Sub(b.updated).Seconds()
+	b.updated = now
+	b.packets = min(b.pps, b.packets+elapsed*b.pps)
+	b.bytes = min(b.byteBurst, b.bytes+elapsed*b.bps)
+
+	switch {
+	case b.pps > 0 && b.packets < 1:
+		exceeded = "pps"
+	case b.bps > 0 && b.bytes < float64(n):
+		exceeded = "bps"
+	default:
+		b.packets--
+		b.bytes -= float64(n)
+		return "", false
+	}
+	b.dropped++
+	return exceeded, b.dropped == 1
+}
+
+func (b *packetBucket) droppedCount() int64 {
+	if b == nil {
+		return 0
+	}
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.dropped
+}
@@ -0,0 +1,168 @@
+package handler
+
+import (
+	"encoding/json"
+	"testing"
+	"time"
+)
+
+func TestRateLimitSession_RequiresConfig(t *testing.T) {
+	for _, raw := range []string{
+		``,
+		`{}`,
+		`{"default": {"inbound": {"pps": 10}}, "policy": "block"}`,
+		`{"sni": {"a.example.com": {"inbound": {"bps": -1}}}}`,
+	} {
+		if _, err := NewRateLimitSessionHandler(json.RawMessage(raw)); err == nil {
+			t.Errorf("expected error for config %q", raw)
+		}
+	}
+}
+
+func TestPacketBucket(t *testing.T) {
+	now := time.Unix(1000, 0)
+	b := newPacketBucket(&DirectionLimit{PPS: 3, BPS: 10000}, now)
+
+	for i := 0; i < 3; i++ {
+		if exceeded, _ := b.take(100, now); exceeded != "" {
+			t.Fatalf("packet %d dropped: %s", i+1, exceeded)
+		}
+	}
+	exceeded, first := b.take(100, now)
+	if exceeded != "pps" || !first {
+		t.Errorf("got (%q, %v), want (pps, true)", exceeded, first)
+	}
+	if _, first := b.take(100, now); first {
+		t.Error("second drop reported as first")
+	}
+
+	// One second later the budget is back; a large packet hits the byte limit
+	now = now.Add(time.Second)
+	if exceeded, _ := b.take(10001, now); exceeded != "bps" {
+		t.Errorf("got %q, want bps", exceeded)
+	}
+	if exceeded, _ := b.take(10000, now); exceeded != "" {
+		t.Errorf("packet within byte budget dropped: %s", exceeded)
+	}
+	if b.droppedCount() != 3 {
+		t.Errorf("dropped = %d, want 3", b.droppedCount())
+	}
+}
+
+func TestPacketBucket_BPSBelowDatagramSize(t *testing.T) {
+	now := time.Unix(1000, 0)
+	b := newPacketBucket(&DirectionLimit{BPS: 500}, now)
+
+	if exceeded, _ := b.take(1200, now); exceeded != "" {
+		t.Fatalf("full-size packet dropped: %s", exceeded)
+	}
+	if exceeded, _ := b.take(1200, now); exceeded != "bps" {
+		t.Errorf("got %q, want bps", exceeded)
+	}
+	// 500 bytes/s: enough for the next packet after ~2.4s
+	if exceeded, _ := b.take(1200, now.Add(3*time.Second)); exceeded != "" {
+		t.Errorf("packet dropped after refill: %s", exceeded)
+	}
+}
+
+func TestRateLimitSession_PerSNI(t *testing.T) {
+	h, err := NewRateLimitSessionHandler(json.RawMessage(`{
+		"default": {"inbound": {"pps": 1}},
+		"sni": {"minigames.example.com": {"inbound": {"pps": 100}}}
+	}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	small := &Context{Hello: &ClientHello{SNI: "lobby.example.com"}}
+	big := &Context{Hello: &ClientHello{SNI: "minigames.example.com"}}
+	h.OnConnect(small)
+	h.OnConnect(big)
+
+	packet := make([]byte, 100)
+	if r := h.OnPacket(small, packet, Inbound); r.Action != Continue {
+		t.Fatal("first packet dropped")
+	}
+	if r := h.OnPacket(small, packet, Inbound); r.Action != Drop {
+		t.Error("default limit not applied")
+	}
+	// Unlimited direction
+	if r := h.OnPacket(small, packet, Outbound); r.Action != Continue {
+		t.Error("outbound dropped without an outbound limit")
+	}
+	for i := 0; i < 50; i++ {
+		if r := h.OnPacket(big, packet, Inbound); r.Action != Continue {
+			t.Fatalf("packet %d dropped despite the larger SNI budget", i+1)
+		}
+	}
+}
+
+func TestRateLimitSession_Outbound(t *testing.T) {
+	in, err := NewRateLimitSessionHandler(json.RawMessage(`{"default": {"inbound": {"pps": 1}}}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if in.(OutboundHandler).WantsOutbound() {
+		t.Error("inbound-only limits should not want outbound packets")
+	}
+
+	h, err := NewRateLimitSessionHandler(json.RawMessage(`{"sni": {"a.example.com": {"outbound": {"pps": 1}}}}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !h.(OutboundHandler).WantsOutbound() {
+		t.Fatal("outbound limits should want outbound packets")
+	}
+
+	// Through the chain, as the forwarder sees it
+	fwd := newMockHandler("fwd", Handled, Continue)
+	ctx := &Context{Hello: &ClientHello{SNI: "a.example.com"}}
+	NewChain(h, fwd).OnConnect(ctx)
+	if !ctx.filterOutbound([]byte{0x40}) {
+		t.Error("first outbound packet dropped")
+	}
+	if ctx.filterOutbound([]byte{0x40}) {
+		t.Error("second outbound packet passed")
+	}
+}
+
+func TestRateLimitSession_Kill(t *testing.T) {
+	h, err := NewRateLimitSessionHandler(json.RawMessage(`{"default": {"inbound": {"pps": 1}}, "policy": "kill"}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	killed := false
+	ctx := &Context{DropSession: func() { killed = true }}
+	h.OnConnect(ctx)
+
+	h.OnPacket(ctx, []byte{0x40}, Inbound)
+	if r := h.OnPacket(ctx, []byte{0x40}, Inbound); r.Action != Drop || r.Error == nil {
+		t.Errorf("expected Drop with error, got %v", r)
+	}
+	if !killed {
+		t.Error("session was not killed")
+	}
+}
+
+func TestRateLimitSession_Ban(t *testing.T) {
+	h, err := NewRateLimitSessionHandler(json.RawMessage(`{"default": {"inbound": {"pps": 1}}, "policy": "ban"}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	killed, banned := false, ""
+	ctx := &Context{
+		Session:     &Session{},
+		DropSession: func() { killed = true },
+		BanClient:   func(reason string) { banned = reason },
+	}
+	ctx.Session.ValidateAddress()
+	h.OnConnect(ctx)
+
+	h.OnPacket(ctx, []byte{0x40}, Inbound)
+	if r := h.OnPacket(ctx, []byte{0x40}, Inbound); r.Action != Drop {
+		t.Errorf("expected Drop, got %v", r)
+	}
+	if !killed || banned != "ratelimit-session inbound pps" {
+		t.Errorf("killed=%v banned=%q", killed, banned)
+	}
+}
@@ -3,6 +3,9 @@ package handler
 import (
 	"encoding/json"
 	"fmt"
+	"log"
+	"maps"
+	"reflect"
 )
 
 // HandlerConfig represents a handler configuration from JSON.
@@ -14,23 +17,60 @@ type HandlerConfig struct {
 // HandlerFactory creates a handler from JSON config.
 type HandlerFactory func(config json.RawMessage) (Handler, error)
 
+// registration is a registered handler type.
+type registration struct {
+	factory  HandlerFactory
+	config   reflect.Type // nil if the handler takes no config or didn't declare it
+	noConfig bool         // Declared to take no config (see RegisterConfig)
+}
+
 // registry holds all registered handler factories.
-var registry = map[string]HandlerFactory{}
+var registry = map[string]registration{}
 
 // Register adds a handler factory to the registry.
 func Register(name string, factory HandlerFactory) {
-	registry[name] = factory
+	registry[name] = registration{factory: factory}
+}
+
+// RegisterConfig adds a handler factory to the registry with the struct it
+// decodes its config into, e.g. ForwarderConfig{}, or nil if the handler
+// takes no config, which BuildChain then rejects. Handlers lists its fields
+// as the handler's options.
+func RegisterConfig(name string, factory HandlerFactory, config any) {
+	r := registration{factory: factory, noConfig: config == nil}
+	if config != nil {
+		r.config = reflect.TypeOf(config)
+	}
+	registry[name] = r
 }
 
-// BuildChain creates a handler chain from configuration.
+// BuildChain creates a handler chain from configuration. It fails if a
+// handler requires a context key no earlier handler provides, e.g. a
+// forwarder without a router before it.
 func BuildChain(configs []HandlerConfig) (*Chain, error) {
+	chain, err := buildChain(configs)
+	if err != nil {
+		return nil, err
+	}
+	if _, _, err := chain.checkKeys(nil, ""); err != nil {
+		return nil, err
+	}
+	return chain, nil
+}
+
+// buildChain creates a handler chain without checking keys, for chains
+// nested in a handler: they are checked with the chain around them.
+func buildChain(configs []HandlerConfig) (*Chain, error) {
 	var handlers []Handler
 	for _, cfg := range configs {
-		factory, ok := registry[cfg.Type]
+		r, ok := registry[cfg.Type]
 		if !ok {
 			return nil, fmt.Errorf("unknown handler type: %s", cfg.Type)
 		}
-		h, err := factory(cfg.Config)
+		if r.noConfig && !emptyConfig(cfg.Config) {
+			return nil, fmt.Errorf("failed to create handler %s: %s takes no config", cfg.Type, cfg.Type)
+		}
+		h, err := r.factory(cfg.Config)
 		if err != nil {
 			return nil, fmt.Errorf("failed to create handler %s: %w", cfg.Type, err)
 		}
@@ -39,6 +79,82 @@ func BuildChain(configs []HandlerConfig) (*Chain, error) {
 	return NewChain(handlers...), nil
 }
 
+// emptyConfig reports whether raw is absent, null or an empty object.
+func emptyConfig(raw json.RawMessage) bool {
+	var fields map[string]json.RawMessage
+	return len(raw) == 0 || json.Unmarshal(raw, &fields) == nil && len(fields) == 0
+}
+
+// skipper is implemented by nesters that may pass a connection on without
+// running any of their nested chains (e.g. match without a default).
+type skipper interface {
+	maySkip() bool
+}
+
+// checkKeys checks that the keys each handler requires are in provided or
+// provided by an earlier handler, and returns the keys provided after the
+// chain. Keys provided in every nested chain of a handler count as provided
+// after it, unless the connection can skip them all (see skipper).
+//
+// Handlers that implement neither KeyProvider nor KeyRequirer, such as
+// custom handlers written before keys existed, may set any key. unknown is
+// the name of the last such handler before the chain, and the returned name
+// the last one after it. A missing key is only a warning if one ran before.
+func (c *Chain) checkKeys(provided map[string]bool, unknown string) (map[string]bool, string, error) {
+	provided = maps.Clone(provided)
+	if provided == nil {
+		provided = make(map[string]bool)
+	}
+	for _, h := range c.handlers {
+		r, requires := h.(KeyRequirer)
+		if requires {
+			for _, k := range r.RequiresKeys() {
+				if provided[k.Name()] {
+					continue
+				}
+				if unknown == "" {
+					return nil, "", fmt.Errorf("%s requires %q, but no handler before it sets it", h.Name(), k.Name())
+				}
+				log.Printf("[handler] %s requires %q; assuming %s sets it, as it doesn't declare the keys it provides", h.Name(), k.Name(), unknown)
+				provided[k.Name()] = true
+			}
+		}
+		n, nests := h.(nester)
+		if nests {
+			var common map[string]bool
+			after := unknown
+			for i, chain := range n.nestedChains() {
+				keys, last, err := chain.checkKeys(provided, unknown)
+				if err != nil {
+					return nil, "", err
+				}
+				if i == 0 {
+					common = keys
+				} else {
+					maps.DeleteFunc(common, func(k string, _ bool) bool { return !keys[k] })
+				}
+				if last != unknown {
+					after = last
+				}
+			}
+			if s, ok := h.(skipper); common != nil && !(ok && s.maySkip()) {
+				provided = common
+			}
+			unknown = after
+		}
+		p, provides := h.(KeyProvider)
+		if provides {
+			for _, k := range p.ProvidesKeys() {
+				provided[k.Name()] = true
+			}
+		}
+		if !requires && !nests && !provides {
+			unknown = h.Name()
+		}
+	}
+	return provided, unknown, nil
+}
+
 // ListHandlers returns all registered handler names.
 func ListHandlers() []string {
 	names := make([]string, 0, len(registry))
@@ -0,0 +1,273 @@
+package handler
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"maps"
+	"reflect"
+	"slices"
+	"strconv"
+	"strings"
+)
+
+// HandlerInfo describes a registered handler type.
+type HandlerInfo struct {
+	Name    string
+	Options []ConfigOption // Empty if the handler takes no config
+}
+
+// ConfigOption is a field of a handler's config. Fields of nested objects
+// follow their parent, named by their path: "per_ip.rate" for a field of an
+// object, "branches[].sni" for one in an array of objects, "targets.*.cert"
+// for one in a map of objects.
+type ConfigOption struct {
+	Name string
+	Type string // e.g. "string", "int", "[]string", "map[string]object", "[]handler"
+}
+
+var (
+	handlerConfigType = reflect.TypeFor[HandlerConfig]()
+	rawMessageType    = reflect.TypeFor[json.RawMessage]()
+)
+
+// Handlers describes all registered handler types, sorted by name.
+func Handlers() []HandlerInfo {
+	infos := make([]HandlerInfo, 0, len(registry))
+	for name, r := range registry {
+		info := HandlerInfo{Name: name}
+		if r.config != nil {
+			info.Options = describeFields("", r.config)
+		}
+		infos = append(infos, info)
+	}
+	slices.SortFunc(infos, func(a, b HandlerInfo) int { return strings.Compare(a.Name, b.Name) })
+	return infos
+}
+
+func describeFields(prefix string, t reflect.Type) []ConfigOption {
+	var options []ConfigOption
+	for _, f := range configFields(deref(t)) {
+		name := prefix + f.name
+		options = append(options, ConfigOption{Name: name, Type: typeName(f.typ)})
+
+		// Fields of objects nested in arrays and maps
+		elem := deref(f.typ)
+		for {
+			if elem.Kind() == reflect.Slice && elem.Elem().Kind() != reflect.Uint8 {
+				name += "[]"
+			} else if elem.Kind() == reflect.Map {
+				name += ".*"
+			} else {
+				break
+			}
+			elem = deref(elem.Elem())
+		}
+		if elem.Kind() == reflect.Struct && elem != handlerConfigType {
+			options = append(options, describeFields(name+".", elem)...)
+		}
+	}
+	return options
+}
+
+// typeName returns the name of a config type as shown in ConfigOption.
+func typeName(t reflect.Type) string {
+	t = deref(t)
+	switch {
+	case t == handlerConfigType:
+		return "handler"
+	case t == rawMessageType:
+		return "any"
+	}
+	switch t.Kind() {
+	case reflect.Struct:
+		return "object"
+	case reflect.Map:
+		return "map[string]" + typeName(t.Elem())
+	case reflect.Slice, reflect.Array:
+		if t.Elem().Kind() == reflect.Uint8 {
+			return "base64"
+		}
+		return "[]" + typeName(t.Elem())
+	case reflect.String:
+		return "string"
+	case reflect.Bool:
+		return "bool"
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64,
+		reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		return "int"
+	case reflect.Float32, reflect.Float64:
+		return "number"
+	}
+	return "any"
+}
+
+// configField is a field of a config struct, by its JSON name.
+type configField struct {
+	name string
+	typ  reflect.Type
+}
+
+// configFields returns the fields encoding/json decodes into t, including
+// those of embedded structs.
+func configFields(t reflect.Type) []configField {
+	var fields []configField
+	for i := range t.NumField() {
+		f := t.Field(i)
+		tag, _, _ := strings.Cut(f.Tag.Get("json"), ",")
+		if tag == "-" {
+			continue
+		}
+		if f.Anonymous && tag == "" && deref(f.Type).Kind() == reflect.Struct {
+			fields = append(fields, configFields(deref(f.Type))...)
+			continue
+		}
+		if !f.IsExported() {
+			continue
+		}
+		if tag == "" {
+			tag = f.Name
+		}
+		fields = append(fields, configField{name: tag, typ: f.Type})
+	}
+	return fields
+}
+
+// decodeConfig decodes a handler's JSON config into v like json.Unmarshal,
+// but rejects unknown fields. Errors name the JSON path of the field, e.g.
+// "per_ip.rate: expected number, got string", and suggest the field an
+// unknown one is a typo of.
+func decodeConfig(raw json.RawMessage, v any) error {
+	dec := json.NewDecoder(bytes.NewReader(raw))
+	dec.DisallowUnknownFields()
+	err := dec.Decode(v)
+	if err == nil {
+		if _, err := dec.Token(); err != io.EOF {
+			return errors.New("unexpected data after the config object")
+		}
+		return nil
+	}
+	if err == io.EOF {
+		return io.ErrUnexpectedEOF
+	}
+	var typeErr *json.UnmarshalTypeError
+	if errors.As(err, &typeErr) && typeErr.Field != "" {
+		return fmt.Errorf("%s: expected %s, got %s", typeErr.Field, typeName(typeErr.Type), typeErr.Value)
+	}
+	// encoding/json names only the key of an unknown field, not where it is
+	if key, ok := strings.CutPrefix(err.Error(), "json: unknown field "); ok {
+		key, _ = strconv.Unquote(key)
+		var doc any
+		json.Unmarshal(raw, &doc)
+		if path, fields, ok := findUnknown(doc, reflect.TypeOf(v), key); ok {
+			return unknownField(path, key, fields)
+		}
+		return fmt.Errorf("%s: unknown field", key)
+	}
+	return err
+}
+
+// findUnknown finds the object key named key in the decoded JSON value v
+// that is not a field of the Go type t the value decodes into. It returns the
+// key's path and the fields it could have meant.
+func findUnknown(v any, t reflect.Type, key string) (string, []configField, bool) {
+	t = deref(t)
+	switch v := v.(type) {
+	case map[string]any:
+		if t.Kind() == reflect.Map {
+			for _, k := range slices.Sorted(maps.Keys(v)) {
+				if path, fields, ok := findUnknown(v[k], t.Elem(), key); ok {
+					return k + "." + path, fields, true
+				}
+			}
+			return "", nil, false
+		}
+		if t.Kind() != reflect.Struct || t == rawMessageType {
+			return "", nil, false
+		}
+		fields := configFields(t)
+		for _, k := range slices.Sorted(maps.Keys(v)) {
+			f, ok := findField(fields, k)
+			if !ok {
+				if k == key {
+					return k, fields, true
+				}
+				continue
+			}
+			if path, fields, ok := findUnknown(v[k], f.typ, key); ok {
+				return k + "." + path, fields, true
+			}
+		}
+	case []any:
+		if t.Kind() != reflect.Slice && t.Kind() != reflect.Array {
+			return "", nil, false
+		}
+		for i, elem := range v {
+			if path, fields, ok := findUnknown(elem, t.Elem(), key); ok {
+				return strconv.Itoa(i) + "." + path, fields, true
+			}
+		}
+	}
+	return "", nil, false
+}
+
+// findField finds the field for a JSON key the way encoding/json does:
+// exact match first, then case-insensitive.
+func findField(fields []configField, key string) (configField, bool) {
+	for _, f := range fields {
+		if f.name == key {
+			return f, true
+		}
+	}
+	for _, f := range fields {
+		if strings.EqualFold(f.name, key) {
+			return f, true
+		}
+	}
+	return configField{}, false
+}
+
+// unknownField returns the error for an unknown key, suggesting the field
+// it is a typo of, if any.
+func unknownField(path, key string, fields []configField) error {
+	best, bestDist := "", 3 // Suggest fields at most 2 edits away
+	for _, f := range fields {
+		if d := editDistance(key, f.name); d < bestDist {
+			best, bestDist = f.name, d
+		}
+	}
+	if best != "" {
+		return fmt.Errorf("%s: unknown field (did you mean %q?)", path, best)
+	}
+	return fmt.Errorf("%s: unknown field", path)
+}
+
+// editDistance returns the Levenshtein distance between a and b.
+func editDistance(a, b string) int {
+	prev := make([]int, len(b)+1)
+	cur := make([]int, len(b)+1)
+	for j := range prev {
+		prev[j] = j
+	}
+	for i := 1; i <= len(a); i++ {
+		cur[0] = i
+		for j := 1; j <= len(b); j++ {
+			cost := 1
+			if a[i-1] == b[j-1] {
+				cost = 0
+			}
+			cur[j] = min(prev[j]+1, cur[j-1]+1, prev[j-1]+cost)
+		}
+		prev, cur = cur, prev
+	}
+	return prev[len(b)]
+}
+
+func deref(t reflect.Type) reflect.Type {
+	for t.Kind() == reflect.Pointer {
+		t = t.Elem()
+	}
+	return t
+}
@@ -0,0 +1,134 @@
+package handler
+
+import (
+	"encoding/json"
+	"strings"
+	"testing"
+)
+
+func TestBuildChain_ConfigErrors(t *testing.T) {
+	tests := []struct {
+		name     string
+		handlers string
+		wantErr  string
+	}{
+		{
+			"valid",
+			`[{"type": "ratelimit-ip", "config": {"per_ip": {"rate": 0.5, "burst": 2}, "IPv4_Prefix": 24, "ban_after": null}},
+			  {"type": "match", "config": {"branches": [{"sni": ["*.example.com"], "handlers": [{"type": "simple-router", "config": {"backend": "10.0.0.1:5520"}}]}]}},
+			  {"type": "sni-router", "config": {"routes": {"a.com": "b:443", "b.com": ["b:443"], "c.com": {"backend": "b:443", "idle_timeout": 60}}}},
+			  {"type": "logsni"}]`,
+			"",
+		},
+		{
+			"typo",
+			`[{"type": "ratelimit-global", "config": {"max_paralel_connections": 100}}]`,
+			`failed to create handler ratelimit-global: invalid ratelimit-global config: max_paralel_connections: unknown field (did you mean "max_parallel_connections"?)`,
+		},
+		{
+			"unknown field",
+			`[{"type": "forwarder", "config": {"proxy_protocol": {"backends": ["*"], "version": 2}}}]`,
+			`failed to create handler forwarder: invalid forwarder config: proxy_protocol.version: unknown field`,
+		},
+		{
+			"wrong type",
+			`[{"type": "logsni"}, {"type": "forwarder", "config": {"transparent": "yes"}}]`,
+			`failed to create handler forwarder: invalid forwarder config: transparent: expected bool, got string`,
+		},
+		{
+			"not an int",
+			`[{"type": "ratelimit-ip", "config": {"ipv4_prefix": 24.5}}]`,
+			`failed to create handler ratelimit-ip: invalid ratelimit-ip config: ipv4_prefix: expected int, got number 24.5`,
+		},
+		{
+			"nested handler",
+			`[{"type": "match", "config": {"branches": [{"cidr": ["10.0.0.0/8"], "handlers": [{"type": "simple-router", "config": {"backnd": "x"}}]}]}}]`,
+			`failed to create handler match: match: branch 0: failed to create handler simple-router: invalid static config: backnd: unknown field (did you mean "backend"?)`,
+		},
+		{
+			"nested handler field",
+			`[{"type": "match", "config": {"branches": [], "default": [{"type": "logsni", "confg": {}}]}}]`,
+			`failed to create handler match: invalid match config: default.0.confg: unknown field (did you mean "config"?)`,
+		},
+		{
+			"no config",
+			`[{"type": "logsni", "config": {"verbose": true}}]`,
+			`failed to create handler logsni: logsni takes no config`,
+		},
+		{
+			"empty config",
+			`[{"type": "logsni", "config": {}}, {"type": "example", "config": null}]`,
+			"",
+		},
+		{
+			"route object",
+			`[{"type": "sni-router", "config": {"routes": {"a.com": {"backend": "b:443", "idle_timout": 60}}}}]`,
+			`failed to create handler sni-router: invalid route for SNI a.com: idle_timout: unknown field (did you mean "idle_timeout"?)`,
+		},
+		{
+			"route form",
+			`[{"type": "sni-router", "config": {"routes": {"a.com": 443}}}]`,
+			`failed to create handler sni-router: invalid route for SNI a.com: expected string, array or object`,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var configs []HandlerConfig
+			if err := json.Unmarshal([]byte(tt.handlers), &configs); err != nil {
+				t.Fatal(err)
+			}
+			_, err := BuildChain(configs)
+			if tt.wantErr == "" {
+				if err != nil {
+					t.Fatalf("unexpected error: %v", err)
+				}
+				return
+			}
+			if err == nil || err.Error() != tt.wantErr {
+				t.Errorf("got error %v, want %q", err, tt.wantErr)
+			}
+		})
+	}
+}
+
+func TestDecodeConfig(t *testing.T) {
+	// Factories reject typos when called directly too
+	if _, err := NewRateLimitGlobalHandler(json.RawMessage(`{"max_paralel_connections": 100}`)); err == nil {
+		t.Error("unknown field accepted")
+	}
+
+	var cfg StaticConfig
+	for _, raw := range []string{``, `{"backend": "x"} {}`, `{"backend": 1}`} {
+		if err := decodeConfig(json.RawMessage(raw), &cfg); err == nil {
+			t.Errorf("no error for %q", raw)
+		}
+	}
+	if err := decodeConfig(json.RawMessage(`{"Backend": "x"}`), &cfg); err != nil || cfg.Backend != "x" {
+		t.Errorf("got %+v, %v", cfg, err)
+	}
+}
+
+func TestHandlers(t *testing.T) {
+	infos := Handlers()
+	byName := make(map[string]HandlerInfo)
+	for i, info := range infos {
+		if i > 0 && infos[i-1].Name >= info.Name {
+			t.Errorf("not sorted: %q before %q", infos[i-1].Name, info.Name)
+		}
+		byName[info.Name] = info
+	}
+
+	if opts := byName["logsni"].Options; len(opts) != 0 {
+		t.Errorf("logsni options: %v", opts)
+	}
+	var got []string
+	for _, o := range byName["match"].Options {
+		got = append(got, o.Name+" "+o.Type)
+	}
+	want := "branches []object, branches[].sni []string, branches[].alpn []string, branches[].cidr []string, " +
+		"branches[].values map[string]string, branches[].handlers []handler, default []handler"
+	if strings.Join(got, ", ") != want {
+		t.Errorf("match options:\n got %s\nwant %s", strings.Join(got, ", "), want)
+	}
+}
@@ -0,0 +1,556 @@
+package handler
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"math"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	lua "github.com/yuin/gopher-lua"
+	"github.com/yuin/gopher-lua/parse"
+)
+
+func init() {
+	RegisterConfig("script", NewScriptHandler, ScriptConfig{})
+}
+
+// ScriptConfig is the configuration for the script handler.
+type ScriptConfig struct {
+	File      string `json:"file,omitempty"`       // Path to a Lua script
+	Source    string `json:"source,omitempty"`     // Inline Lua source (instead of file)
+	TimeoutMs int    `json:"timeout_ms,omitempty"` // Max run time per call in milliseconds (default: 10)
+}
+
+const (
+	defaultScriptTimeout = 10 * time.Millisecond
+
+	// The time limit is checked between Lua instructions, so a single call
+	// into the string library can't be interrupted. Pattern calls whose
+	// estimated worst-case backtracking (see patternCost) exceeds
+	// maxPatternCost steps are refused (a few ms of work), and string.rep can't build strings over maxScriptString.
+	maxPatternCost  = 1e6
+	maxScriptString = 1 << 20
+)
+
+// ScriptHandler runs the on_connect and on_packet functions of a Lua script.
+// Scripts can read the connection's SNI, ALPN, client address and context
+// values, set the backend or other values, and continue, handle or drop.
+//
+// Lua states aren't safe for concurrent use, so each call borrows a state
+// from a pool; globals set by one call may or may not be seen by the next.
+type ScriptHandler struct {
+	name      string // Script file name (or "inline") for errors
+	proto     *lua.FunctionProto
+	timeout   time.Duration
+	onConnect bool // Script defines on_connect
+	onPacket  bool // Script defines on_packet
+	states    sync.Pool
+}
+
+// NewScriptHandler creates a new script handler. The script is compiled and
+// its top level run once, so syntax and load errors fail the config.
+func NewScriptHandler(raw json.RawMessage) (Handler, error) {
+	var cfg ScriptConfig
+	if len(raw) > 0 {
+		if err := decodeConfig(raw, &cfg); err != nil {
+			return nil, fmt.Errorf("invalid script config: %w", err)
+		}
+	}
+	if (cfg.File == "") == (cfg.Source == "") {
+		return nil, fmt.Errorf("script requires either 'file' or 'source'")
+	}
+	if cfg.TimeoutMs < 0 {
+		return nil, fmt.Errorf("script: timeout_ms must not be negative")
+	}
+
+	h := &ScriptHandler{name: "inline", timeout: defaultScriptTimeout}
+	if cfg.TimeoutMs > 0 {
+		h.timeout = time.Duration(cfg.TimeoutMs) * time.Millisecond
+	}
+	source := cfg.Source
+	if cfg.File != "" {
+		data, err := os.ReadFile(cfg.File)
+		if err != nil {
+			return nil, fmt.Errorf("script: %w", err)
+		}
+		h.name, source = cfg.File, string(data)
+	}
+
+	chunk, err := parse.Parse(strings.NewReader(source), h.name)
+	if err != nil {
+		return nil, fmt.Errorf("script: %w", err)
+	}
+	h.proto, err = lua.Compile(chunk, h.name)
+	if err != nil {
+		return nil, fmt.Errorf("script: %w", err)
+	}
+
+	L, err := h.newState()
+	if err != nil {
+		return nil, fmt.Errorf("script: %w", err)
+	}
+	_, h.onConnect = L.GetGlobal("on_connect").(*lua.LFunction)
+	_, h.onPacket = L.GetGlobal("on_packet").(*lua.LFunction)
+	if !h.onConnect && !h.onPacket {
+		L.Close()
+		return nil, fmt.Errorf("script: %s defines neither on_connect nor on_packet", h.name)
+	}
+	h.states.Put(L)
+	return h, nil
+}
+
+// newState creates a Lua state with the safe standard libraries (no io, os
+// or loading other files) and runs the script's top level in it.
+func (h *ScriptHandler) newState() (*lua.LState, error) {
+	L := lua.NewState(lua.Options{SkipOpenLibs: true})
+	for _, lib := range []struct {
+		name string
+		open lua.LGFunction
+	}{
+		{lua.BaseLibName, lua.OpenBase},
+		{lua.TabLibName, lua.OpenTable},
+		{lua.StringLibName, lua.OpenString},
+		{lua.MathLibName, lua.OpenMath},
+	} {
+		L.Push(L.NewFunction(lib.open))
+		L.Push(lua.LString(lib.name))
+		L.Call(1, 0)
+	}
+	for _, name := range []string{"dofile", "loadfile", "load", "loadstring", "require", "module"} {
+		L.SetGlobal(name, lua.LNil)
+	}
+	limitStringLib(L)
+
+	L.Push(L.NewFunctionFromProto(h.proto))
+	if err := h.pcall(L, 0, 0); err != nil {
+		L.Close()
+		return nil, err
+	}
+	return L, nil
+}
+
+// limitStringLib wraps the string functions that can run for long in a single
+// call, which the time limit can't interrupt. Method calls such as s:find()
+// go through the same table.
+func limitStringLib(L *lua.LState) {
+	lib := L.GetGlobal(lua.StringLibName).(*lua.LTable)
+	for _, name := range []string{"find", "match", "gmatch", "gsub"} {
+		orig := lib.RawGetString(name).(*lua.LFunction).GFunction
+		lib.RawSetString(name, L.NewFunction(func(L *lua.LState) int {
+			plain := name == "find" && lua.LVAsBool(L.Get(4))
+			if !plain && patternCost(len(L.CheckString(1)), L.CheckString(2)) > maxPatternCost {
+				L.RaiseError("string.%s: pattern too complex for a %d-byte string", name, len(L.CheckString(1)))
+			}
+			return orig(L)
+		}))
+	}
+
+	rep := lib.RawGetString("rep").(*lua.LFunction).GFunction
+	lib.RawSetString("rep", L.NewFunction(func(L *lua.LState) int {
+		s, n, sep := L.CheckString(1), L.CheckInt(2), L.OptString(3, "")
+		if n > 0 && float64(n)*float64(len(s)+len(sep)) > maxScriptString {
+			L.RaiseError("string.rep: result larger than %d bytes", maxScriptString)
+		}
+		return rep(L)
+	}))
+}
+
+// patternCost estimates the worst-case steps of matching a Lua pattern
+// against a string of n bytes. A repeated item backtracks over the whole
+// string only if what may follow it can match the same bytes: in
+// "^([%w-]+)%.(%w+)$" each run ends at the one place its dot can match, while
+// in "(.-)%.(.*)" the first one is tried at every dot. Unanchored patterns are
+// tried at every start position.
+func patternCost(n int, pattern string) float64 {
+	items, anchored := parsePattern(pattern)
+	size := float64(n + 1)
+	cost := 1.0
+	if !anchored {
+		cost = size
+	}
+	repeated := false
+	for i, item := range items {
+		if item.repeat == 0 {
+			continue
+		}
+		repeated = true
+		if !overlapsNext(items, i) {
+			continue
+		}
+		if item.repeat == '?' {
+			cost *= 2
+		} else {
+			cost *= size
+		}
+	}
+	if repeated {
+		cost *= size // Each run scans up to the whole string
+	}
+	return cost
+}
+
+// patternItem is a single-byte item of a Lua pattern, possibly repeated.
+type patternItem struct {
+	set    [256]bool // Bytes the item matches
+	repeat byte      // '*', '+', '-', '?' or 0
+	empty  bool      // Can match the empty string
+}
+
+// parsePattern splits a Lua pattern into its items, the way gopher-lua parses
+// it. Captures are left out; back references and %b count as items matching
+// any byte, resp. their opening byte. anchored is set for a leading '^'.
+func parsePattern(p string) (items []patternItem, anchored bool) {
+	i := 0
+	if strings.HasPrefix(p, "^") {
+		anchored = true
+		i++
+	}
+	for i < len(p) {
+		var item patternItem
+		switch c := p[i]; {
+		case c == '(' || c == ')' || c == '$' && i == len(p)-1:
+			i++
+			continue
+		case c == '%' && i+1 == len(p):
+			return items, anchored // Invalid, left to the matcher
+		case c == '%' && p[i+1] >= '1' && p[i+1] <= '9':
+			item = patternItem{set: allBytes, empty: true}
+			items = append(items, item)
+			i += 2
+			continue
+		case c == '%' && p[i+1] == 'b':
+			if i+2 < len(p) {
+				item.set[p[i+2]] = true
+			}
+			items = append(items, item)
+			i += 4
+			continue
+		case c == '%':
+			item.set = classSet(p[i+1])
+			i += 2
+		case c == '.':
+			item.set = allBytes
+			i++
+		case c == '[':
+			item.set, i = parseSet(p, i+1)
+		default:
+			item.set[c] = true
+			i++
+		}
+		if i < len(p) && strings.IndexByte("*+-?", p[i]) >= 0 {
+			item.repeat = p[i]
+			item.empty = p[i] != '+'
+			i++
+		}
+		items = append(items, item)
+	}
+	return items, anchored
+}
+
+// parseSet parses the set starting after the '[' at p[i-1] and returns it
+// with the index after its ']'.
+func parseSet(p string, i int) ([256]bool, int) {
+	negate := i < len(p) && p[i] == '^'
+	if negate {
+		i++
+	}
+	type entry struct {
+		set [256]bool
+		lit int // The literal byte, or -1 for a class
+	}
+	var entries []entry
+	isRange := false
+	for i < len(p) {
+		c := p[i]
+		if c == ']' && len(entries) > 0 {
+			i++
+			break
+		}
+		if c == '-' && len(entries) > 0 {
+			isRange = true
+			i++
+			continue
+		}
+		e := entry{lit: int(c)}
+		if c == '%' && i+1 < len(p) {
+			e = entry{set: classSet(p[i+1]), lit: -1}
+			i++
+		} else {
+			e.set[c] = true
+		}
+		i++
+		entries = append(entries, e)
+		if isRange && len(entries) >= 2 {
+			// Only ranges between two literal bytes match anything
+			begin, end := entries[len(entries)-2], entries[len(entries)-1]
+			r := entry{lit: -1}
+			if begin.lit >= 0 && end.lit >= 0 {
+				for b := begin.lit; b <= end.lit; b++ {
+					r.set[b] = true
+				}
+			}
+			entries = append(entries[:len(entries)-2], r)
+			isRange = false
+		}
+	}
+	if isRange {
+		entries = append(entries, entry{lit: '-'})
+		entries[len(entries)-1].set['-'] = true
+	}
+
+	var set [256]bool
+	for b := range set {
+		for _, e := range entries {
+			set[b] = set[b] || e.set[b]
+		}
+		set[b] = set[b] != negate
+	}
+	return set, i
+}
+
+// allBytes is the set of a class matching any byte.
+var allBytes = func() (set [256]bool) {
+	for b := range set {
+		set[b] = true
+	}
+	return set
+}()
+
+// classSet returns the bytes matched by the class %c.
+func classSet(c byte) [256]bool {
+	var set [256]bool
+	lower := c | 0x20
+	if !strings.ContainsRune("acdlpsuwxz", rune(lower)) {
+		set[c] = true // Escaped literal
+		return set
+	}
+	for b := range set {
+		var in bool
+		switch lower {
+		case 'a':
+			in = 'A' <= b && b <= 'Z' || 'a' <= b && b <= 'z'
+		case 'c':
+			in = b <= 0x1F || b == 0x7F
+		case 'd':
+			in = '0' <= b && b <= '9'
+		case 'l':
+			in = 'a' <= b && b <= 'z'
+		case 'p':
+			in = 0x21 <= b && b <= 0x2f || 0x3a <= b && b <= 0x40 || 0x5b <= b && b <= 0x60 || 0x7b <= b && b <= 0x7e
+		case 's':
+			in = strings.IndexByte(" \f\n\r\t\v", byte(b)) >= 0
+		case 'u':
+			in = 'A' <= b && b <= 'Z'
+		case 'w':
+			in = '0' <= b && b <= '9' || 'A' <= b && b <= 'Z' || 'a' <= b && b <= 'z'
+		case 'x':
+			in = '0' <= b && b <= '9' || 'a' <= b && b <= 'f' || 'A' <= b && b <= 'F'
+		case 'z':
+			in = b == 0
+		}
+		set[b] = in != (c != lower) // Upper case: complement
+	}
+	return set
+}
+
+// overlapsNext reports whether items[i] shares a byte with an item that may
+// follow it, up to the first one that can't match the empty string. If not,
+// matching can only go on where its run ends. At the end of the pattern the
+// match succeeds or fails right away.
+func overlapsNext(items []patternItem, i int) bool {
+	for _, next := range items[i+1:] {
+		for b := range next.set {
+			if next.set[b] && items[i].set[b] {
+				return true
+			}
+		}
+		if !next.empty {
+			return false
+		}
+	}
+	return false
+}
+
+// pcall calls the function on the stack under the handler's time limit.
+func (h *ScriptHandler) pcall(L *lua.LState, nargs, nret int) error {
+	ctx, cancel := context.WithTimeout(context.Background(), h.timeout)
+	defer cancel()
+	L.SetContext(ctx)
+	defer L.RemoveContext()
+	return L.PCall(nargs, nret, nil)
+}
+
+// call runs a script function with the connection table and extra arguments,
+// copies changed values back into the context and converts the returned
+// action into a Result.
+func (h *ScriptHandler) call(ctx *Context, fn string, args ...lua.LValue) Result {
+	L, ok := h.states.Get().(*lua.LState)
+	if !ok {
+		var err error
+		if L, err = h.newState(); err != nil {
+			return Result{Action: Drop, Error: fmt.Errorf("script %s: %w", h.name, err)}
+		}
+	}
+
+	conn, before := connTable(L, ctx)
+	L.Push(L.GetGlobal(fn))
+	L.Push(conn)
+	for _, arg := range args {
+		L.Push(arg)
+	}
+	if err := h.pcall(L, 1+len(args), 2); err != nil {
+		// A timed out state may be left mid-call: don't reuse it
+		L.Close()
+		return Result{Action: Drop, Error: fmt.Errorf("script %s: %s: %w", h.name, fn, err)}
+	}
+	action, reason := L.Get(-2), L.Get(-1)
+	L.Pop(2)
+
+	storeValues(ctx, conn, before)
+	h.states.Put(L)
+
+	switch lua.LVAsString(action) {
+	case "", "continue":
+		return Result{Action: Continue}
+	case "handled":
+		return Result{Action: Handled}
+	case "drop":
+		if reason == lua.LNil {
+			return Result{Action: Drop, Error: fmt.Errorf("script %s: %s dropped", h.name, fn)}
+		}
+		return Result{Action: Drop, Error: fmt.Errorf("script %s: %s", h.name, lua.LVAsString(reason))}
+	default:
+		return Result{Action: Drop, Error: fmt.Errorf("script %s: %s returned unknown action %q", h.name, fn, action.String())}
+	}
+}
+
+// connTable builds the table passed to script functions, and returns the
+// values it contains so storeValues can tell which ones the script changed.
+func connTable(L *lua.LState, ctx *Context) (*lua.LTable, map[string]lua.LValue) {
+	conn := L.NewTable()
+	if ctx.Hello != nil {
+		conn.RawSetString("sni", lua.LString(ctx.Hello.SNI))
+		conn.RawSetString("ja4", lua.LString(ctx.Hello.JA4))
+		alpn := L.NewTable()
+		for _, p := range ctx.Hello.ALPNProtocols {
+			alpn.Append(lua.LString(p))
+		}
+		conn.RawSetString("alpn", alpn)
+	}
+	if ctx.ClientAddr != nil {
+		conn.RawSetString("client_ip", lua.LString(ctx.ClientAddr.IP.String()))
+		conn.RawSetString("client_port", lua.LNumber(ctx.ClientAddr.Port))
+	}
+
+	before := make(map[string]lua.LValue)
+	values := L.NewTable()
+	ctx.Range(func(key string, value any) bool {
+		if v := toLua(value); v != lua.LNil && !strings.HasPrefix(key, "_") {
+			before[key] = v
+			values.RawSetString(key, v)
+		}
+		return true
+	})
+	conn.RawSetString("values", values)
+	conn.RawSetString("backend", values.RawGetString(Backend.Name()))
+	return conn, before
+}
+
+// storeValues copies values the script set or changed into the context.
+// conn.backend is shorthand for conn.values.backend.
+func storeValues(ctx *Context, conn *lua.LTable, before map[string]lua.LValue) {
+	if backend, ok := conn.RawGetString("backend").(lua.LString); ok && backend != before[Backend.Name()] {
+		Backend.Set(ctx, string(backend))
+	}
+	values, ok := conn.RawGetString("values").(*lua.LTable)
+	if !ok {
+		return
+	}
+	values.ForEach(func(k, v lua.LValue) {
+		key, ok := k.(lua.LString)
+		if !ok || strings.HasPrefix(string(key), "_") || v == before[string(key)] {
+			return
+		}
+		if value := fromLua(v); value != nil {
+			ctx.Set(string(key), value)
+		}
+	})
+}
+
+// toLua converts a context value to Lua. Other types than strings, numbers
+// and booleans aren't visible to scripts.
+func toLua(v any) lua.LValue {
+	switch v := v.(type) {
+	case string:
+		return lua.LString(v)
+	case bool:
+		return lua.LBool(v)
+	case int:
+		return lua.LNumber(v)
+	case int64:
+		return lua.LNumber(v)
+	case float64:
+		return lua.LNumber(v)
+	}
+	return lua.LNil
+}
+
+// fromLua converts a Lua value back; whole numbers become int so GetInt
+// finds them.
+func fromLua(v lua.LValue) any {
+	switch v := v.(type) {
+	case lua.LString:
+		return string(v)
+	case lua.LBool:
+		return bool(v)
+	case lua.LNumber:
+		if f := float64(v); f == math.Trunc(f) && math.Abs(f) < 1<<53 {
+			return int(f)
+		}
+		return float64(v)
+	}
+	return nil
+}
+
+// Name returns the handler name.
+func (h *ScriptHandler) Name() string {
+	return "script"
+}
+
+// OnConnect calls the script's on_connect(conn).
+func (h *ScriptHandler) OnConnect(ctx *Context) Result {
+	if !h.onConnect {
+		return Result{Action: Continue}
+	}
+	return h.call(ctx, "on_connect")
+}
+
+// OnPacket calls the script's on_packet(conn, dir, size) with dir
+// "inbound" or "outbound".
+func (h *ScriptHandler) OnPacket(ctx *Context, packet []byte, dir Direction) Result {
+	if !h.onPacket {
+		return Result{Action: Continue}
+	}
+	d := "inbound"
+	if dir == Outbound {
+		d = "outbound"
+	}
+	return h.call(ctx, "on_packet", lua.LString(d), lua.LNumber(len(packet)))
+}
+
+// OnDisconnect does nothing.
+func (h *ScriptHandler) OnDisconnect(ctx *Context) {}
+
+// ProvidesKeys reports that the script may set the backend.
+func (h *ScriptHandler) ProvidesKeys() []AnyKey {
+	return []AnyKey{Backend}
+}
+
+// WantsOutbound reports whether the script defines on_packet.
+func (h *ScriptHandler) WantsOutbound() bool {
+	return h.onPacket
+}
@@ -0,0 +1,237 @@
+package handler
+
+import (
+	"encoding/json"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func newScriptHandler(t *testing.T, source string) Handler {
+	t.Helper()
+	raw, _ := json.Marshal(ScriptConfig{Source: source})
+	h, err := NewScriptHandler(raw)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return h
+}
+
+func TestScript_RequiresConfig(t *testing.T) {
+	for _, raw := range []string{
+		``,
+		`{"file": "a.lua", "source": "function on_connect(conn) end"}`,
+		`{"file": "/nonexistent.lua"}`,
+		`{"source": "function on_connect(conn"}`,
+		`{"source": "x = 1"}`,
+		`{"source": "error('boom')"}`,
+		`{"source": "function on_connect(conn) end", "timeout_ms": -1}`,
+	} {
+		if _, err := NewScriptHandler(json.RawMessage(raw)); err == nil {
+			t.Errorf("expected error for config %q", raw)
+		}
+	}
+}
+
+func TestScript_OnConnect(t *testing.T) {
+	h := newScriptHandler(t, `
+		function on_connect(conn)
+			if conn.sni == "blocked.example.com" then
+				return "drop", "blocked domain"
+			end
+			if conn.alpn[1] == "h3" and conn.client_ip == "192.0.2.1" then
+				conn.backend = "10.0.0.1:5520"
+				conn.values.tier = "vip"
+				conn.values.weight = conn.values.weight + 1
+			end
+			if conn.values.fingerprint_tag == "bot" then
+				return "handled"
+			end
+		end
+	`)
+
+	ctx := newMatchContext("play.example.com", []string{"h3"}, "192.0.2.1")
+	ctx.Set("weight", int64(2))
+	ctx.Set("unchanged", int64(7))
+	if r := h.OnConnect(ctx); r.Action != Continue {
+		t.Fatalf("got action %v, want Continue", r.Action)
+	}
+	if got := ctx.GetString("backend"); got != "10.0.0.1:5520" {
+		t.Errorf("backend = %q, want 10.0.0.1:5520", got)
+	}
+	if got := ctx.GetString("tier"); got != "vip" {
+		t.Errorf("tier = %q, want vip", got)
+	}
+	if got := ctx.GetInt("weight"); got != 3 {
+		t.Errorf("weight = %d, want 3", got)
+	}
+	if got := ctx.GetInt64("unchanged"); got != 7 {
+		t.Errorf("unchanged value was rewritten as %T", ctx.values["unchanged"])
+	}
+
+	r := h.OnConnect(newMatchContext("blocked.example.com", nil, "127.0.0.1"))
+	if r.Action != Drop || r.Error == nil || !strings.Contains(r.Error.Error(), "blocked domain") {
+		t.Errorf("got %v (%v), want Drop with reason", r.Action, r.Error)
+	}
+
+	tagged := newMatchContext("play.example.com", nil, "127.0.0.1")
+	FingerprintTag.Set(tagged, "bot")
+	if r := h.OnConnect(tagged); r.Action != Handled {
+		t.Errorf("got action %v, want Handled", r.Action)
+	}
+}
+
+func TestScript_OnPacket(t *testing.T) {
+	h := newScriptHandler(t, `
+		function on_packet(conn, dir, size)
+			if dir == "outbound" and size > 100 then
+				return "drop"
+			end
+		end
+	`)
+	if !h.(OutboundHandler).WantsOutbound() {
+		t.Fatal("script with on_packet should want outbound packets")
+	}
+	ctx := newMatchContext("play.example.com", nil, "127.0.0.1")
+	if r := h.OnConnect(ctx); r.Action != Continue {
+		t.Errorf("got action %v without on_connect, want Continue", r.Action)
+	}
+	if r := h.OnPacket(ctx, make([]byte, 200), Inbound); r.Action != Continue {
+		t.Errorf("inbound: got action %v, want Continue", r.Action)
+	}
+	if r := h.OnPacket(ctx, make([]byte, 200), Outbound); r.Action != Drop {
+		t.Errorf("outbound: got action %v, want Drop", r.Action)
+	}
+}
+
+func TestScript_Limits(t *testing.T) {
+	h := newScriptHandler(t, `
+		function on_connect(conn)
+			if conn.sni == "loop" then
+				while true do end
+			end
+			if conn.sni == "io" then
+				return tostring(io == nil and os == nil and dofile == nil)
+			end
+			return conn.sni
+		end
+	`)
+
+	ctx := &Context{Hello: &ClientHello{SNI: "loop"}, ClientAddr: &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)}}
+	if r := h.OnConnect(ctx); r.Action != Drop || r.Error == nil {
+		t.Errorf("got %v (%v), want Drop after timeout", r.Action, r.Error)
+	}
+	// The pool replaces the state that timed out
+	if r := h.OnConnect(&Context{Hello: &ClientHello{SNI: "handled"}}); r.Action != Handled {
+		t.Errorf("got action %v, want Handled", r.Action)
+	}
+	r := h.OnConnect(&Context{Hello: &ClientHello{SNI: "io"}})
+	if r.Error == nil || !strings.Contains(r.Error.Error(), `"true"`) {
+		t.Errorf("io, os or dofile available to scripts: %v", r.Error)
+	}
+}
+
+func TestScript_PatternLimits(t *testing.T) {
+	h := newScriptHandler(t, `
+		function on_connect(conn)
+			if conn.sni == "backtrack" then
+				string.find(string.rep('a', 24)..'c', 'a-a-a-a-a-a-a-a-b')
+			elseif conn.sni == "method" then
+				(string.rep('a', 24)..'c'):match('a*a*a*a*a*a*a*a*b')
+			elseif conn.sni == "rep" then
+				string.rep('x', 1073741824)
+			elseif conn.sni == "plain" then
+				return tostring(string.find(string.rep('a', 1000), 'a-a-a-a-b', 1, true))
+			elseif conn.sni:sub(-3) == ".gg" then
+				local sub, domain, tld = conn.sni:match('^([%w-]+)%.([%w-]+)%.(%w+)$')
+				return domain == "mynetwork" and "handled" or "drop"
+			else
+				return conn.sni:match('^(.-)%.example%.com$')
+			end
+		end
+	`)
+
+	for _, sni := range []string{"backtrack", "method", "rep"} {
+		start := time.Now()
+		r := h.OnConnect(&Context{Hello: &ClientHello{SNI: sni}})
+		if r.Action != Drop || r.Error == nil {
+			t.Errorf("%s: got %v (%v), want Drop", sni, r.Action, r.Error)
+		}
+		if d := time.Since(start); d > time.Second {
+			t.Errorf("%s: took %v", sni, d)
+		}
+	}
+
+	// Plain finds and simple patterns still work
+	r := h.OnConnect(&Context{Hello: &ClientHello{SNI: "plain"}})
+	if r.Error == nil || !strings.Contains(r.Error.Error(), `"nil"`) {
+		t.Errorf("plain: got %v", r.Error)
+	}
+	if r := h.OnConnect(&Context{Hello: &ClientHello{SNI: "handled.example.com"}}); r.Action != Handled {
+		t.Errorf("simple pattern: got %v (%v), want Handled", r.Action, r.Error)
+	}
+	if r := h.OnConnect(&Context{Hello: &ClientHello{SNI: "survival-games-eu-west-1.mynetwork.gg"}}); r.Action != Handled {
+		t.Errorf("multi-label pattern: got %v (%v), want Handled", r.Action, r.Error)
+	}
+}
+
+func TestPatternCost(t *testing.T) {
+	tests := []struct {
+		pattern string
+		want    float64
+	}{
+		{"abc", 11},
+		{"^(.-)%.example%.com$", 121},
+		{"a-a-b", 1331},
+		{"%*%-[*+-?]", 11}, // Escaped and in sets: literals
+		{"[]*]x*", 121},
+		{"[^]*]x*", 121},
+		{"^([%w-]+)%.([%w-]+)%.(%w+)$", 11}, // Each run ends at its dot
+		{"(.-)%.(.*)", 1331},
+		{"%d+%a+", 121},
+		{"%w+%a+", 1331},
+		{"[^%.]+%.", 121},
+		{"[a-c]*d", 121},
+		{"[a-c]*b", 1331},
+		{"%W*%.", 1331}, // Complement of %w includes the dot
+		{"a*b?a", 1331}, // b? can be skipped
+		{"a?a", 242},
+	}
+	for _, tt := range tests {
+		if got := patternCost(10, tt.pattern); got != tt.want {
+			t.Errorf("patternCost(10, %q) = %v, want %v", tt.pattern, got, tt.want)
+		}
+	}
+}
+
+func TestScript_File(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "route.lua")
+	if err := os.WriteFile(path, []byte(`function on_connect(conn) conn.backend = "10.0.0.1:5520" end`), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	raw, _ := json.Marshal(ScriptConfig{File: path})
+	h, err := NewScriptHandler(raw)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Each config load reads the file again
+	if err := os.WriteFile(path, []byte(`function on_connect(conn) conn.backend = "10.0.0.2:5520" end`), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	reloaded, err := NewScriptHandler(raw)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for want, h := range map[string]Handler{"10.0.0.1:5520": h, "10.0.0.2:5520": reloaded} {
+		ctx := &Context{}
+		h.OnConnect(ctx)
+		if got := ctx.GetString("backend"); got != want {
+			t.Errorf("backend = %q, want %q", got, want)
+		}
+	}
+}
@@ -8,7 +8,7 @@ import (
 )
 
 func init() {
-	Register("simple-router", NewStaticHandler)
+	RegisterConfig("simple-router", NewStaticHandler, StaticConfig{})
 }
 
 // StaticConfig is the configuration for the static handler.
@@ -27,7 +27,7 @@ type StaticHandler struct {
 func NewStaticHandler(raw json.RawMessage) (Handler, error) {
 	var cfg StaticConfig
 	if len(raw) > 0 {
-		if err := json.Unmarshal(raw, &cfg); err != nil {
+		if err := decodeConfig(raw, &cfg); err != nil {
 			return nil, fmt.Errorf("invalid static config: %w", err)
 		}
 	}
@@ -55,10 +55,22 @@ func (h *StaticHandler) Name() string {
 func (h *StaticHandler) OnConnect(ctx *Context) Result {
 	idx := h.counter.Add(1) - 1
 	backend := h.backends[idx%uint64(len(h.backends))]
-	ctx.Set("backend", backend)
+	Backend.Set(ctx, backend)
 	return Result{Action: Continue}
 }
 
+// ProvidesKeys reports that the handler sets the backend.
+func (h *StaticHandler) ProvidesKeys() []AnyKey {
+	return []AnyKey{Backend}
+}
+
+// Reload continues the round-robin rotation of the handler it replaces.
+func (h *StaticHandler) Reload(old Handler) {
+	if o, ok := old.(*StaticHandler); ok {
+		h.counter.Store(o.counter.Load())
+	}
+}
+
 // OnPacket passes through.
 func (h *StaticHandler) OnPacket(ctx *Context, packet []byte, dir Direction) Result {
 	return Result{Action: Continue}
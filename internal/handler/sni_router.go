@@ -5,16 +5,63 @@ import (
 	"errors"
 	"fmt"
 	"sync/atomic"
+	"time"
 )
 
 func init() {
-	Register("sni-router", NewDynamicHandler)
+	RegisterConfig("sni-router", NewDynamicHandler, SNIRouterConfig{})
 }
 
 // route holds backends for a single SNI with its own round-robin counter.
 type route struct {
-	backends []string
-	counter  atomic.Uint64
+	backends    []string
+	idleTimeout time.Duration // 0 = proxy default
+	counter     atomic.Uint64
+}
+
+// SNIRouterConfig is the configuration for the sni-router handler.
+type SNIRouterConfig struct {
+	Routes map[string]RouteConfig `json:"routes"` // SNI -> route
+}
+
+// RouteConfig is the route of one SNI. In JSON it is a backend address, an
+// array of them, or an object for settings beyond backends.
+type RouteConfig struct {
+	Backend     string   `json:"backend,omitempty"`
+	Backends    []string `json:"backends,omitempty"`
+	IdleTimeout int      `json:"idle_timeout,omitempty"` // Seconds
+}
+
+// UnmarshalJSON accepts all three forms of a route.
+func (r *RouteConfig) UnmarshalJSON(data []byte) error {
+	var v any
+	if err := json.Unmarshal(data, &v); err != nil {
+		return err
+	}
+	switch v := v.(type) {
+	case string:
+		*r = RouteConfig{Backends: []string{v}}
+	case []any:
+		backends := make([]string, len(v))
+		for i, b := range v {
+			s, ok := b.(string)
+			if !ok {
+				return fmt.Errorf("backend %d: expected string", i)
+			}
+			backends[i] = s
+		}
+		*r = RouteConfig{Backends: backends}
+	case map[string]any:
+		type plain RouteConfig // Without this method
+		var p plain
+		if err := decodeConfig(data, &p); err != nil {
+			return err
+		}
+		*r = RouteConfig(p)
+	default:
+		return errors.New("expected string, array or object")
+	}
+	return nil
 }
 
 // next returns the next backend using round-robin.
@@ -30,12 +77,12 @@ type DynamicHandler struct {
 
 // NewDynamicHandler creates a new dynamic handler.
 func NewDynamicHandler(raw json.RawMessage) (Handler, error) {
-	// Parse as map[string]any to handle both string and []string values
+	// Routes are decoded one by one, so errors name the SNI
 	var cfg struct {
-		Routes map[string]any `json:"routes"`
+		Routes map[string]json.RawMessage `json:"routes"`
 	}
 	if len(raw) > 0 {
-		if err := json.Unmarshal(raw, &cfg); err != nil {
+		if err := decodeConfig(raw, &cfg); err != nil {
 			return nil, fmt.Errorf("invalid dynamic config: %w", err)
 		}
 	}
@@ -45,26 +92,21 @@ func NewDynamicHandler(raw json.RawMessage) (Handler, error) {
 
 	routes := make(map[string]*route, len(cfg.Routes))
 	for sni, val := range cfg.Routes {
-		var backends []string
-		switch v := val.(type) {
-		case string:
-			backends = []string{v}
-		case []any:
-			backends = make([]string, len(v))
-			for i, b := range v {
-				s, ok := b.(string)
-				if !ok {
-					return nil, fmt.Errorf("invalid backend for SNI %s: expected string", sni)
-				}
-				backends[i] = s
-			}
-		default:
-			return nil, fmt.Errorf("invalid backend for SNI %s: expected string or array", sni)
+		var rc RouteConfig
+		if err := json.Unmarshal(val, &rc); err != nil {
+			return nil, fmt.Errorf("invalid route for SNI %s: %w", sni, err)
+		}
+		if rc.IdleTimeout < 0 {
+			return nil, fmt.Errorf("invalid idle_timeout for SNI %s", sni)
+		}
+		backends := rc.Backends
+		if rc.Backend != "" {
+			backends = append([]string{rc.Backend}, backends...)
 		}
 		if len(backends) == 0 {
 			return nil, fmt.Errorf("empty backends for SNI %s", sni)
 		}
-		routes[sni] = &route{backends: backends}
+		routes[sni] = &route{backends: backends, idleTimeout: time.Duration(rc.IdleTimeout) * time.Second}
 	}
 
 	return &DynamicHandler{routes: routes}, nil
@@ -75,7 +117,7 @@ func (h *DynamicHandler) Name() string {
 	return "sni-router"
 }
 
-// OnConnect sets the backend address based on SNI.
+// OnConnect sets the backend address, and the route's idle timeout if any, based on SNI.
 func (h *DynamicHandler) OnConnect(ctx *Context) Result {
 	if ctx.Hello == nil {
 		return Result{Action: Drop, Error: errors.New("no ClientHello")}
@@ -91,10 +133,31 @@ func (h *DynamicHandler) OnConnect(ctx *Context) Result {
 		return Result{Action: Drop, Error: fmt.Errorf("unknown SNI: %s", sni)}
 	}
 
-	ctx.Set("backend", r.next())
+	Backend.Set(ctx, r.next())
+	if r.idleTimeout > 0 {
+		ctx.SetIdleTimeout(r.idleTimeout)
+	}
 	return Result{Action: Continue}
 }
 
+// ProvidesKeys reports that the handler sets the backend.
+func (h *DynamicHandler) ProvidesKeys() []AnyKey {
+	return []AnyKey{Backend}
+}
+
+// Reload continues the round-robin rotation of routes that still exist.
+func (h *DynamicHandler) Reload(old Handler) {
+	o, ok := old.(*DynamicHandler)
+	if !ok {
+		return
+	}
+	for sni, r := range h.routes {
+		if prev, ok := o.routes[sni]; ok {
+			r.counter.Store(prev.counter.Load())
+		}
+	}
+}
+
 // OnPacket passes through.
 func (h *DynamicHandler) OnPacket(ctx *Context, packet []byte, dir Direction) Result {
 	return Result{Action: Continue}
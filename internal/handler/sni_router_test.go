@@ -5,6 +5,7 @@ import (
 	"strings"
 	"sync"
 	"testing"
+	"time"
 )
 
 func TestNewDynamicHandler(t *testing.T) {
@@ -34,10 +35,15 @@ func TestNewDynamicHandler(t *testing.T) {
 			wantErr: "requires 'routes' config",
 		},
 		{
-			name:    "missing routes",
-			config:  `{"other": "value"}`,
+			name:    "empty routes",
+			config:  `{"routes": {}}`,
 			wantErr: "requires 'routes' config",
 		},
+		{
+			name:    "unknown field",
+			config:  `{"other": "value"}`,
+			wantErr: "other: unknown field",
+		},
 		{
 			name:    "invalid JSON",
 			config:  `{invalid`,
@@ -46,7 +52,22 @@ func TestNewDynamicHandler(t *testing.T) {
 		{
 			name:    "invalid backend type number",
 			config:  `{"routes": {"x.com": 123}}`,
-			wantErr: "expected string or array",
+			wantErr: "expected string, array or object",
+		},
+		{
+			name:    "route object",
+			config:  `{"routes": {"x.com": {"backends": ["b1:443", "b2:443"], "idle_timeout": 60}}}`,
+			wantErr: "",
+		},
+		{
+			name:    "route object without backends",
+			config:  `{"routes": {"x.com": {"idle_timeout": 60}}}`,
+			wantErr: "empty backends",
+		},
+		{
+			name:    "route object with negative idle_timeout",
+			config:  `{"routes": {"x.com": {"backend": "b:443", "idle_timeout": -1}}}`,
+			wantErr: "invalid idle_timeout",
 		},
 		{
 			name:    "empty backends array",
@@ -94,6 +115,31 @@ func TestDynamicHandler_Name(t *testing.T) {
 	}
 }
 
+func TestDynamicHandler_RouteIdleTimeout(t *testing.T) {
+	h, err := NewDynamicHandler(json.RawMessage(`{"routes": {
+		"lobby.com": {"backend": "b:443", "idle_timeout": 60},
+		"play.com": "p:443"
+	}}`))
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	lobby := &Context{Hello: &ClientHello{SNI: "lobby.com"}}
+	h.OnConnect(lobby)
+	if got := lobby.GetString("backend"); got != "b:443" {
+		t.Errorf("backend = %q, want b:443", got)
+	}
+	if got := lobby.IdleTimeout(); got != 60*time.Second {
+		t.Errorf("IdleTimeout = %v, want 60s", got)
+	}
+
+	play := &Context{Hello: &ClientHello{SNI: "play.com"}}
+	h.OnConnect(play)
+	if got := play.IdleTimeout(); got != 0 {
+		t.Errorf("IdleTimeout = %v, want no override", got)
+	}
+}
+
 func TestDynamicHandler_OnConnect(t *testing.T) {
 	tests := []struct {
 		name        string
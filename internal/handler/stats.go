@@ -0,0 +1,189 @@
+package handler
+
+import (
+	"fmt"
+	"log"
+	"runtime/debug"
+	"strconv"
+	"sync/atomic"
+	"time"
+)
+
+// LatencyBuckets are the upper bounds of the handler latency histograms.
+// CallStats.Latency has one more bucket for calls slower than the last bound.
+var LatencyBuckets = [...]time.Duration{
+	time.Microsecond,
+	5 * time.Microsecond,
+	10 * time.Microsecond,
+	50 * time.Microsecond,
+	100 * time.Microsecond,
+	500 * time.Microsecond,
+	time.Millisecond,
+	5 * time.Millisecond,
+	10 * time.Millisecond,
+	50 * time.Millisecond,
+}
+
+// packetSampleRate is how often OnPacket calls are timed: every packet
+// would double the cost of cheap handlers.
+const packetSampleRate = 64
+
+// HandlerStats holds the counters of one handler in a chain.
+type HandlerStats struct {
+	ID         string // Position in the chain, e.g. "2", or "2.0.1" for handler 1 of nested chain 0 of handler 2
+	Name       string
+	Panics     int64 // Recovered panics, in any method
+	Connect    CallStats
+	Packet     CallStats // Both directions; latency sampled (1 in 64 calls)
+	Disconnect CallStats
+}
+
+// CallStats holds the counters of one handler method.
+type CallStats struct {
+	Calls      int64
+	Drops      int64                          // Calls that returned Drop, including panics and Pending calls resumed with Drop
+	Latency    [len(LatencyBuckets) + 1]int64 // Timed calls per bucket, see LatencyBuckets
+	LatencySum time.Duration                  // Total time of the timed calls
+}
+
+// stage is a handler in a chain, with its counters. Calls through a stage
+// turn panics into Drop, so one broken handler can't take the proxy down.
+type stage struct {
+	h     Handler
+	stats *handlerCounters
+}
+
+type handlerCounters struct {
+	panics                      atomic.Int64
+	connect, packet, disconnect callCounters
+}
+
+type callCounters struct {
+	calls, drops atomic.Int64
+	latency      [len(LatencyBuckets) + 1]atomic.Int64
+	latencySum   atomic.Int64
+}
+
+func newStage(h Handler) *stage {
+	return &stage{h: h, stats: &handlerCounters{}}
+}
+
+func (c *callCounters) observe(d time.Duration) {
+	i := 0
+	for i < len(LatencyBuckets) && d > LatencyBuckets[i] {
+		i++
+	}
+	c.latency[i].Add(1)
+	c.latencySum.Add(int64(d))
+}
+
+func (c *callCounters) snapshot() CallStats {
+	s := CallStats{
+		Calls:      c.calls.Load(),
+		Drops:      c.drops.Load(),
+		LatencySum: time.Duration(c.latencySum.Load()),
+	}
+	for i := range c.latency {
+		s.Latency[i] = c.latency[i].Load()
+	}
+	return s
+}
+
+// recovered logs a panic of the handler (with the stack the first time) and
+// returns the Drop result that replaces the call's result.
+func (s *stage) recovered(method string, r any) Result {
+	if s.stats.panics.Add(1) == 1 {
+		log.Printf("[chain] %s panicked in %s: %v\n%s", s.h.Name(), method, r, debug.Stack())
+	} else {
+		log.Printf("[chain] %s panicked in %s: %v", s.h.Name(), method, r)
+	}
+	return Result{Action: Drop, Error: fmt.Errorf("%s panicked: %v", s.h.Name(), r)}
+}
+
+func (s *stage) connect(ctx *Context) (result Result) {
+	start := time.Now()
+	defer func() {
+		if r := recover(); r != nil {
+			result = s.recovered("OnConnect", r)
+		}
+		c := &s.stats.connect
+		c.calls.Add(1)
+		if result.Action == Drop {
+			c.drops.Add(1)
+		}
+		c.observe(time.Since(start))
+	}()
+	return s.h.OnConnect(ctx)
+}
+
+func (s *stage) packet(ctx *Context, packet []byte, dir Direction) (result Result) {
+	c := &s.stats.packet
+	var start time.Time
+	if c.calls.Add(1)%packetSampleRate == 0 {
+		start = time.Now()
+	}
+	defer func() {
+		if r := recover(); r != nil {
+			result = s.recovered("OnPacket", r)
+		}
+		if result.Action == Drop {
+			c.drops.Add(1)
+		}
+		if !start.IsZero() {
+			c.observe(time.Since(start))
+		}
+	}()
+	return s.h.OnPacket(ctx, packet, dir)
+}
+
+func (s *stage) disconnect(ctx *Context) {
+	start := time.Now()
+	defer func() {
+		if r := recover(); r != nil {
+			s.recovered("OnDisconnect", r)
+		}
+		s.stats.disconnect.calls.Add(1)
+		s.stats.disconnect.observe(time.Since(start))
+	}()
+	s.h.OnDisconnect(ctx)
+}
+
+func (s *stage) resume(r SessionResumer, ctx *Context) (err error) {
+	defer func() {
+		if p := recover(); p != nil {
+			err = s.recovered("ResumeSession", p).Error
+		}
+	}()
+	return r.ResumeSession(ctx)
+}
+
+// Stats returns the counters of all handlers in the chain, including those
+// in nested chains, depth-first in config order. Handlers that took over from
+// a handler of a previous config (see Reload) continue its counters.
+func (c *Chain) Stats() []HandlerStats {
+	var stats []HandlerStats
+	c.walkStages("", func(id string, s *stage) {
+		stats = append(stats, HandlerStats{
+			ID:         id,
+			Name:       s.h.Name(),
+			Panics:     s.stats.panics.Load(),
+			Connect:    s.stats.connect.snapshot(),
+			Packet:     s.stats.packet.snapshot(),
+			Disconnect: s.stats.disconnect.snapshot(),
+		})
+	})
+	return stats
+}
+
+// walkStages is walk with the stages and their IDs (see HandlerStats).
+func (c *Chain) walkStages(prefix string, fn func(id string, s *stage)) {
+	for i, s := range c.stages {
+		id := prefix + strconv.Itoa(i)
+		fn(id, s)
+		if n, ok := s.h.(nester); ok {
+			for j, nested := range n.nestedChains() {
+				nested.walkStages(id+"."+strconv.Itoa(j)+".", fn)
+			}
+		}
+	}
+}
@@ -0,0 +1,114 @@
+package handler
+
+import (
+	"strings"
+	"testing"
+)
+
+// panicHandler panics in the methods named in panics.
+type panicHandler struct {
+	*mockHandler
+	panics string
+}
+
+func (h *panicHandler) OnConnect(ctx *Context) Result {
+	if strings.Contains(h.panics, "connect") {
+		panic("connect bug")
+	}
+	return h.mockHandler.OnConnect(ctx)
+}
+
+func (h *panicHandler) OnPacket(ctx *Context, packet []byte, dir Direction) Result {
+	if strings.Contains(h.panics, "packet") {
+		var m map[string]int
+		m["x"]++ // nil map write
+	}
+	return h.mockHandler.OnPacket(ctx, packet, dir)
+}
+
+func (h *panicHandler) OnDisconnect(ctx *Context) {
+	if strings.Contains(h.panics, "disconnect") {
+		panic("disconnect bug")
+	}
+	h.mockHandler.OnDisconnect(ctx)
+}
+
+func TestChain_RecoversPanics(t *testing.T) {
+	bad := &panicHandler{mockHandler: newMockHandler("bad", Continue, Continue), panics: "connect packet disconnect"}
+	after := newMockHandler("after", Handled, Handled)
+	chain := NewChain(bad, after)
+	ctx := &Context{}
+
+	r := chain.OnConnect(ctx)
+	if r.Action != Drop || r.Error == nil || !strings.Contains(r.Error.Error(), "bad panicked: connect bug") {
+		t.Errorf("OnConnect: got %v (%v), want Drop with the panic", r.Action, r.Error)
+	}
+	if after.connectCalled {
+		t.Error("handler after the panic was called")
+	}
+	if r := chain.OnPacket(ctx, []byte{0x40}, Inbound); r.Action != Drop {
+		t.Errorf("OnPacket: got %v, want Drop", r.Action)
+	}
+	chain.OnDisconnect(ctx)
+	if !after.disconnectCalled {
+		t.Error("a panic in OnDisconnect skipped the next handler")
+	}
+
+	stats := chain.Stats()
+	if stats[0].Panics != 3 || stats[0].Connect.Drops != 1 || stats[0].Packet.Drops != 1 {
+		t.Errorf("bad: %+v", stats[0])
+	}
+	if stats[1].Panics != 0 || stats[1].Disconnect.Calls != 1 {
+		t.Errorf("after: %+v", stats[1])
+	}
+}
+
+func TestChain_Stats(t *testing.T) {
+	router := newMockHandler("router", Continue, Continue)
+	fwd := newMockHandler("forwarder", Handled, Handled)
+	match := &MatchHandler{branches: []*matchBranch{{handlers: NewChain(newMockHandler("nested", Continue, Continue))}}}
+	chain := NewChain(router, match, fwd)
+
+	ctx := &Context{}
+	chain.OnConnect(ctx)
+	for i := 0; i < 2*packetSampleRate; i++ {
+		chain.OnPacket(ctx, []byte{0x40}, Inbound)
+	}
+
+	stats := chain.Stats()
+	var ids []string
+	for _, s := range stats {
+		ids = append(ids, s.ID+"="+s.Name)
+	}
+	if got := strings.Join(ids, " "); got != "0=router 1=match 1.0.0=nested 2=forwarder" {
+		t.Fatalf("got %s", got)
+	}
+
+	s := stats[0]
+	if s.Connect.Calls != 1 || s.Packet.Calls != 2*packetSampleRate {
+		t.Errorf("calls: connect %d, packet %d", s.Connect.Calls, s.Packet.Calls)
+	}
+	var timed int64
+	for _, n := range s.Packet.Latency {
+		timed += n
+	}
+	if timed != 2 {
+		t.Errorf("timed %d packets, want 2 (1 in %d)", timed, packetSampleRate)
+	}
+	timed = 0
+	for _, n := range s.Connect.Latency {
+		timed += n
+	}
+	if timed != 1 {
+		t.Errorf("timed %d connects, want 1", timed)
+	}
+
+	// A reloaded chain continues the counters
+	next := NewChain(newMockHandler("router", Continue, Continue), newMockHandler("forwarder", Handled, Handled))
+	next.Reload(chain)
+	next.OnConnect(&Context{})
+	stats = next.Stats()
+	if stats[0].Connect.Calls != 2 || stats[1].Connect.Calls != 2 {
+		t.Errorf("counters not continued: %+v", stats)
+	}
+}
@@ -2,15 +2,22 @@ package handler
 
 import (
 	"context"
+	"crypto/tls"
 	"encoding/json"
 	"errors"
+	"fmt"
 	"log"
+	"os"
+	"reflect"
+	"slices"
+	"strings"
+	"sync/atomic"
 
 	terminator "quic-terminator"
 )
 
 func init() {
-	Register("terminator", NewTerminatorHandler)
+	RegisterConfig("terminator", NewTerminatorHandler, TerminatorHandlerConfig{})
 }
 
 // TerminatorCertConfig holds TLS config for a certificate.
@@ -39,14 +46,31 @@ type TerminatorHandlerConfig struct {
 }
 
 // TerminatorHandler wraps the terminator library as a HyProxy handler.
+// The terminator starts in Start; a reload keeps it running if neither the
+// config nor the certificate files changed.
 type TerminatorHandler struct {
-	term *terminator.Terminator
+	cfg            terminator.Config
+	certs          string // Certificate file stamps, see certStamp
+	inst           *terminatorInstance
+	packetHandlers []terminator.PacketHandler // Added before Start
+}
+
+// terminatorDCIDKey holds the DCID the backend is registered under, for
+// OnDisconnect.
+var terminatorDCIDKey = NewKey[string]("terminator_dcid")
+
+// terminatorInstance is a running terminator, shared by the handlers that
+// kept it across reloads. The last one to shut down closes it.
+type terminatorInstance struct {
+	term  *terminator.Terminator
+	certs string
+	refs  atomic.Int32
 }
 
 // NewTerminatorHandler creates a new terminator handler.
 func NewTerminatorHandler(raw json.RawMessage) (Handler, error) {
 	var cfg TerminatorHandlerConfig
-	if err := json.Unmarshal(raw, &cfg); err != nil {
+	if err := decodeConfig(raw, &cfg); err != nil {
 		return nil, err
 	}
 
@@ -79,12 +103,71 @@ func NewTerminatorHandler(raw json.RawMessage) (Handler, error) {
 		}
 	}
 
-	term, err := terminator.New(termCfg)
-	if err != nil {
-		return nil, err
+	// Fail on broken certificates now, not when the chain starts
+	for _, t := range certTargets(termCfg) {
+		if _, err := tls.LoadX509KeyPair(t.CertFile, t.KeyFile); err != nil {
+			return nil, fmt.Errorf("terminator: %w", err)
+		}
+	}
+
+	return &TerminatorHandler{cfg: termCfg, certs: certStamp(termCfg)}, nil
+}
+
+// certTargets returns the default and per-target certificate configs.
+func certTargets(cfg terminator.Config) []*terminator.TargetConfig {
+	var targets []*terminator.TargetConfig
+	if cfg.Default != nil {
+		targets = append(targets, cfg.Default)
+	}
+	for _, t := range cfg.Targets {
+		targets = append(targets, t)
+	}
+	return targets
+}
+
+// certStamp identifies the current contents of the certificate files by
+// their size and modification time, so a reload notices renewed certificates.
+func certStamp(cfg terminator.Config) string {
+	var stamps []string
+	for _, t := range certTargets(cfg) {
+		for _, name := range []string{t.CertFile, t.KeyFile} {
+			if fi, err := os.Stat(name); err == nil {
+				stamps = append(stamps, fmt.Sprintf("%s:%d:%d", name, fi.Size(), fi.ModTime().UnixNano()))
+			}
+		}
 	}
+	slices.Sort(stamps)
+	return strings.Join(stamps, ",")
+}
 
-	return &TerminatorHandler{term: term}, nil
+// Reload keeps the old handler's terminator, and the sessions it bridges,
+// if the config and certificates are unchanged.
+func (h *TerminatorHandler) Reload(old Handler) {
+	o, ok := old.(*TerminatorHandler)
+	if !ok || o.inst == nil || !reflect.DeepEqual(h.cfg, o.cfg) || h.certs != o.inst.certs {
+		return
+	}
+	o.inst.refs.Add(1)
+	h.inst = o.inst
+}
+
+// Start starts the terminator, unless Reload kept the old one.
+func (h *TerminatorHandler) Start(ctx context.Context) error {
+	if h.inst == nil {
+		term, err := terminator.New(h.cfg)
+		if err != nil {
+			return err
+		}
+		h.inst = &terminatorInstance{term: term, certs: h.certs}
+		h.inst.refs.Store(1)
+	} else {
+		log.Printf("[terminator] config unchanged, keeping terminator on %s", h.inst.term.InternalAddr)
+	}
+	for _, ph := range h.packetHandlers {
+		h.inst.term.AddPacketHandler(ph)
+	}
+	h.packetHandlers = nil
+	return nil
 }
 
 // Name returns the handler name.
@@ -94,7 +177,7 @@ func (h *TerminatorHandler) Name() string {
 
 // OnConnect stores backend mapping by DCID and redirects to internal listener.
 func (h *TerminatorHandler) OnConnect(ctx *Context) Result {
-	backend := ctx.GetString("backend")
+	backend := Backend.Value(ctx)
 	if backend == "" {
 		return Result{Action: Drop, Error: errors.New("no backend")}
 	}
@@ -106,10 +189,10 @@ func (h *TerminatorHandler) OnConnect(ctx *Context) Result {
 	}
 
 	// Store DCID in context for cleanup in OnDisconnect
-	ctx.Set("terminator_dcid", dcid)
+	terminatorDCIDKey.Set(ctx, dcid)
 
 	// Register backend for this DCID
-	h.term.RegisterBackend(dcid, backend)
+	h.inst.term.RegisterBackend(dcid, backend)
 
 	sni := ""
 	if ctx.Hello != nil {
@@ -119,10 +202,10 @@ func (h *TerminatorHandler) OnConnect(ctx *Context) Result {
 	if len(dcid) > 8 {
 		dcidShort = dcid[:8]
 	}
-	log.Printf("[terminator] %s (dcid=%s) → %s (via %s)", sni, dcidShort, backend, h.term.InternalAddr)
+	log.Printf("[terminator] %s (dcid=%s) → %s (via %s)", sni, dcidShort, backend, h.inst.term.InternalAddr)
 
 	// Redirect to internal listener
-	ctx.Set("backend", h.term.InternalAddr)
+	Backend.Set(ctx, h.inst.term.InternalAddr)
 	return Result{Action: Continue}
 }
 
@@ -134,19 +217,38 @@ func (h *TerminatorHandler) OnPacket(ctx *Context, packet []byte, dir Direction)
 // OnDisconnect cleans up backend mapping if connection didn't reach terminator.
 func (h *TerminatorHandler) OnDisconnect(ctx *Context) {
 	// Clean up using DCID stored in context (InitialPacket may be nil at this point)
-	dcid := ctx.GetString("terminator_dcid")
-	if dcid != "" {
-		h.term.UnregisterBackend(dcid)
+	dcid := terminatorDCIDKey.Value(ctx)
+	if dcid != "" && h.inst != nil {
+		h.inst.term.UnregisterBackend(dcid)
 	}
 }
 
-// Shutdown gracefully shuts down the terminator.
+// RequiresKeys reports that the terminator needs the real backend.
+func (h *TerminatorHandler) RequiresKeys() []AnyKey {
+	return []AnyKey{Backend}
+}
+
+// ProvidesKeys reports that the terminator replaces the backend with its
+// internal listener.
+func (h *TerminatorHandler) ProvidesKeys() []AnyKey {
+	return []AnyKey{Backend}
+}
+
+// Shutdown closes the terminator once no handler from a later reload uses it.
 func (h *TerminatorHandler) Shutdown(ctx context.Context) error {
-	return h.term.Close()
+	if h.inst == nil || h.inst.refs.Add(-1) > 0 {
+		return nil
+	}
+	return h.inst.term.Close()
 }
 
 // AddPacketHandler registers a handler for decrypted Hytale protocol packets.
-// Handlers are executed in the order they are added.
+// Handlers are executed in the order they are added. Handlers added before
+// Start are registered when the terminator starts.
 func (h *TerminatorHandler) AddPacketHandler(handler terminator.PacketHandler) {
-	h.term.AddPacketHandler(handler)
+	if h.inst == nil {
+		h.packetHandlers = append(h.packetHandlers, handler)
+		return
+	}
+	h.inst.term.AddPacketHandler(handler)
 }
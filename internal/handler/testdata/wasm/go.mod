@@ -0,0 +1,3 @@
+module wasmtest
+
+go 1.25.0
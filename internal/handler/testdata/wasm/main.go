@@ -0,0 +1,83 @@
+// Command wasmtest is the wasm handler's test module. It behaves according
+// to the connection's SNI and context values.
+package main
+
+import (
+	"strconv"
+	"unsafe"
+)
+
+//go:wasmexport quic_relay_abi_version
+func abiVersion() int32 { return 1 }
+
+//go:wasmexport on_connect
+func onConnect() int32 {
+	switch sni, _ := get(":sni"); sni {
+	case "loop":
+		for {
+		}
+	case "alloc":
+		hog = make([]byte, 128<<20)
+		hog[len(hog)-1] = 1
+	}
+	alpn, _ := get(":alpn")
+	set("seen_alpn", alpn)
+	if weight, ok := get("weight"); ok {
+		set("weight_text", weight)
+	}
+	action, _ := get("action")
+	n, _ := strconv.Atoi(action)
+	return int32(n)
+}
+
+var hog []byte
+
+//go:wasmexport on_packet
+func onPacket(dir, size int32) int32 {
+	buf := make([]byte, size)
+	packet(buf)
+	set("last_packet", strconv.Itoa(int(dir))+":"+strconv.Itoa(int(size))+":"+strconv.Itoa(int(buf[0])))
+	if buf[0] == 0xff {
+		return 2
+	}
+	return 0
+}
+
+//go:wasmexport on_disconnect
+func onDisconnect() {
+	set("disconnected", "yes")
+}
+
+//go:wasmimport quic_relay get
+func hostGet(keyPtr unsafe.Pointer, keyLen uint32, bufPtr unsafe.Pointer, bufLen uint32) int32
+
+//go:wasmimport quic_relay set
+func hostSet(keyPtr unsafe.Pointer, keyLen uint32, valPtr unsafe.Pointer, valLen uint32)
+
+//go:wasmimport quic_relay packet
+func hostPacket(bufPtr unsafe.Pointer, bufLen uint32) int32
+
+func get(key string) (string, bool) {
+	// Small buffer, so values are fetched again in full
+	buf := make([]byte, 4)
+	for {
+		n := hostGet(unsafe.Pointer(unsafe.StringData(key)), uint32(len(key)), unsafe.Pointer(&buf[0]), uint32(len(buf)))
+		if n < 0 {
+			return "", false
+		}
+		if int(n) <= len(buf) {
+			return string(buf[:n]), true
+		}
+		buf = make([]byte, n)
+	}
+}
+
+func set(key, value string) {
+	hostSet(unsafe.Pointer(unsafe.StringData(key)), uint32(len(key)), unsafe.Pointer(unsafe.StringData(value)), uint32(len(value)))
+}
+
+func packet(buf []byte) {
+	hostPacket(unsafe.Pointer(&buf[0]), uint32(len(buf)))
+}
+
+func main() {}
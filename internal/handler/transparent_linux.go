@@ -0,0 +1,70 @@
+//go:build linux
+
+package handler
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"syscall"
+
+	"golang.org/x/sys/unix"
+)
+
+// checkTransparent verifies that sockets can be bound with IP_TRANSPARENT.
+// Fails with a readable error when CAP_NET_ADMIN is missing.
+func checkTransparent() error {
+	fd, err := unix.Socket(unix.AF_INET, unix.SOCK_DGRAM, 0)
+	if err != nil {
+		return err
+	}
+	defer unix.Close(fd)
+
+	return transparentError(unix.SetsockoptInt(fd, unix.SOL_IP, unix.IP_TRANSPARENT, 1))
+}
+
+// transparentError turns the result of setting IP_TRANSPARENT into a readable error.
+func transparentError(err error) error {
+	if errors.Is(err, unix.EPERM) {
+		return errors.New("transparent mode requires CAP_NET_ADMIN (run as root, or grant it with 'setcap cap_net_admin+ep' or systemd 'AmbientCapabilities=CAP_NET_ADMIN')")
+	}
+	if err != nil {
+		return fmt.Errorf("IP_TRANSPARENT not supported: %w", err)
+	}
+	return nil
+}
+
+// dialTransparent connects to remote from a socket bound to local, which need
+// not be an address of this host (Linux TPROXY). Replies only arrive if routing
+// sends them back to this host.
+func dialTransparent(local, remote *net.UDPAddr) (*net.UDPConn, error) {
+	d := net.Dialer{
+		LocalAddr: local,
+		Control:   transparentControl,
+	}
+	c, err := d.Dial("udp", remote.String())
+	if err != nil {
+		return nil, err
+	}
+	return c.(*net.UDPConn), nil
+}
+
+// transparentControl sets IP_TRANSPARENT/IPV6_TRANSPARENT before bind.
+// SO_REUSEADDR allows binding the client's port, which may also be in use locally.
+func transparentControl(network, _ string, c syscall.RawConn) error {
+	var serr error
+	err := c.Control(func(fd uintptr) {
+		if serr = unix.SetsockoptInt(int(fd), unix.SOL_SOCKET, unix.SO_REUSEADDR, 1); serr != nil {
+			return
+		}
+		if network == "udp6" {
+			serr = unix.SetsockoptInt(int(fd), unix.SOL_IPV6, unix.IPV6_TRANSPARENT, 1)
+		} else {
+			serr = unix.SetsockoptInt(int(fd), unix.SOL_IP, unix.IP_TRANSPARENT, 1)
+		}
+	})
+	if err != nil {
+		return err
+	}
+	return serr
+}
@@ -0,0 +1,70 @@
+//go:build linux
+
+package handler
+
+import (
+	"encoding/json"
+	"errors"
+	"runtime"
+	"strings"
+	"testing"
+
+	"golang.org/x/sys/unix"
+)
+
+// withoutNetAdmin runs fn on an OS thread that has dropped CAP_NET_ADMIN and
+// CAP_NET_RAW, either of which allows IP_TRANSPARENT. Capabilities are per
+// thread; the thread exits with the goroutine.
+func withoutNetAdmin(t *testing.T, fn func()) {
+	t.Helper()
+	errCh := make(chan error, 1)
+	go func() {
+		runtime.LockOSThread() // Never unlocked: the thread is discarded
+
+		hdr := unix.CapUserHeader{Version: unix.LINUX_CAPABILITY_VERSION_3}
+		var data [2]unix.CapUserData
+		if err := unix.Capget(&hdr, &data[0]); err != nil {
+			errCh <- err
+			return
+		}
+		for _, c := range []int{unix.CAP_NET_ADMIN, unix.CAP_NET_RAW} {
+			data[c/32].Effective &^= 1 << (c % 32)
+		}
+		if err := unix.Capset(&hdr, &data[0]); err != nil {
+			errCh <- err
+			return
+		}
+		fn()
+		errCh <- nil
+	}()
+	if err := <-errCh; err != nil {
+		t.Fatalf("failed to drop capabilities: %v", err)
+	}
+}
+
+func TestTransparentError(t *testing.T) {
+	if err := transparentError(nil); err != nil {
+		t.Errorf("nil: got %v", err)
+	}
+	if err := transparentError(unix.EPERM); err == nil || !strings.Contains(err.Error(), "CAP_NET_ADMIN") {
+		t.Errorf("EPERM: got %v, want CAP_NET_ADMIN hint", err)
+	}
+	if err := transparentError(unix.ENOPROTOOPT); !errors.Is(err, unix.ENOPROTOOPT) || !strings.Contains(err.Error(), "not supported") {
+		t.Errorf("ENOPROTOOPT: got %v", err)
+	}
+}
+
+func TestForwarder_TransparentWithoutCapability(t *testing.T) {
+	var checkErr, cfgErr error
+	withoutNetAdmin(t, func() {
+		checkErr = checkTransparent()
+		_, cfgErr = NewForwarderHandler(json.RawMessage(`{"transparent": true}`))
+	})
+
+	if checkErr == nil || !strings.Contains(checkErr.Error(), "CAP_NET_ADMIN") {
+		t.Errorf("checkTransparent: got %v, want CAP_NET_ADMIN error", checkErr)
+	}
+	if cfgErr == nil || !strings.Contains(cfgErr.Error(), "forwarder: transparent mode requires CAP_NET_ADMIN") {
+		t.Errorf("NewForwarderHandler: got %v, want CAP_NET_ADMIN error", cfgErr)
+	}
+}
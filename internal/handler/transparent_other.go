@@ -0,0 +1,18 @@
+//go:build !linux
+
+package handler
+
+import (
+	"errors"
+	"net"
+)
+
+var errTransparentUnsupported = errors.New("transparent mode is only supported on Linux")
+
+func checkTransparent() error {
+	return errTransparentUnsupported
+}
+
+func dialTransparent(local, remote *net.UDPAddr) (*net.UDPConn, error) {
+	return nil, errTransparentUnsupported
+}
@@ -0,0 +1,22 @@
+//go:build !linux
+
+package handler
+
+import (
+	"encoding/json"
+	"errors"
+	"net"
+	"testing"
+)
+
+func TestTransparentUnsupported(t *testing.T) {
+	if err := checkTransparent(); !errors.Is(err, errTransparentUnsupported) {
+		t.Errorf("checkTransparent: got %v, want %v", err, errTransparentUnsupported)
+	}
+	if _, err := dialTransparent(&net.UDPAddr{}, &net.UDPAddr{}); !errors.Is(err, errTransparentUnsupported) {
+		t.Errorf("dialTransparent: got %v, want %v", err, errTransparentUnsupported)
+	}
+	if _, err := NewForwarderHandler(json.RawMessage(`{"transparent": true}`)); !errors.Is(err, errTransparentUnsupported) {
+		t.Errorf("NewForwarderHandler: got %v, want %v", err, errTransparentUnsupported)
+	}
+}
@@ -0,0 +1,396 @@
+package handler
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"runtime"
+	"strings"
+	"time"
+
+	"github.com/tetratelabs/wazero"
+	"github.com/tetratelabs/wazero/api"
+	"github.com/tetratelabs/wazero/imports/wasi_snapshot_preview1"
+)
+
+func init() {
+	RegisterConfig("wasm", NewWasmHandler, WasmConfig{})
+}
+
+// WasmABIVersion is the version of the host interface modules are built
+// against. Modules export quic_relay_abi_version returning it; changes that
+// break existing modules get a new version.
+//
+// ABI version 1. Host functions, imported from module "quic_relay" (i32
+// pointers and lengths into the module's exported memory):
+//
+//	get(key_ptr, key_len, buf_ptr, buf_len i32) i32
+//	    Copies the value of key into buf, as much as fits. Returns the full
+//	    length of the value, or -1 if it isn't set. Keys are context values
+//	    (strings, numbers and booleans as text) or connection fields:
+//	    ":sni", ":alpn" (comma-separated), ":ja4", ":client_ip".
+//	set(key_ptr, key_len, val_ptr, val_len i32)
+//	    Stores a string context value, e.g. "backend".
+//	packet(buf_ptr, buf_len i32) i32
+//	    Copies the current packet into buf, as much as fits. Returns its
+//	    full length (0 outside on_packet).
+//	log(msg_ptr, msg_len i32)
+//	    Writes msg to the proxy log.
+//
+// Module exports:
+//
+//	memory
+//	quic_relay_abi_version() i32
+//	on_connect() i32             (optional)
+//	on_packet(dir, len i32) i32  (optional, dir 0 = inbound, 1 = outbound)
+//	on_disconnect()              (optional)
+//
+// on_connect and on_packet return 0 to continue, 1 if handled, 2 to drop.
+// WASI is available without files, environment or network, so modules built
+// for wasip1 work; reactor modules are initialized with _initialize.
+const WasmABIVersion = 1
+
+// WasmConfig is the configuration for the wasm handler.
+type WasmConfig struct {
+	File        string `json:"file"`                    // Path to the .wasm module
+	MaxMemoryMB int    `json:"max_memory_mb,omitempty"` // Memory limit per instance (default: 64)
+	TimeoutMs   int    `json:"timeout_ms,omitempty"`    // Max run time per call in milliseconds (default: 10)
+}
+
+const (
+	defaultWasmMemoryMB = 64
+	defaultWasmTimeout  = 10 * time.Millisecond
+	wasmInitTimeout     = time.Second // Instantiation includes the module's runtime setup
+	wasmPageSize        = 64 << 10
+)
+
+// wasmExports are the functions a module can export, with their signatures.
+var wasmExports = map[string]struct{ params, results []api.ValueType }{
+	"quic_relay_abi_version": {nil, []api.ValueType{api.ValueTypeI32}},
+	"on_connect":             {nil, []api.ValueType{api.ValueTypeI32}},
+	"on_packet":              {[]api.ValueType{api.ValueTypeI32, api.ValueTypeI32}, []api.ValueType{api.ValueTypeI32}},
+	"on_disconnect":          {nil, nil},
+}
+
+// WasmHandler runs a WebAssembly module implementing the handler ABI (see
+// WasmABIVersion). Each handler has its own runtime with the configured
+// memory limit; calls are stopped after the timeout.
+//
+// Module instances aren't safe for concurrent use, so each call borrows one
+// from a pool of at most GOMAXPROCS instances, which also bounds the memory
+// the module can use in total. Modules must not rely on state kept between calls.
+type WasmHandler struct {
+	name      string // Module file name for logs and errors
+	timeout   time.Duration
+	runtime   wazero.Runtime
+	module    wazero.CompiledModule
+	exports   map[string]bool
+	instances chan api.Module // Idle instances; nil entries are free slots
+}
+
+// wasmCall is the connection a module call is for, passed to host functions
+// through the call's context.
+type wasmCall struct {
+	ctx    *Context
+	packet []byte
+}
+
+type wasmCallKey struct{}
+
+// NewWasmHandler creates a new wasm handler. The module is compiled and
+// instantiated once, so invalid modules fail the config.
+func NewWasmHandler(raw json.RawMessage) (Handler, error) {
+	var cfg WasmConfig
+	if len(raw) > 0 {
+		if err := decodeConfig(raw, &cfg); err != nil {
+			return nil, fmt.Errorf("invalid wasm config: %w", err)
+		}
+	}
+	if cfg.File == "" {
+		return nil, fmt.Errorf("wasm requires 'file'")
+	}
+	if cfg.MaxMemoryMB < 0 || cfg.TimeoutMs < 0 {
+		return nil, fmt.Errorf("wasm: max_memory_mb and timeout_ms must not be negative")
+	}
+	bin, err := os.ReadFile(cfg.File)
+	if err != nil {
+		return nil, fmt.Errorf("wasm: %w", err)
+	}
+
+	h := &WasmHandler{
+		name:      filepath.Base(cfg.File),
+		timeout:   defaultWasmTimeout,
+		exports:   make(map[string]bool),
+		instances: make(chan api.Module, runtime.GOMAXPROCS(0)),
+	}
+	if cfg.TimeoutMs > 0 {
+		h.timeout = time.Duration(cfg.TimeoutMs) * time.Millisecond
+	}
+	memoryMB := defaultWasmMemoryMB
+	if cfg.MaxMemoryMB > 0 {
+		memoryMB = cfg.MaxMemoryMB
+	}
+
+	ctx := context.Background()
+	h.runtime = wazero.NewRuntimeWithConfig(ctx, wazero.NewRuntimeConfig().
+		WithMemoryLimitPages(uint32(memoryMB<<20/wasmPageSize)).
+		WithCloseOnContextDone(true))
+	if err := h.setup(ctx, bin); err != nil {
+		h.runtime.Close(ctx)
+		return nil, fmt.Errorf("wasm: %s: %w", h.name, err)
+	}
+	return h, nil
+}
+
+// setup registers the host functions, compiles the module, checks its
+// exports and creates the first instance.
+func (h *WasmHandler) setup(ctx context.Context, bin []byte) error {
+	if _, err := wasi_snapshot_preview1.Instantiate(ctx, h.runtime); err != nil {
+		return err
+	}
+	_, err := h.runtime.NewHostModuleBuilder("quic_relay").
+		NewFunctionBuilder().WithFunc(wasmGet).Export("get").
+		NewFunctionBuilder().WithFunc(wasmSet).Export("set").
+		NewFunctionBuilder().WithFunc(wasmPacket).Export("packet").
+		NewFunctionBuilder().WithFunc(h.wasmLog).Export("log").
+		Instantiate(ctx)
+	if err != nil {
+		return err
+	}
+
+	if h.module, err = h.runtime.CompileModule(ctx, bin); err != nil {
+		return err
+	}
+	for name, def := range h.module.ExportedFunctions() {
+		want, ok := wasmExports[name]
+		if !ok {
+			continue
+		}
+		if !equalTypes(def.ParamTypes(), want.params) || !equalTypes(def.ResultTypes(), want.results) {
+			return fmt.Errorf("export %s has the wrong signature", name)
+		}
+		h.exports[name] = true
+	}
+	if !h.exports["quic_relay_abi_version"] {
+		return fmt.Errorf("missing export quic_relay_abi_version")
+	}
+	if !h.exports["on_connect"] && !h.exports["on_packet"] {
+		return fmt.Errorf("exports neither on_connect nor on_packet")
+	}
+
+	m, err := h.instantiate()
+	if err != nil {
+		return err
+	}
+	version, err := h.invoke(m, nil, "quic_relay_abi_version")
+	if err != nil {
+		return err
+	}
+	if version != WasmABIVersion {
+		m.Close(ctx)
+		return fmt.Errorf("built for ABI version %d, want %d", version, WasmABIVersion)
+	}
+	h.instances <- m
+	for len(h.instances) < cap(h.instances) {
+		h.instances <- nil
+	}
+	return nil
+}
+
+func equalTypes(a, b []api.ValueType) bool {
+	return string(a) == string(b)
+}
+
+// instantiate creates a module instance with its own memory. WASI reactor
+// modules (e.g. Go's -buildmode=c-shared) are initialized with _initialize.
+func (h *WasmHandler) instantiate() (api.Module, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), max(h.timeout, wasmInitTimeout))
+	defer cancel()
+	return h.runtime.InstantiateModule(ctx, h.module, wazero.NewModuleConfig().
+		WithName("").
+		WithStartFunctions("_initialize"))
+}
+
+// invoke calls an exported function of m under the handler's time limit. A
+// module that failed is closed, as it may be left in any state.
+func (h *WasmHandler) invoke(m api.Module, call *wasmCall, fn string, params ...uint64) (uint32, error) {
+	ctx, cancel := context.WithTimeout(context.WithValue(context.Background(), wasmCallKey{}, call), h.timeout)
+	defer cancel()
+	results, err := m.ExportedFunction(fn).Call(ctx, params...)
+	if err != nil {
+		m.Close(context.Background())
+		return 0, err
+	}
+	if len(results) == 0 {
+		return 0, nil
+	}
+	return api.DecodeU32(results[0]), nil
+}
+
+// call runs an exported handler function on a pooled instance. It waits up
+// to the timeout for an instance if all are busy. Instances that failed are
+// closed and their slot is freed; the next call creates a new one.
+func (h *WasmHandler) call(call *wasmCall, fn string, params ...uint64) (uint32, error) {
+	var m api.Module
+	timer := time.NewTimer(h.timeout)
+	select {
+	case m = <-h.instances:
+		timer.Stop()
+	case <-timer.C:
+		return 0, errors.New("all module instances busy")
+	}
+	if m == nil {
+		var err error
+		if m, err = h.instantiate(); err != nil {
+			h.instances <- nil
+			return 0, err
+		}
+	}
+	result, err := h.invoke(m, call, fn, params...)
+	if err != nil {
+		h.instances <- nil
+		return 0, err
+	}
+	h.instances <- m
+	return result, nil
+}
+
+// result converts a return value of on_connect or on_packet into a Result.
+func (h *WasmHandler) result(fn string, action uint32, err error) Result {
+	if err != nil {
+		return Result{Action: Drop, Error: fmt.Errorf("wasm %s: %s: %w", h.name, fn, err)}
+	}
+	switch Action(action) {
+	case Continue:
+		return Result{Action: Continue}
+	case Handled:
+		return Result{Action: Handled}
+	case Drop:
+		return Result{Action: Drop, Error: fmt.Errorf("wasm %s: %s dropped", h.name, fn)}
+	default:
+		return Result{Action: Drop, Error: fmt.Errorf("wasm %s: %s returned unknown action %d", h.name, fn, action)}
+	}
+}
+
+// Name returns the handler name.
+func (h *WasmHandler) Name() string {
+	return "wasm"
+}
+
+// OnConnect calls the module's on_connect.
+func (h *WasmHandler) OnConnect(ctx *Context) Result {
+	if !h.exports["on_connect"] {
+		return Result{Action: Continue}
+	}
+	action, err := h.call(&wasmCall{ctx: ctx}, "on_connect")
+	return h.result("on_connect", action, err)
+}
+
+// OnPacket calls the module's on_packet.
+func (h *WasmHandler) OnPacket(ctx *Context, packet []byte, dir Direction) Result {
+	if !h.exports["on_packet"] {
+		return Result{Action: Continue}
+	}
+	action, err := h.call(&wasmCall{ctx: ctx, packet: packet}, "on_packet", uint64(dir), uint64(len(packet)))
+	return h.result("on_packet", action, err)
+}
+
+// OnDisconnect calls the module's on_disconnect.
+func (h *WasmHandler) OnDisconnect(ctx *Context) {
+	if !h.exports["on_disconnect"] {
+		return
+	}
+	if _, err := h.call(&wasmCall{ctx: ctx}, "on_disconnect"); err != nil {
+		log.Printf("[wasm] %s: on_disconnect: %v", h.name, err)
+	}
+}
+
+// ProvidesKeys reports that the module may set the backend.
+func (h *WasmHandler) ProvidesKeys() []AnyKey {
+	return []AnyKey{Backend}
+}
+
+// WantsOutbound reports whether the module exports on_packet.
+func (h *WasmHandler) WantsOutbound() bool {
+	return h.exports["on_packet"]
+}
+
+// Shutdown closes the runtime and all module instances.
+func (h *WasmHandler) Shutdown(ctx context.Context) error {
+	return h.runtime.Close(ctx)
+}
+
+// get returns a connection field or context value as text.
+func (c *wasmCall) get(key string) (string, bool) {
+	ctx, hello := c.ctx, c.ctx.Hello
+	switch {
+	case key == ":sni" && hello != nil:
+		return hello.SNI, true
+	case key == ":alpn" && hello != nil:
+		return strings.Join(hello.ALPNProtocols, ","), true
+	case key == ":ja4" && hello != nil:
+		return hello.JA4, true
+	case key == ":client_ip" && ctx.ClientAddr != nil:
+		return ctx.ClientAddr.IP.String(), true
+	case strings.HasPrefix(key, ":"), strings.HasPrefix(key, "_"):
+		return "", false
+	}
+	v, ok := ctx.Get(key)
+	if !ok {
+		return "", false
+	}
+	switch v := v.(type) {
+	case string:
+		return v, true
+	case int, int64, float64, bool:
+		return fmt.Sprint(v), true
+	}
+	return "", false
+}
+
+func wasmGet(ctx context.Context, m api.Module, keyPtr, keyLen, bufPtr, bufLen uint32) int32 {
+	call, _ := ctx.Value(wasmCallKey{}).(*wasmCall)
+	key, ok := m.Memory().Read(keyPtr, keyLen)
+	if call == nil || !ok {
+		return -1
+	}
+	value, ok := call.get(string(key))
+	if !ok {
+		return -1
+	}
+	if n := min(len(value), int(bufLen)); n > 0 && !m.Memory().WriteString(bufPtr, value[:n]) {
+		return -1
+	}
+	return int32(len(value))
+}
+
+func wasmSet(ctx context.Context, m api.Module, keyPtr, keyLen, valPtr, valLen uint32) {
+	call, _ := ctx.Value(wasmCallKey{}).(*wasmCall)
+	key, ok := m.Memory().Read(keyPtr, keyLen)
+	value, ok2 := m.Memory().Read(valPtr, valLen)
+	if call == nil || !ok || !ok2 || strings.HasPrefix(string(key), "_") || strings.HasPrefix(string(key), ":") {
+		return
+	}
+	call.ctx.Set(string(key), string(value))
+}
+
+func wasmPacket(ctx context.Context, m api.Module, bufPtr, bufLen uint32) int32 {
+	call, _ := ctx.Value(wasmCallKey{}).(*wasmCall)
+	if call == nil {
+		return 0
+	}
+	if n := min(len(call.packet), int(bufLen)); n > 0 && !m.Memory().Write(bufPtr, call.packet[:n]) {
+		return 0
+	}
+	return int32(len(call.packet))
+}
+
+func (h *WasmHandler) wasmLog(ctx context.Context, m api.Module, msgPtr, msgLen uint32) {
+	if msg, ok := m.Memory().Read(msgPtr, msgLen); ok {
+		log.Printf("[wasm] %s: %s", h.name, msg)
+	}
+}
@@ -0,0 +1,168 @@
+package handler
+
+import (
+	"context"
+	"encoding/json"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"runtime"
+	"sync"
+	"testing"
+
+	"github.com/tetratelabs/wazero/api"
+)
+
+// buildWasm builds the Go module in dir as a WASI reactor.
+func buildWasm(t *testing.T, dir string) string {
+	t.Helper()
+	if testing.Short() {
+		t.Skip("skipping wasm module build in short mode")
+	}
+	goBin, err := exec.LookPath("go")
+	if err != nil {
+		t.Skip("go toolchain not found")
+	}
+	out := filepath.Join(t.TempDir(), "module.wasm")
+	cmd := exec.Command(goBin, "build", "-buildmode=c-shared", "-o", out, ".")
+	cmd.Dir = dir
+	cmd.Env = append(os.Environ(), "GOOS=wasip1", "GOARCH=wasm", "GOFLAGS=")
+	if output, err := cmd.CombinedOutput(); err != nil {
+		t.Fatalf("building %s: %v\n%s", dir, err, output)
+	}
+	return out
+}
+
+func newWasmHandler(t *testing.T, cfg WasmConfig) Handler {
+	t.Helper()
+	raw, _ := json.Marshal(cfg)
+	h, err := NewWasmHandler(raw)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { h.(Shutdowner).Shutdown(context.Background()) })
+	return h
+}
+
+func TestWasm_RequiresConfig(t *testing.T) {
+	notWasm := filepath.Join(t.TempDir(), "not.wasm")
+	os.WriteFile(notWasm, []byte("not wasm"), 0o644)
+	for _, raw := range []string{
+		``,
+		`{"file": "/nonexistent.wasm"}`,
+		`{"file": "` + notWasm + `"}`,
+		`{"file": "` + notWasm + `", "timeout_ms": -1}`,
+	} {
+		if _, err := NewWasmHandler(json.RawMessage(raw)); err == nil {
+			t.Errorf("expected error for config %q", raw)
+		}
+	}
+}
+
+func TestWasm(t *testing.T) {
+	module := buildWasm(t, "testdata/wasm")
+	h := newWasmHandler(t, WasmConfig{File: module, MaxMemoryMB: 64, TimeoutMs: 100})
+
+	t.Run("connect", func(t *testing.T) {
+		ctx := newMatchContext("play.example.com", []string{"hytale/1", "h3"}, "127.0.0.1")
+		ctx.Set("weight", int64(12345))
+		ctx.Set("action", "1")
+		if r := h.OnConnect(ctx); r.Action != Handled {
+			t.Fatalf("got action %v (%v), want Handled", r.Action, r.Error)
+		}
+		if got := ctx.GetString("seen_alpn"); got != "hytale/1,h3" {
+			t.Errorf("seen_alpn = %q", got)
+		}
+		if got := ctx.GetString("weight_text"); got != "12345" {
+			t.Errorf("weight_text = %q", got)
+		}
+
+		ctx.Set("action", "2")
+		if r := h.OnConnect(ctx); r.Action != Drop || r.Error == nil {
+			t.Errorf("got action %v, want Drop with error", r.Action)
+		}
+		ctx.Set("action", "7")
+		if r := h.OnConnect(ctx); r.Action != Drop {
+			t.Errorf("got action %v for unknown action, want Drop", r.Action)
+		}
+	})
+
+	t.Run("packet", func(t *testing.T) {
+		if !h.(OutboundHandler).WantsOutbound() {
+			t.Error("module with on_packet should want outbound packets")
+		}
+		ctx := newMatchContext("play.example.com", nil, "127.0.0.1")
+		if r := h.OnPacket(ctx, []byte{0x40, 1, 2}, Outbound); r.Action != Continue {
+			t.Errorf("got action %v (%v), want Continue", r.Action, r.Error)
+		}
+		if got := ctx.GetString("last_packet"); got != "1:3:64" {
+			t.Errorf("last_packet = %q, want 1:3:64", got)
+		}
+		if r := h.OnPacket(ctx, []byte{0xff}, Inbound); r.Action != Drop {
+			t.Errorf("got action %v, want Drop", r.Action)
+		}
+		h.OnDisconnect(ctx)
+		if got := ctx.GetString("disconnected"); got != "yes" {
+			t.Error("on_disconnect not called")
+		}
+	})
+
+	t.Run("limits", func(t *testing.T) {
+		for _, sni := range []string{"loop", "alloc"} {
+			r := h.OnConnect(newMatchContext(sni, nil, "127.0.0.1"))
+			if r.Action != Drop || r.Error == nil {
+				t.Errorf("%s: got action %v, want Drop with error", sni, r.Action)
+			}
+		}
+		// The failed instances are replaced
+		ctx := newMatchContext("play.example.com", nil, "127.0.0.1")
+		if r := h.OnConnect(ctx); r.Action != Continue {
+			t.Errorf("got action %v (%v), want Continue", r.Action, r.Error)
+		}
+	})
+
+	t.Run("pool", func(t *testing.T) {
+		var wg sync.WaitGroup
+		for range 4 * runtime.GOMAXPROCS(0) {
+			wg.Go(func() {
+				h.OnConnect(newMatchContext("play.example.com", nil, "127.0.0.1"))
+			})
+		}
+		wg.Wait()
+
+		// Every slot is returned and no more instances exist than slots
+		pool := h.(*WasmHandler).instances
+		if len(pool) != cap(pool) {
+			t.Fatalf("%d of %d slots returned", len(pool), cap(pool))
+		}
+		slots := make([]api.Module, cap(pool))
+		live := 0
+		for i := range slots {
+			if slots[i] = <-pool; slots[i] != nil {
+				live++
+			}
+		}
+		for _, m := range slots {
+			pool <- m
+		}
+		if live == 0 || live > runtime.GOMAXPROCS(0) {
+			t.Errorf("%d live instances, want 1 to %d", live, runtime.GOMAXPROCS(0))
+		}
+	})
+}
+
+func TestWasm_Example(t *testing.T) {
+	module := buildWasm(t, "../../examples/wasm-blocklist")
+	h := newWasmHandler(t, WasmConfig{File: module})
+
+	if r := h.OnConnect(newMatchContext("a.blocked.example.com", nil, "127.0.0.1")); r.Action != Drop {
+		t.Errorf("got action %v, want Drop", r.Action)
+	}
+	ctx := newMatchContext("eu.example.com", nil, "127.0.0.1")
+	if r := h.OnConnect(ctx); r.Action != Continue {
+		t.Errorf("got action %v (%v), want Continue", r.Action, r.Error)
+	}
+	if got := ctx.GetString("backend"); got != "10.0.1.1:5520" {
+		t.Errorf("backend = %q, want 10.0.1.1:5520", got)
+	}
+}
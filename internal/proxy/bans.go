@@ -0,0 +1,60 @@
+package proxy
+
+import (
+	"log"
+	"net"
+	"net/netip"
+
+	"quic-relay/internal/ban"
+)
+
+// SetBans enables the ban list, or disables it if cfg is nil (hot-reload safe).
+// The first call loads persisted bans; later calls keep existing bans and only
+// apply the new settings.
+func (p *Proxy) SetBans(cfg *ban.Config) error {
+	if cfg == nil {
+		if old := p.bans.Swap(nil); old != nil {
+			old.Flush()
+		}
+		return nil
+	}
+	if l := p.bans.Load(); l != nil {
+		return l.Configure(cfg)
+	}
+	l, err := ban.New(cfg)
+	if err != nil {
+		return err
+	}
+	p.bans.Store(l)
+	return nil
+}
+
+// Bans returns the ban list, or nil if banning is disabled.
+func (p *Proxy) Bans() *ban.List {
+	return p.bans.Load()
+}
+
+// FlushBans writes pending ban list changes to disk.
+func (p *Proxy) FlushBans() {
+	if l := p.bans.Load(); l != nil {
+		if err := l.Flush(); err != nil {
+			log.Printf("[proxy] failed to save ban list: %v", err)
+		}
+	}
+}
+
+// banClient returns the Context.BanClient callback for a connection.
+func (p *Proxy) banClient(clientAddr *net.UDPAddr) func(reason string) {
+	return func(reason string) {
+		l := p.bans.Load()
+		if l == nil {
+			return
+		}
+		addr, ok := netip.AddrFromSlice(clientAddr.IP)
+		if !ok {
+			return
+		}
+		addr = addr.Unmap()
+		l.Ban(netip.PrefixFrom(addr, addr.BitLen()), reason)
+	}
+}
@@ -0,0 +1,113 @@
+package proxy
+
+import (
+	"net"
+	"net/netip"
+	"testing"
+
+	"quic-relay/internal/ban"
+	"quic-relay/internal/handler"
+)
+
+func TestHandlePacket_BannedClientDroppedEarly(t *testing.T) {
+	p := New("", handler.NewChain())
+	if err := p.SetBans(&ban.Config{StrikeLimit: 2}); err != nil {
+		t.Fatal(err)
+	}
+	client := &net.UDPAddr{IP: net.IPv4(192, 0, 2, 1), Port: 4000}
+	other := &net.UDPAddr{IP: net.IPv4(192, 0, 2, 2), Port: 4000}
+	validatedSession(p, client)
+	validatedSession(p, other)
+
+	// Version Negotiation: clients never send it
+	junk := append([]byte{0x80, 0, 0, 0, 0, 8}, make([]byte, 20)...)
+
+	// Two rejected packets reach the strike limit; later ones never reach the filter
+	for i := 0; i < 5; i++ {
+		p.handlePacket(nil, client, junk)
+	}
+	if n := p.RejectStats()["server_only"]; n != 2 {
+		t.Errorf("rejected %d packets, want 2 before the ban", n)
+	}
+	if !p.Bans().IsBanned(client.IP) {
+		t.Error("client not banned after reaching the strike limit")
+	}
+
+	p.handlePacket(nil, other, junk)
+	if n := p.RejectStats()["server_only"]; n != 3 {
+		t.Error("other client affected by the ban")
+	}
+}
+
+// validatedSession adds a session for clientAddr whose address is validated.
+func validatedSession(p *Proxy, clientAddr *net.UDPAddr) {
+	session := &handler.Session{}
+	session.SetClientAddr(clientAddr)
+	session.ValidateAddress()
+	key := "session-" + clientAddr.String()
+	p.storeSession(key, &handler.Context{ClientAddr: clientAddr, Session: session})
+	p.clientSessions.Store(clientAddr.String(), key)
+}
+
+func TestHandlePacket_NoStrikesForUnvalidatedAddress(t *testing.T) {
+	p := New("", handler.NewChain())
+	if err := p.SetBans(&ban.Config{StrikeLimit: 2}); err != nil {
+		t.Fatal(err)
+	}
+	junk := paddedInitial(0xBABABABA, []byte{1, 2, 3, 4, 5, 6, 7, 8}, nil)
+	vn := append([]byte{0x80, 0, 0, 0, 0, 8}, make([]byte, 20)...)
+
+	// Without a session, and with one still in its handshake: may be spoofed
+	victim := &net.UDPAddr{IP: net.IPv4(192, 0, 2, 1), Port: 4000}
+	for i := 0; i < 5; i++ {
+		p.handlePacket(nil, victim, junk)
+	}
+	session := &handler.Session{}
+	session.SetClientAddr(victim)
+	p.storeSession("handshake", &handler.Context{ClientAddr: victim, Session: session})
+	p.clientSessions.Store(victim.String(), "handshake")
+	for i := 0; i < 5; i++ {
+		p.handlePacket(nil, victim, vn)
+	}
+	if p.Bans().IsBanned(victim.IP) {
+		t.Error("unvalidated address banned by strikes")
+	}
+}
+
+func TestHandlePacket_StrikesOffByDefault(t *testing.T) {
+	p := New("", handler.NewChain())
+	if err := p.SetBans(&ban.Config{}); err != nil {
+		t.Fatal(err)
+	}
+	client := &net.UDPAddr{IP: net.IPv4(192, 0, 2, 1), Port: 4000}
+	validatedSession(p, client)
+
+	vn := append([]byte{0x80, 0, 0, 0, 0, 8}, make([]byte, 20)...)
+	for i := 0; i < 500; i++ {
+		p.handlePacket(nil, client, vn)
+	}
+	if p.Bans().IsBanned(client.IP) {
+		t.Error("banned with strike_limit unset")
+	}
+}
+
+func TestBanClient(t *testing.T) {
+	p := New("", handler.NewChain())
+	client := &net.UDPAddr{IP: net.ParseIP("::ffff:198.51.100.7"), Port: 4000}
+	p.banClient(client)("test") // Banning disabled: no-op
+
+	if err := p.SetBans(&ban.Config{}); err != nil {
+		t.Fatal(err)
+	}
+	p.banClient(client)("test")
+	entries := p.Bans().Entries()
+	if len(entries) != 1 || entries[0].Prefix != netip.MustParsePrefix("198.51.100.7/32") {
+		t.Errorf("entries = %v", entries)
+	}
+
+	// Disabling keeps nothing around
+	p.SetBans(nil)
+	if p.Bans() != nil {
+		t.Error("ban list not disabled")
+	}
+}
@@ -0,0 +1,153 @@
+package proxy
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"strings"
+	"time"
+
+	"quic-relay/internal/handler"
+)
+
+// Each session is pinned to the chain that accepted it (ctx.Chain), so its
+// packets and disconnect reach the handler instances that saw its OnConnect.
+// A chain holds one reference while it is current and one per session; a
+// chain replaced by a reload is shut down when its last session ends.
+
+// ReloadChain atomically replaces the handler chain for new connections.
+// Existing sessions stay on the chain that accepted them.
+// The new handlers take over state from the old ones and are started before
+// the swap; if that fails, the old chain stays in place.
+func (p *Proxy) ReloadChain(chain *handler.Chain) error {
+	old := p.chain.Load()
+	chain.Reload(old)
+	if err := chain.Start(p.ctx); err != nil {
+		return err
+	}
+	p.chain.Store(chain)
+	p.retired.Store(old, struct{}{})
+	p.releaseChain(old)
+	return nil
+}
+
+// acquireChain returns the current chain with a reference taken for a session.
+func (p *Proxy) acquireChain() *handler.Chain {
+	for {
+		chain := p.chain.Load()
+		if chain.Acquire() {
+			return chain
+		}
+		// Retired and released since the load; a newer chain is in place
+	}
+}
+
+// releaseChain drops a session's reference, and shuts the chain down if it
+// was retired and this was its last session.
+func (p *Proxy) releaseChain(chain *handler.Chain) {
+	if !chain.Release() {
+		return
+	}
+	p.retired.Delete(chain)
+	log.Printf("[proxy] shutting down handlers of a previous config (last session ended)")
+	p.chainShutdowns.Add(1)
+	go func() {
+		defer p.chainShutdowns.Done()
+		p.shutdownChain(chain)
+	}()
+}
+
+// shutdownChains shuts down the current chain and all retired ones, whether
+// or not sessions still use them, when the proxy stops or hands off.
+func (p *Proxy) shutdownChains() {
+	p.retired.Range(func(key, _ any) bool {
+		p.shutdownChain(key.(*handler.Chain))
+		return true
+	})
+	p.shutdownChain(p.chain.Load())
+	p.chainShutdowns.Wait()
+}
+
+// shutdownChain shuts down the handlers of a chain that no longer serves.
+func (p *Proxy) shutdownChain(chain *handler.Chain) {
+	ctx, cancel := context.WithTimeout(context.Background(), handlerShutdownTimeout)
+	defer cancel()
+	if err := chain.Shutdown(ctx); err != nil {
+		log.Printf("[proxy] handler shutdown: %v", err)
+	}
+}
+
+// HandlerStats returns the counters of the current chain's handlers. Handlers
+// that replaced one of a previous config share its counters, so these include
+// the sessions still on older chains.
+func (p *Proxy) HandlerStats() []handler.HandlerStats {
+	return p.chain.Load().Stats()
+}
+
+// formatHandlerStats renders per-handler counter deltas since last, keyed by
+// position and name, e.g. "0:sni-router connect=12 drops=1 avg=3µs p99<=5µs".
+// Handlers that weren't called are left out. Returns "" if none were.
+func (p *Proxy) formatHandlerStats(last map[string]handler.HandlerStats) string {
+	var parts []string
+	seen := make(map[string]bool)
+	for _, s := range p.HandlerStats() {
+		key := s.ID + ":" + s.Name
+		prev := last[key]
+		last[key] = s
+		seen[key] = true
+
+		var fields []string
+		if d := s.Panics - prev.Panics; d > 0 {
+			fields = append(fields, fmt.Sprintf("panics=%d", d))
+		}
+		fields = appendCallStats(fields, "connect", s.Connect, prev.Connect)
+		fields = appendCallStats(fields, "packet", s.Packet, prev.Packet)
+		fields = appendCallStats(fields, "disconnect", s.Disconnect, prev.Disconnect)
+		if len(fields) > 0 {
+			parts = append(parts, key+" "+strings.Join(fields, " "))
+		}
+	}
+	for key := range last {
+		if !seen[key] {
+			delete(last, key) // Handler of a replaced config
+		}
+	}
+	return strings.Join(parts, "; ")
+}
+
+// appendCallStats appends the calls, drops, average latency and the bucket
+// bound of the 99th percentile of one method since prev.
+func appendCallStats(fields []string, method string, cur, prev handler.CallStats) []string {
+	if cur.Calls <= prev.Calls {
+		return fields // Not called, or counters of a new handler under an old key
+	}
+	fields = append(fields, fmt.Sprintf("%s=%d", method, cur.Calls-prev.Calls))
+	if d := cur.Drops - prev.Drops; d > 0 {
+		fields = append(fields, fmt.Sprintf("drops=%d", d))
+	}
+
+	var latency [len(handler.LatencyBuckets) + 1]int64
+	var timed int64
+	for i := range latency {
+		latency[i] = cur.Latency[i] - prev.Latency[i]
+		timed += latency[i]
+	}
+	if timed <= 0 {
+		return fields
+	}
+	avg := (cur.LatencySum - prev.LatencySum) / time.Duration(timed)
+	fields = append(fields, "avg="+avg.String())
+	var n int64
+	for i, c := range latency {
+		if n += c; n*100 < timed*99 {
+			continue
+		}
+		if i < len(handler.LatencyBuckets) {
+			fields = append(fields, "p99<="+handler.LatencyBuckets[i].String())
+		} else {
+			fields = append(fields, "p99>"+handler.LatencyBuckets[i-1].String())
+		}
+		break
+	}
+	return fields
+}
@@ -0,0 +1,85 @@
+package proxy
+
+import (
+	"log"
+	"time"
+
+	"quic-relay/internal/handler"
+)
+
+const (
+	defaultDrainIdleTimeout = 30 // seconds
+	drainCheckInterval      = time.Second
+)
+
+// SetDrainTimeout updates the drain settings (atomic, hot-reload safe).
+// timeout is the maximum drain duration in seconds; <= 0 makes Drain stop immediately.
+// idleTimeout closes sessions idle for longer while draining; <= 0 uses default (30 seconds).
+func (p *Proxy) SetDrainTimeout(timeout, idleTimeout int) {
+	if timeout < 0 {
+		timeout = 0
+	}
+	if idleTimeout <= 0 {
+		idleTimeout = defaultDrainIdleTimeout
+	}
+	p.drainTimeout.Store(int64(timeout))
+	p.drainIdle.Store(int64(idleTimeout))
+}
+
+// IsDraining returns whether the proxy is draining.
+func (p *Proxy) IsDraining() bool {
+	return p.draining.Load()
+}
+
+// Drain gracefully shuts down the proxy.
+// New connections are rejected immediately while existing sessions keep
+// forwarding until they go idle or the drain timeout passes, then Stop is called.
+// Blocks until the proxy is stopped. Calling Stop concurrently aborts the drain.
+func (p *Proxy) Drain() {
+	if !p.draining.CompareAndSwap(false, true) {
+		return // Already draining
+	}
+
+	timeout := time.Duration(p.drainTimeout.Load()) * time.Second
+	if timeout <= 0 {
+		p.Stop()
+		return
+	}
+
+	log.Printf("[proxy] draining %d sessions (timeout %v)", p.SessionCount(), timeout)
+
+	deadline := time.NewTimer(timeout)
+	defer deadline.Stop()
+	ticker := time.NewTicker(drainCheckInterval)
+	defer ticker.Stop()
+
+	for {
+		// Idle timeout is re-read so a reload can shorten a running drain
+		idle := time.Duration(p.drainIdle.Load()) * time.Second
+		p.sessions.Range(func(key, value any) bool {
+			ctx := value.(*handler.Context)
+			if ctx.Session != nil && ctx.Session.IdleDuration() > idle {
+				ctx.Chain.OnDisconnect(ctx)
+				p.deleteSession(key.(string), ctx)
+			}
+			return true
+		})
+
+		if p.SessionCount() == 0 {
+			log.Printf("[proxy] drain complete")
+			break
+		}
+
+		select {
+		case <-p.ctx.Done():
+			return // Stopped by someone else
+		case <-deadline.C:
+			log.Printf("[proxy] drain timeout reached, closing %d remaining sessions", p.SessionCount())
+			p.Stop()
+			return
+		case <-ticker.C:
+		}
+	}
+
+	p.Stop()
+}
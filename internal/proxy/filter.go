@@ -0,0 +1,148 @@
+package proxy
+
+import (
+	"encoding/binary"
+	"fmt"
+	"net"
+	"strings"
+	"sync/atomic"
+
+	"quic-relay/internal/handler"
+	"quic-relay/internal/quicvarint"
+)
+
+// RejectReason is why a packet was dropped by the sanity filter.
+type RejectReason int
+
+const (
+	RejectTooSmall   RejectReason = iota // Initial datagram below 1200 bytes
+	RejectVersion                        // Version other than QUIC v1
+	RejectCIDLength                      // CID over 20 bytes, or client DCID under 8 bytes
+	RejectMalformed                      // Truncated header, token or length field
+	RejectServerOnly                     // Retry or Version Negotiation sent by a client
+	numRejectReasons
+)
+
+func (r RejectReason) String() string {
+	switch r {
+	case RejectTooSmall:
+		return "too_small"
+	case RejectVersion:
+		return "version"
+	case RejectCIDLength:
+		return "cid_length"
+	case RejectMalformed:
+		return "malformed"
+	case RejectServerOnly:
+		return "server_only"
+	default:
+		return "unknown"
+	}
+}
+
+const (
+	minInitialSize    = 1200 // RFC 9000 Section 14.1: client Initial datagrams are padded to this
+	minInitialDCIDLen = 8    // RFC 9000 Section 7.2
+)
+
+// rejectCounters counts filtered packets per reason.
+type rejectCounters [numRejectReasons]atomic.Int64
+
+// RejectStats returns the number of packets dropped by the sanity filter, by reason.
+func (p *Proxy) RejectStats() map[string]int64 {
+	stats := make(map[string]int64, numRejectReasons)
+	for r := RejectReason(0); r < numRejectReasons; r++ {
+		stats[r.String()] = p.rejected[r].Load()
+	}
+	return stats
+}
+
+// reject counts a dropped packet. Repeat offenders get banned if strikes are
+// enabled, but only from addresses one of their sessions has validated: the
+// source address of anything else may be spoofed.
+func (p *Proxy) reject(clientAddr *net.UDPAddr, reason RejectReason) {
+	p.rejected[reason].Add(1)
+	if bans := p.bans.Load(); bans != nil && p.addressValidated(clientAddr) {
+		bans.Strike(clientAddr.IP, reason.String())
+	}
+}
+
+// addressValidated reports whether clientAddr is the address of a session
+// that has validated it (see handler.Context.AddressValidated).
+func (p *Proxy) addressValidated(clientAddr *net.UDPAddr) bool {
+	dcidKey, ok := p.clientSessions.Load(clientAddr.String())
+	if !ok {
+		return false
+	}
+	val, ok := p.sessions.Load(dcidKey)
+	return ok && val.(*handler.Context).AddressValidated()
+}
+
+// isServerOnly reports whether a client sent a packet only servers may send.
+// Cheap enough to run before the session lookup.
+func isServerOnly(packet []byte) bool {
+	if packet[0]&0x80 == 0 || len(packet) < 5 {
+		return false
+	}
+	version := binary.BigEndian.Uint32(packet[1:5])
+	return version == 0 || (version == quicVersion1 && packet[0]&0x30 == 0x30)
+}
+
+// checkLongHeader validates the header of a long header packet that has no
+// session yet, before anything is allocated or derived for it. Initials must
+// also meet the minimum datagram size and carry well-formed token and length fields.
+func checkLongHeader(packet []byte, pktType PacketType) (RejectReason, bool) {
+	if pktType == PacketInitial && len(packet) < minInitialSize {
+		return RejectTooSmall, false
+	}
+	if len(packet) < 7 {
+		return RejectMalformed, false
+	}
+	if binary.BigEndian.Uint32(packet[1:5]) != quicVersion1 {
+		return RejectVersion, false
+	}
+
+	offset := 5
+	dcidLen := int(packet[offset])
+	if dcidLen > maxCIDLen || (pktType == PacketInitial && dcidLen < minInitialDCIDLen) {
+		return RejectCIDLength, false
+	}
+	offset += 1 + dcidLen
+	if offset >= len(packet) {
+		return RejectMalformed, false
+	}
+	scidLen := int(packet[offset])
+	if scidLen > maxCIDLen {
+		return RejectCIDLength, false
+	}
+	offset += 1 + scidLen
+
+	if pktType == PacketInitial {
+		tokenLen, n, err := quicvarint.Read(packet[min(offset, len(packet)):])
+		if err != nil || tokenLen > uint64(len(packet)-offset-n) {
+			return RejectMalformed, false
+		}
+		offset += n + int(tokenLen)
+	}
+
+	length, n, err := quicvarint.Read(packet[min(offset, len(packet)):])
+	if err != nil || length > uint64(len(packet)-offset-n) || length < 20 {
+		// 20 bytes: packet number plus the smallest payload header protection can sample
+		return RejectMalformed, false
+	}
+	return 0, true
+}
+
+// formatRejects renders counter deltas since last, e.g. "too_small=12 version=3".
+// Returns "" if nothing was rejected.
+func (p *Proxy) formatRejects(last *[numRejectReasons]int64) string {
+	var parts []string
+	for r := RejectReason(0); r < numRejectReasons; r++ {
+		cur := p.rejected[r].Load()
+		if d := cur - last[r]; d > 0 {
+			parts = append(parts, fmt.Sprintf("%s=%d", r, d))
+		}
+		last[r] = cur
+	}
+	return strings.Join(parts, " ")
+}
@@ -0,0 +1,89 @@
+package proxy
+
+import (
+	"net"
+	"testing"
+
+	"quic-relay/internal/handler"
+)
+
+// paddedInitial builds a 1200-byte Initial whose Length field covers the rest of the datagram.
+func paddedInitial(version uint32, dcid, scid []byte) []byte {
+	b := []byte{0xC0, byte(version >> 24), byte(version >> 16), byte(version >> 8), byte(version)}
+	b = append(b, byte(len(dcid)))
+	b = append(b, dcid...)
+	b = append(b, byte(len(scid)))
+	b = append(b, scid...)
+	b = append(b, 0) // No token
+	n := minInitialSize - len(b) - 2
+	b = append(b, 0x40|byte(n>>8), byte(n))
+	return append(b, make([]byte, n)...)
+}
+
+func TestCheckLongHeader(t *testing.T) {
+	dcid := []byte{1, 2, 3, 4, 5, 6, 7, 8}
+	valid := paddedInitial(quicVersion1, dcid, nil)
+
+	badLength := paddedInitial(quicVersion1, dcid, nil)
+	badLength[len(dcid)+8] = 0x7F // Length far beyond the datagram
+
+	badToken := paddedInitial(quicVersion1, dcid, nil)
+	badToken[len(dcid)+7] = 0x7F // 2-byte varint token length > datagram
+
+	tests := []struct {
+		name   string
+		packet []byte
+		typ    PacketType
+		reason RejectReason
+		ok     bool
+	}{
+		{"valid Initial", valid, PacketInitial, 0, true},
+		{"too small", valid[:1199], PacketInitial, RejectTooSmall, false},
+		{"unknown version", paddedInitial(0x6b3343cf, dcid, nil), PacketInitial, RejectVersion, false},
+		{"DCID too long", paddedInitial(quicVersion1, make([]byte, 21), nil), PacketInitial, RejectCIDLength, false},
+		{"DCID too short", paddedInitial(quicVersion1, []byte{1, 2, 3}, nil), PacketInitial, RejectCIDLength, false},
+		{"SCID too long", paddedInitial(quicVersion1, dcid, make([]byte, 21)), PacketInitial, RejectCIDLength, false},
+		{"bad length", badLength, PacketInitial, RejectMalformed, false},
+		{"bad token length", badToken, PacketInitial, RejectMalformed, false},
+		{"short Handshake", []byte{0xE0, 0, 0, 0, 1, 4, 1, 2, 3, 4, 0, 0x14}, PacketHandshake, RejectMalformed, false},
+	}
+	for _, tt := range tests {
+		reason, ok := checkLongHeader(tt.packet, tt.typ)
+		if ok != tt.ok || (!ok && reason != tt.reason) {
+			t.Errorf("%s: got (%s, %v), want (%s, %v)", tt.name, reason, ok, tt.reason, tt.ok)
+		}
+	}
+}
+
+func TestIsServerOnly(t *testing.T) {
+	if !isServerOnly([]byte{0xF0, 0, 0, 0, 1, 0}) {
+		t.Error("Retry not detected")
+	}
+	if !isServerOnly([]byte{0xC7, 0, 0, 0, 0, 0}) {
+		t.Error("Version Negotiation not detected")
+	}
+	if isServerOnly(paddedInitial(quicVersion1, []byte{1, 2, 3, 4, 5, 6, 7, 8}, nil)) {
+		t.Error("Initial flagged as server-only")
+	}
+	if isServerOnly([]byte{0x40, 1, 2, 3}) {
+		t.Error("short header flagged as server-only")
+	}
+}
+
+func TestHandlePacket_FiltersJunkBeforeAssembler(t *testing.T) {
+	p := New("", handler.NewChain())
+	client := &net.UDPAddr{IP: net.IPv4(192, 0, 2, 1), Port: 4000}
+
+	p.handlePacket(nil, client, paddedInitial(quicVersion1, []byte{1, 2, 3, 4, 5, 6, 7, 8}, nil)[:600])
+	p.handlePacket(nil, client, paddedInitial(0xBABABABA, []byte{1, 2, 3, 4, 5, 6, 7, 8}, nil))
+	p.handlePacket(nil, client, []byte{0xF0, 0, 0, 0, 1, 8, 1, 2, 3, 4, 5, 6, 7, 8, 0})
+
+	p.assemblers.Range(func(key, _ any) bool {
+		t.Errorf("assembler allocated for junk DCID %x", key)
+		return true
+	})
+	stats := p.RejectStats()
+	if stats["too_small"] != 1 || stats["version"] != 1 || stats["server_only"] != 1 {
+		t.Errorf("RejectStats = %v", stats)
+	}
+}
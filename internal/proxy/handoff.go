@@ -0,0 +1,576 @@
+package proxy
+
+import (
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"os"
+	"slices"
+	"syscall"
+	"time"
+
+	"quic-relay/internal/handler"
+)
+
+// Zero-downtime upgrade: the running process passes its UDP listener, session
+// state and backend sockets to a freshly started successor over a Unix socket.
+//
+// Protocol (stream socket, successor = new process):
+//  1. successor -> old: handoffReady (chain built, ready to take over)
+//  2. old -> successor: uint32 length + JSON handoffState
+//  3. old -> successor: file descriptors in batches (1 byte + SCM_RIGHTS each),
+//     listener first, then the retiring listeners left by Rebind, then one
+//     backend socket per session in state order
+//  4. successor -> old: handoffAck (sessions restored)
+//  5. old -> successor: handoffDone (old has stopped and released its
+//     handlers' resources; successor starts serving), or handoffAbort if the
+//     old process failed before getting the ack and serves the sessions again
+const (
+	handoffReady   byte = 'R'
+	handoffAck     byte = 'A'
+	handoffDone    byte = 'D'
+	handoffAbort   byte = 'X'
+	handoffTimeout      = 30 * time.Second
+	handoffFDBatch      = 200 // Below the kernel's SCM_MAX_FD (253)
+	maxHandoffSize      = 256 << 20
+)
+
+// handoffState is the serialized proxy state sent to the successor.
+type handoffState struct {
+	Retiring    int              `json:"retiring,omitempty"` // Number of retiring listeners sent after the current one
+	Sessions    []handoffSession `json:"sessions"`
+	Aliases     []handoffAlias   `json:"aliases"`
+	DCIDLengths []int            `json:"dcid_lengths"`
+}
+
+// handoffSession describes a single session. Its backend socket is sent separately.
+type handoffSession struct {
+	ID           uint64            `json:"id"`
+	DCID         []byte            `json:"dcid"`
+	ClientAddr   string            `json:"client_addr"`
+	BackendAddr  string            `json:"backend_addr"`
+	CreatedAt    int64             `json:"created_at"`
+	LastActivity int64             `json:"last_activity"`
+	SNI          string            `json:"sni,omitempty"`
+	ALPN         []string          `json:"alpn,omitempty"`
+	Values       map[string]string `json:"values,omitempty"`       // String context values only; others are process-local and rebuilt by ResumeSession
+	IdleTimeout  int64             `json:"idle_timeout,omitempty"` // Per-session idle timeout in nanoseconds (0 = default)
+	Listener     int               `json:"listener,omitempty"`     // Listener the session replies through: 0 = current, i = i-th retiring
+	ProxyHeader  []byte            `json:"proxy_header,omitempty"` // PROXY protocol preamble (nil if disabled)
+}
+
+// handoffAlias maps a learned server SCID to the session's original DCID.
+type handoffAlias struct {
+	SCID []byte `json:"scid"`
+	DCID []byte `json:"dcid"`
+}
+
+// HandOff transfers the listener and all sessions to a successor process
+// connected via uc, which must call Inherit on its side.
+// Blocks until the successor is ready. If the successor never becomes ready,
+// the proxy keeps running and an error is returned.
+//
+// Once it is ready, the proxy stops reading packets and detaches its
+// sessions to send them. Until the successor acknowledges, the proxy keeps
+// its listeners, backend sockets and handlers: if the transfer fails or the
+// successor exits, it takes the sessions back and resumes serving, and an
+// error is returned. After the acknowledgement Done is closed, and the proxy
+// must exit.
+func (p *Proxy) HandOff(uc *net.UnixConn) error {
+	if p.conn.Load() == nil {
+		return errors.New("proxy is not running")
+	}
+
+	// 1. Wait for the successor to finish building its handler chain
+	uc.SetDeadline(time.Now().Add(handoffTimeout))
+	var ready [1]byte
+	if _, err := io.ReadFull(uc, ready[:]); err != nil || ready[0] != handoffReady {
+		return fmt.Errorf("successor not ready: %v", err)
+	}
+
+	// 2. Dup all listeners, then stop reading from them and let in-flight
+	// packets finish. The listeners stay open so backend replies still reach
+	// clients meanwhile. Holding listenersMu keeps Rebind out.
+	p.listenersMu.Lock()
+	conn := p.conn.Load()
+	listeners := []*net.UDPConn{conn}
+	p.retiring.Range(func(key, _ any) bool {
+		listeners = append(listeners, key.(*net.UDPConn))
+		return true
+	})
+	files := make([]*os.File, 0, len(listeners))
+	defer func() {
+		for _, f := range files {
+			f.Close()
+		}
+	}()
+	for _, l := range listeners {
+		f, err := l.File()
+		if err != nil {
+			p.listenersMu.Unlock()
+			return fmt.Errorf("failed to dup listener: %w", err)
+		}
+		files = append(files, f)
+	}
+	p.handingOff.Store(true)
+	pool := p.workerPool
+	p.listenersMu.Unlock()
+	for _, l := range listeners {
+		l.SetReadDeadline(time.Now())
+	}
+	p.listeners.Wait()
+	if pool != nil {
+		pool.Flush()
+	}
+
+	// 3. Detach sessions: mark closed so backend readers stop without closing
+	// the sockets, and unblock their pending reads.
+	state := handoffState{Retiring: len(listeners) - 1}
+	detached := make(map[string]*handler.Context)
+	p.sessions.Range(func(key, value any) bool {
+		ctx := value.(*handler.Context)
+		s := ctx.Session
+		if s == nil || s.BackendConn == nil || !s.Close() {
+			return true
+		}
+		detached[key.(string)] = ctx
+		s.BackendConn.SetReadDeadline(time.Now())
+
+		f, err := s.BackendConn.File()
+		if err != nil {
+			log.Printf("[proxy] handoff: skipping session=%d: %v", s.ID, err)
+			return true
+		}
+		files = append(files, f)
+		hs := newHandoffSession(ctx)
+		hs.Listener = max(slices.Index(listeners, ctx.ProxyConn), 0)
+		state.Sessions = append(state.Sessions, hs)
+		return true
+	})
+
+	p.dcidAliases.Range(func(key, value any) bool {
+		state.Aliases = append(state.Aliases, handoffAlias{
+			SCID: []byte(key.(string)),
+			DCID: []byte(value.(string)),
+		})
+		return true
+	})
+
+	p.dcidLengthsMu.RLock()
+	for l := range p.dcidLengths {
+		state.DCIDLengths = append(state.DCIDLengths, l)
+	}
+	p.dcidLengthsMu.RUnlock()
+
+	// 4. Send state and descriptors, then wait for the successor's ack
+	err := writeHandoffState(uc, &state)
+	if err == nil {
+		err = writeHandoffFiles(uc, files)
+	}
+	if err == nil {
+		var ack [1]byte
+		if _, readErr := io.ReadFull(uc, ack[:]); readErr != nil || ack[0] != handoffAck {
+			err = fmt.Errorf("successor did not acknowledge handoff: %v", readErr)
+		}
+	}
+	if err != nil {
+		uc.Write([]byte{handoffAbort})
+		p.resumeAfterHandOff(&state, files[len(listeners):], listeners, detached)
+		return err
+	}
+
+	// 5. The successor has the sessions: stop for good, release handler
+	// resources such as fixed listen ports, and let it start its chain
+	p.cancel()
+	<-p.runDone
+	if pool != nil {
+		pool.Stop()
+	}
+	for _, l := range listeners {
+		l.Close()
+	}
+	p.shutdownChains()
+	if _, err := uc.Write([]byte{handoffDone}); err != nil {
+		log.Printf("[proxy] handoff: failed to confirm to successor: %v", err)
+	}
+
+	log.Printf("[proxy] handed off listener and %d sessions", len(state.Sessions))
+	return nil
+}
+
+// resumeAfterHandOff takes the sessions back after a failed handoff and
+// serves the listeners again. The sessions are restored from the descriptors
+// that were sent, as the successor would have, since their backend readers
+// have stopped.
+func (p *Proxy) resumeAfterHandOff(state *handoffState, files []*os.File, listeners []*net.UDPConn, detached map[string]*handler.Context) {
+	for key, ctx := range detached {
+		ctx.Session.BackendConn.Close() // The copy in files stays open
+		p.deleteSession(key, ctx)
+	}
+	restored := p.resumeSessions(p.restoreSessions(state, files, listeners))
+
+	p.listenersMu.Lock()
+	p.handingOff.Store(false)
+	for _, l := range listeners {
+		p.listeners.Add(1)
+		go p.serve(l)
+	}
+	p.listenersMu.Unlock()
+	log.Printf("[proxy] handoff failed, resumed serving %d/%d sessions", restored, len(state.Sessions))
+}
+
+// Inherit takes over the listener and sessions from a predecessor process
+// connected via uc (see HandOff). Must be called before Run.
+// Sessions are resumed by the first handler in the chain implementing
+// handler.SessionResumer; sessions without one are closed. If the
+// predecessor aborts after sending them, they are left to it and an error is
+// returned.
+func (p *Proxy) Inherit(uc *net.UnixConn) error {
+	uc.SetDeadline(time.Now().Add(handoffTimeout))
+
+	if _, err := uc.Write([]byte{handoffReady}); err != nil {
+		return fmt.Errorf("failed to signal readiness: %w", err)
+	}
+
+	state, err := readHandoffState(uc)
+	if err != nil {
+		return err
+	}
+
+	if state.Retiring < 0 {
+		return fmt.Errorf("invalid handoff state: %d retiring listeners", state.Retiring)
+	}
+	nListeners := 1 + state.Retiring
+	files, err := readHandoffFiles(uc, nListeners+len(state.Sessions))
+	if err != nil {
+		return err
+	}
+
+	listeners := make([]*net.UDPConn, 0, nListeners)
+	for i, f := range files[:nListeners] {
+		l, err := restoreListener(f)
+		if err != nil {
+			for _, l := range listeners {
+				l.Close()
+			}
+			for _, f := range files[i+1:] {
+				f.Close()
+			}
+			return err
+		}
+		listeners = append(listeners, l)
+	}
+	sessions := p.restoreSessions(state, files[nListeners:], listeners)
+
+	// Until the predecessor confirms, it may still take the sessions back
+	if _, err := uc.Write([]byte{handoffAck}); err != nil {
+		err = fmt.Errorf("failed to acknowledge handoff: %w", err)
+		p.abandonInherited(sessions, listeners)
+		return err
+	}
+	var done [1]byte
+	if _, err := io.ReadFull(uc, done[:]); errors.Is(err, io.EOF) {
+		// The predecessor exited after the ack, so it can't resume them
+		log.Printf("[proxy] handoff: predecessor exited without confirming")
+	} else if err != nil || done[0] != handoffDone {
+		p.abandonInherited(sessions, listeners)
+		return fmt.Errorf("predecessor aborted the handoff: %v", err)
+	}
+
+	p.conn.Store(listeners[0])
+	for _, l := range listeners[1:] {
+		p.retiring.Store(l, struct{}{}) // Served and retired by Run
+	}
+	restored := p.resumeSessions(sessions)
+
+	log.Printf("[proxy] inherited listener %s (%d retiring) and %d/%d sessions", listeners[0].LocalAddr(), state.Retiring, restored, len(state.Sessions))
+	return nil
+}
+
+// restoreSessions stores the sessions of state around their backend sockets
+// in files, with their lookup keys and aliases, and returns them. Sessions
+// reply through their listener in listeners.
+func (p *Proxy) restoreSessions(state *handoffState, files []*os.File, listeners []*net.UDPConn) []*handler.Context {
+	for _, l := range state.DCIDLengths {
+		p.registerDCIDLength(l)
+	}
+
+	var sessions []*handler.Context
+	for i, hs := range state.Sessions {
+		f := files[i]
+		conn := listeners[0]
+		if hs.Listener > 0 && hs.Listener < len(listeners) {
+			conn = listeners[hs.Listener]
+		}
+		ctx, err := p.restoreSession(hs, f, conn)
+		f.Close()
+		if err != nil {
+			log.Printf("[proxy] handoff: failed to restore session=%d: %v", hs.ID, err)
+			continue
+		}
+
+		dcidKey := string(hs.DCID)
+		p.storeSession(dcidKey, ctx)
+		p.clientSessions.Store(ctx.Session.ClientAddr().String(), dcidKey)
+		sessions = append(sessions, ctx)
+	}
+
+	for _, a := range state.Aliases {
+		if val, ok := p.sessions.Load(string(a.DCID)); ok && val.(*handler.Context).Session.AddAlias(string(a.SCID)) {
+			p.dcidAliases.Store(string(a.SCID), string(a.DCID))
+		}
+	}
+	return sessions
+}
+
+// resumeSessions passes restored sessions to the chain, which starts
+// forwarding them, and returns how many were resumed. The others are closed.
+func (p *Proxy) resumeSessions(sessions []*handler.Context) int {
+	resumed := 0
+	for _, ctx := range sessions {
+		dcidKey := string(ctx.Session.DCID)
+		err := ctx.Chain.ResumeSession(ctx)
+		if errors.Is(err, handler.ErrNotResumed) {
+			log.Printf("[proxy] handoff: no handler can resume session=%d, closing", ctx.Session.ID)
+			ctx.Session.BackendConn.Close()
+			p.deleteSession(dcidKey, ctx)
+			continue
+		}
+		if err != nil {
+			log.Printf("[proxy] handoff: failed to resume session=%d: %v", ctx.Session.ID, err)
+			ctx.Chain.OnDisconnect(ctx)
+			p.deleteSession(dcidKey, ctx)
+			continue
+		}
+		resumed++
+	}
+	return resumed
+}
+
+// abandonInherited closes the sessions and listeners of a failed Inherit.
+// The predecessor holds its own copies of the sockets.
+func (p *Proxy) abandonInherited(sessions []*handler.Context, listeners []*net.UDPConn) {
+	for _, ctx := range sessions {
+		ctx.Session.BackendConn.Close()
+		p.deleteSession(string(ctx.Session.DCID), ctx)
+	}
+	for _, l := range listeners {
+		l.Close()
+	}
+}
+
+// newHandoffSession captures the transferable state of a session context.
+func newHandoffSession(ctx *handler.Context) handoffSession {
+	s := ctx.Session
+	hs := handoffSession{
+		ID:           s.ID,
+		DCID:         s.DCID,
+		ClientAddr:   s.ClientAddr().String(),
+		BackendAddr:  s.BackendAddr.String(),
+		CreatedAt:    s.CreatedAt.UnixNano(),
+		LastActivity: s.LastActivity.Load(),
+		IdleTimeout:  int64(ctx.IdleTimeout()),
+		ProxyHeader:  s.ProxyHeader(),
+	}
+	if hs.IdleTimeout == 0 {
+		// Transport parameters aren't transferred; keep the timeout derived from them
+		hs.IdleTimeout = int64(clientIdleTimeout(ctx))
+	}
+	if ctx.Hello != nil {
+		hs.SNI = ctx.Hello.SNI
+		hs.ALPN = ctx.Hello.ALPNProtocols
+	}
+	ctx.Range(func(key string, value any) bool {
+		if v, ok := value.(string); ok {
+			if hs.Values == nil {
+				hs.Values = make(map[string]string)
+			}
+			hs.Values[key] = v
+		}
+		return true
+	})
+	return hs
+}
+
+// restoreListener turns an inherited descriptor back into a UDP listener.
+// The descriptor is closed in any case.
+func restoreListener(f *os.File) (*net.UDPConn, error) {
+	l, err := net.FilePacketConn(f)
+	f.Close()
+	if err != nil {
+		return nil, fmt.Errorf("failed to restore listener: %w", err)
+	}
+	udpConn, ok := l.(*net.UDPConn)
+	if !ok {
+		l.Close()
+		return nil, errors.New("inherited listener is not a UDP socket")
+	}
+	return udpConn, nil
+}
+
+// restoreSession rebuilds a session context around an inherited backend socket
+// that replies to the client through conn.
+func (p *Proxy) restoreSession(hs handoffSession, f *os.File, conn *net.UDPConn) (*handler.Context, error) {
+	clientAddr, err := net.ResolveUDPAddr("udp", hs.ClientAddr)
+	if err != nil {
+		return nil, err
+	}
+	backendAddr, err := net.ResolveUDPAddr("udp", hs.BackendAddr)
+	if err != nil {
+		return nil, err
+	}
+	c, err := net.FileConn(f)
+	if err != nil {
+		return nil, err
+	}
+	backendConn, ok := c.(*net.UDPConn)
+	if !ok {
+		c.Close()
+		return nil, errors.New("backend socket is not UDP")
+	}
+
+	session := &handler.Session{
+		ID:          hs.ID,
+		DCID:        hs.DCID,
+		BackendAddr: backendAddr,
+		BackendConn: backendConn,
+		CreatedAt:   time.Unix(0, hs.CreatedAt),
+	}
+	session.SetClientAddr(clientAddr)
+	session.LastActivity.Store(hs.LastActivity)
+	session.SetProxyHeader(hs.ProxyHeader)
+
+	ctx := &handler.Context{
+		ClientAddr: clientAddr,
+		Hello:      &handler.ClientHello{SNI: hs.SNI, ALPNProtocols: hs.ALPN},
+		Session:    session,
+		ProxyConn:  conn,
+	}
+	for k, v := range hs.Values {
+		ctx.Set(k, v)
+	}
+	ctx.SetIdleTimeout(time.Duration(hs.IdleTimeout))
+
+	dcidKey := string(hs.DCID)
+	ctx.OnServerPacket = func(packet []byte) {
+		p.learnServerSCID(dcidKey, ctx, packet)
+	}
+	ctx.DropSession = func() { p.dropSession(dcidKey, ctx) }
+	ctx.BanClient = p.banClient(clientAddr)
+	return ctx, nil
+}
+
+// writeHandoffState sends the length-prefixed JSON state.
+func writeHandoffState(uc *net.UnixConn, state *handoffState) error {
+	data, err := json.Marshal(state)
+	if err != nil {
+		return fmt.Errorf("failed to encode handoff state: %w", err)
+	}
+	var hdr [4]byte
+	binary.BigEndian.PutUint32(hdr[:], uint32(len(data)))
+	if _, err := uc.Write(hdr[:]); err != nil {
+		return fmt.Errorf("failed to send handoff state: %w", err)
+	}
+	if _, err := uc.Write(data); err != nil {
+		return fmt.Errorf("failed to send handoff state: %w", err)
+	}
+	return nil
+}
+
+// readHandoffState reads the length-prefixed JSON state.
+func readHandoffState(uc *net.UnixConn) (*handoffState, error) {
+	var hdr [4]byte
+	if _, err := io.ReadFull(uc, hdr[:]); err != nil {
+		return nil, fmt.Errorf("failed to read handoff state: %w", err)
+	}
+	size := binary.BigEndian.Uint32(hdr[:])
+	if size > maxHandoffSize {
+		return nil, fmt.Errorf("handoff state too large: %d bytes", size)
+	}
+	data := make([]byte, size)
+	if _, err := io.ReadFull(uc, data); err != nil {
+		return nil, fmt.Errorf("failed to read handoff state: %w", err)
+	}
+	var state handoffState
+	if err := json.Unmarshal(data, &state); err != nil {
+		return nil, fmt.Errorf("invalid handoff state: %w", err)
+	}
+	return &state, nil
+}
+
+// writeHandoffFiles sends descriptors in batches, one byte of payload each.
+func writeHandoffFiles(uc *net.UnixConn, files []*os.File) error {
+	for start := 0; start < len(files); start += handoffFDBatch {
+		end := min(start+handoffFDBatch, len(files))
+		fds := make([]int, 0, end-start)
+		for _, f := range files[start:end] {
+			fd, err := fileDescriptor(f)
+			if err != nil {
+				return fmt.Errorf("failed to send descriptors: %w", err)
+			}
+			fds = append(fds, fd)
+		}
+		if _, _, err := uc.WriteMsgUnix([]byte{0}, syscall.UnixRights(fds...), nil); err != nil {
+			return fmt.Errorf("failed to send descriptors: %w", err)
+		}
+	}
+	return nil
+}
+
+// fileDescriptor returns the descriptor of f. Unlike f.Fd it leaves the socket
+// non-blocking, which the connection f was dup'd from shares and still needs
+// if the handoff fails.
+func fileDescriptor(f *os.File) (int, error) {
+	rc, err := f.SyscallConn()
+	if err != nil {
+		return 0, err
+	}
+	var fd int
+	if err := rc.Control(func(s uintptr) { fd = int(s) }); err != nil {
+		return 0, err
+	}
+	return fd, nil
+}
+
+// readHandoffFiles receives exactly n descriptors sent by writeHandoffFiles.
+func readHandoffFiles(uc *net.UnixConn, n int) ([]*os.File, error) {
+	files := make([]*os.File, 0, n)
+	closeAll := func() {
+		for _, f := range files {
+			f.Close()
+		}
+	}
+
+	var b [1]byte
+	oob := make([]byte, syscall.CmsgSpace(handoffFDBatch*4))
+	for len(files) < n {
+		_, oobn, _, _, err := uc.ReadMsgUnix(b[:], oob)
+		if err != nil {
+			closeAll()
+			return nil, fmt.Errorf("failed to receive descriptors: %w", err)
+		}
+		msgs, err := syscall.ParseSocketControlMessage(oob[:oobn])
+		if err != nil {
+			closeAll()
+			return nil, fmt.Errorf("failed to parse descriptors: %w", err)
+		}
+		for _, msg := range msgs {
+			fds, err := syscall.ParseUnixRights(&msg)
+			if err != nil {
+				continue
+			}
+			for _, fd := range fds {
+				files = append(files, os.NewFile(uintptr(fd), "handoff"))
+			}
+		}
+	}
+	if len(files) != n {
+		closeAll()
+		return nil, fmt.Errorf("expected %d descriptors, got %d", n, len(files))
+	}
+	return files, nil
+}
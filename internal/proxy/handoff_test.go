@@ -0,0 +1,460 @@
+package proxy
+
+import (
+	"net"
+	"os"
+	"os/exec"
+	"syscall"
+	"testing"
+	"time"
+
+	"quic-relay/internal/handler"
+)
+
+// unixPair returns both ends of a connected Unix stream socket.
+func unixPair(t *testing.T) (*net.UnixConn, *net.UnixConn) {
+	t.Helper()
+	fds, err := syscall.Socketpair(syscall.AF_UNIX, syscall.SOCK_STREAM, 0)
+	if err != nil {
+		t.Fatalf("socketpair: %v", err)
+	}
+	conns := make([]*net.UnixConn, 2)
+	for i, fd := range fds {
+		f := os.NewFile(uintptr(fd), "pair")
+		c, err := net.FileConn(f)
+		f.Close()
+		if err != nil {
+			t.Fatalf("FileConn: %v", err)
+		}
+		conns[i] = c.(*net.UnixConn)
+	}
+	return conns[0], conns[1]
+}
+
+func listenUDP(t *testing.T) *net.UDPConn {
+	t.Helper()
+	conn, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatalf("listen: %v", err)
+	}
+	return conn
+}
+
+func TestHandOff_TransfersListenerAndSessions(t *testing.T) {
+	backend := listenUDP(t)
+	defer backend.Close()
+	client := listenUDP(t)
+	defer client.Close()
+
+	// Old process: listener plus one forwarded session
+	oldFwd, _ := handler.NewForwarderHandler(nil)
+	old := New("", handler.NewChain(oldFwd))
+	old.conn.Store(listenUDP(t))
+	listenAddr := old.conn.Load().LocalAddr().String()
+	go old.Run()
+	waitRunning(t, old)
+
+	dcid := []byte{1, 2, 3, 4, 5, 6, 7, 8}
+	ctx := &handler.Context{
+		ClientAddr: client.LocalAddr().(*net.UDPAddr),
+		Hello:      &handler.ClientHello{SNI: "play.example.com"},
+		ProxyConn:  old.conn.Load(),
+	}
+	ctx.Set("backend", backend.LocalAddr().String())
+	if result := oldFwd.OnConnect(ctx); result.Action != handler.Handled {
+		t.Fatalf("OnConnect: %v", result.Error)
+	}
+	ctx.Session.DCID = dcid
+	ctx.Session.SetProxyHeader([]byte("preamble"))
+	old.registerDCIDLength(len(dcid))
+	old.storeSession(string(dcid), ctx)
+	old.clientSessions.Store(client.LocalAddr().String(), string(dcid))
+	old.dcidAliases.Store("server-scid", string(dcid))
+
+	// New process inherits everything
+	newFwd, _ := handler.NewForwarderHandler(nil)
+	next := New("", handler.NewChain(newFwd))
+	defer next.Stop()
+
+	oldEnd, newEnd := unixPair(t)
+	defer oldEnd.Close()
+	defer newEnd.Close()
+
+	errCh := make(chan error, 1)
+	go func() { errCh <- next.Inherit(newEnd) }()
+
+	if err := old.HandOff(oldEnd); err != nil {
+		t.Fatalf("HandOff: %v", err)
+	}
+	if err := <-errCh; err != nil {
+		t.Fatalf("Inherit: %v", err)
+	}
+
+	if got := next.conn.Load().LocalAddr().String(); got != listenAddr {
+		t.Errorf("listener address = %s, want %s", got, listenAddr)
+	}
+	if next.SessionCount() != 1 {
+		t.Fatalf("expected 1 session, got %d", next.SessionCount())
+	}
+	if _, ok := next.dcidAliases.Load("server-scid"); !ok {
+		t.Error("alias was not transferred")
+	}
+
+	val, ok := next.sessions.Load(string(dcid))
+	if !ok {
+		t.Fatal("session not found by DCID")
+	}
+	restored := val.(*handler.Context)
+	if restored.Hello.SNI != "play.example.com" || restored.GetString("backend") != backend.LocalAddr().String() {
+		t.Errorf("session state not restored: sni=%q backend=%q", restored.Hello.SNI, restored.GetString("backend"))
+	}
+	if got := string(restored.Session.ProxyHeader()); got != "preamble" {
+		t.Errorf("PROXY header = %q, want %q", got, "preamble")
+	}
+
+	// Client -> backend through the inherited backend socket
+	packet := append([]byte{0x40}, dcid...)
+	packet = append(packet, []byte("ping")...)
+	next.handlePacket(next.conn.Load(), client.LocalAddr().(*net.UDPAddr), packet)
+
+	buf := make([]byte, 1500)
+	backend.SetReadDeadline(time.Now().Add(2 * time.Second))
+	n, from, err := backend.ReadFromUDP(buf)
+	if err != nil {
+		t.Fatalf("backend read: %v", err)
+	}
+	if string(buf[:n]) != string(packet) {
+		t.Errorf("backend got %q, want %q", buf[:n], packet)
+	}
+
+	// Backend -> client through the inherited listener
+	if _, err := backend.WriteToUDP([]byte("pong"), from); err != nil {
+		t.Fatalf("backend write: %v", err)
+	}
+	client.SetReadDeadline(time.Now().Add(2 * time.Second))
+	n, src, err := client.ReadFromUDP(buf)
+	if err != nil {
+		t.Fatalf("client read: %v", err)
+	}
+	if string(buf[:n]) != "pong" {
+		t.Errorf("client got %q, want %q", buf[:n], "pong")
+	}
+	if src.String() != listenAddr {
+		t.Errorf("reply came from %s, want %s", src, listenAddr)
+	}
+}
+
+func TestHandOff_RetiringListener(t *testing.T) {
+	backend := listenUDP(t)
+	defer backend.Close()
+	client := listenUDP(t)
+	defer client.Close()
+
+	oldFwd, _ := handler.NewForwarderHandler(nil)
+	old := New("", handler.NewChain(oldFwd))
+	old.conn.Store(listenUDP(t))
+	retiringAddr := old.conn.Load().LocalAddr().String()
+	go old.Run()
+	waitRunning(t, old)
+
+	// Session on the first listener, then move to a new address
+	dcid := []byte{1, 1, 2, 2, 3, 3, 4, 4}
+	ctx := &handler.Context{
+		ClientAddr: client.LocalAddr().(*net.UDPAddr),
+		Hello:      &handler.ClientHello{SNI: "play.example.com"},
+		ProxyConn:  old.conn.Load(),
+	}
+	ctx.Set("backend", backend.LocalAddr().String())
+	if result := oldFwd.OnConnect(ctx); result.Action != handler.Handled {
+		t.Fatalf("OnConnect: %v", result.Error)
+	}
+	ctx.Session.DCID = dcid
+	old.registerDCIDLength(len(dcid))
+	old.storeSession(string(dcid), ctx)
+	old.clientSessions.Store(client.LocalAddr().String(), string(dcid))
+
+	if err := old.Rebind("127.0.0.1:0"); err != nil {
+		t.Fatalf("Rebind: %v", err)
+	}
+	currentAddr := old.conn.Load().LocalAddr().String()
+
+	newFwd, _ := handler.NewForwarderHandler(nil)
+	next := New("", handler.NewChain(newFwd))
+	defer next.Stop()
+
+	oldEnd, newEnd := unixPair(t)
+	defer oldEnd.Close()
+	defer newEnd.Close()
+
+	errCh := make(chan error, 1)
+	go func() { errCh <- next.Inherit(newEnd) }()
+	if err := old.HandOff(oldEnd); err != nil {
+		t.Fatalf("HandOff: %v", err)
+	}
+	if err := <-errCh; err != nil {
+		t.Fatalf("Inherit: %v", err)
+	}
+
+	if got := next.conn.Load().LocalAddr().String(); got != currentAddr {
+		t.Errorf("listener address = %s, want %s", got, currentAddr)
+	}
+	val, ok := next.sessions.Load(string(dcid))
+	if !ok {
+		t.Fatal("session not found by DCID")
+	}
+	restored := val.(*handler.Context)
+	if got := restored.ProxyConn.LocalAddr().String(); got != retiringAddr {
+		t.Fatalf("session replies through %s, want retiring listener %s", got, retiringAddr)
+	}
+	if _, ok := next.retiring.Load(restored.ProxyConn); !ok {
+		t.Error("retiring listener was not registered")
+	}
+
+	// Backend -> client through the inherited retiring listener
+	packet := append([]byte{0x40}, dcid...)
+	next.handlePacket(restored.ProxyConn, client.LocalAddr().(*net.UDPAddr), packet)
+	buf := make([]byte, 1500)
+	backend.SetReadDeadline(time.Now().Add(2 * time.Second))
+	_, from, err := backend.ReadFromUDP(buf)
+	if err != nil {
+		t.Fatalf("backend read: %v", err)
+	}
+	if _, err := backend.WriteToUDP([]byte("pong"), from); err != nil {
+		t.Fatalf("backend write: %v", err)
+	}
+	client.SetReadDeadline(time.Now().Add(2 * time.Second))
+	_, src, err := client.ReadFromUDP(buf)
+	if err != nil {
+		t.Fatalf("client read: %v", err)
+	}
+	if src.String() != retiringAddr {
+		t.Errorf("reply came from %s, want %s", src, retiringAddr)
+	}
+}
+
+// handoffChildEnv makes the test binary act as the successor process in
+// TestHandOff_TwoProcesses, inheriting from the Unix socket on fd 3.
+const handoffChildEnv = "QUIC_RELAY_HANDOFF_TEST_CHILD"
+
+// runHandoffChild inherits from the parent test process and serves until killed.
+func runHandoffChild(t *testing.T) {
+	f := os.NewFile(3, "handoff")
+	c, err := net.FileConn(f)
+	f.Close()
+	if err != nil {
+		t.Fatalf("FileConn: %v", err)
+	}
+	fwd, _ := handler.NewForwarderHandler(nil)
+	p := New("", handler.NewChain(fwd))
+	if err := p.Inherit(c.(*net.UnixConn)); err != nil {
+		t.Fatalf("Inherit: %v", err)
+	}
+	c.Close()
+	if err := p.Run(); err != nil {
+		t.Fatalf("Run: %v", err)
+	}
+}
+
+func TestHandOff_TwoProcesses(t *testing.T) {
+	if os.Getenv(handoffChildEnv) == "1" {
+		runHandoffChild(t)
+		return
+	}
+
+	backend := listenUDP(t)
+	defer backend.Close()
+	client := listenUDP(t)
+	defer client.Close()
+
+	fwd, _ := handler.NewForwarderHandler(nil)
+	old := New("", handler.NewChain(fwd))
+	old.conn.Store(listenUDP(t))
+	listenAddr := old.conn.Load().LocalAddr().(*net.UDPAddr)
+	go old.Run()
+	waitRunning(t, old)
+
+	dcid := []byte{8, 7, 6, 5, 4, 3, 2, 1}
+	ctx := &handler.Context{
+		ClientAddr: client.LocalAddr().(*net.UDPAddr),
+		Hello:      &handler.ClientHello{SNI: "play.example.com"},
+		ProxyConn:  old.conn.Load(),
+	}
+	ctx.Set("backend", backend.LocalAddr().String())
+	if result := fwd.OnConnect(ctx); result.Action != handler.Handled {
+		t.Fatalf("OnConnect: %v", result.Error)
+	}
+	ctx.Session.DCID = dcid
+	old.registerDCIDLength(len(dcid))
+	old.storeSession(string(dcid), ctx)
+	old.clientSessions.Store(client.LocalAddr().String(), string(dcid))
+
+	// Successor: this test binary again, running only this test
+	fds, err := syscall.Socketpair(syscall.AF_UNIX, syscall.SOCK_STREAM|syscall.SOCK_CLOEXEC, 0)
+	if err != nil {
+		t.Fatalf("socketpair: %v", err)
+	}
+	parentFile := os.NewFile(uintptr(fds[0]), "parent")
+	childFile := os.NewFile(uintptr(fds[1]), "child")
+	defer parentFile.Close()
+
+	cmd := exec.Command(os.Args[0], "-test.run=^TestHandOff_TwoProcesses$")
+	cmd.Env = append(os.Environ(), handoffChildEnv+"=1")
+	cmd.ExtraFiles = []*os.File{childFile}
+	cmd.Stdout = os.Stdout
+	cmd.Stderr = os.Stderr
+	err = cmd.Start()
+	childFile.Close()
+	if err != nil {
+		t.Fatalf("start successor: %v", err)
+	}
+	defer func() {
+		cmd.Process.Kill()
+		cmd.Wait()
+	}()
+
+	c, err := net.FileConn(parentFile)
+	if err != nil {
+		t.Fatalf("FileConn: %v", err)
+	}
+	defer c.Close()
+	if err := old.HandOff(c.(*net.UnixConn)); err != nil {
+		t.Fatalf("HandOff: %v", err)
+	}
+
+	// Client -> backend through the successor's listener and backend socket
+	packet := append([]byte{0x40}, dcid...)
+	packet = append(packet, []byte("ping")...)
+	if _, err := client.WriteToUDP(packet, listenAddr); err != nil {
+		t.Fatalf("client write: %v", err)
+	}
+	buf := make([]byte, 1500)
+	backend.SetReadDeadline(time.Now().Add(5 * time.Second))
+	n, from, err := backend.ReadFromUDP(buf)
+	if err != nil {
+		t.Fatalf("backend read: %v", err)
+	}
+	if string(buf[:n]) != string(packet) {
+		t.Errorf("backend got %q, want %q", buf[:n], packet)
+	}
+
+	// Backend -> client through the successor
+	if _, err := backend.WriteToUDP([]byte("pong"), from); err != nil {
+		t.Fatalf("backend write: %v", err)
+	}
+	client.SetReadDeadline(time.Now().Add(5 * time.Second))
+	n, src, err := client.ReadFromUDP(buf)
+	if err != nil {
+		t.Fatalf("client read: %v", err)
+	}
+	if string(buf[:n]) != "pong" {
+		t.Errorf("client got %q, want %q", buf[:n], "pong")
+	}
+	if src.String() != listenAddr.String() {
+		t.Errorf("reply came from %s, want %s", src, listenAddr)
+	}
+}
+
+func TestHandOff_SuccessorNotReady(t *testing.T) {
+	old := New("", handler.NewChain())
+	old.conn.Store(listenUDP(t))
+	defer old.conn.Load().Close()
+
+	oldEnd, newEnd := unixPair(t)
+	defer oldEnd.Close()
+	newEnd.Close() // Successor died before signalling readiness
+
+	if err := old.HandOff(oldEnd); err == nil {
+		t.Fatal("expected error when successor is not ready")
+	}
+
+	select {
+	case <-old.Done():
+		t.Error("proxy should keep running after failed handoff")
+	default:
+	}
+}
+
+func TestHandOff_SuccessorNoAck(t *testing.T) {
+	backend := listenUDP(t)
+	defer backend.Close()
+	client := listenUDP(t)
+	defer client.Close()
+
+	fwd, _ := handler.NewForwarderHandler(nil)
+	old := New("", handler.NewChain(fwd))
+	old.conn.Store(listenUDP(t))
+	listenAddr := old.conn.Load().LocalAddr().(*net.UDPAddr)
+	go old.Run()
+	waitRunning(t, old)
+	defer old.Stop()
+
+	dcid := []byte{9, 9, 8, 8, 7, 7, 6, 6}
+	ctx := &handler.Context{
+		ClientAddr: client.LocalAddr().(*net.UDPAddr),
+		Hello:      &handler.ClientHello{SNI: "play.example.com"},
+		ProxyConn:  old.conn.Load(),
+	}
+	ctx.Set("backend", backend.LocalAddr().String())
+	if result := fwd.OnConnect(ctx); result.Action != handler.Handled {
+		t.Fatalf("OnConnect: %v", result.Error)
+	}
+	ctx.Session.DCID = dcid
+	old.registerDCIDLength(len(dcid))
+	old.storeSession(string(dcid), ctx)
+	old.clientSessions.Store(client.LocalAddr().String(), string(dcid))
+
+	// Successor takes the state, then dies before acknowledging
+	oldEnd, newEnd := unixPair(t)
+	defer oldEnd.Close()
+	go func() {
+		defer newEnd.Close()
+		newEnd.Write([]byte{handoffReady})
+		state, err := readHandoffState(newEnd)
+		if err != nil {
+			return
+		}
+		files, _ := readHandoffFiles(newEnd, 1+state.Retiring+len(state.Sessions))
+		for _, f := range files {
+			f.Close()
+		}
+	}()
+
+	if err := old.HandOff(oldEnd); err == nil {
+		t.Fatal("expected error when successor doesn't acknowledge")
+	}
+	select {
+	case <-old.Done():
+		t.Fatal("proxy should keep running after failed handoff")
+	default:
+	}
+	if old.SessionCount() != 1 {
+		t.Fatalf("expected 1 session, got %d", old.SessionCount())
+	}
+
+	// The old process still forwards the session both ways
+	packet := append([]byte{0x40}, dcid...)
+	packet = append(packet, []byte("ping")...)
+	if _, err := client.WriteToUDP(packet, listenAddr); err != nil {
+		t.Fatalf("client write: %v", err)
+	}
+	buf := make([]byte, 1500)
+	backend.SetReadDeadline(time.Now().Add(5 * time.Second))
+	n, from, err := backend.ReadFromUDP(buf)
+	if err != nil {
+		t.Fatalf("backend read: %v", err)
+	}
+	if string(buf[:n]) != string(packet) {
+		t.Errorf("backend got %q, want %q", buf[:n], packet)
+	}
+	if _, err := backend.WriteToUDP([]byte("pong"), from); err != nil {
+		t.Fatalf("backend write: %v", err)
+	}
+	client.SetReadDeadline(time.Now().Add(5 * time.Second))
+	n, _, err = client.ReadFromUDP(buf)
+	if err != nil {
+		t.Fatalf("client read: %v", err)
+	}
+	if string(buf[:n]) != "pong" {
+		t.Errorf("client got %q, want %q", buf[:n], "pong")
+	}
+}
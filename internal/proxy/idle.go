@@ -0,0 +1,187 @@
+package proxy
+
+import (
+	"container/heap"
+	"log"
+	"sync"
+	"time"
+
+	"quic-relay/internal/handler"
+)
+
+const (
+	// idleGrace is added to the client's max_idle_timeout. The connection's
+	// effective timeout can be slightly longer (at least 3 PTOs, RFC 9000
+	// Section 10.1), and packets in flight shouldn't find the session gone.
+	idleGrace = 5 * time.Second
+
+	// minCleanupInterval bounds how often idle sessions are swept when
+	// timeouts are short.
+	minCleanupInterval = time.Second
+)
+
+// sessionIdleTimeout returns how long a session may be idle before it is
+// removed: the handler override if set, else the client's advertised
+// max_idle_timeout (plus grace) capped at session_timeout, else session_timeout.
+func (p *Proxy) sessionIdleTimeout(ctx *handler.Context) time.Duration {
+	if d := ctx.IdleTimeout(); d > 0 {
+		return d
+	}
+	global := time.Duration(p.sessionTimeout.Load()) * time.Second
+	if d := clientIdleTimeout(ctx); d > 0 {
+		return min(d, global)
+	}
+	return global
+}
+
+// clientIdleTimeout returns the idle timeout derived from the client's
+// transport parameters, or 0 if it didn't advertise one.
+func clientIdleTimeout(ctx *handler.Context) time.Duration {
+	if ctx.Hello == nil || ctx.Hello.TransportParameters == nil || ctx.Hello.TransportParameters.MaxIdleTimeout == 0 {
+		return 0
+	}
+	return ctx.Hello.TransportParameters.MaxIdleTimeout + idleGrace
+}
+
+// sweepIdleSessions removes sessions idle for longer than their timeout and
+// returns the interval until the next sweep, within [minCleanupInterval,
+// cleanupInterval]. Only sessions that are due are looked at (see idleQueue),
+// so short timeouts don't make every sweep scan all sessions. With all, every
+// session is scheduled again first, to pick up timeouts changed since it was
+// scheduled (a reload or SetIdleTimeout); cleanupSessions does this every
+// cleanupInterval.
+func (p *Proxy) sweepIdleSessions(all bool) time.Duration {
+	now := time.Now()
+	if all {
+		p.sessions.Range(func(key, value any) bool {
+			p.scheduleIdle(key.(string), value.(*handler.Context), now)
+			return true
+		})
+	}
+
+	for _, e := range p.idle.due(now) {
+		if val, ok := p.sessions.Load(e.key); !ok || val != e.ctx {
+			continue // Removed or replaced meanwhile
+		}
+		timeout := p.sessionIdleTimeout(e.ctx)
+		if idle := e.ctx.Session.IdleDuration(); idle > timeout {
+			log.Printf("[proxy] cleaning up idle session: %s (idle %v, timeout %v)", e.key, idle, timeout)
+			e.ctx.Chain.OnDisconnect(e.ctx)
+			p.deleteSession(e.key, e.ctx)
+			continue
+		}
+		// Active since it was scheduled
+		p.scheduleIdle(e.key, e.ctx, now)
+	}
+
+	next, ok := p.idle.next()
+	if !ok {
+		return cleanupInterval
+	}
+	return min(max(next.Sub(now), minCleanupInterval), cleanupInterval)
+}
+
+// scheduleIdle queues a session to be checked when it would time out if it
+// stays idle from now on.
+func (p *Proxy) scheduleIdle(key string, ctx *handler.Context, now time.Time) {
+	if ctx.Session == nil {
+		return
+	}
+	p.idle.schedule(key, ctx, now.Add(p.sessionIdleTimeout(ctx)-ctx.Session.IdleDuration()))
+}
+
+// idleQueue orders sessions by the time they can time out at the earliest,
+// so a sweep only looks at the sessions that are due. Sessions active since
+// they were queued are queued again by the sweep.
+type idleQueue struct {
+	mu      sync.Mutex
+	heap    idleHeap
+	entries map[string]*idleEntry // Session key -> its entry in heap
+}
+
+type idleEntry struct {
+	key      string
+	ctx      *handler.Context
+	deadline time.Time
+	index    int // Position in idleHeap
+}
+
+// schedule queues a session for deadline, replacing its previous entry.
+func (q *idleQueue) schedule(key string, ctx *handler.Context, deadline time.Time) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	if e, ok := q.entries[key]; ok {
+		e.ctx, e.deadline = ctx, deadline
+		heap.Fix(&q.heap, e.index)
+		return
+	}
+	if q.entries == nil {
+		q.entries = make(map[string]*idleEntry)
+	}
+	e := &idleEntry{key: key, ctx: ctx, deadline: deadline}
+	q.entries[key] = e
+	heap.Push(&q.heap, e)
+}
+
+// remove drops the entry of a session, unless another session took its key.
+func (q *idleQueue) remove(key string, ctx *handler.Context) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	if e, ok := q.entries[key]; ok && e.ctx == ctx {
+		heap.Remove(&q.heap, e.index)
+		delete(q.entries, key)
+	}
+}
+
+// due removes and returns the entries whose deadline has passed.
+func (q *idleQueue) due(now time.Time) []*idleEntry {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	var due []*idleEntry
+	for len(q.heap) > 0 && !q.heap[0].deadline.After(now) {
+		e := heap.Pop(&q.heap).(*idleEntry)
+		delete(q.entries, e.key)
+		due = append(due, e)
+	}
+	return due
+}
+
+// next returns the earliest deadline, or false if nothing is queued.
+func (q *idleQueue) next() (time.Time, bool) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	if len(q.heap) == 0 {
+		return time.Time{}, false
+	}
+	return q.heap[0].deadline, true
+}
+
+// idleHeap implements heap.Interface, earliest deadline first.
+type idleHeap []*idleEntry
+
+func (h idleHeap) Len() int           { return len(h) }
+func (h idleHeap) Less(i, j int) bool { return h[i].deadline.Before(h[j].deadline) }
+
+func (h idleHeap) Swap(i, j int) {
+	h[i], h[j] = h[j], h[i]
+	h[i].index = i
+	h[j].index = j
+}
+
+func (h *idleHeap) Push(x any) {
+	e := x.(*idleEntry)
+	e.index = len(*h)
+	*h = append(*h, e)
+}
+
+func (h *idleHeap) Pop() any {
+	old := *h
+	e := old[len(old)-1]
+	old[len(old)-1] = nil
+	*h = old[:len(old)-1]
+	return e
+}
@@ -0,0 +1,94 @@
+package proxy
+
+import (
+	"testing"
+	"time"
+
+	"quic-relay/internal/handler"
+)
+
+// newIdleTestContext returns a session context idle for idle, whose client
+// advertised clientTimeout (0 = no transport parameters).
+func newIdleTestContext(idle, clientTimeout time.Duration) *handler.Context {
+	ctx := newDrainTestContext(idle)
+	if clientTimeout > 0 {
+		ctx.Hello = &handler.ClientHello{TransportParameters: &handler.TransportParameters{MaxIdleTimeout: clientTimeout}}
+	}
+	return ctx
+}
+
+func TestSessionIdleTimeout(t *testing.T) {
+	p := New("", handler.NewChain())
+	p.SetSessionTimeout(600)
+
+	if got := p.sessionIdleTimeout(newIdleTestContext(0, 0)); got != 600*time.Second {
+		t.Errorf("no transport parameters: %v, want session_timeout", got)
+	}
+	if got := p.sessionIdleTimeout(newIdleTestContext(0, 30*time.Second)); got != 30*time.Second+idleGrace {
+		t.Errorf("client timeout: %v, want 30s + grace", got)
+	}
+	if got := p.sessionIdleTimeout(newIdleTestContext(0, time.Hour)); got != 600*time.Second {
+		t.Errorf("client timeout above session_timeout: %v, want session_timeout", got)
+	}
+
+	// Handler override wins, even above session_timeout
+	ctx := newIdleTestContext(0, 30*time.Second)
+	ctx.SetIdleTimeout(time.Hour)
+	if got := p.sessionIdleTimeout(ctx); got != time.Hour {
+		t.Errorf("override: %v, want 1h", got)
+	}
+}
+
+func TestSweepIdleSessions(t *testing.T) {
+	p := New("", handler.NewChain())
+	p.SetSessionTimeout(600)
+
+	p.storeSession("dead", newIdleTestContext(time.Minute, 10*time.Second))    // Past 10s + grace
+	p.storeSession("alive", newIdleTestContext(5*time.Second, 10*time.Second)) // Within 10s + grace
+	p.storeSession("default", newIdleTestContext(time.Minute, 0))              // Within session_timeout
+
+	next := p.sweepIdleSessions(false)
+	if _, ok := p.sessions.Load("dead"); ok {
+		t.Error("session past its client idle timeout not removed")
+	}
+	for _, key := range []string{"alive", "default"} {
+		if _, ok := p.sessions.Load(key); !ok {
+			t.Errorf("session %q removed early", key)
+		}
+	}
+	// "alive" can time out in 10s: sweep again then
+	if want := 10 * time.Second; next > want || next < want-time.Second {
+		t.Errorf("next sweep in %v, want ~%v", next, want)
+	}
+
+	// Only long timeouts: back to the regular interval
+	alive, _ := p.sessions.Load("alive")
+	p.deleteSession("alive", alive.(*handler.Context))
+	if next := p.sweepIdleSessions(false); next != cleanupInterval {
+		t.Errorf("next sweep in %v, want %v", next, cleanupInterval)
+	}
+}
+
+func TestSweepIdleSessions_OnlyDue(t *testing.T) {
+	p := New("", handler.NewChain())
+	p.SetSessionTimeout(600)
+
+	// Timed out since it was scheduled, but not due yet: left for its sweep
+	ctx := newIdleTestContext(0, 0)
+	p.storeSession("quiet", ctx)
+	ctx.SetIdleTimeout(time.Nanosecond)
+	time.Sleep(time.Millisecond)
+	p.sweepIdleSessions(false)
+	if _, ok := p.sessions.Load("quiet"); !ok {
+		t.Fatal("session checked before it was due")
+	}
+
+	// A full sweep picks up the changed timeout
+	p.sweepIdleSessions(true)
+	if _, ok := p.sessions.Load("quiet"); ok {
+		t.Error("session past its new timeout not removed by a full sweep")
+	}
+	if _, ok := p.idle.next(); ok {
+		t.Error("removed session still queued")
+	}
+}
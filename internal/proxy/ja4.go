@@ -0,0 +1,120 @@
+package proxy
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"slices"
+	"strings"
+
+	"quic-relay/internal/handler"
+)
+
+// ja4 computes the JA4 fingerprint of a QUIC ClientHello
+// (https://github.com/FoxIO-LLC/ja4/blob/main/technical_details/JA4.md):
+//
+//	q13d0312h3_<ciphers hash>_<extensions hash>
+//
+// The first part is the protocol, highest TLS version, SNI present (d) or not
+// (i), cipher and extension counts, and the first and last character of the
+// first ALPN value. Ciphers and extensions are sorted before hashing, so
+// clients that randomize their order still get one fingerprint.
+func ja4(h *handler.ClientHello) string {
+	ciphers := withoutGREASE(h.CipherSuites)
+	extensions := withoutGREASE(h.Extensions)
+
+	sni := 'i'
+	if h.SNI != "" {
+		sni = 'd'
+	}
+	a := fmt.Sprintf("q%s%c%02d%02d%s", ja4Version(h), sni, min(len(ciphers), 99), min(len(extensions), 99), ja4ALPN(h.ALPNProtocols))
+
+	slices.Sort(ciphers)
+	b := ja4Hash(hexList(ciphers))
+
+	// SNI and ALPN are already covered by the first part
+	extensions = slices.DeleteFunc(extensions, func(e uint16) bool { return e == 0x0000 || e == 0x0010 })
+	slices.Sort(extensions)
+	c := "000000000000"
+	if len(extensions) > 0 {
+		s := hexList(extensions)
+		if sigs := withoutGREASE(h.SignatureAlgorithms); len(sigs) > 0 {
+			s += "_" + hexList(sigs) // In the order sent
+		}
+		c = ja4Hash(s)
+	}
+	return a + "_" + b + "_" + c
+}
+
+func ja4Version(h *handler.ClientHello) string {
+	v := h.Version
+	if versions := withoutGREASE(h.SupportedVersions); len(versions) > 0 {
+		v = slices.Max(versions)
+	}
+	switch v {
+	case 0x0304:
+		return "13"
+	case 0x0303:
+		return "12"
+	case 0x0302:
+		return "11"
+	case 0x0301:
+		return "10"
+	case 0x0300:
+		return "s3"
+	default:
+		return "00"
+	}
+}
+
+// ja4ALPN returns the first and last character of the first ALPN value, or
+// of its hex encoding if either isn't alphanumeric. "00" if there is none.
+func ja4ALPN(protocols []string) string {
+	if len(protocols) == 0 || protocols[0] == "" {
+		return "00"
+	}
+	p := protocols[0]
+	first, last := p[0], p[len(p)-1]
+	if !isAlnum(first) || !isAlnum(last) {
+		x := hex.EncodeToString([]byte(p))
+		return x[:1] + x[len(x)-1:]
+	}
+	return string([]byte{first, last})
+}
+
+func isAlnum(c byte) bool {
+	return c >= '0' && c <= '9' || c >= 'A' && c <= 'Z' || c >= 'a' && c <= 'z'
+}
+
+// ja4Hash returns the first 12 hex characters of the SHA-256 of s, or zeros if s is empty.
+func ja4Hash(s string) string {
+	if s == "" {
+		return "000000000000"
+	}
+	sum := sha256.Sum256([]byte(s))
+	return hex.EncodeToString(sum[:6])
+}
+
+func hexList(values []uint16) string {
+	parts := make([]string, len(values))
+	for i, v := range values {
+		parts[i] = fmt.Sprintf("%04x", v)
+	}
+	return strings.Join(parts, ",")
+}
+
+// isGREASE reports whether v is a GREASE value (RFC 8701): 0x0a0a, 0x1a1a, ... 0xfafa.
+func isGREASE(v uint16) bool {
+	return v&0x0f0f == 0x0a0a && v>>8 == v&0xff
+}
+
+// withoutGREASE returns a copy of values with GREASE values removed.
+func withoutGREASE(values []uint16) []uint16 {
+	out := make([]uint16, 0, len(values))
+	for _, v := range values {
+		if !isGREASE(v) {
+			out = append(out, v)
+		}
+	}
+	return out
+}
@@ -0,0 +1,160 @@
+package proxy
+
+import (
+	"encoding/binary"
+	"slices"
+	"testing"
+	"time"
+
+	"quic-relay/internal/handler"
+)
+
+// testExtension is a ClientHello extension for buildClientHello.
+type testExtension struct {
+	typ  uint16
+	data []byte
+}
+
+// buildClientHello encodes a TLS ClientHello handshake message.
+func buildClientHello(ciphers []uint16, exts []testExtension) []byte {
+	body := binary.BigEndian.AppendUint16(nil, 0x0303)
+	body = append(body, make([]byte, 32)...) // Random
+	body = append(body, 0)                   // Session ID
+	body = binary.BigEndian.AppendUint16(body, uint16(2*len(ciphers)))
+	for _, c := range ciphers {
+		body = binary.BigEndian.AppendUint16(body, c)
+	}
+	body = append(body, 1, 0) // Compression: null
+
+	var extData []byte
+	for _, e := range exts {
+		extData = binary.BigEndian.AppendUint16(extData, e.typ)
+		extData = binary.BigEndian.AppendUint16(extData, uint16(len(e.data)))
+		extData = append(extData, e.data...)
+	}
+	body = binary.BigEndian.AppendUint16(body, uint16(len(extData)))
+	body = append(body, extData...)
+
+	msg := []byte{0x01, byte(len(body) >> 16), byte(len(body) >> 8), byte(len(body))}
+	return append(msg, body...)
+}
+
+// u16List encodes values with a length prefix of prefixLen bytes.
+func u16List(prefixLen int, values ...uint16) []byte {
+	var b []byte
+	if prefixLen == 1 {
+		b = []byte{byte(2 * len(values))}
+	} else {
+		b = binary.BigEndian.AppendUint16(nil, uint16(2*len(values)))
+	}
+	for _, v := range values {
+		b = binary.BigEndian.AppendUint16(b, v)
+	}
+	return b
+}
+
+// chromeHello is the example from the JA4 specification, sent over QUIC.
+func chromeHello() []byte {
+	sni := []byte{0, 14, 0, 0, 11}
+	sni = append(sni, "example.com"...)
+	exts := []testExtension{
+		{0x2a2a, nil},
+		{0x0000, sni},
+		{0x0010, []byte{0, 3, 2, 'h', '2'}},
+		{0x0005, []byte{1, 0, 0, 0, 0}},
+		{0x000a, u16List(2, 0x3a3a, 0x001d, 0x0017, 0x0018)},
+		{0x000b, []byte{1, 0}},
+		{0x000d, u16List(2, 0x0403, 0x0804, 0x0401, 0x0503, 0x0805, 0x0501, 0x0806, 0x0601)},
+		{0x0012, nil},
+		{0x0015, nil},
+		{0x0017, nil},
+		{0x001b, []byte{2, 0, 2}},
+		{0x0023, nil},
+		{0x002b, u16List(1, 0x4a4a, 0x0304, 0x0303)},
+		{0x002d, []byte{1, 1}},
+		{0x0033, []byte{0, 41, 0x0a, 0x0a, 0, 1, 0, 0x00, 0x1d, 0, 32}}, // GREASE share with a 1-byte key, then X25519
+		{0x4469, nil},
+		{0xff01, []byte{0}},
+		{0x0039, []byte{0x01, 0x02, 0x67, 0x10}},
+	}
+	exts[14].data = append(exts[14].data, make([]byte, 32)...) // X25519 public key
+	ciphers := []uint16{0x1a1a, 0x1301, 0x1302, 0x1303, 0xc02b, 0xc02f, 0xc02c, 0xc030, 0xcca9, 0xcca8, 0xc013, 0xc014, 0x009c, 0x009d, 0x002f, 0x0035}
+	return buildClientHello(ciphers, exts)
+}
+
+func TestParseTLSClientHello_Full(t *testing.T) {
+	hello, err := parseTLSClientHello(chromeHello())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if hello.SNI != "example.com" || !slices.Equal(hello.ALPNProtocols, []string{"h2"}) {
+		t.Errorf("SNI=%q ALPN=%v", hello.SNI, hello.ALPNProtocols)
+	}
+	if hello.Version != 0x0303 || len(hello.CipherSuites) != 16 || hello.CipherSuites[1] != 0x1301 {
+		t.Errorf("Version=%04x CipherSuites=%04x", hello.Version, hello.CipherSuites)
+	}
+	if len(hello.Extensions) != 18 || hello.Extensions[0] != 0x2a2a || hello.Extensions[17] != 0x0039 {
+		t.Errorf("Extensions=%04x", hello.Extensions)
+	}
+	if !slices.Equal(hello.SupportedGroups, []uint16{0x3a3a, 0x001d, 0x0017, 0x0018}) {
+		t.Errorf("SupportedGroups=%04x", hello.SupportedGroups)
+	}
+	if !slices.Equal(hello.SupportedVersions, []uint16{0x4a4a, 0x0304, 0x0303}) {
+		t.Errorf("SupportedVersions=%04x", hello.SupportedVersions)
+	}
+	if len(hello.SignatureAlgorithms) != 8 || hello.SignatureAlgorithms[0] != 0x0403 {
+		t.Errorf("SignatureAlgorithms=%04x", hello.SignatureAlgorithms)
+	}
+	if !slices.Equal(hello.KeyShares, []uint16{0x0a0a, 0x001d}) {
+		t.Errorf("KeyShares=%04x", hello.KeyShares)
+	}
+	if !slices.Equal(hello.RawTransportParameters, []byte{0x01, 0x02, 0x67, 0x10}) {
+		t.Errorf("RawTransportParameters=%x", hello.RawTransportParameters)
+	}
+	if tp := hello.TransportParameters; tp == nil || tp.MaxIdleTimeout != 10*time.Second {
+		t.Errorf("TransportParameters=%+v", tp)
+	}
+}
+
+func TestJA4(t *testing.T) {
+	hello, err := parseTLSClientHello(chromeHello())
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Hashes from the JA4 specification's example; 0x0039 is the one extension
+	// not in it, so only the third part differs.
+	want := "q13d1517h2_8daaf6152771_"
+	if hello.JA4[:len(want)] != want {
+		t.Errorf("JA4 = %s, want prefix %s", hello.JA4, want)
+	}
+
+	hello.Extensions = slices.DeleteFunc(hello.Extensions, func(e uint16) bool { return e == 0x0039 })
+	if got := ja4(hello); got != "q13d1516h2_8daaf6152771_e5627efa2ab1" {
+		t.Errorf("JA4 = %s, want q13d1516h2_8daaf6152771_e5627efa2ab1", got)
+	}
+
+	// Extension order doesn't matter
+	slices.Reverse(hello.Extensions)
+	if got := ja4(hello); got != "q13d1516h2_8daaf6152771_e5627efa2ab1" {
+		t.Errorf("JA4 changed with extension order: %s", got)
+	}
+}
+
+func TestJA4_Edges(t *testing.T) {
+	for _, tt := range []struct {
+		hello handler.ClientHello
+		want  string
+	}{
+		{handler.ClientHello{Version: 0x0303}, "q12i000000_000000000000_000000000000"},
+		{handler.ClientHello{Version: 0x0303, ALPNProtocols: []string{"hytale/1"}}, "q12i0000h1_000000000000_000000000000"},
+		{handler.ClientHello{Version: 0x0303, ALPNProtocols: []string{"\x00ab\xff"}}, "q12i00000f_000000000000_000000000000"},
+		{handler.ClientHello{Version: 0x0303, ALPNProtocols: []string{"x"}}, "q12i0000xx_000000000000_000000000000"},
+	} {
+		if got := ja4(&tt.hello); got != tt.want {
+			t.Errorf("ja4(%+v) = %s, want %s", tt.hello, got, tt.want)
+		}
+	}
+	if !isGREASE(0xfafa) || isGREASE(0x0a1a) || isGREASE(0x1301) {
+		t.Error("isGREASE")
+	}
+}
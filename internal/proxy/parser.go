@@ -13,6 +13,7 @@ import (
 
 	"quic-relay/internal/debug"
 	"quic-relay/internal/handler"
+	"quic-relay/internal/quicvarint"
 )
 
 // QUIC Version 1 constants
@@ -248,7 +249,7 @@ func ExtractAllSCIDs(datagram []byte) [][]byte {
 		if headerOffset >= len(pkt) {
 			break
 		}
-		pktLen, lenBytes, err := readVarInt(pkt[headerOffset:])
+		pktLen, lenBytes, err := quicvarint.Read(pkt[headerOffset:])
 		if err != nil || lenBytes == 0 {
 			break
 		}
@@ -326,7 +327,7 @@ func ExtractCryptoFramesFromPacket(packet []byte) ([]CryptoFrame, error) {
 	offset += scidLen
 
 	// Token Length
-	tokenLen, n, err := readVarInt(packet[offset:])
+	tokenLen, n, err := quicvarint.Read(packet[offset:])
 	if err != nil {
 		return nil, fmt.Errorf("failed to read token length: %w", err)
 	}
@@ -334,7 +335,7 @@ func ExtractCryptoFramesFromPacket(packet []byte) ([]CryptoFrame, error) {
 	offset += int(tokenLen)
 
 	// Payload Length
-	payloadLen, n, err := readVarInt(packet[offset:])
+	payloadLen, n, err := quicvarint.Read(packet[offset:])
 	if err != nil {
 		return nil, fmt.Errorf("failed to read payload length: %w", err)
 	}
@@ -553,7 +554,7 @@ func extractCryptoFrames(data []byte) []CryptoFrame {
 	offset := 0
 
 	for offset < len(data) {
-		frameType, n, err := readVarInt(data[offset:])
+		frameType, n, err := quicvarint.Read(data[offset:])
 		if err != nil {
 			break
 		}
@@ -569,25 +570,25 @@ func extractCryptoFrames(data []byte) []CryptoFrame {
 			// No payload
 		case 0x02, 0x03: // ACK (RFC 9000 Section 19.3)
 			// Largest Acknowledged
-			if _, n, err := readVarInt(data[offset:]); err != nil {
+			if _, n, err := quicvarint.Read(data[offset:]); err != nil {
 				return frames
 			} else {
 				offset += n
 			}
 			// ACK Delay
-			if _, n, err := readVarInt(data[offset:]); err != nil {
+			if _, n, err := quicvarint.Read(data[offset:]); err != nil {
 				return frames
 			} else {
 				offset += n
 			}
 			// ACK Range Count
-			rangeCount, n, err := readVarInt(data[offset:])
+			rangeCount, n, err := quicvarint.Read(data[offset:])
 			if err != nil {
 				return frames
 			}
 			offset += n
 			// First ACK Range
-			if _, n, err := readVarInt(data[offset:]); err != nil {
+			if _, n, err := quicvarint.Read(data[offset:]); err != nil {
 				return frames
 			} else {
 				offset += n
@@ -595,13 +596,13 @@ func extractCryptoFrames(data []byte) []CryptoFrame {
 			// ACK Ranges
 			for i := uint64(0); i < rangeCount; i++ {
 				// Gap
-				if _, n, err := readVarInt(data[offset:]); err != nil {
+				if _, n, err := quicvarint.Read(data[offset:]); err != nil {
 					return frames
 				} else {
 					offset += n
 				}
 				// ACK Range Length
-				if _, n, err := readVarInt(data[offset:]); err != nil {
+				if _, n, err := quicvarint.Read(data[offset:]); err != nil {
 					return frames
 				} else {
 					offset += n
@@ -610,7 +611,7 @@ func extractCryptoFrames(data []byte) []CryptoFrame {
 			// ECN Counts (only for type 0x03)
 			if frameType == 0x03 {
 				for i := 0; i < 3; i++ {
-					if _, n, err := readVarInt(data[offset:]); err != nil {
+					if _, n, err := quicvarint.Read(data[offset:]); err != nil {
 						return frames
 					} else {
 						offset += n
@@ -619,14 +620,14 @@ func extractCryptoFrames(data []byte) []CryptoFrame {
 			}
 		case 0x06: // CRYPTO
 			// Offset (variable-length integer)
-			cryptoOffset, n, err := readVarInt(data[offset:])
+			cryptoOffset, n, err := quicvarint.Read(data[offset:])
 			if err != nil {
 				break
 			}
 			offset += n
 
 			// Length (variable-length integer)
-			length, n, err := readVarInt(data[offset:])
+			length, n, err := quicvarint.Read(data[offset:])
 			if err != nil {
 				break
 			}
@@ -719,9 +720,17 @@ func parseTLSClientHello(data []byte) (*handler.ClientHello, error) {
 		return nil, errors.New("ClientHello truncated")
 	}
 
+	data = data[:4+hsLen]
 	offset := 4
 
 	// Client Version (2 bytes)
+	if len(data) < offset+2+32 {
+		return nil, errors.New("ClientHello too short for random")
+	}
+	hello := &handler.ClientHello{
+		Raw:     data,
+		Version: binary.BigEndian.Uint16(data[offset:]),
+	}
 	offset += 2
 
 	// Random (32 bytes)
@@ -741,6 +750,10 @@ func parseTLSClientHello(data []byte) (*handler.ClientHello, error) {
 	}
 	cipherSuitesLen := int(data[offset])<<8 | int(data[offset+1])
 	offset += 2
+	if offset+cipherSuitesLen > len(data) {
+		return nil, errors.New("ClientHello cipher suites truncated")
+	}
+	hello.CipherSuites = parseUint16List(data[offset : offset+cipherSuitesLen])
 	offset += cipherSuitesLen
 
 	// Compression Methods Length
@@ -759,10 +772,6 @@ func parseTLSClientHello(data []byte) (*handler.ClientHello, error) {
 	offset += 2
 
 	// Parse extensions
-	hello := &handler.ClientHello{
-		Raw: data,
-	}
-
 	extEnd := offset + extensionsLen
 	debug.Printf(" parsing extensions: len=%d, extEnd=%d, dataLen=%d", extensionsLen, extEnd, len(data))
 	for offset < extEnd && offset+4 <= len(data) {
@@ -777,22 +786,78 @@ func parseTLSClientHello(data []byte) (*handler.ClientHello, error) {
 			debug.Printf(" extension truncated: offset=%d extLen=%d dataLen=%d", offset, extLen, len(data))
 			break
 		}
+		hello.Extensions = append(hello.Extensions, uint16(extType))
+		ext := data[offset : offset+extLen]
 
 		switch extType {
 		case 0x00: // SNI
-			hello.SNI = parseSNI(data[offset : offset+extLen])
+			hello.SNI = parseSNI(ext)
 			debug.Printf(" parsed SNI=%q", hello.SNI)
 		case 0x10: // ALPN
-			hello.ALPNProtocols = parseALPN(data[offset : offset+extLen])
+			hello.ALPNProtocols = parseALPN(ext)
 			debug.Printf(" parsed ALPN=%v", hello.ALPNProtocols)
+		case 0x0a: // supported_groups
+			if len(ext) >= 2 {
+				hello.SupportedGroups = parseUint16List(ext[2:])
+			}
+		case 0x0d: // signature_algorithms
+			if len(ext) >= 2 {
+				hello.SignatureAlgorithms = parseUint16List(ext[2:])
+			}
+		case 0x2b: // supported_versions (1-byte list length in a ClientHello)
+			if len(ext) >= 1 {
+				hello.SupportedVersions = parseUint16List(ext[1:])
+			}
+		case 0x33: // key_share
+			hello.KeyShares = parseKeyShares(ext)
+		case 0x39: // quic_transport_parameters
+			hello.RawTransportParameters = ext
+			tp, err := parseTransportParameters(ext)
+			if err != nil {
+				debug.Printf(" malformed transport parameters: %v", err)
+				break
+			}
+			hello.TransportParameters = tp
 		}
 
 		offset += extLen
 	}
 
+	hello.JA4 = ja4(hello)
 	return hello, nil
 }
 
+// parseUint16List decodes a list of big-endian uint16 values, ignoring a trailing odd byte.
+func parseUint16List(data []byte) []uint16 {
+	if len(data) < 2 {
+		return nil
+	}
+	list := make([]uint16, len(data)/2)
+	for i := range list {
+		list[i] = binary.BigEndian.Uint16(data[2*i:])
+	}
+	return list
+}
+
+// parseKeyShares extracts the groups from a key_share extension.
+func parseKeyShares(data []byte) []uint16 {
+	if len(data) < 2 {
+		return nil
+	}
+	var groups []uint16
+	offset := 2
+	for offset+4 <= len(data) {
+		group := binary.BigEndian.Uint16(data[offset:])
+		keyLen := int(binary.BigEndian.Uint16(data[offset+2:]))
+		offset += 4 + keyLen
+		if offset > len(data) {
+			break
+		}
+		groups = append(groups, group)
+	}
+	return groups
+}
+
 // parseSNI extracts the server name from SNI extension.
 func parseSNI(data []byte) string {
 	if len(data) < 5 {
@@ -841,35 +906,3 @@ func parseALPN(data []byte) []string {
 
 	return protocols
 }
-
-// readVarInt reads a QUIC variable-length integer.
-func readVarInt(data []byte) (uint64, int, error) {
-	if len(data) == 0 {
-		return 0, 0, errors.New("empty data")
-	}
-
-	prefix := data[0] >> 6
-	length := 1 << prefix
-
-	if len(data) < length {
-		return 0, 0, errors.New("data too short for varint")
-	}
-
-	var value uint64
-	switch length {
-	case 1:
-		value = uint64(data[0] & 0x3f)
-	case 2:
-		value = uint64(data[0]&0x3f)<<8 | uint64(data[1])
-	case 4:
-		value = uint64(data[0]&0x3f)<<24 | uint64(data[1])<<16 |
-			uint64(data[2])<<8 | uint64(data[3])
-	case 8:
-		value = uint64(data[0]&0x3f)<<56 | uint64(data[1])<<48 |
-			uint64(data[2])<<40 | uint64(data[3])<<32 |
-			uint64(data[4])<<24 | uint64(data[5])<<16 |
-			uint64(data[6])<<8 | uint64(data[7])
-	}
-
-	return value, length, nil
-}
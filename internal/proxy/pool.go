@@ -10,9 +10,11 @@ import (
 
 // WorkItem represents a UDP packet to be processed by a worker.
 type WorkItem struct {
+	Conn       *net.UDPConn // Listener the packet arrived on
 	ClientAddr *net.UDPAddr
 	Packet     []byte
 	Buffer     *[]byte // Reference for returning to pool
+	Task       func()  // If set, run instead of handling a packet (see Run)
 }
 
 // WorkerPool manages a sharded pool of packet processing workers.
@@ -21,7 +23,9 @@ type WorkItem struct {
 type WorkerPool struct {
 	queues        []chan WorkItem
 	wg            sync.WaitGroup
-	handler       func(*net.UDPAddr, []byte)
+	mu            sync.RWMutex // Held by Run while queueing, so Stop can't close a queue under it
+	stopped       bool
+	handler       func(*net.UDPConn, *net.UDPAddr, []byte)
 	workers       int
 	queuePerShard int
 	dropped       []uint64 // Per-shard drop counters (atomic)
@@ -30,7 +34,7 @@ type WorkerPool struct {
 // NewWorkerPool creates a sharded worker pool.
 // workers: number of workers/shards (0 = NumCPU * 2)
 // queueSize: total queue capacity across all shards (0 = 10000)
-func NewWorkerPool(workers, queueSize int, handler func(*net.UDPAddr, []byte)) *WorkerPool {
+func NewWorkerPool(workers, queueSize int, handler func(*net.UDPConn, *net.UDPAddr, []byte)) *WorkerPool {
 	if workers <= 0 {
 		workers = runtime.NumCPU() * 2
 	}
@@ -68,9 +72,12 @@ func (p *WorkerPool) Start() {
 
 // Stop gracefully shuts down the pool and waits for workers to finish.
 func (p *WorkerPool) Stop() {
+	p.mu.Lock()
+	p.stopped = true
 	for i := 0; i < p.workers; i++ {
 		close(p.queues[i])
 	}
+	p.mu.Unlock()
 	p.wg.Wait()
 }
 
@@ -91,6 +98,53 @@ func (p *WorkerPool) Submit(item WorkItem) bool {
 	}
 }
 
+// Run runs fn on the worker of addr's shard, after the packets from addr
+// queued before it, so it never runs concurrently with them. fn is never
+// dropped: if the queue is full, a goroutine waits for room, and if the pool
+// is stopped, fn runs on the calling goroutine.
+func (p *WorkerPool) Run(addr *net.UDPAddr, fn func()) {
+	idx := hashAddr(addr) % uint32(p.workers)
+	item := WorkItem{ClientAddr: addr, Task: fn}
+	p.mu.RLock()
+	if p.stopped {
+		p.mu.RUnlock()
+		fn()
+		return
+	}
+	select {
+	case p.queues[idx] <- item:
+		p.mu.RUnlock()
+	default:
+		p.mu.RUnlock()
+		go p.queueTask(idx, item)
+	}
+}
+
+// queueTask waits for room in a full queue for a task of Run.
+func (p *WorkerPool) queueTask(idx uint32, item WorkItem) {
+	p.mu.RLock()
+	defer p.mu.RUnlock()
+	if p.stopped {
+		item.Task()
+		return
+	}
+	p.queues[idx] <- item
+}
+
+// Flush waits until every packet queued before the call has been handled.
+func (p *WorkerPool) Flush() {
+	var wg sync.WaitGroup
+	p.mu.RLock()
+	if !p.stopped {
+		for i := 0; i < p.workers; i++ {
+			wg.Add(1)
+			p.queues[i] <- WorkItem{Task: wg.Done}
+		}
+	}
+	p.mu.RUnlock()
+	wg.Wait()
+}
+
 // Dropped returns total dropped packets across all shards.
 func (p *WorkerPool) Dropped() uint64 {
 	var total uint64
@@ -112,7 +166,11 @@ func (p *WorkerPool) QueueSize() int {
 func (p *WorkerPool) worker(id int) {
 	defer p.wg.Done()
 	for item := range p.queues[id] {
-		p.handler(item.ClientAddr, item.Packet)
+		if item.Task != nil {
+			item.Task()
+			continue
+		}
+		p.handler(item.Conn, item.ClientAddr, item.Packet)
 		if item.Buffer != nil {
 			handler.PutBuffer(item.Buffer)
 		}
@@ -11,7 +11,7 @@ import (
 func TestWorkerPool_Submit(t *testing.T) {
 	var processed atomic.Int32
 
-	pool := NewWorkerPool(2, 100, func(addr *net.UDPAddr, packet []byte) {
+	pool := NewWorkerPool(2, 100, func(conn *net.UDPConn, addr *net.UDPAddr, packet []byte) {
 		processed.Add(1)
 	})
 	pool.Start()
@@ -35,7 +35,7 @@ func TestWorkerPool_Submit(t *testing.T) {
 
 func TestWorkerPool_Backpressure(t *testing.T) {
 	// Create pool with tiny queue (min queuePerShard is 100, so we need more items)
-	pool := NewWorkerPool(1, 100, func(addr *net.UDPAddr, packet []byte) {
+	pool := NewWorkerPool(1, 100, func(conn *net.UDPConn, addr *net.UDPAddr, packet []byte) {
 		// Simulate slow processing
 		time.Sleep(10 * time.Millisecond)
 	})
@@ -65,7 +65,7 @@ func TestWorkerPool_Backpressure(t *testing.T) {
 func TestWorkerPool_Stop(t *testing.T) {
 	var processed atomic.Int32
 
-	pool := NewWorkerPool(4, 100, func(addr *net.UDPAddr, packet []byte) {
+	pool := NewWorkerPool(4, 100, func(conn *net.UDPConn, addr *net.UDPAddr, packet []byte) {
 		processed.Add(1)
 	})
 	pool.Start()
@@ -87,7 +87,7 @@ func TestWorkerPool_Stop(t *testing.T) {
 }
 
 func TestWorkerPool_QueueSize(t *testing.T) {
-	pool := NewWorkerPool(1, 100, func(addr *net.UDPAddr, packet []byte) {
+	pool := NewWorkerPool(1, 100, func(conn *net.UDPConn, addr *net.UDPAddr, packet []byte) {
 		time.Sleep(10 * time.Millisecond)
 	})
 	pool.Start()
@@ -109,7 +109,7 @@ func TestWorkerPool_QueueSize(t *testing.T) {
 func TestWorkerPool_BufferReturn(t *testing.T) {
 	var bufferReturned atomic.Bool
 
-	pool := NewWorkerPool(1, 10, func(addr *net.UDPAddr, packet []byte) {
+	pool := NewWorkerPool(1, 10, func(conn *net.UDPConn, addr *net.UDPAddr, packet []byte) {
 		// Do nothing
 	})
 	pool.Start()
@@ -141,7 +141,7 @@ func TestWorkerPool_BufferReturn(t *testing.T) {
 }
 
 func TestNewWorkerPool_Defaults(t *testing.T) {
-	pool := NewWorkerPool(0, 0, func(addr *net.UDPAddr, packet []byte) {})
+	pool := NewWorkerPool(0, 0, func(conn *net.UDPConn, addr *net.UDPAddr, packet []byte) {})
 
 	if pool.workers <= 0 {
 		t.Error("workers should be set to default when 0")
@@ -150,3 +150,35 @@ func TestNewWorkerPool_Defaults(t *testing.T) {
 		t.Error("queuePerShard should be set to default when 0")
 	}
 }
+
+func TestWorkerPool_Run(t *testing.T) {
+	var packets atomic.Int32
+	release := make(chan struct{})
+	pool := NewWorkerPool(1, 100, func(conn *net.UDPConn, addr *net.UDPAddr, packet []byte) {
+		<-release
+		packets.Add(1)
+	})
+	pool.Start()
+	addr := &net.UDPAddr{IP: net.ParseIP("127.0.0.1"), Port: 1234}
+
+	// Fill the queue: the task waits for room instead of being dropped, and
+	// runs after the packets queued before it
+	var want int32
+	for pool.Submit(WorkItem{ClientAddr: addr, Packet: []byte{0x01}}) {
+		want++
+	}
+	done := make(chan int32)
+	pool.Run(addr, func() { done <- packets.Load() })
+	close(release)
+	if got := <-done; got != want {
+		t.Errorf("task ran after %d packets, want %d", got, want)
+	}
+
+	// After Stop, tasks run on the caller
+	pool.Stop()
+	ran := false
+	pool.Run(addr, func() { ran = true })
+	if !ran {
+		t.Error("task not run after Stop")
+	}
+}
@@ -6,7 +6,9 @@ import (
 	"context"
 	"crypto/aes"
 	"crypto/cipher"
+	"crypto/rand"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"log"
 	"net"
@@ -16,6 +18,7 @@ import (
 	"sync/atomic"
 	"time"
 
+	"quic-relay/internal/ban"
 	"quic-relay/internal/debug"
 	"quic-relay/internal/handler"
 )
@@ -25,6 +28,13 @@ type Config struct {
 	Listen         string                  `json:"listen"`
 	Handlers       []handler.HandlerConfig `json:"handlers"`
 	SessionTimeout int                     `json:"session_timeout,omitempty"` // Idle timeout in seconds (default: 600)
+
+	// Graceful shutdown: stop accepting new connections and wait for sessions to end
+	DrainTimeout     int `json:"drain_timeout,omitempty"`      // Max drain duration in seconds (default: 0 = stop immediately)
+	DrainIdleTimeout int `json:"drain_idle_timeout,omitempty"` // Idle timeout in seconds while draining (default: 30)
+
+	Retry *RetryConfig `json:"retry,omitempty"` // Stateless Retry under load (default: disabled)
+	Ban   *ban.Config  `json:"ban,omitempty"`   // Ban list (default: disabled)
 }
 
 // LoadConfig loads configuration from a JSON file.
@@ -45,6 +55,14 @@ func ParseConfig(data []byte) (*Config, error) {
 	return &cfg, nil
 }
 
+// CheckConfig checks settings that depend on the handler chain built from cfg.
+func CheckConfig(cfg *Config, chain *handler.Chain) error {
+	if cfg.Retry != nil && !chain.SendsProxyHeaders() {
+		return errors.New("retry requires the forwarder's proxy_protocol for all backends: backends learn the Retry connection IDs from the PROXY protocol header")
+	}
+	return nil
+}
+
 // CryptoAssembler collects CRYPTO frames from multiple Initial packets.
 // Production-ready: bounded memory, timeout-based cleanup, cached crypto objects.
 type CryptoAssembler struct {
@@ -68,10 +86,14 @@ const (
 	assemblerTimeout    = 5 * time.Second          // Clean up incomplete assemblers after 5s
 
 	// Bounds for maps to prevent unbounded memory growth
-	maxSessions       = 100000
-	maxAssemblers     = 50000
-	maxPendingPerDCID = 10 // Max buffered packets per DCID
-	cleanupInterval   = 30 * time.Second
+	maxSessions           = 100000
+	maxAssemblers         = 50000
+	maxPendingPerDCID     = 10              // Max buffered packets per DCID
+	maxAliasesPerSession  = 8               // Max server SCIDs learned per session
+	pendingConnectTimeout = 3 * time.Second // Max time handlers may keep OnConnect Pending
+	cleanupInterval       = 30 * time.Second
+
+	handlerShutdownTimeout = 10 * time.Second // Max time for handlers to release resources
 )
 
 // pendingPacket holds a packet that arrived before its session was created.
@@ -243,18 +265,41 @@ func (a *CryptoAssembler) GetCrypto() (cipher.Block, cipher.AEAD, []byte) {
 // Proxy is the main UDP proxy server.
 type Proxy struct {
 	listenAddr     string
-	conn           *net.UDPConn
+	conn           atomic.Pointer[net.UDPConn]   // Current listener (swapped by Rebind)
+	listeners      sync.WaitGroup                // Running read loops (current and retiring listeners)
+	listenersMu    sync.Mutex                    // Orders listeners.Add in Rebind against Wait in Run
+	retiring       sync.Map                      // *net.UDPConn -> struct{}: listeners replaced by Rebind, still serving their sessions
 	chain          atomic.Pointer[handler.Chain] // Atomic for hot reload
+	retired        sync.Map                      // *handler.Chain replaced by a reload, still pinned by sessions (see chains.go)
+	chainShutdowns sync.WaitGroup                // Shutdowns of retired chains in progress
 	sessionTimeout atomic.Int64                  // Idle timeout in seconds (atomic for hot reload)
+	drainTimeout   atomic.Int64                  // Max drain duration in seconds (atomic for hot reload)
+	drainIdle      atomic.Int64                  // Idle timeout in seconds while draining
+	draining       atomic.Bool                   // Set by Drain: new connections are rejected
 	sessions       sync.Map                      // DCID (string) -> *handler.Context
 	sessionCount   atomic.Int64                  // O(1) session counter
 	assemblers     sync.Map                      // DCID (string) -> *CryptoAssembler
 	pendingPackets sync.Map                      // DCID (string) -> *pendingBuffer (out-of-order packets)
+	connecting     sync.Map                      // DCID (string) -> *handler.Context (OnConnect Pending)
 	dcidAliases    sync.Map                      // Server SCID (string) -> original DCID (string)
 	clientSessions sync.Map                      // Client address (string) -> original DCID (string)
+	idle           idleQueue                     // Sessions by when they can time out (see idle.go)
 	workerPool     *WorkerPool
 	ctx            context.Context
 	cancel         context.CancelFunc
+	runDone        chan struct{} // Closed when the Run read loop exits
+	handingOff     atomic.Bool   // Listener is being passed to a successor (see HandOff)
+	stopOnce       sync.Once
+
+	// Stateless Retry (see retry.go)
+	retry         atomic.Pointer[retryGuard] // nil = disabled
+	retryKey      []byte                     // Token MAC key, random per process
+	retriesSent   atomic.Int64
+	retryAccepted atomic.Int64
+	retryRejected atomic.Int64
+
+	rejected rejectCounters           // Packets dropped by the sanity filter (see filter.go)
+	bans     atomic.Pointer[ban.List] // nil = banning disabled (see bans.go)
 
 	// DCID length tracking for Short Header parsing
 	dcidLengths   map[int]struct{}
@@ -271,9 +316,13 @@ func New(listenAddr string, chain *handler.Chain) *Proxy {
 		dcidLengths: make(map[int]struct{}),
 		ctx:         ctx,
 		cancel:      cancel,
+		runDone:     make(chan struct{}),
+		retryKey:    make([]byte, 32),
 	}
+	rand.Read(p.retryKey)
 	p.chain.Store(chain)
 	p.sessionTimeout.Store(defaultSessionTimeout)
+	p.drainIdle.Store(defaultDrainIdleTimeout)
 	return p
 }
 
@@ -286,57 +335,98 @@ func (p *Proxy) SetSessionTimeout(seconds int) {
 	p.sessionTimeout.Store(int64(seconds))
 }
 
-// ReloadChain atomically replaces the handler chain.
-// Existing sessions continue with their established connections.
-func (p *Proxy) ReloadChain(chain *handler.Chain) {
-	p.chain.Store(chain)
-}
-
 // Run starts the proxy server.
+// Blocks until the proxy is stopped or has handed off to a successor.
 func (p *Proxy) Run() error {
 	// Start coarse clock for efficient session activity tracking
 	handler.StartCoarseClock(p.ctx)
 
-	addr, err := net.ResolveUDPAddr("udp", p.listenAddr)
-	if err != nil {
-		return fmt.Errorf("failed to resolve address: %w", err)
+	if err := p.chain.Load().Start(p.ctx); err != nil {
+		return err
 	}
 
-	p.conn, err = net.ListenUDP("udp", addr)
-	if err != nil {
-		return fmt.Errorf("failed to listen: %w", err)
+	// Listener may already be inherited from a previous process (see Inherit)
+	conn := p.conn.Load()
+	if conn == nil {
+		addr, err := net.ResolveUDPAddr("udp", p.listenAddr)
+		if err != nil {
+			return fmt.Errorf("failed to resolve address: %w", err)
+		}
+
+		conn, err = net.ListenUDP("udp", addr)
+		if err != nil {
+			return fmt.Errorf("failed to listen: %w", err)
+		}
+		p.conn.Store(conn)
 	}
-	defer p.conn.Close()
+	defer close(p.runDone)
 
-	log.Printf("[proxy] listening on %s", p.listenAddr)
+	log.Printf("[proxy] listening on %s", conn.LocalAddr())
 	log.Printf("[proxy] handler chain: %v", p.handlerNames())
 	log.Printf("[proxy] session timeout: %ds", p.sessionTimeout.Load())
 
 	// Start worker pool (bounded goroutines instead of unbounded per-packet)
 	// Note: workerPool.Stop() is called in Stop() for proper graceful shutdown
+	p.listenersMu.Lock()
 	p.workerPool = NewWorkerPool(0, 0, p.handlePacket)
 	p.workerPool.Start()
+	p.listeners.Add(1)
+	go p.serve(conn)
+	// Retiring listeners inherited from a previous process (see Inherit)
+	p.retiring.Range(func(key, _ any) bool {
+		old := key.(*net.UDPConn)
+		p.listeners.Add(1)
+		go p.serve(old)
+		go p.retireListener(old)
+		return true
+	})
+	p.listenersMu.Unlock()
 
 	// Start session cleanup goroutine
 	go p.cleanupSessions()
 
+	<-p.ctx.Done()
+
+	// Wait for all read loops, including listeners added by Rebind
+	p.listenersMu.Lock()
+	p.listenersMu.Unlock()
+	p.listeners.Wait()
+
+	// During handoff the listener must stay open until sessions are detached
+	if !p.handingOff.Load() {
+		p.conn.Load().Close()
+	}
+	return nil
+}
+
+// serve reads packets from a listener and submits them to the worker pool.
+// Returns when the proxy stops or hands off, or the listener is closed.
+func (p *Proxy) serve(conn *net.UDPConn) {
+	defer p.listeners.Done()
+
 	for {
 		select {
 		case <-p.ctx.Done():
-			return nil
+			return
 		default:
 		}
+		if p.handingOff.Load() {
+			return // Served again if the handoff fails (see HandOff)
+		}
 
 		// Get buffer from pool (eliminates per-packet allocation)
 		buf := handler.GetBuffer()
 
-		p.conn.SetReadDeadline(time.Now().Add(1 * time.Second))
-		n, clientAddr, err := p.conn.ReadFromUDP(*buf)
+		conn.SetReadDeadline(time.Now().Add(1 * time.Second))
+		n, clientAddr, err := conn.ReadFromUDP(*buf)
 		if err != nil {
 			handler.PutBuffer(buf)
 			if netErr, ok := err.(net.Error); ok && netErr.Timeout() {
 				continue
 			}
+			if errors.Is(err, net.ErrClosed) {
+				return
+			}
 			log.Printf("Read error: %v", err)
 			continue
 		}
@@ -344,6 +434,7 @@ func (p *Proxy) Run() error {
 		// Submit to worker pool (non-blocking with backpressure)
 		// Buffer is returned to pool by worker after processing
 		if !p.workerPool.Submit(WorkItem{
+			Conn:       conn,
 			ClientAddr: clientAddr,
 			Packet:     (*buf)[:n],
 			Buffer:     buf,
@@ -356,33 +447,35 @@ func (p *Proxy) Run() error {
 // handlePacket processes an incoming UDP packet.
 // Uses QUIC Connection ID (DCID) for session lookup instead of IP:Port.
 // This enables Connection Migration (RFC 9000 Section 9).
-func (p *Proxy) handlePacket(clientAddr *net.UDPAddr, packet []byte) {
+// conn is the listener the packet arrived on; replies for new sessions use it.
+func (p *Proxy) handlePacket(conn *net.UDPConn, clientAddr *net.UDPAddr, packet []byte) {
+	// Banned clients are dropped before any parsing work
+	if bans := p.bans.Load(); bans != nil && bans.IsBanned(clientAddr.IP) {
+		debug.Printf(" dropping packet from banned %s", clientAddr)
+		return
+	}
+
 	// DEBUG: Log packet reception
 	debug.Printf(" received %d bytes from %s, first byte: 0x%02x", len(packet), clientAddr, packet[0])
 
 	pktType := ClassifyPacket(packet)
 	debug.Printf(" packet type: %s", pktType)
 
+	// Clients never send Retry or Version Negotiation
+	if isServerOnly(packet) {
+		p.reject(clientAddr, RejectServerOnly)
+		debug.Printf(" dropping server-only packet from %s", clientAddr)
+		return
+	}
+
 	// 1. Try to find existing session by DCID (with client address fallback)
 	ctx, dcid := p.findSession(packet, pktType, clientAddr)
 	if ctx != nil {
 		// Connection Migration: update client address if changed (atomic)
-		currentAddr := ctx.Session.ClientAddr()
-		if !currentAddr.IP.Equal(clientAddr.IP) || currentAddr.Port != clientAddr.Port {
-			log.Printf("[proxy] connection migration: %s -> %s (DCID=%x)",
-				currentAddr, clientAddr, ctx.Session.DCID)
-			ctx.Session.SetClientAddr(clientAddr)
-
-			// Update clientSessions mapping for the new address
-			dcidKey := string(ctx.Session.DCID)
-			oldKey := currentAddr.String()
-			newKey := clientAddr.String()
-			p.clientSessions.Delete(oldKey)
-			p.clientSessions.Store(newKey, dcidKey)
-		}
+		p.migrateClient(ctx, clientAddr)
 
 		// Forward packet through handler chain
-		result := p.chain.Load().OnPacket(ctx, packet, handler.Inbound)
+		result := ctx.Chain.OnPacket(ctx, packet, handler.Inbound)
 		if result.Action == handler.Drop && result.Error != nil {
 			log.Printf("[proxy] packet dropped: %v", result.Error)
 		}
@@ -390,6 +483,24 @@ func (p *Proxy) handlePacket(clientAddr *net.UDPAddr, packet []byte) {
 	}
 
 	// 2. No session found - only Initial packets can create new sessions
+	if p.draining.Load() {
+		debug.Printf(" draining, ignoring packet without session")
+		return
+	}
+	if conn != p.conn.Load() {
+		debug.Printf(" listener %s is retiring, ignoring packet without session", conn.LocalAddr())
+		return
+	}
+
+	// Drop junk before anything is allocated or derived for it
+	if pktType == PacketInitial || pktType == PacketZeroRTT || pktType == PacketHandshake {
+		if reason, ok := checkLongHeader(packet, pktType); !ok {
+			p.reject(clientAddr, reason)
+			debug.Printf(" rejected %s from %s: %s", pktType, clientAddr, reason)
+			return
+		}
+	}
+
 	if pktType != PacketInitial {
 		// Buffer 0-RTT and Handshake packets that arrived before Initial
 		if pktType == PacketZeroRTT || pktType == PacketHandshake {
@@ -413,6 +524,18 @@ func (p *Proxy) handlePacket(clientAddr *net.UDPAddr, packet []byte) {
 	}
 	dcidKey := string(dcid)
 
+	// A handler is still deciding on this connection: keep its retransmits for the session
+	if _, ok := p.connecting.Load(dcidKey); ok {
+		p.bufferPendingPacket(dcidKey, packet)
+		return
+	}
+
+	// Under load, make the client prove its address before doing any crypto work
+	odcid, ok := p.admitInitial(conn, clientAddr, packet)
+	if !ok {
+		return
+	}
+
 	// 3. Try to parse ClientHello from Initial packet
 	assemblerVal, loaded := p.assemblers.LoadOrStore(dcidKey, NewCryptoAssembler())
 	assembler := assemblerVal.(*CryptoAssembler)
@@ -446,22 +569,30 @@ func (p *Proxy) handlePacket(clientAddr *net.UDPAddr, packet []byte) {
 		debug.Printf(" TryParse returned nil (not enough data yet)")
 		return
 	}
-	debug.Printf(" parsed ClientHello: SNI=%q ALPN=%v", hello.SNI, hello.ALPNProtocols)
+	debug.Printf(" parsed ClientHello: SNI=%q ALPN=%v JA4=%s", hello.SNI, hello.ALPNProtocols, hello.JA4)
 
 	// Clean up assembler
 	p.assemblers.Delete(dcidKey)
 
 	log.Printf("[proxy] new connection: SNI=%q DCID=%x", hello.SNI, dcid)
 
-	// Create context with DCID
+	// Create context with DCID, pinned to the current chain for its lifetime
+	chain := p.acquireChain()
 	newCtx := &handler.Context{
 		ClientAddr:    clientAddr,
 		InitialPacket: packet,
 		Hello:         hello,
-		ProxyConn:     p.conn,
+		ProxyConn:     conn,
+		Chain:         chain,
 	}
 	// Set session count for rate limiters
-	newCtx.Set("_session_count", p.sessionCount.Load())
+	handler.SessionCount.Set(newCtx, p.sessionCount.Load())
+	newCtx.BanClient = p.banClient(clientAddr)
+	if odcid != nil {
+		// Backends need both CIDs to echo them in their transport parameters
+		handler.RetryODCID.Set(newCtx, bytes.Clone(odcid))
+		handler.RetrySCID.Set(newCtx, bytes.Clone(dcid))
+	}
 
 	// Set callback to learn server's SCID(s) from response packets
 	// This enables routing subsequent client packets that use server's CID
@@ -469,39 +600,122 @@ func (p *Proxy) handlePacket(clientAddr *net.UDPAddr, packet []byte) {
 		p.learnServerSCID(dcidKey, newCtx, packet)
 	}
 
+	// Set before any handler runs: the forwarder's backend reader may kill
+	// the session before it is registered (see registerSession)
+	newCtx.DropSession = func() { p.dropSession(dcidKey, newCtx) }
+
+	// A handler waiting for I/O resumes the connection from its own goroutine.
+	// It is finished on the client's worker, like its packets, so packets
+	// handled meanwhile can't overtake the buffered ones being flushed.
+	newCtx.ConnectTimeout = pendingConnectTimeout
+	newCtx.OnResume = func(result handler.Result) {
+		finish := func() {
+			if result.Action == handler.Handled && (p.ctx.Err() != nil || p.handingOff.Load()) {
+				// Resumed after Stop has closed the sessions, or while they are handed off
+				result = handler.Result{Action: handler.Drop, Error: errors.New("proxy stopped")}
+			}
+			p.finishConnect(dcid, newCtx, result)
+		}
+		if p.workerPool == nil {
+			finish() // Not running
+			return
+		}
+		p.workerPool.Run(clientAddr, finish)
+	}
+	p.connecting.Store(dcidKey, newCtx)
+
 	// Process through handler chain
-	result := p.chain.Load().OnConnect(newCtx)
-	if result.Action == handler.Drop {
+	result := chain.OnConnect(newCtx)
+	if result.Action == handler.Pending {
+		return
+	}
+	p.finishConnect(dcid, newCtx, result)
+}
+
+// finishConnect registers the session of a connection the handler chain has
+// handled, or cleans up after a dropped one.
+func (p *Proxy) finishConnect(dcid []byte, ctx *handler.Context, result handler.Result) {
+	dcidKey := string(dcid)
+	// Registered first: until then, packets for the connection are buffered
+	defer p.connecting.Delete(dcidKey)
+
+	if result.Action == handler.Drop || ctx.Session == nil {
 		if result.Error != nil {
 			log.Printf("[proxy] connection dropped: %v", result.Error)
 		}
+		// Let earlier handlers release what they reserved in OnConnect,
+		// unless a handler already dropped the session
+		if !ctx.Dropped() {
+			ctx.Chain.OnDisconnect(ctx)
+		}
+		if ctx.Session != nil {
+			// The backend may already have answered and taught us its SCID
+			p.forgetSession(dcidKey, ctx)
+		}
+		p.releaseChain(ctx.Chain)
 		return
 	}
 
-	if result.Action == handler.Handled && newCtx.Session != nil {
-		// Store DCID in session for future lookups
-		newCtx.Session.DCID = make([]byte, len(dcid))
-		copy(newCtx.Session.DCID, dcid)
+	if result.Action == handler.Handled {
+		p.registerSession(dcid, ctx)
+	}
+}
 
-		// Register DCID length for Short Header parsing
-		p.registerDCIDLength(len(dcid))
+// registerSession makes a session created by the handler chain reachable
+// by its DCID and client address.
+func (p *Proxy) registerSession(dcid []byte, ctx *handler.Context) {
+	dcidKey := string(dcid)
 
-		// Store session by DCID
-		p.storeSession(dcidKey, newCtx)
+	// Store DCID in session for future lookups
+	ctx.Session.DCID = bytes.Clone(dcid)
 
-		// Also store by client address for fallback lookup
-		// (handles cases where client uses CIDs we don't know about)
-		clientKey := clientAddr.String()
-		p.clientSessions.Store(clientKey, dcidKey)
+	// Register DCID length for Short Header parsing
+	p.registerDCIDLength(len(dcid))
 
-		// Flush any packets that arrived before this Initial (out-of-order)
-		p.flushPendingPackets(dcidKey, newCtx)
+	// Store session by DCID
+	p.storeSession(dcidKey, ctx)
 
-		// Set DropSession callback for immediate session termination by handlers
-		newCtx.DropSession = func() {
-			p.chain.Load().OnDisconnect(newCtx)
-			p.deleteSession(dcidKey, newCtx)
-		}
+	// Also store by client address for fallback lookup
+	// (handles cases where client uses CIDs we don't know about)
+	p.clientSessions.Store(ctx.Session.ClientAddr().String(), dcidKey)
+
+	// A handler killed the session before it was stored: its DropSession
+	// found nothing to delete, so finish the job
+	if ctx.Dropped() {
+		p.deleteSession(dcidKey, ctx)
+		return
+	}
+
+	// Flush any packets that arrived before this Initial (out-of-order)
+	p.flushPendingPackets(dcidKey, ctx)
+}
+
+// dropSession ends a session at a handler's request (see handler.Context.Drop).
+func (p *Proxy) dropSession(key string, ctx *handler.Context) {
+	ctx.Chain.OnDisconnect(ctx)
+	p.deleteSession(key, ctx)
+}
+
+// migrateClient moves a session to a new client address (Connection Migration).
+func (p *Proxy) migrateClient(ctx *handler.Context, clientAddr *net.UDPAddr) {
+	currentAddr := ctx.Session.ClientAddr()
+	if currentAddr.IP.Equal(clientAddr.IP) && currentAddr.Port == clientAddr.Port {
+		return
+	}
+	log.Printf("[proxy] connection migration: %s -> %s (DCID=%x)",
+		currentAddr, clientAddr, ctx.Session.DCID)
+	ctx.Session.SetClientAddr(clientAddr)
+
+	// Update clientSessions mapping for the new address. Another session may
+	// own the old address by now, so only remove the mapping if it is ours.
+	dcidKey := string(ctx.Session.DCID)
+	newKey := clientAddr.String()
+	p.clientSessions.CompareAndDelete(currentAddr.String(), dcidKey)
+	p.clientSessions.Store(newKey, dcidKey)
+
+	// The session may have been deleted meanwhile, before it could see the new address
+	if _, ok := p.sessions.Load(dcidKey); !ok {
+		p.clientSessions.CompareAndDelete(newKey, dcidKey)
 	}
 }
 
@@ -639,9 +853,20 @@ func (p *Proxy) learnServerSCID(originalDCID string, ctx *handler.Context, datag
 			continue
 		}
 
+		// The session owns its aliases, so deleteSession can remove them
+		if ctx.Session == nil || ctx.Session.AliasCount() >= maxAliasesPerSession || !ctx.Session.AddAlias(scidKey) {
+			continue
+		}
+
 		// Store alias: server's SCID -> original DCID
 		p.dcidAliases.Store(scidKey, originalDCID)
 
+		// Undo if the session was deleted before the alias was published
+		if ctx.Session.AliasesTaken() {
+			p.dcidAliases.CompareAndDelete(scidKey, originalDCID)
+			return
+		}
+
 		// Track SCID length for Short Header parsing
 		p.registerDCIDLength(len(scid))
 
@@ -649,14 +874,25 @@ func (p *Proxy) learnServerSCID(originalDCID string, ctx *handler.Context, datag
 	}
 }
 
+// Done returns a channel that is closed once the proxy stops accepting packets,
+// either because Stop was called or because it handed off to a new process.
+func (p *Proxy) Done() <-chan struct{} {
+	return p.ctx.Done()
+}
+
 // Stop stops the proxy server gracefully.
+// Safe to call multiple times and concurrently with Drain.
 func (p *Proxy) Stop() {
+	p.stopOnce.Do(p.stop)
+}
+
+func (p *Proxy) stop() {
 	// 1. Signal shutdown to stop accepting new packets
 	p.cancel()
 
 	// 2. Close listener (no new packets will be received)
-	if p.conn != nil {
-		p.conn.Close()
+	if conn := p.conn.Load(); conn != nil {
+		conn.Close()
 	}
 
 	// 3. Drain worker pool - wait for in-flight packets to finish
@@ -667,35 +903,46 @@ func (p *Proxy) Stop() {
 	// 4. Cleanup all sessions (now safe - no more packet processing)
 	p.sessions.Range(func(key, value any) bool {
 		ctx := value.(*handler.Context)
-		p.chain.Load().OnDisconnect(ctx)
+		ctx.Chain.OnDisconnect(ctx)
 		p.deleteSession(key.(string), ctx)
 		return true
 	})
+
+	// 5. Persist bans that are still waiting for a delayed save
+	p.FlushBans()
+
+	// 6. Release handler resources (listeners, goroutines)
+	p.shutdownChains()
 }
 
 // cleanupSessions periodically removes stale sessions and expired assemblers.
 func (p *Proxy) cleanupSessions() {
-	ticker := time.NewTicker(cleanupInterval)
-	defer ticker.Stop()
+	timer := time.NewTimer(cleanupInterval)
+	defer timer.Stop()
+
+	var lastRejected [numRejectReasons]int64
+	lastHandlerStats := make(map[string]handler.HandlerStats)
+	lastFull := time.Now()
 
 	for {
 		select {
 		case <-p.ctx.Done():
 			return
-		case <-ticker.C:
-			// Cleanup idle sessions
-			timeout := time.Duration(p.sessionTimeout.Load()) * time.Second
-			p.sessions.Range(func(key, value any) bool {
-				ctx := value.(*handler.Context)
-				if ctx.Session != nil {
-					if ctx.Session.IdleDuration() > timeout {
-						log.Printf("[proxy] cleaning up idle session: %s (idle %v)", key, ctx.Session.IdleDuration())
-						p.chain.Load().OnDisconnect(ctx)
-						p.deleteSession(key.(string), ctx)
-					}
-				}
-				return true
-			})
+		case <-timer.C:
+			if p.handingOff.Load() {
+				// Sessions are being sent to a successor; leave them as they are
+				timer.Reset(time.Second)
+				continue
+			}
+
+			// Cleanup idle sessions, more often when timeouts are short (see idle.go).
+			// Everything else runs every cleanupInterval
+			full := time.Since(lastFull) >= cleanupInterval
+			timer.Reset(p.sweepIdleSessions(full))
+			if !full {
+				continue
+			}
+			lastFull = time.Now()
 
 			// Cleanup expired assemblers (prevents memory leaks)
 			assemblerCount := 0
@@ -721,6 +968,17 @@ func (p *Proxy) cleanupSessions() {
 				})
 			}
 
+			if bans := p.bans.Load(); bans != nil {
+				bans.Prune()
+			}
+
+			if summary := p.formatRejects(&lastRejected); summary != "" {
+				log.Printf("[proxy] filtered packets in last %v: %s", cleanupInterval, summary)
+			}
+			if summary := p.formatHandlerStats(lastHandlerStats); summary != "" {
+				log.Printf("[proxy] handler calls in last %v: %s", cleanupInterval, summary)
+			}
+
 			// Cleanup expired pending packet buffers
 			p.pendingPackets.Range(func(key, value any) bool {
 				buf := value.(*pendingBuffer)
@@ -748,24 +1006,40 @@ func (p *Proxy) SessionCount() int {
 	return int(p.sessionCount.Load())
 }
 
-// deleteSession removes a session and decrements the counter.
-// Note: DCID aliases are cleaned up by timeout-based cleanup.
+// deleteSession removes a session with its client address mapping and DCID
+// aliases, decrements the counter and unpins its chain.
 func (p *Proxy) deleteSession(key string, ctx *handler.Context) {
 	if _, loaded := p.sessions.LoadAndDelete(key); loaded {
 		p.sessionCount.Add(-1)
+		p.idle.remove(key, ctx)
+		p.forgetSession(key, ctx)
+		p.releaseChain(ctx.Chain)
+	}
+}
 
-		// O(1) - directly delete using known client address from context
-		if ctx != nil && ctx.Session != nil {
-			if clientAddr := ctx.Session.ClientAddr(); clientAddr != nil {
-				p.clientSessions.Delete(clientAddr.String())
-			}
-		}
+// forgetSession removes the lookup keys pointing at session key. Each is only
+// removed if it still points at this session: a client address can have been
+// taken over by a new session in the meantime.
+func (p *Proxy) forgetSession(key string, ctx *handler.Context) {
+	if ctx == nil || ctx.Session == nil {
+		return
+	}
+	// O(1) - directly delete using known client address from context
+	if clientAddr := ctx.Session.ClientAddr(); clientAddr != nil {
+		p.clientSessions.CompareAndDelete(clientAddr.String(), key)
+	}
+	for _, alias := range ctx.Session.TakeAliases() {
+		p.dcidAliases.CompareAndDelete(alias, key)
 	}
 }
 
 // storeSession stores a session with bounds checking.
 // Triggers cleanup if limit is approached.
 func (p *Proxy) storeSession(key string, ctx *handler.Context) {
+	if ctx.Chain == nil {
+		ctx.Chain = p.acquireChain()
+	}
+
 	// O(1) increment
 	count := p.sessionCount.Add(1)
 
@@ -775,6 +1049,7 @@ func (p *Proxy) storeSession(key string, ctx *handler.Context) {
 	}
 
 	p.sessions.Store(key, ctx)
+	p.scheduleIdle(key, ctx, time.Now())
 }
 
 // bufferPendingPacket stores a packet that arrived before its session existed.
@@ -811,7 +1086,7 @@ func (p *Proxy) flushPendingPackets(dcidKey string, ctx *handler.Context) {
 	buf.mu.Unlock()
 
 	for _, pkt := range packets {
-		p.chain.Load().OnPacket(ctx, pkt.data, handler.Inbound)
+		ctx.Chain.OnPacket(ctx, pkt.data, handler.Inbound)
 	}
 }
 
@@ -879,7 +1154,7 @@ func (p *Proxy) cleanupOldestSessions(n int) {
 		age := heap.Pop(h).(sessionAge)
 		if val, ok := p.sessions.Load(age.key); ok {
 			ctx := val.(*handler.Context)
-			p.chain.Load().OnDisconnect(ctx)
+			ctx.Chain.OnDisconnect(ctx)
 			p.deleteSession(age.key, ctx)
 			removed++
 		}
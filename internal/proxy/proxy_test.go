@@ -1,7 +1,14 @@
 package proxy
 
 import (
+	"context"
+	"encoding/binary"
+	"errors"
+	"net"
 	"quic-relay/internal/handler"
+	"strings"
+	"sync"
+	"sync/atomic"
 	"testing"
 	"time"
 )
@@ -178,3 +185,398 @@ func TestBufferPool(t *testing.T) {
 	// PutBuffer with nil should not panic
 	handler.PutBuffer(nil)
 }
+
+// newDrainTestContext returns a session context with the given idle time.
+func newDrainTestContext(idle time.Duration) *handler.Context {
+	ctx := &handler.Context{Session: &handler.Session{}}
+	ctx.Session.LastActivity.Store(time.Now().Add(-idle).Unix())
+	return ctx
+}
+
+func TestDrain_RejectsNewConnections(t *testing.T) {
+	p := New("", handler.NewChain())
+	p.draining.Store(true)
+
+	// Long header Initial with an 8-byte DCID
+	packet := append([]byte{0xC0, 0, 0, 0, 1, 8}, make([]byte, 1200)...)
+	p.handlePacket(nil, &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1), Port: 1234}, packet)
+
+	p.assemblers.Range(func(key, value any) bool {
+		t.Error("no assembler should be created while draining")
+		return false
+	})
+}
+
+func TestDrain_WaitsForSessions(t *testing.T) {
+	p := New("", handler.NewChain())
+	p.SetDrainTimeout(10, 60)
+	ctx := newDrainTestContext(0)
+	p.storeSession("active", ctx)
+
+	done := make(chan struct{})
+	go func() {
+		p.Drain()
+		close(done)
+	}()
+
+	select {
+	case <-done:
+		t.Fatal("Drain returned while a session was active")
+	case <-time.After(1500 * time.Millisecond):
+	}
+
+	if !p.IsDraining() {
+		t.Error("IsDraining should be true")
+	}
+
+	p.deleteSession("active", ctx)
+
+	select {
+	case <-done:
+	case <-time.After(3 * time.Second):
+		t.Fatal("Drain did not return after last session ended")
+	}
+}
+
+func TestDrain_ClosesIdleSessions(t *testing.T) {
+	p := New("", handler.NewChain())
+	p.SetDrainTimeout(10, 5)
+	p.storeSession("idle", newDrainTestContext(time.Minute))
+
+	done := make(chan struct{})
+	go func() {
+		p.Drain()
+		close(done)
+	}()
+
+	select {
+	case <-done:
+	case <-time.After(3 * time.Second):
+		t.Fatal("Drain should close idle sessions and return")
+	}
+	if p.SessionCount() != 0 {
+		t.Errorf("expected 0 sessions, got %d", p.SessionCount())
+	}
+}
+
+func TestDrain_Timeout(t *testing.T) {
+	p := New("", handler.NewChain())
+	p.SetDrainTimeout(1, 60)
+	p.storeSession("active", newDrainTestContext(0))
+
+	start := time.Now()
+	p.Drain()
+
+	if elapsed := time.Since(start); elapsed > 3*time.Second {
+		t.Errorf("Drain took %v, expected about 1s", elapsed)
+	}
+	if p.SessionCount() != 0 {
+		t.Errorf("expected remaining sessions to be closed, got %d", p.SessionCount())
+	}
+}
+
+// syncMapLen counts the entries of m.
+func syncMapLen(m *sync.Map) int {
+	n := 0
+	m.Range(func(_, _ any) bool {
+		n++
+		return true
+	})
+	return n
+}
+
+func TestSessionChurn_NoLeaks(t *testing.T) {
+	p := New("", handler.NewChain())
+	const sessions, workers = 5000, 8
+
+	var wg sync.WaitGroup
+	for w := 0; w < workers; w++ {
+		wg.Add(1)
+		go func(w int) {
+			defer wg.Done()
+			for i := w; i < sessions; i += workers {
+				dcid := binary.BigEndian.AppendUint64(nil, uint64(i))
+				client := &net.UDPAddr{IP: net.IPv4(10, 0, byte(i>>8), byte(i)), Port: 4000}
+				ctx := &handler.Context{ClientAddr: client, Session: &handler.Session{}}
+				ctx.Session.SetClientAddr(client)
+				ctx.OnServerPacket = func(packet []byte) {
+					p.learnServerSCID(string(dcid), ctx, packet)
+				}
+				p.registerSession(dcid, ctx)
+
+				// Backend answers from its own connection ID
+				scid := append([]byte{0xEE}, dcid...)
+				ctx.NotifyServerPacket(paddedInitial(quicVersion1, nil, scid))
+				if _, ok := p.dcidAliases.Load(string(scid)); !ok {
+					t.Errorf("session %d: server SCID not learned", i)
+				}
+				if i%2 == 0 {
+					p.migrateClient(ctx, &net.UDPAddr{IP: client.IP, Port: 5000})
+				}
+
+				switch i % 3 {
+				case 0:
+					ctx.Drop()
+				case 1:
+					// Backend packet with a new SCID racing the session's removal
+					done := make(chan struct{})
+					go func() {
+						ctx.NotifyServerPacket(paddedInitial(quicVersion1, nil, append([]byte{0xDD}, dcid...)))
+						close(done)
+					}()
+					ctx.Drop()
+					<-done
+				default:
+					// Left for the idle sweep (never touched, so idle since 1970)
+				}
+			}
+		}(w)
+	}
+	wg.Wait()
+	p.sweepIdleSessions(false)
+
+	for name, m := range map[string]*sync.Map{
+		"sessions":       &p.sessions,
+		"dcidAliases":    &p.dcidAliases,
+		"clientSessions": &p.clientSessions,
+		"assemblers":     &p.assemblers,
+		"pendingPackets": &p.pendingPackets,
+	} {
+		if n := syncMapLen(m); n != 0 {
+			t.Errorf("%s: %d entries left after all sessions ended", name, n)
+		}
+	}
+	if n := p.sessionCount.Load(); n != 0 {
+		t.Errorf("sessionCount = %d, want 0", n)
+	}
+}
+
+func TestDeleteSession_KeepsReusedClientAddress(t *testing.T) {
+	p := New("", handler.NewChain())
+	client := &net.UDPAddr{IP: net.IPv4(192, 0, 2, 1), Port: 4000}
+
+	old := &handler.Context{Session: &handler.Session{}}
+	old.Session.SetClientAddr(client)
+	p.registerSession([]byte("old-dcid"), old)
+
+	// A new connection from the same address replaces the mapping before the old one is removed
+	next := &handler.Context{Session: &handler.Session{}}
+	next.Session.SetClientAddr(client)
+	p.registerSession([]byte("new-dcid"), next)
+
+	p.deleteSession("old-dcid", old)
+	if key, ok := p.clientSessions.Load(client.String()); !ok || key != "new-dcid" {
+		t.Errorf("client address mapping = %v, want new-dcid", key)
+	}
+}
+
+// lifecycleHandler counts Start and Shutdown calls.
+type lifecycleHandler struct {
+	handler.Handler
+	startErr error
+	started  atomic.Int32
+	shutdown atomic.Int32
+}
+
+func (h *lifecycleHandler) Start(ctx context.Context) error {
+	h.started.Add(1)
+	return h.startErr
+}
+
+// OnDisconnect does nothing: the test sessions have no backend socket.
+func (h *lifecycleHandler) OnDisconnect(ctx *handler.Context) {}
+
+func (h *lifecycleHandler) Shutdown(ctx context.Context) error {
+	h.shutdown.Add(1)
+	return nil
+}
+
+func TestReloadChain_Lifecycle(t *testing.T) {
+	fwd, _ := handler.NewForwarderHandler(nil)
+	old := &lifecycleHandler{Handler: fwd}
+	oldChain := handler.NewChain(old)
+	p := New("", oldChain)
+	pinned := &handler.Context{Session: &handler.Session{}}
+	p.storeSession("pinned", pinned)
+
+	// A chain that fails to start is shut down and doesn't replace the old one
+	broken := &lifecycleHandler{Handler: fwd, startErr: errors.New("port in use")}
+	if err := p.ReloadChain(handler.NewChain(broken)); err == nil {
+		t.Fatal("expected error")
+	}
+	if broken.shutdown.Load() != 1 || p.chain.Load() != oldChain {
+		t.Errorf("broken chain: shutdown %d, replaced %v", broken.shutdown.Load(), p.chain.Load() != oldChain)
+	}
+
+	next := &lifecycleHandler{Handler: fwd}
+	if err := p.ReloadChain(handler.NewChain(next)); err != nil {
+		t.Fatal(err)
+	}
+	p.chainShutdowns.Wait()
+	if next.started.Load() != 1 || old.shutdown.Load() != 0 {
+		t.Errorf("next started %d, old shutdown %d while a session is pinned to it", next.started.Load(), old.shutdown.Load())
+	}
+	if pinned.Chain != oldChain {
+		t.Error("session moved to the new chain")
+	}
+	fresh := &handler.Context{Session: &handler.Session{}}
+	p.storeSession("fresh", fresh)
+	if fresh.Chain == oldChain {
+		t.Error("new session pinned to the old chain")
+	}
+
+	// The old chain shuts down with its last session
+	p.deleteSession("pinned", pinned)
+	p.chainShutdowns.Wait()
+	if old.shutdown.Load() != 1 {
+		t.Errorf("old shutdown %d after its last session, want 1", old.shutdown.Load())
+	}
+
+	p.Stop()
+	if next.shutdown.Load() != 1 {
+		t.Errorf("Stop: shutdown %d, want 1", next.shutdown.Load())
+	}
+}
+
+// countingHandler counts the packets and disconnects it sees.
+type countingHandler struct {
+	packets, disconnects atomic.Int32
+}
+
+func (h *countingHandler) Name() string                                  { return "counting" }
+func (h *countingHandler) OnConnect(ctx *handler.Context) handler.Result { return handler.Result{} }
+func (h *countingHandler) OnDisconnect(ctx *handler.Context)             { h.disconnects.Add(1) }
+func (h *countingHandler) OnPacket(ctx *handler.Context, packet []byte, dir handler.Direction) handler.Result {
+	h.packets.Add(1)
+	return handler.Result{Action: handler.Handled}
+}
+
+func TestPendingConnect(t *testing.T) {
+	counter := &countingHandler{}
+	p := New("", handler.NewChain(counter))
+	client := &net.UDPAddr{IP: net.IPv4(192, 0, 2, 1), Port: 4000}
+	newPending := func(dcid []byte) *handler.Context {
+		ctx := &handler.Context{ClientAddr: client, Chain: p.acquireChain(), Session: &handler.Session{}}
+		ctx.Session.SetClientAddr(client)
+		p.connecting.Store(string(dcid), ctx)
+		return ctx
+	}
+
+	// Retransmits while a handler decides are kept for the session, not parsed again
+	dcid := []byte{1, 2, 3, 4, 5, 6, 7, 8}
+	ctx := newPending(dcid)
+	p.handlePacket(nil, client, paddedInitial(quicVersion1, dcid, nil))
+	if n := syncMapLen(&p.assemblers); n != 0 {
+		t.Fatalf("retransmit started a new connection (%d assemblers)", n)
+	}
+	p.finishConnect(dcid, ctx, handler.Result{Action: handler.Handled})
+	if _, ok := p.sessions.Load(string(dcid)); !ok {
+		t.Fatal("session not registered")
+	}
+	if counter.packets.Load() != 1 {
+		t.Errorf("buffered packets passed to the chain: %d, want 1", counter.packets.Load())
+	}
+
+	// A dropped connection is cleaned up like one dropped in OnConnect
+	dropped := []byte{8, 7, 6, 5, 4, 3, 2, 1}
+	p.finishConnect(dropped, newPending(dropped), handler.Result{Action: handler.Drop, Error: handler.ErrConnectTimeout})
+	if counter.disconnects.Load() != 1 {
+		t.Errorf("OnDisconnect calls: %d, want 1", counter.disconnects.Load())
+	}
+	if _, ok := p.sessions.Load(string(dropped)); ok {
+		t.Error("dropped connection registered")
+	}
+	if n := syncMapLen(&p.connecting); n != 0 {
+		t.Errorf("connecting: %d entries left", n)
+	}
+}
+
+// killingHandler kills sessions on their first packet, like ratelimit-session
+// with the kill policy.
+type killingHandler struct {
+	countingHandler
+}
+
+func (h *killingHandler) OnPacket(ctx *handler.Context, packet []byte, dir handler.Direction) handler.Result {
+	ctx.Drop()
+	return handler.Result{Action: handler.Drop}
+}
+
+func TestDropSession_BeforeRegistration(t *testing.T) {
+	killer := &killingHandler{}
+	p := New("", handler.NewChain(killer))
+	client := &net.UDPAddr{IP: net.IPv4(192, 0, 2, 1), Port: 4000}
+	newConnecting := func(dcid []byte) *handler.Context {
+		ctx := &handler.Context{ClientAddr: client, Chain: p.acquireChain(), Session: &handler.Session{}}
+		ctx.Session.SetClientAddr(client)
+		ctx.DropSession = func() { p.dropSession(string(dcid), ctx) }
+		p.connecting.Store(string(dcid), ctx)
+		return ctx
+	}
+
+	// Killed by the backend reader while the chain is still connecting
+	dcid := []byte{1, 2, 3, 4, 5, 6, 7, 8}
+	ctx := newConnecting(dcid)
+	ctx.Drop()
+	p.finishConnect(dcid, ctx, handler.Result{Action: handler.Handled})
+	if p.SessionCount() != 0 {
+		t.Fatalf("dropped session registered (%d sessions)", p.SessionCount())
+	}
+	if _, ok := p.clientSessions.Load(client.String()); ok {
+		t.Error("dropped session still reachable by client address")
+	}
+
+	// Killed by a packet flushed right after registration
+	dcid = []byte{8, 7, 6, 5, 4, 3, 2, 1}
+	ctx = newConnecting(dcid)
+	p.bufferPendingPacket(string(dcid), paddedInitial(quicVersion1, dcid, nil))
+	p.finishConnect(dcid, ctx, handler.Result{Action: handler.Handled})
+	if p.SessionCount() != 0 {
+		t.Fatalf("killed session still registered (%d sessions)", p.SessionCount())
+	}
+
+	if got := killer.disconnects.Load(); got != 2 {
+		t.Errorf("OnDisconnect calls: %d, want 2", got)
+	}
+}
+
+// statsTestHandler drops connections to "drop.example.com".
+type statsTestHandler struct{}
+
+func (statsTestHandler) Name() string { return "stats-test" }
+
+func (statsTestHandler) OnConnect(ctx *handler.Context) handler.Result {
+	if ctx.Hello.SNI == "drop.example.com" {
+		return handler.Result{Action: handler.Drop}
+	}
+	return handler.Result{Action: handler.Handled}
+}
+
+func (statsTestHandler) OnPacket(ctx *handler.Context, packet []byte, dir handler.Direction) handler.Result {
+	return handler.Result{Action: handler.Handled}
+}
+
+func (statsTestHandler) OnDisconnect(ctx *handler.Context) {}
+
+func TestFormatHandlerStats(t *testing.T) {
+	chain := handler.NewChain(statsTestHandler{})
+	p := New("", chain)
+	last := make(map[string]handler.HandlerStats)
+	if got := p.formatHandlerStats(last); got != "" {
+		t.Errorf("no calls: got %q", got)
+	}
+
+	for _, sni := range []string{"a.example.com", "b.example.com", "drop.example.com"} {
+		chain.OnConnect(&handler.Context{Hello: &handler.ClientHello{SNI: sni}})
+	}
+	got := p.formatHandlerStats(last)
+	if !strings.HasPrefix(got, "0:stats-test connect=3 drops=1 avg=") || !strings.Contains(got, " p99") {
+		t.Errorf("got %q", got)
+	}
+
+	// Only calls since the last summary count
+	chain.OnPacket(&handler.Context{}, []byte{0x40}, handler.Inbound)
+	if got := p.formatHandlerStats(last); got != "0:stats-test packet=1" {
+		t.Errorf("got %q, want 0:stats-test packet=1", got)
+	}
+}
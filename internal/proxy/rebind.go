@@ -0,0 +1,86 @@
+package proxy
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"net"
+	"time"
+
+	"quic-relay/internal/handler"
+)
+
+// Rebind moves the proxy to a new listen address (hot reload).
+// New connections are accepted on the new socket immediately. The old socket
+// keeps serving its existing sessions until they end, then it is closed.
+// On error the proxy keeps listening on the old address.
+func (p *Proxy) Rebind(listenAddr string) error {
+	addr, err := net.ResolveUDPAddr("udp", listenAddr)
+	if err != nil {
+		return fmt.Errorf("failed to resolve address: %w", err)
+	}
+
+	p.listenersMu.Lock()
+	defer p.listenersMu.Unlock()
+
+	if p.ctx.Err() != nil || p.workerPool == nil {
+		return errors.New("proxy is not running")
+	}
+	if p.handingOff.Load() {
+		return errors.New("handoff in progress")
+	}
+
+	conn, err := net.ListenUDP("udp", addr)
+	if err != nil {
+		return fmt.Errorf("failed to listen: %w", err)
+	}
+
+	old := p.conn.Swap(conn)
+	p.listeners.Add(1)
+	go p.serve(conn)
+
+	log.Printf("[proxy] listening on %s, retiring %s", conn.LocalAddr(), old.LocalAddr())
+	p.retiring.Store(old, struct{}{})
+	go p.retireListener(old)
+	return nil
+}
+
+// retireListener closes a replaced listener once no session uses it anymore.
+// During a handoff the listener is left open for HandOff to pass on, or to
+// serve again if the handoff fails.
+func (p *Proxy) retireListener(conn *net.UDPConn) {
+	ticker := time.NewTicker(drainCheckInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-p.ctx.Done():
+			if !p.handingOff.Load() {
+				p.retiring.Delete(conn)
+				conn.Close()
+			}
+			return
+		case <-ticker.C:
+		}
+
+		if !p.handingOff.Load() && !p.listenerInUse(conn) {
+			log.Printf("[proxy] closed retired listener %s", conn.LocalAddr())
+			p.retiring.Delete(conn)
+			conn.Close()
+			return
+		}
+	}
+}
+
+// listenerInUse reports whether any session replies through conn.
+func (p *Proxy) listenerInUse(conn *net.UDPConn) bool {
+	inUse := false
+	p.sessions.Range(func(key, value any) bool {
+		if value.(*handler.Context).ProxyConn == conn {
+			inUse = true
+			return false
+		}
+		return true
+	})
+	return inUse
+}
@@ -0,0 +1,77 @@
+package proxy
+
+import (
+	"testing"
+	"time"
+
+	"quic-relay/internal/handler"
+)
+
+// waitRunning blocks until Run has started its worker pool.
+func waitRunning(t *testing.T, p *Proxy) {
+	t.Helper()
+	for i := 0; i < 100; i++ {
+		p.listenersMu.Lock()
+		running := p.workerPool != nil
+		p.listenersMu.Unlock()
+		if running {
+			return
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	t.Fatal("proxy did not start")
+}
+
+func TestRebind_RetiresOldListener(t *testing.T) {
+	p := New("127.0.0.1:0", handler.NewChain())
+	go p.Run()
+	defer p.Stop()
+	waitRunning(t, p)
+
+	old := p.conn.Load()
+	ctx := &handler.Context{Session: &handler.Session{}, ProxyConn: old}
+	p.storeSession("on-old-listener", ctx)
+
+	if err := p.Rebind("127.0.0.1:0"); err != nil {
+		t.Fatalf("Rebind: %v", err)
+	}
+	current := p.conn.Load()
+	if current == old {
+		t.Fatal("listener was not replaced")
+	}
+
+	// Old listener stays open while a session uses it
+	time.Sleep(1500 * time.Millisecond)
+	if err := old.SetReadDeadline(time.Now()); err != nil {
+		t.Fatalf("old listener closed while in use: %v", err)
+	}
+
+	p.deleteSession("on-old-listener", ctx)
+
+	deadline := time.Now().Add(3 * time.Second)
+	for old.SetReadDeadline(time.Now()) == nil {
+		if time.Now().After(deadline) {
+			t.Fatal("old listener was not closed after its sessions ended")
+		}
+		time.Sleep(50 * time.Millisecond)
+	}
+
+	if err := current.SetReadDeadline(time.Time{}); err != nil {
+		t.Errorf("new listener should stay open: %v", err)
+	}
+}
+
+func TestRebind_FailureKeepsListener(t *testing.T) {
+	p := New("127.0.0.1:0", handler.NewChain())
+	go p.Run()
+	defer p.Stop()
+	waitRunning(t, p)
+
+	old := p.conn.Load()
+	if err := p.Rebind("invalid-address"); err == nil {
+		t.Fatal("expected error for invalid address")
+	}
+	if p.conn.Load() != old {
+		t.Error("listener should not change on failed rebind")
+	}
+}
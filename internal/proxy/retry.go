@@ -0,0 +1,295 @@
+package proxy
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/binary"
+	"errors"
+	"log"
+	"net"
+	"sync"
+	"time"
+
+	"quic-relay/internal/debug"
+	"quic-relay/internal/quicvarint"
+)
+
+// RetryConfig enables stateless source address validation (RFC 9000 Section 8.1.2).
+// Above Threshold new connections per second, Initials without a valid token
+// are answered with a Retry packet instead of being parsed and forwarded.
+//
+// The client checks the server's original_destination_connection_id and
+// retry_source_connection_id transport parameters after a Retry, so backends
+// must be told about it: they receive both CIDs as PROXY protocol TLVs
+// (see proxyproto.TypeRetryODCID). Only enable this for backends that use them;
+// CheckConfig rejects chains whose forwarders don't send the header.
+//
+// Only QUIC v1 is supported (the integrity tag and packet type differ per
+// version); Initials of other versions are rejected by the packet filter
+// before they get here.
+type RetryConfig struct {
+	Threshold     int `json:"threshold"`                // New connections per second before Retry kicks in (0 = always)
+	TokenLifetime int `json:"token_lifetime,omitempty"` // Token validity in seconds (default: 10)
+}
+
+const (
+	defaultTokenLifetime = 10
+	retryTokenMarker     = 0x52 // First token byte, tells our tokens from backend NEW_TOKENs
+	retryTokenMACLen     = 16
+	retryTokenMinLen     = 1 + 8 + 1 + retryTokenMACLen // marker + expiry + odcid len + MAC
+	maxCIDLen            = 20
+)
+
+// RFC 9001 Section 5.8: fixed key and nonce for the QUIC v1 Retry Integrity Tag.
+// Other versions use their own, so buildRetryPacket only supports v1.
+var (
+	retryIntegrityKey   = []byte{0xbe, 0x0c, 0x69, 0x0b, 0x9f, 0x66, 0x57, 0x5a, 0x1d, 0x76, 0x6b, 0x54, 0xe3, 0x68, 0xc8, 0x4e}
+	retryIntegrityNonce = []byte{0x46, 0x15, 0x99, 0xd3, 0x5d, 0x63, 0x2b, 0xf2, 0x23, 0x98, 0x25, 0xbb}
+	retryAEAD           cipher.AEAD
+)
+
+func init() {
+	block, err := aes.NewCipher(retryIntegrityKey)
+	if err != nil {
+		panic(err)
+	}
+	retryAEAD, err = cipher.NewGCM(block)
+	if err != nil {
+		panic(err)
+	}
+}
+
+// retryGuard tracks the new-connection rate and decides when Retry is required.
+type retryGuard struct {
+	threshold int
+	lifetime  time.Duration
+	key       []byte // HMAC key, shared across reloads
+
+	mu       sync.Mutex
+	window   int64               // Unix second being counted
+	seen     map[string]struct{} // DCIDs of new connection attempts in window, at most threshold+1
+	lastRate int                 // Attempts in the previous second
+	active   bool                // Last decision, for logging transitions
+}
+
+// RetryStats holds Retry counters.
+type RetryStats struct {
+	Sent     int64 // Retry packets sent
+	Accepted int64 // Initials admitted with a valid token
+	Rejected int64 // Initials with an invalid or expired token of ours
+}
+
+// SetRetry enables Retry under load, or disables it if cfg is nil (hot-reload safe).
+func (p *Proxy) SetRetry(cfg *RetryConfig) {
+	if cfg == nil {
+		p.retry.Store(nil)
+		return
+	}
+	lifetime := cfg.TokenLifetime
+	if lifetime <= 0 {
+		lifetime = defaultTokenLifetime
+	}
+	p.retry.Store(&retryGuard{
+		threshold: cfg.Threshold,
+		lifetime:  time.Duration(lifetime) * time.Second,
+		key:       p.retryKey,
+	})
+}
+
+// RetryStats returns the Retry counters.
+func (p *Proxy) RetryStats() RetryStats {
+	return RetryStats{
+		Sent:     p.retriesSent.Load(),
+		Accepted: p.retryAccepted.Load(),
+		Rejected: p.retryRejected.Load(),
+	}
+}
+
+// required records a new connection attempt for dcid and reports whether
+// Retry is needed. Initials sharing a DCID, such as the packets of a
+// multi-packet ClientHello and retransmits, count as one attempt.
+func (g *retryGuard) required(dcid []byte, now int64) bool {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+
+	if g.window != now {
+		prev := len(g.seen)
+		if now != g.window+1 {
+			prev = 0 // Quiet second(s) in between
+		}
+		g.lastRate = prev
+		g.window = now
+		clear(g.seen)
+	}
+	if g.seen == nil {
+		g.seen = make(map[string]struct{})
+	}
+	// Counting past the threshold changes nothing, so the set stays bounded
+	if len(g.seen) <= g.threshold {
+		g.seen[string(dcid)] = struct{}{}
+	}
+	on := len(g.seen) > g.threshold || g.lastRate > g.threshold
+	if g.active != on {
+		g.active = on
+		if on {
+			log.Printf("[proxy] new connection rate above %d/s, requiring Retry", g.threshold)
+		} else {
+			log.Printf("[proxy] new connection rate back to normal, Retry disabled")
+		}
+	}
+	return on
+}
+
+// admitInitial applies Retry-based address validation to an Initial without
+// a session. It returns false if a Retry was sent instead and the packet must
+// not be processed further. For packets carrying a valid token, odcid is the
+// DCID of the client's first Initial.
+func (p *Proxy) admitInitial(conn *net.UDPConn, clientAddr *net.UDPAddr, packet []byte) (odcid []byte, ok bool) {
+	g := p.retry.Load()
+	if g == nil {
+		return nil, true
+	}
+
+	dcid, scid, token, err := parseInitialHeader(packet)
+	if err != nil {
+		return nil, true // Let the regular path deal with it
+	}
+
+	if len(token) > 0 && token[0] == retryTokenMarker {
+		odcid, err := g.validateToken(token, clientAddr, dcid, time.Now())
+		if err == nil {
+			p.retryAccepted.Add(1)
+			return odcid, true
+		}
+		// Could also be a backend NEW_TOKEN that happens to start with our
+		// marker, so treat it like any token we didn't issue
+		p.retryRejected.Add(1)
+		debug.Printf(" retry token from %s rejected: %v", clientAddr, err)
+	}
+
+	// Tokens we didn't issue are the backend's business unless we're under load
+	if !g.required(dcid, time.Now().Unix()) {
+		return nil, true
+	}
+
+	newSCID := make([]byte, max(len(dcid), 8))
+	rand.Read(newSCID)
+	var unused [1]byte
+	rand.Read(unused[:])
+
+	retryPkt, err := buildRetryPacket(unused[0], quicVersion1, scid, newSCID, dcid, g.newToken(clientAddr, dcid, newSCID, time.Now()))
+	if err != nil {
+		debug.Printf(" failed to build Retry: %v", err)
+		return nil, false
+	}
+	if _, err := conn.WriteToUDP(retryPkt, clientAddr); err != nil {
+		debug.Printf(" failed to send Retry to %s: %v", clientAddr, err)
+		return nil, false
+	}
+	p.retriesSent.Add(1)
+	debug.Printf(" sent Retry to %s (ODCID=%x, SCID=%x)", clientAddr, dcid, newSCID)
+	return nil, false
+}
+
+// newToken creates a token binding the client IP, the original DCID and the
+// CID the client must use next. Format: marker | expiry (8) | odcid len | odcid | MAC.
+func (g *retryGuard) newToken(clientAddr *net.UDPAddr, odcid, retrySCID []byte, now time.Time) []byte {
+	token := make([]byte, 0, retryTokenMinLen+len(odcid))
+	token = append(token, retryTokenMarker)
+	token = binary.BigEndian.AppendUint64(token, uint64(now.Add(g.lifetime).Unix()))
+	token = append(token, byte(len(odcid)))
+	token = append(token, odcid...)
+	return append(token, g.mac(token, clientAddr, retrySCID)...)
+}
+
+// validateToken checks a token presented with dcid and returns the original DCID.
+func (g *retryGuard) validateToken(token []byte, clientAddr *net.UDPAddr, dcid []byte, now time.Time) ([]byte, error) {
+	if len(token) < retryTokenMinLen {
+		return nil, errors.New("token too short")
+	}
+	odcidLen := int(token[9])
+	if odcidLen > maxCIDLen || len(token) != retryTokenMinLen+odcidLen {
+		return nil, errors.New("malformed token")
+	}
+	body := token[:len(token)-retryTokenMACLen]
+	if !hmac.Equal(token[len(body):], g.mac(body, clientAddr, dcid)) {
+		return nil, errors.New("bad token MAC")
+	}
+	if now.Unix() > int64(binary.BigEndian.Uint64(token[1:9])) {
+		return nil, errors.New("token expired")
+	}
+	return token[10 : 10+odcidLen], nil
+}
+
+func (g *retryGuard) mac(body []byte, clientAddr *net.UDPAddr, retrySCID []byte) []byte {
+	m := hmac.New(sha256.New, g.key)
+	m.Write(body)
+	m.Write(clientAddr.IP.To16())
+	m.Write(retrySCID)
+	return m.Sum(nil)[:retryTokenMACLen]
+}
+
+// buildRetryPacket encodes a QUIC v1 Retry packet (RFC 9000 Section 17.2.5)
+// including its Retry Integrity Tag (RFC 9001 Section 5.8). unused fills the
+// four unused bits of the first byte, which the tag covers as well.
+func buildRetryPacket(unused byte, version uint32, dcid, scid, odcid, token []byte) ([]byte, error) {
+	if len(dcid) > maxCIDLen || len(scid) > maxCIDLen || len(odcid) > maxCIDLen {
+		return nil, errors.New("connection ID too long")
+	}
+
+	// Retry Pseudo-Packet: ODCID length | ODCID | Retry packet without the tag
+	pseudo := make([]byte, 0, 1+len(odcid)+7+len(dcid)+len(scid)+len(token)+retryAEAD.Overhead())
+	pseudo = append(pseudo, byte(len(odcid)))
+	pseudo = append(pseudo, odcid...)
+	start := len(pseudo)
+
+	pseudo = append(pseudo, 0xF0|unused&0x0F)
+	pseudo = binary.BigEndian.AppendUint32(pseudo, version)
+	pseudo = append(pseudo, byte(len(dcid)))
+	pseudo = append(pseudo, dcid...)
+	pseudo = append(pseudo, byte(len(scid)))
+	pseudo = append(pseudo, scid...)
+	pseudo = append(pseudo, token...)
+
+	tag := retryAEAD.Seal(nil, retryIntegrityNonce, nil, pseudo)
+	return append(pseudo[start:], tag...), nil
+}
+
+// parseInitialHeader returns the connection IDs and token of an Initial,
+// whose version checkLongHeader has already checked.
+func parseInitialHeader(packet []byte) (dcid, scid, token []byte, err error) {
+	if len(packet) < 7 || packet[0]&0x80 == 0 {
+		return nil, nil, nil, errors.New("not a long header packet")
+	}
+	offset := 5
+
+	dcidLen := int(packet[offset])
+	offset++
+	if dcidLen > maxCIDLen || offset+dcidLen >= len(packet) {
+		return nil, nil, nil, errors.New("invalid DCID length")
+	}
+	dcid = packet[offset : offset+dcidLen]
+	offset += dcidLen
+
+	scidLen := int(packet[offset])
+	offset++
+	if scidLen > maxCIDLen || offset+scidLen > len(packet) {
+		return nil, nil, nil, errors.New("invalid SCID length")
+	}
+	scid = packet[offset : offset+scidLen]
+	offset += scidLen
+
+	tokenLen, n, err := quicvarint.Read(packet[offset:])
+	if err != nil {
+		return nil, nil, nil, err
+	}
+	offset += n
+	if tokenLen > uint64(len(packet)-offset) {
+		return nil, nil, nil, errors.New("invalid token length")
+	}
+	token = packet[offset : offset+int(tokenLen)]
+	return dcid, scid, token, nil
+}
@@ -0,0 +1,251 @@
+package proxy
+
+import (
+	"bytes"
+	"encoding/hex"
+	"encoding/json"
+	"net"
+	"testing"
+	"time"
+
+	"quic-relay/internal/handler"
+)
+
+// RFC 9001 Appendix A.4
+func TestBuildRetryPacket_RFCVector(t *testing.T) {
+	odcid, _ := hex.DecodeString("8394c8f03e515708")
+	scid, _ := hex.DecodeString("f067a5502a4262b5")
+	want, _ := hex.DecodeString("ff000000010008f067a5502a4262b5746f6b656e04a265ba2eff4d829058fb3f0f2496ba")
+
+	got, err := buildRetryPacket(0x0F, quicVersion1, nil, scid, odcid, []byte("token"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(got, want) {
+		t.Errorf("retry packet mismatch\n got %x\nwant %x", got, want)
+	}
+}
+
+// testInitial builds an (unencrypted) Initial header, enough for admitInitial.
+func testInitial(dcid, scid, token []byte) []byte {
+	b := []byte{0xC0, 0, 0, 0, 1}
+	b = append(b, byte(len(dcid)))
+	b = append(b, dcid...)
+	b = append(b, byte(len(scid)))
+	b = append(b, scid...)
+	b = append(b, byte(len(token))) // 1-byte varint, tokens stay below 64 bytes
+	b = append(b, token...)
+	b = append(b, 0) // Length
+	return b
+}
+
+func TestRetryToken(t *testing.T) {
+	g := &retryGuard{lifetime: 10 * time.Second, key: []byte("test-key")}
+	client := &net.UDPAddr{IP: net.IPv4(192, 0, 2, 1), Port: 4000}
+	odcid := []byte{1, 2, 3, 4, 5, 6, 7, 8}
+	scid := []byte{9, 9, 9, 9, 9, 9, 9, 9}
+	now := time.Now()
+	token := g.newToken(client, odcid, scid, now)
+
+	got, err := g.validateToken(token, client, scid, now)
+	if err != nil || !bytes.Equal(got, odcid) {
+		t.Fatalf("valid token: odcid=%x err=%v", got, err)
+	}
+
+	// Port changes (NAT rebinding) are fine, the IP is what gets validated
+	if _, err := g.validateToken(token, &net.UDPAddr{IP: client.IP, Port: 5000}, scid, now); err != nil {
+		t.Errorf("token rejected after port change: %v", err)
+	}
+
+	tampered := bytes.Clone(token)
+	tampered[10] ^= 1
+
+	for name, tc := range map[string]struct {
+		token  []byte
+		client *net.UDPAddr
+		dcid   []byte
+		now    time.Time
+	}{
+		"other IP":   {token, &net.UDPAddr{IP: net.IPv4(192, 0, 2, 2), Port: 4000}, scid, now},
+		"other DCID": {token, client, odcid, now},
+		"expired":    {token, client, scid, now.Add(time.Minute)},
+		"tampered":   {tampered, client, scid, now},
+		"truncated":  {token[:len(token)-1], client, scid, now},
+	} {
+		if _, err := g.validateToken(tc.token, tc.client, tc.dcid, tc.now); err == nil {
+			t.Errorf("%s: expected token to be rejected", name)
+		}
+	}
+}
+
+func TestRetryGuard_Threshold(t *testing.T) {
+	g := &retryGuard{threshold: 2}
+	for i := 0; i < 2; i++ {
+		if g.required([]byte{byte(i)}, 100) {
+			t.Fatalf("attempt %d: Retry required below threshold", i+1)
+		}
+	}
+	if !g.required([]byte{2}, 100) {
+		t.Fatal("Retry not required above threshold")
+	}
+	// Still on in the next second because of the previous second's rate
+	if !g.required([]byte{3}, 101) {
+		t.Error("Retry should stay on for one second after a burst")
+	}
+	// Off again after a quiet period
+	if g.required([]byte{4}, 110) {
+		t.Error("Retry should turn off once the rate drops")
+	}
+}
+
+func TestRetryGuard_CountsPerDCID(t *testing.T) {
+	g := &retryGuard{threshold: 2}
+	// Packets of one multi-packet ClientHello, plus a retransmit
+	for i := 0; i < 5; i++ {
+		if g.required([]byte{1, 2, 3, 4}, 100) {
+			t.Fatalf("packet %d: Retry required for a single connection", i+1)
+		}
+	}
+	if g.required([]byte{5, 6, 7, 8}, 100) {
+		t.Error("Retry required for the second connection")
+	}
+}
+
+func TestHandlePacket_RetryOnlyV1(t *testing.T) {
+	p := New("", handler.NewChain())
+	p.SetRetry(&RetryConfig{Threshold: 0})
+	conn := listenUDP(t)
+	defer conn.Close()
+	p.conn.Store(conn)
+
+	clientAddr := &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1), Port: 9}
+	initial := func(version []byte) []byte {
+		packet := testInitial([]byte{1, 2, 3, 4, 5, 6, 7, 8}, nil, nil)
+		copy(packet[1:5], version)
+		packet[len(packet)-1] = 63 // Length, enough to pass the filter
+		return append(packet, make([]byte, minInitialSize)...)
+	}
+
+	p.handlePacket(conn, clientAddr, initial([]byte{0, 0, 0, 1}))
+	if stats := p.RetryStats(); stats.Sent != 1 {
+		t.Fatalf("sent %d Retries for QUIC v1, want 1", stats.Sent)
+	}
+
+	// QUIC v2 uses another Retry integrity key: the filter rejects it first
+	p.handlePacket(conn, clientAddr, initial([]byte{0x6b, 0x33, 0x43, 0xcf}))
+	if stats := p.RetryStats(); stats.Sent != 1 {
+		t.Errorf("sent %d Retries for QUIC v2, want none", stats.Sent-1)
+	}
+}
+
+func TestCheckConfig_RetryRequiresProxyProtocol(t *testing.T) {
+	cfg, err := ParseConfig([]byte(`{"retry": {"threshold": 100}}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	build := func(handlers string) *handler.Chain {
+		t.Helper()
+		var configs []handler.HandlerConfig
+		if err := json.Unmarshal([]byte(handlers), &configs); err != nil {
+			t.Fatal(err)
+		}
+		chain, err := handler.BuildChain(configs)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return chain
+	}
+
+	plain := build(`[{"type": "simple-router", "config": {"backend": "127.0.0.1:5521"}}, {"type": "forwarder"}]`)
+	if err := CheckConfig(cfg, plain); err == nil {
+		t.Error("retry accepted without proxy_protocol")
+	}
+	someBackends := build(`[{"type": "simple-router", "config": {"backend": "127.0.0.1:5521"}}, {"type": "forwarder", "config": {"proxy_protocol": {"backends": ["127.0.0.1:5522"]}}}]`)
+	if err := CheckConfig(cfg, someBackends); err == nil {
+		t.Error("retry accepted with proxy_protocol for some backends only")
+	}
+	withHeader := build(`[{"type": "simple-router", "config": {"backend": "127.0.0.1:5521"}}, {"type": "forwarder", "config": {"proxy_protocol": {"backends": ["*"]}}}]`)
+	if err := CheckConfig(cfg, withHeader); err != nil {
+		t.Errorf("retry with proxy_protocol: %v", err)
+	}
+	cfg.Retry = nil
+	if err := CheckConfig(cfg, plain); err != nil {
+		t.Errorf("no retry: %v", err)
+	}
+}
+
+func TestAdmitInitial_RetryRoundTrip(t *testing.T) {
+	p := New("", nil)
+	p.SetRetry(&RetryConfig{Threshold: 0})
+
+	conn := listenUDP(t)
+	defer conn.Close()
+	client := listenUDP(t)
+	defer client.Close()
+	clientAddr := client.LocalAddr().(*net.UDPAddr)
+
+	odcid := []byte{1, 2, 3, 4, 5, 6, 7, 8}
+	clientSCID := []byte{0xAA, 0xBB, 0xCC, 0xDD}
+
+	// First Initial has no token: answered with a Retry
+	if _, ok := p.admitInitial(conn, clientAddr, testInitial(odcid, clientSCID, nil)); ok {
+		t.Fatal("Initial without token should not be admitted")
+	}
+
+	buf := make([]byte, 1500)
+	client.SetReadDeadline(time.Now().Add(2 * time.Second))
+	n, _, err := client.ReadFromUDP(buf)
+	if err != nil {
+		t.Fatalf("no Retry received: %v", err)
+	}
+	retry := buf[:n]
+	if ClassifyPacket(retry) != PacketRetry {
+		t.Fatalf("expected Retry, got %s", ClassifyPacket(retry))
+	}
+
+	// Parse the Retry like a client would and check the integrity tag
+	dcid, retrySCID, err := ExtractDCIDAndSCID(retry)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(dcid, clientSCID) {
+		t.Errorf("Retry DCID = %x, want client SCID %x", dcid, clientSCID)
+	}
+	tokenStart := 1 + 4 + 1 + len(dcid) + 1 + len(retrySCID)
+	token := retry[tokenStart : len(retry)-16]
+	rebuilt, _ := buildRetryPacket(retry[0], quicVersion1, dcid, retrySCID, odcid, token)
+	if !bytes.Equal(rebuilt, retry) {
+		t.Error("Retry integrity tag does not verify")
+	}
+
+	// Second Initial carries the token and uses the Retry SCID as DCID
+	got, ok := p.admitInitial(conn, clientAddr, testInitial(retrySCID, clientSCID, token))
+	if !ok || !bytes.Equal(got, odcid) {
+		t.Fatalf("Initial with valid token: admitted=%v odcid=%x", ok, got)
+	}
+
+	// Replaying the token against another CID gets another Retry
+	if _, ok := p.admitInitial(conn, clientAddr, testInitial(odcid, clientSCID, token)); ok {
+		t.Error("token accepted for a different DCID")
+	}
+
+	stats := p.RetryStats()
+	if stats.Sent != 2 || stats.Accepted != 1 || stats.Rejected != 1 {
+		t.Errorf("stats = %+v, want 2 sent, 1 accepted, 1 rejected", stats)
+	}
+}
+
+func TestAdmitInitial_BelowThreshold(t *testing.T) {
+	p := New("", nil)
+	dcid := []byte{1, 2, 3, 4, 5, 6, 7, 8}
+	if _, ok := p.admitInitial(nil, &net.UDPAddr{}, testInitial(dcid, nil, nil)); !ok {
+		t.Error("Initial dropped with Retry disabled")
+	}
+
+	// Foreign tokens (e.g. a backend NEW_TOKEN) pass through while not under load
+	p.SetRetry(&RetryConfig{Threshold: 100})
+	foreign := append([]byte{retryTokenMarker}, make([]byte, 40)...)
+	if _, ok := p.admitInitial(nil, &net.UDPAddr{IP: net.IPv4(192, 0, 2, 1)}, testInitial(dcid, nil, foreign)); !ok {
+		t.Error("Initial with foreign token dropped below threshold")
+	}
+}
@@ -0,0 +1,155 @@
+package proxy
+
+import (
+	"fmt"
+	"time"
+
+	"quic-relay/internal/handler"
+	"quic-relay/internal/quicvarint"
+)
+
+// Transport parameter IDs (RFC 9000 Section 18.2, RFC 9221, RFC 9287).
+const (
+	tpOriginalDestinationConnectionID = 0x00
+	tpMaxIdleTimeout                  = 0x01
+	tpStatelessResetToken             = 0x02
+	tpMaxUDPPayloadSize               = 0x03
+	tpInitialMaxData                  = 0x04
+	tpInitialMaxStreamDataBidiLocal   = 0x05
+	tpInitialMaxStreamDataBidiRemote  = 0x06
+	tpInitialMaxStreamDataUni         = 0x07
+	tpInitialMaxStreamsBidi           = 0x08
+	tpInitialMaxStreamsUni            = 0x09
+	tpAckDelayExponent                = 0x0a
+	tpMaxAckDelay                     = 0x0b
+	tpDisableActiveMigration          = 0x0c
+	tpPreferredAddress                = 0x0d
+	tpActiveConnectionIDLimit         = 0x0e
+	tpInitialSourceConnectionID       = 0x0f
+	tpRetrySourceConnectionID         = 0x10
+	tpMaxDatagramFrameSize            = 0x20
+	tpGreaseQUICBit                   = 0x2ab2
+)
+
+// parseTransportParameters decodes a client's quic_transport_parameters
+// extension. It fails only if the encoding is broken; values a conforming
+// client wouldn't send are reported in Anomalies.
+func parseTransportParameters(data []byte) (*handler.TransportParameters, error) {
+	tp := &handler.TransportParameters{
+		MaxUDPPayloadSize:       65527,
+		AckDelayExponent:        3,
+		MaxAckDelay:             25 * time.Millisecond,
+		ActiveConnectionIDLimit: 2,
+	}
+	seen := make(map[uint64]bool)
+	haveSCID := false
+
+	for len(data) > 0 {
+		id, n, err := quicvarint.Read(data)
+		if err != nil {
+			return nil, fmt.Errorf("parameter ID: %w", err)
+		}
+		data = data[n:]
+		length, n, err := quicvarint.Read(data)
+		if err != nil {
+			return nil, fmt.Errorf("length of parameter 0x%x: %w", id, err)
+		}
+		data = data[n:]
+		if length > uint64(len(data)) {
+			return nil, fmt.Errorf("parameter 0x%x truncated", id)
+		}
+		value := data[:length]
+		data = data[length:]
+
+		if seen[id] {
+			tp.Anomalies = append(tp.Anomalies, fmt.Sprintf("duplicate parameter 0x%x", id))
+		}
+		seen[id] = true
+
+		switch id {
+		case tpOriginalDestinationConnectionID, tpStatelessResetToken, tpPreferredAddress, tpRetrySourceConnectionID:
+			tp.Anomalies = append(tp.Anomalies, fmt.Sprintf("server-only parameter 0x%x", id))
+		case tpDisableActiveMigration:
+			tp.DisableActiveMigration = true
+			if len(value) != 0 {
+				tp.Anomalies = append(tp.Anomalies, "disable_active_migration has a value")
+			}
+		case tpGreaseQUICBit:
+			tp.GreaseQUICBit = true
+			if len(value) != 0 {
+				tp.Anomalies = append(tp.Anomalies, "grease_quic_bit has a value")
+			}
+		case tpInitialSourceConnectionID:
+			haveSCID = true
+			tp.InitialSourceConnectionID = value
+			if len(value) > maxCIDLen {
+				tp.Anomalies = append(tp.Anomalies, fmt.Sprintf("initial_source_connection_id of %d bytes", len(value)))
+			}
+		case tpMaxIdleTimeout, tpMaxUDPPayloadSize, tpInitialMaxData,
+			tpInitialMaxStreamDataBidiLocal, tpInitialMaxStreamDataBidiRemote, tpInitialMaxStreamDataUni,
+			tpInitialMaxStreamsBidi, tpInitialMaxStreamsUni, tpAckDelayExponent, tpMaxAckDelay,
+			tpActiveConnectionIDLimit, tpMaxDatagramFrameSize:
+			v, n, err := quicvarint.Read(value)
+			if err != nil || n != len(value) {
+				return nil, fmt.Errorf("parameter 0x%x: invalid varint value", id)
+			}
+			setTransportParameter(tp, id, v)
+		default:
+			tp.Unknown = append(tp.Unknown, id)
+		}
+	}
+
+	if !haveSCID {
+		tp.Anomalies = append(tp.Anomalies, "missing initial_source_connection_id")
+	}
+	return tp, nil
+}
+
+// setTransportParameter stores an integer parameter and flags values out of
+// the range RFC 9000 allows.
+func setTransportParameter(tp *handler.TransportParameters, id, v uint64) {
+	switch id {
+	case tpMaxIdleTimeout:
+		tp.MaxIdleTimeout = time.Duration(min(v, 1<<40)) * time.Millisecond
+	case tpMaxUDPPayloadSize:
+		tp.MaxUDPPayloadSize = v
+		if v < 1200 {
+			tp.Anomalies = append(tp.Anomalies, fmt.Sprintf("max_udp_payload_size %d below 1200", v))
+		}
+	case tpInitialMaxData:
+		tp.InitialMaxData = v
+	case tpInitialMaxStreamDataBidiLocal:
+		tp.InitialMaxStreamDataBidiLocal = v
+	case tpInitialMaxStreamDataBidiRemote:
+		tp.InitialMaxStreamDataBidiRemote = v
+	case tpInitialMaxStreamDataUni:
+		tp.InitialMaxStreamDataUni = v
+	case tpInitialMaxStreamsBidi:
+		tp.InitialMaxStreamsBidi = v
+		if v > 1<<60 {
+			tp.Anomalies = append(tp.Anomalies, "initial_max_streams_bidi above 2^60")
+		}
+	case tpInitialMaxStreamsUni:
+		tp.InitialMaxStreamsUni = v
+		if v > 1<<60 {
+			tp.Anomalies = append(tp.Anomalies, "initial_max_streams_uni above 2^60")
+		}
+	case tpAckDelayExponent:
+		tp.AckDelayExponent = v
+		if v > 20 {
+			tp.Anomalies = append(tp.Anomalies, fmt.Sprintf("ack_delay_exponent %d above 20", v))
+		}
+	case tpMaxAckDelay:
+		tp.MaxAckDelay = time.Duration(min(v, 1<<40)) * time.Millisecond
+		if v >= 1<<14 {
+			tp.Anomalies = append(tp.Anomalies, fmt.Sprintf("max_ack_delay %d not below 2^14", v))
+		}
+	case tpActiveConnectionIDLimit:
+		tp.ActiveConnectionIDLimit = v
+		if v < 2 {
+			tp.Anomalies = append(tp.Anomalies, fmt.Sprintf("active_connection_id_limit %d below 2", v))
+		}
+	case tpMaxDatagramFrameSize:
+		tp.MaxDatagramFrameSize = v
+	}
+}
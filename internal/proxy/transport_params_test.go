@@ -0,0 +1,90 @@
+package proxy
+
+import (
+	"bytes"
+	"slices"
+	"testing"
+	"time"
+)
+
+// tpVarint encodes v as a 4-byte QUIC varint.
+func tpVarint(v uint64) []byte {
+	return []byte{0x80 | byte(v>>24), byte(v >> 16), byte(v >> 8), byte(v)}
+}
+
+// tpParam encodes one transport parameter.
+func tpParam(id uint64, value []byte) []byte {
+	b := append(tpVarint(id), tpVarint(uint64(len(value)))...)
+	return append(b, value...)
+}
+
+func TestParseTransportParameters(t *testing.T) {
+	scid := []byte{1, 2, 3, 4, 5, 6, 7, 8}
+	var data []byte
+	data = append(data, tpParam(tpMaxIdleTimeout, tpVarint(30000))...)
+	data = append(data, tpParam(tpMaxUDPPayloadSize, tpVarint(1452))...)
+	data = append(data, tpParam(tpInitialMaxData, tpVarint(786432))...)
+	data = append(data, tpParam(tpInitialMaxStreamsBidi, tpVarint(100))...)
+	data = append(data, tpParam(tpActiveConnectionIDLimit, tpVarint(4))...)
+	data = append(data, tpParam(tpDisableActiveMigration, nil)...)
+	data = append(data, tpParam(tpInitialSourceConnectionID, scid)...)
+	data = append(data, tpParam(tpMaxDatagramFrameSize, tpVarint(1200))...)
+	data = append(data, tpParam(0x1b, []byte{0xde, 0xad})...) // Reserved (31*0+27)
+
+	tp, err := parseTransportParameters(data)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if tp.MaxIdleTimeout != 30*time.Second || tp.MaxUDPPayloadSize != 1452 || tp.InitialMaxData != 786432 {
+		t.Errorf("got %+v", tp)
+	}
+	if tp.InitialMaxStreamsBidi != 100 || tp.ActiveConnectionIDLimit != 4 || !tp.DisableActiveMigration {
+		t.Errorf("got %+v", tp)
+	}
+	if !bytes.Equal(tp.InitialSourceConnectionID, scid) || tp.MaxDatagramFrameSize != 1200 {
+		t.Errorf("got %+v", tp)
+	}
+	// Not sent: defaults
+	if tp.AckDelayExponent != 3 || tp.MaxAckDelay != 25*time.Millisecond {
+		t.Errorf("defaults not applied: %+v", tp)
+	}
+	if !slices.Equal(tp.Unknown, []uint64{0x1b}) || len(tp.Anomalies) != 0 {
+		t.Errorf("Unknown=%v Anomalies=%v", tp.Unknown, tp.Anomalies)
+	}
+}
+
+func TestParseTransportParameters_Anomalies(t *testing.T) {
+	var data []byte
+	data = append(data, tpParam(tpStatelessResetToken, make([]byte, 16))...)
+	data = append(data, tpParam(tpMaxUDPPayloadSize, tpVarint(1000))...)
+	data = append(data, tpParam(tpMaxUDPPayloadSize, tpVarint(1500))...)
+	data = append(data, tpParam(tpActiveConnectionIDLimit, tpVarint(1))...)
+
+	tp, err := parseTransportParameters(data)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []string{
+		"server-only parameter 0x2",
+		"max_udp_payload_size 1000 below 1200",
+		"duplicate parameter 0x3",
+		"active_connection_id_limit 1 below 2",
+		"missing initial_source_connection_id",
+	}
+	if !slices.Equal(tp.Anomalies, want) {
+		t.Errorf("Anomalies = %q, want %q", tp.Anomalies, want)
+	}
+}
+
+func TestParseTransportParameters_Malformed(t *testing.T) {
+	for name, data := range map[string][]byte{
+		"truncated value":  append(tpVarint(tpInitialMaxData), 0x08, 0x01),
+		"missing length":   tpVarint(tpInitialMaxData),
+		"varint too short": tpParam(tpInitialMaxData, []byte{0x80, 0x01}),
+		"trailing bytes":   tpParam(tpInitialMaxData, []byte{0x01, 0x02}),
+	} {
+		if _, err := parseTransportParameters(data); err == nil {
+			t.Errorf("%s: expected error", name)
+		}
+	}
+}
@@ -0,0 +1,36 @@
+package quicvarint
+
+import (
+	"encoding/hex"
+	"testing"
+)
+
+// RFC 9000 Appendix A.1
+func TestRead(t *testing.T) {
+	tests := []struct {
+		hex  string
+		want uint64
+		n    int
+	}{
+		{"c2197c5eff14e88c", 151288809941952652, 8},
+		{"9d7f3e7d", 494878333, 4},
+		{"7bbd", 15293, 2},
+		{"25", 37, 1},
+		{"4025", 37, 2},
+		{"25ff", 37, 1}, // Trailing bytes are left alone
+	}
+	for _, tt := range tests {
+		data, _ := hex.DecodeString(tt.hex)
+		v, n, err := Read(data)
+		if err != nil || v != tt.want || n != tt.n {
+			t.Errorf("Read(%s) = %d, %d, %v; want %d, %d", tt.hex, v, n, err, tt.want, tt.n)
+		}
+	}
+
+	for _, bad := range []string{"", "40", "9d7f3e", "c2197c5eff14e8"} {
+		data, _ := hex.DecodeString(bad)
+		if _, _, err := Read(data); err == nil {
+			t.Errorf("Read(%q): expected error", bad)
+		}
+	}
+}
@@ -0,0 +1,3 @@
+module proxyproto
+
+go 1.25.0
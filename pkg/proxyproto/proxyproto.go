@@ -0,0 +1,212 @@
+// Package proxyproto encodes and decodes PROXY protocol v2 headers for UDP.
+//
+// The relay sends the header as a separate datagram ahead of a client's QUIC
+// Initial packets, so backends learn the real client address and SNI.
+// A header datagram can never be mistaken for QUIC: it starts with 0x0D,
+// which has the QUIC fixed bit (0x40) cleared.
+//
+// Backend usage:
+//
+//	if proxyproto.IsHeader(datagram) {
+//		hdr, _, err := proxyproto.Parse(datagram)
+//		// remember hdr.Source for the sender's address, then skip the datagram
+//	}
+package proxyproto
+
+import (
+	"encoding/binary"
+	"errors"
+	"net/netip"
+)
+
+// Signature is the fixed 12-byte prefix of every v2 header.
+var Signature = [12]byte{0x0D, 0x0A, 0x0D, 0x0A, 0x00, 0x0D, 0x0A, 0x51, 0x55, 0x49, 0x54, 0x0A}
+
+// Command is the v2 command.
+type Command byte
+
+const (
+	// Local means the connection was made by the relay itself (no addresses).
+	Local Command = 0x0
+	// Proxy means the connection was relayed on behalf of Source.
+	Proxy Command = 0x1
+)
+
+// TLV types (PP2_TYPE_*) used by the relay.
+const (
+	TypeALPN      byte = 0x01
+	TypeAuthority byte = 0x02 // Host name the client connected to (SNI)
+
+	// Custom types (PP2_TYPE_MIN_CUSTOM range) for connections the relay
+	// validated with a QUIC Retry. The backend must send them back as its
+	// original_destination_connection_id and retry_source_connection_id
+	// transport parameters, or the client aborts the handshake.
+	TypeRetryODCID byte = 0xE0
+	TypeRetrySCID  byte = 0xE1
+)
+
+const (
+	version2     = 0x20
+	famUDP4      = 0x12 // AF_INET, SOCK_DGRAM
+	famUDP6      = 0x22 // AF_INET6, SOCK_DGRAM
+	famUnspec    = 0x00
+	headerLen    = 16 // Signature + ver/cmd + fam + len
+	addrLenUDP4  = 12
+	addrLenUDP6  = 36
+	maxHeaderLen = headerLen + 0xFFFF
+)
+
+// Header is a decoded PROXY protocol v2 header.
+type Header struct {
+	Command     Command
+	Source      netip.AddrPort // Original client address
+	Destination netip.AddrPort // Address the client connected to
+	TLVs        []TLV
+}
+
+// TLV is a type-length-value extension.
+type TLV struct {
+	Type  byte
+	Value []byte
+}
+
+// Authority returns the host name (SNI) carried in the header, if any.
+func (h *Header) Authority() string {
+	return string(h.find(TypeAuthority))
+}
+
+// ALPN returns the first ALPN protocol carried in the header, if any.
+func (h *Header) ALPN() string {
+	return string(h.find(TypeALPN))
+}
+
+// Retry returns the original DCID and the Retry SCID if the relay answered
+// the client with a Retry, or nil slices otherwise.
+func (h *Header) Retry() (odcid, retrySCID []byte) {
+	return h.find(TypeRetryODCID), h.find(TypeRetrySCID)
+}
+
+func (h *Header) find(typ byte) []byte {
+	for _, tlv := range h.TLVs {
+		if tlv.Type == typ {
+			return tlv.Value
+		}
+	}
+	return nil
+}
+
+// IsHeader reports whether b starts with the v2 signature.
+func IsHeader(b []byte) bool {
+	return len(b) >= len(Signature) && [12]byte(b[:12]) == Signature
+}
+
+// Append encodes h and appends it to b.
+// Mixed address families are encoded as IPv6 (IPv4-mapped).
+func Append(b []byte, h *Header) ([]byte, error) {
+	src, dst := h.Source, h.Destination
+
+	fam := byte(famUnspec)
+	addrLen := 0
+	if h.Command == Proxy {
+		if !src.IsValid() || !dst.IsValid() {
+			return nil, errors.New("proxyproto: proxy command requires source and destination")
+		}
+		if src.Addr().Unmap().Is4() && dst.Addr().Unmap().Is4() {
+			fam, addrLen = famUDP4, addrLenUDP4
+			src = netip.AddrPortFrom(src.Addr().Unmap(), src.Port())
+			dst = netip.AddrPortFrom(dst.Addr().Unmap(), dst.Port())
+		} else {
+			fam, addrLen = famUDP6, addrLenUDP6
+			src = netip.AddrPortFrom(netip.AddrFrom16(src.Addr().As16()), src.Port())
+			dst = netip.AddrPortFrom(netip.AddrFrom16(dst.Addr().As16()), dst.Port())
+		}
+	}
+
+	length := addrLen
+	for _, tlv := range h.TLVs {
+		length += 3 + len(tlv.Value)
+	}
+	if length > 0xFFFF {
+		return nil, errors.New("proxyproto: header too large")
+	}
+
+	b = append(b, Signature[:]...)
+	b = append(b, version2|byte(h.Command), fam)
+	b = binary.BigEndian.AppendUint16(b, uint16(length))
+	if addrLen > 0 {
+		b = append(b, src.Addr().AsSlice()...)
+		b = append(b, dst.Addr().AsSlice()...)
+		b = binary.BigEndian.AppendUint16(b, src.Port())
+		b = binary.BigEndian.AppendUint16(b, dst.Port())
+	}
+	for _, tlv := range h.TLVs {
+		b = append(b, tlv.Type)
+		b = binary.BigEndian.AppendUint16(b, uint16(len(tlv.Value)))
+		b = append(b, tlv.Value...)
+	}
+	return b, nil
+}
+
+// Parse decodes a header from the start of b.
+// Returns the header and the number of bytes it occupies.
+// TLV values alias b.
+func Parse(b []byte) (*Header, int, error) {
+	if len(b) < headerLen {
+		return nil, 0, errors.New("proxyproto: too short")
+	}
+	if !IsHeader(b) {
+		return nil, 0, errors.New("proxyproto: missing signature")
+	}
+	if b[12]&0xF0 != version2 {
+		return nil, 0, errors.New("proxyproto: unsupported version")
+	}
+
+	h := &Header{Command: Command(b[12] & 0x0F)}
+	if h.Command != Local && h.Command != Proxy {
+		return nil, 0, errors.New("proxyproto: unknown command")
+	}
+
+	length := int(binary.BigEndian.Uint16(b[14:16]))
+	total := headerLen + length
+	if len(b) < total {
+		return nil, 0, errors.New("proxyproto: truncated")
+	}
+	body := b[headerLen:total]
+
+	addrLen := 0
+	switch b[13] {
+	case famUDP4:
+		addrLen = addrLenUDP4
+		if len(body) < addrLen {
+			return nil, 0, errors.New("proxyproto: truncated IPv4 addresses")
+		}
+		h.Source = netip.AddrPortFrom(netip.AddrFrom4([4]byte(body[0:4])), binary.BigEndian.Uint16(body[8:10]))
+		h.Destination = netip.AddrPortFrom(netip.AddrFrom4([4]byte(body[4:8])), binary.BigEndian.Uint16(body[10:12]))
+	case famUDP6:
+		addrLen = addrLenUDP6
+		if len(body) < addrLen {
+			return nil, 0, errors.New("proxyproto: truncated IPv6 addresses")
+		}
+		h.Source = netip.AddrPortFrom(netip.AddrFrom16([16]byte(body[0:16])), binary.BigEndian.Uint16(body[32:34]))
+		h.Destination = netip.AddrPortFrom(netip.AddrFrom16([16]byte(body[16:32])), binary.BigEndian.Uint16(body[34:36]))
+	case famUnspec:
+	default:
+		if h.Command == Proxy {
+			return nil, 0, errors.New("proxyproto: unsupported address family")
+		}
+	}
+
+	for rest := body[addrLen:]; len(rest) > 0; {
+		if len(rest) < 3 {
+			return nil, 0, errors.New("proxyproto: truncated TLV")
+		}
+		n := int(binary.BigEndian.Uint16(rest[1:3]))
+		if len(rest) < 3+n {
+			return nil, 0, errors.New("proxyproto: truncated TLV value")
+		}
+		h.TLVs = append(h.TLVs, TLV{Type: rest[0], Value: rest[3 : 3+n]})
+		rest = rest[3+n:]
+	}
+
+	return h, total, nil
+}
@@ -0,0 +1,95 @@
+package proxyproto
+
+import (
+	"net/netip"
+	"testing"
+)
+
+func TestRoundTrip_IPv4(t *testing.T) {
+	in := &Header{
+		Command:     Proxy,
+		Source:      netip.MustParseAddrPort("203.0.113.7:51234"),
+		Destination: netip.MustParseAddrPort("198.51.100.1:5520"),
+		TLVs: []TLV{
+			{Type: TypeAuthority, Value: []byte("play.example.com")},
+			{Type: TypeRetryODCID, Value: []byte{1, 2, 3, 4}},
+			{Type: TypeRetrySCID, Value: []byte{5, 6, 7, 8}},
+		},
+	}
+	b, err := Append(nil, in)
+	if err != nil {
+		t.Fatalf("Append: %v", err)
+	}
+	if b[13] != famUDP4 {
+		t.Errorf("expected UDP4 family, got 0x%02x", b[13])
+	}
+
+	out, n, err := Parse(b)
+	if err != nil {
+		t.Fatalf("Parse: %v", err)
+	}
+	if n != len(b) {
+		t.Errorf("consumed %d bytes, want %d", n, len(b))
+	}
+	if out.Source != in.Source || out.Destination != in.Destination {
+		t.Errorf("addresses = %v -> %v, want %v -> %v", out.Source, out.Destination, in.Source, in.Destination)
+	}
+	if out.Authority() != "play.example.com" {
+		t.Errorf("Authority = %q", out.Authority())
+	}
+	if odcid, scid := out.Retry(); string(odcid) != "\x01\x02\x03\x04" || string(scid) != "\x05\x06\x07\x08" {
+		t.Errorf("Retry = %x, %x", odcid, scid)
+	}
+}
+
+func TestRoundTrip_MixedFamilies(t *testing.T) {
+	in := &Header{
+		Command:     Proxy,
+		Source:      netip.MustParseAddrPort("203.0.113.7:51234"),
+		Destination: netip.MustParseAddrPort("[2001:db8::1]:5520"),
+	}
+	b, err := Append(nil, in)
+	if err != nil {
+		t.Fatalf("Append: %v", err)
+	}
+	out, _, err := Parse(b)
+	if err != nil {
+		t.Fatalf("Parse: %v", err)
+	}
+	if b[13] != famUDP6 {
+		t.Errorf("expected UDP6 family, got 0x%02x", b[13])
+	}
+	if out.Source.Addr().Unmap() != in.Source.Addr() || out.Source.Port() != in.Source.Port() {
+		t.Errorf("Source = %v, want %v", out.Source, in.Source)
+	}
+}
+
+func TestParse_Invalid(t *testing.T) {
+	valid, _ := Append(nil, &Header{
+		Command:     Proxy,
+		Source:      netip.MustParseAddrPort("10.0.0.1:1"),
+		Destination: netip.MustParseAddrPort("10.0.0.2:2"),
+		TLVs:        []TLV{{Type: TypeALPN, Value: []byte("hytale")}},
+	})
+
+	tests := map[string][]byte{
+		"empty":        nil,
+		"quic initial": append([]byte{0xC0, 0, 0, 0, 1}, make([]byte, 20)...),
+		"truncated":    valid[:len(valid)-1],
+		"bad version":  append(append([]byte{}, valid[:12]...), append([]byte{0x11}, valid[13:]...)...),
+	}
+	for name, b := range tests {
+		if _, _, err := Parse(b); err == nil {
+			t.Errorf("%s: expected error", name)
+		}
+	}
+}
+
+func TestIsHeader(t *testing.T) {
+	if IsHeader([]byte{0xC0, 0x00, 0x00, 0x00, 0x01}) {
+		t.Error("QUIC packet detected as header")
+	}
+	if !IsHeader(Signature[:]) {
+		t.Error("signature not detected")
+	}
+}